@@ -0,0 +1,40 @@
+import React from 'react'
+
+import { Item, Span, A } from 'react-html-email'
+import { StandardEmail, TopBubbleBox, BodyBox, standardFooter, textDefaults } from './common'
+
+module.exports = (
+  <StandardEmail>
+    <TopBubbleBox logo="logo-active.png" padding={15}>
+      <Item align="center">
+        <Span {...textDefaults} fontSize={20}>Here's what you missed on {'{{.SiteName}}'}</Span>
+      </Item>
+    </TopBubbleBox>
+    <BodyBox>
+      {'{{if .Mentions}}'}
+      <Item>
+        <Span {...textDefaults} color="#7d7d7d">You were mentioned:</Span>
+      </Item>
+      {'{{range .Mentions}}'}
+      <Item>
+        <Span {...textDefaults}><strong>{'{{.SenderName}}'}</strong> in <A {...textDefaults} href="{{$.RoomURL .Room}}">&{'{{.Room}}'}</A></Span>
+      </Item>
+      {'{{end}}'}
+      {'{{end}}'}
+      {'{{if .PMs}}'}
+      <Item>
+        <Span {...textDefaults} color="#7d7d7d">Unread private messages:</Span>
+      </Item>
+      {'{{range .PMs}}'}
+      <Item>
+        <Span {...textDefaults}><A {...textDefaults} href="{{$.PMURL .PMID}}">{'{{.Unread}}'} from <strong>{'{{.WithNick}}'}</strong></A></Span>
+      </Item>
+      {'{{end}}'}
+      {'{{end}}'}
+      <Item>
+        <Span {...textDefaults} fontSize={13} color="#7d7d7d">You received this digest because you asked for one. To stop receiving digests, change your <A {...textDefaults} href="{{.EmailPreferencesURL}}">email preferences</A>.</Span>
+      </Item>
+    </BodyBox>
+    {standardFooter}
+  </StandardEmail>
+)
@@ -293,6 +293,7 @@ gulp.task('site-templates', ['heim-git-commit'], () => {
     'error',
     'verify-email',
     'reset-password',
+    'email-preferences',
     'about',
     'about/values',
     'about/conduct',
@@ -303,6 +304,7 @@ gulp.task('site-templates', ['heim-git-commit'], () => {
     'heim',
     'heim/api',
     'libpage',
+    'archive',
   ]
 
   return merge(_.map(pages, (name) => {
@@ -316,7 +318,7 @@ gulp.task('email-templates', () => {
   ReactHTMLEmail.injectReactEmailAttributes()
   ReactHTMLEmail.configStyleValidator({platforms: ['gmail']})
   const renderEmail = require('react-html-email').renderEmail
-  const emails = ['welcome', 'room-invitation', 'room-invitation-welcome', 'verification', 'password-changed', 'password-reset']
+  const emails = ['welcome', 'room-invitation', 'room-invitation-welcome', 'verification', 'password-changed', 'password-reset', 'digest']
 
   const htmls = merge(_.map(emails, (name) => {
     const html = renderEmail(reload('./emails/' + name))
@@ -4,6 +4,7 @@ import 'whatwg-fetch'
 import clientRoom from './clientRoom'
 import clientVerifyEmail from './clientVerifyEmail'
 import clientResetPassword from './clientResetPassword'
+import clientEmailPreferences from './clientEmailPreferences'
 
 // setup globals (used by env frame)
 window.uiwindow = window.top
@@ -26,5 +27,7 @@ if (!entrypoint) {
     clientVerifyEmail()
   } else if (entrypoint === 'reset-password') {
     clientResetPassword()
+  } else if (entrypoint === 'email-preferences') {
+    clientEmailPreferences()
   }
 }
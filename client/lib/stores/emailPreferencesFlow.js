@@ -0,0 +1,60 @@
+import _ from 'lodash'
+import Reflux from 'reflux'
+import Immutable from 'immutable'
+
+import heimURL from '../heim/heimURL'
+import ImmutableMixin from './ImmutableMixin'
+import PostFlowMixin from './PostFlowMixin'
+
+const storeActions = Reflux.createActions([
+  'initData',
+  'save',
+])
+_.extend(module.exports, storeActions)
+
+storeActions.initData.sync = true
+
+const StateRecord = Immutable.Record({
+  email: null,
+  token: null,
+  digest: false,
+  unsubscribed: false,
+  done: false,
+  errors: Immutable.Map(),
+  working: false,
+})
+
+module.exports.store = Reflux.createStore({
+  listenables: [
+    storeActions,
+  ],
+
+  mixins: [
+    ImmutableMixin,
+    PostFlowMixin,
+  ],
+
+  init() {
+    this.state = new StateRecord()
+  },
+
+  getInitialState() {
+    return this.state
+  },
+
+  initData(data) {
+    this.triggerUpdate(this.state.merge(data))
+  },
+
+  save(prefs) {
+    this.triggerUpdate(this.state.merge({
+      digest: !!prefs.digest,
+      unsubscribed: !!prefs.unsubscribed,
+    }))
+    this._postAPI(heimURL('/prefs/emails'), {
+      token: this.state.token,
+      digest: this.state.digest,
+      unsubscribed: this.state.unsubscribed,
+    })
+  },
+})
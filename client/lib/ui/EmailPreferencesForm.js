@@ -0,0 +1,43 @@
+import React from 'react'
+import createReactClass from 'create-react-class'
+import Reflux from 'reflux'
+
+import emailPreferencesFlow from '../stores/emailPreferencesFlow'
+import { Form, CheckField, ErrorMessage } from './forms'
+
+export default createReactClass({
+  displayName: 'EmailPreferencesForm',
+
+  mixins: [
+    Reflux.connect(emailPreferencesFlow.store, 'flow'),
+  ],
+
+  onSubmit(values) {
+    emailPreferencesFlow.save(values)
+  },
+
+  render() {
+    const flow = this.state.flow
+    return (
+      <Form
+        ref="form"
+        className="email-preferences"
+        onSubmit={this.onSubmit}
+        initialValues={{digest: flow.digest, unsubscribed: flow.unsubscribed}}
+        working={flow.working}
+        errors={flow.errors.toJS()}
+      >
+        <h1>email preferences</h1>
+        <h2>which emails should we send to <strong>{flow.email}</strong>?</h2>
+        <CheckField name="digest" tabIndex={1}>
+          a digest of mentions and private messages I missed while away
+        </CheckField>
+        <CheckField name="unsubscribed" tabIndex={2}>
+          nothing but account security and password emails
+        </CheckField>
+        <ErrorMessage name="reason" />
+        {flow.done ? <button type="button" className="major-action done" disabled>your preferences are saved.</button> : <button type="submit" tabIndex={3} className="major-action">save preferences</button>}
+      </Form>
+    )
+  },
+})
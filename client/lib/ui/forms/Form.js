@@ -10,6 +10,7 @@ export default createReactClass({
 
   propTypes: {
     context: PropTypes.object,
+    initialValues: PropTypes.object,
     errors: PropTypes.objectOf(PropTypes.string),
     validators: PropTypes.objectOf(PropTypes.func),
     working: PropTypes.bool,
@@ -22,13 +23,14 @@ export default createReactClass({
     return {
       errors: {},
       context: {},
+      initialValues: {},
       validators: {},
     }
   },
 
   getInitialState() {
     return {
-      values: {},
+      values: _.assign({}, this.props.initialValues),
       errors: {},
     }
   },
@@ -0,0 +1,31 @@
+import React from 'react'
+
+// Rendered by `heimctl export-room --format=html` into a standalone archive, so the styles are inlined rather than
+// linked. The text is templated using Go templates at runtime, hence the {{...}} syntax here.
+const style = `
+body { font-family: sans-serif; margin: 2em; color: #333; }
+.message { margin: .25em 0; }
+.sender { font-weight: bold; }
+.time { color: #999; font-size: .8em; margin-left: .5em; }
+.content { white-space: pre-wrap; word-wrap: break-word; }
+`
+
+module.exports = (
+  <html lang="en-US">
+    <head>
+      <meta charSet="utf-8" />
+      <title>&amp;{'{{.Room}}'} archive</title>
+      <style dangerouslySetInnerHTML={{__html: style}} />
+    </head>
+    <body className="archive-page">
+      <h1>&amp;{'{{.Room}}'}</h1>
+      {'{{range .Messages}}'}
+      <div className="message" id="{{.ID}}" style={{marginLeft: 'calc({{.Depth}} * 1.5em)'}}>
+        <span className="sender">{'{{.Sender}}'}</span>
+        <time className="time">{'{{.Time}}'}</time>
+        <div className="content">{'{{.Content}}'}</div>
+      </div>
+      {'{{end}}'}
+    </body>
+  </html>
+)
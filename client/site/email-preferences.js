@@ -0,0 +1,9 @@
+import React from 'react'
+
+import { MainPage, HeimAttachPoint } from './common'
+
+module.exports = (
+  <MainPage title="Euphoria: Email Preferences" className="form-page" heimPage="email-preferences">
+    <HeimAttachPoint id="form-container" />
+  </MainPage>
+)
@@ -83,13 +83,15 @@ func (t types) registerType(name string) string {
 
 func (t types) linkType(name string) string {
 	switch {
+	case name == "[]byte":
+		return t.linkType("bytes")
 	case strings.HasPrefix(name, "[]"):
 		return fmt.Sprintf("[%s]", t.linkType(name[2:]))
 	case name == "Listing":
 		return t.linkType("[]SessionView")
 	case name == "snowflake.Snowflake":
 		return t.linkType("Snowflake")
-	case name == "json.RawMessage":
+	case name == "json.RawMessage", strings.HasPrefix(name, "map["):
 		return t.linkType("object")
 	default:
 		if link, ok := t[name]; ok {
@@ -161,6 +163,10 @@ func getFields(obs *objects, node ast.Node) []field {
 				Comments: joinComments(f.Comment),
 			}
 			nf.Name, nf.Optional = nameAndOptional(f)
+			if nf.Name == "-" {
+				// not serialized
+				continue
+			}
 			fields = append(fields, nf)
 		}
 		return fields
@@ -190,6 +196,8 @@ func typeIdent(expr ast.Expr) string {
 		return typeIdent(t.X)
 	case *ast.ArrayType:
 		return fmt.Sprintf("[]%s", typeIdent(t.Elt))
+	case *ast.MapType:
+		return fmt.Sprintf("map[%s]%s", typeIdent(t.Key), typeIdent(t.Value))
 	default:
 		return fmt.Sprintf("%#v", expr)
 	}
@@ -311,11 +319,16 @@ func run() error {
 	})
 
 	ts.registerType("bool")
+	ts.registerType("bytes")
 	ts.registerType("int")
 	ts.registerType("object")
 	ts.registerType("string")
 	ts.registerType("AccountView")
 	ts.registerType("AuthOption")
+	ts.registerType("BotToken")
+	ts.registerType("E2EKey")
+	ts.registerType("IncomingWebhook")
+	ts.registerType("Mention")
 	ts.registerType("Message")
 	ts.registerType("PacketType")
 	ts.registerType("PersonalAccountView")
@@ -323,6 +336,7 @@ func run() error {
 	ts.registerType("Snowflake")
 	ts.registerType("Time")
 	ts.registerType("UserID")
+	ts.registerType("Webhook")
 
 	if err := os.Chdir(gendir); err != nil {
 		return fmt.Errorf("chdir error: %s: %s", gendir, err)
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"euphoria.leet.nu/lib/scope"
@@ -176,3 +177,37 @@ func getClient(ctx scope.Context, s *Server, r *http.Request) (*proto.Client, *h
 
 	return client, cookie, agentKey, nil
 }
+
+// bearerToken returns the secret given in the request's Authorization header,
+// if it uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	const scheme = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(scheme):]), true
+}
+
+// getBotClient authenticates a bot's connection to the named room with the
+// given bot token secret. Bots authenticated this way never receive an agent
+// cookie.
+func getBotClient(
+	ctx scope.Context, s *Server, r *http.Request, secret string) (
+	*proto.Client, *security.ManagedKey, error) {
+
+	_, accessKey, err := proto.ParseBotToken(secret)
+	if err != nil {
+		return nil, nil, proto.ErrAccessDenied
+	}
+
+	client := &proto.Client{}
+	client.FromRequest(ctx, r)
+	if err := client.AuthenticateWithBotToken(ctx, s.b, secret); err != nil {
+		return nil, nil, err
+	}
+
+	logging.Logger(ctx).Printf("bot token %s authenticated", client.BotToken.ID)
+	return client, accessKey, nil
+}
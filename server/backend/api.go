@@ -0,0 +1,283 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"euphoria.leet.nu/lib/scope"
+	"github.com/gorilla/mux"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/logging"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const (
+	// DefaultAPILogSize is the number of messages returned by the log and
+	// thread endpoints when n isn't given.
+	DefaultAPILogSize = 100
+
+	// MaxAPILogSize is the maximum number of messages returned by the log
+	// and thread endpoints.
+	MaxAPILogSize = 1000
+)
+
+// An apiRequest is a read-only API request that has been authorized to read
+// a room.
+type apiRequest struct {
+	ctx    scope.Context
+	room   proto.Room
+	client *proto.Client
+	level  proto.PrivilegeLevel
+}
+
+func (s *Server) routeAPI() {
+	const roomPath = "/api/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}"
+
+	s.r.Path(roomPath + "/log").Methods("GET").Handler(
+		instrumentHttpHandlerFunc("apiLog", s.handleAPILog))
+	s.r.Path(roomPath + "/message/{id:[a-z0-9]+}").Methods("GET").Handler(
+		instrumentHttpHandlerFunc("apiMessage", s.handleAPIMessage))
+	s.r.Path(roomPath + "/thread/{id:[a-z0-9]+}").Methods("GET").Handler(
+		instrumentHttpHandlerFunc("apiThread", s.handleAPIThread))
+	s.r.Path(roomPath + "/who").Methods("GET").Handler(
+		instrumentHttpHandlerFunc("apiWho", s.handleAPIWho))
+}
+
+// authorizeAPI resolves the room named in an API request and checks that the
+// client may read it, the same way a websocket would be let into the room.
+// Unlike a websocket, the API never creates rooms. If false is returned, an
+// error response has already been written.
+func (s *Server) authorizeAPI(w http.ResponseWriter, r *http.Request) (*apiRequest, bool) {
+	if !s.policy.AllowAPI {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	ctx := logging.LoggingContext(s.rootCtx.Fork(), os.Stdout,
+		fmt.Sprintf("[api %p] ", r))
+
+	prefix := mux.Vars(r)["prefix"]
+	roomName := mux.Vars(r)["room"]
+
+	var (
+		client *proto.Client
+		err    error
+	)
+	if secret, ok := bearerToken(r); ok {
+		client, _, err = getBotClient(ctx, s, r, secret)
+	} else if _, cookieErr := r.Cookie(agentCookieName); cookieErr == nil {
+		client, _, _, err = getClient(ctx, s, r)
+	} else if prefix == "" {
+		// Anonymous readers aren't issued an agent.
+		client = &proto.Client{}
+		client.FromRequest(ctx, r)
+	} else {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		if err == proto.ErrAccessDenied {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
+		s.serveInternalError(ctx, w, err)
+		return nil, false
+	}
+
+	room, err := s.resolveRoom(ctx, prefix, roomName, client, false)
+	if err != nil {
+		switch err {
+		case proto.ErrAccessDenied:
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		case proto.ErrRoomNotFound:
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		default:
+			s.serveInternalError(ctx, w, err)
+		}
+		return nil, false
+	}
+
+	// Banned clients would be refused on joining the room, so refuse them here.
+	var agentID proto.UserID
+	if client.Agent != nil || client.Account != nil {
+		agentID = client.UserID()
+	}
+	banned, err := room.IsBanned(ctx, agentID, client.IP)
+	if err != nil {
+		s.serveInternalError(ctx, w, err)
+		return nil, false
+	}
+	if banned {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	keyID, isPrivate, err := room.MessageKeyID(ctx)
+	if err != nil {
+		s.serveInternalError(ctx, w, err)
+		return nil, false
+	}
+	if isPrivate {
+		if _, ok := client.Authorization.MessageKeys[keyID]; !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+
+	req := &apiRequest{
+		ctx:    ctx,
+		room:   room,
+		client: client,
+		level:  clientPrivilegeLevel(client),
+	}
+	return req, true
+}
+
+// reply decrypts the payload for the client and writes it as JSON.
+func (req *apiRequest) reply(s *Server, w http.ResponseWriter, payload interface{}) {
+	decrypted, err := proto.DecryptPayload(payload, &req.client.Authorization, req.level)
+	if err != nil {
+		s.serveInternalError(req.ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(decrypted); err != nil {
+		logging.Logger(req.ctx).Printf("error writing api response: %s", err)
+	}
+}
+
+func (s *Server) handleAPILog(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.authorizeAPI(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := apiLogSize(r)
+	if err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cmd := &proto.LogCommand{N: n}
+	anchors := map[string]*snowflake.Snowflake{"before": &cmd.Before, "after": &cmd.After, "around": &cmd.Around}
+	for param, anchor := range anchors {
+		if value := r.FormValue(param); value != "" {
+			if err := anchor.FromString(value); err != nil {
+				http.Error(w, "400 bad request: invalid "+param, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	reply, err := roomLog(req.ctx, req.room, cmd)
+	if err != nil {
+		if err == errLogAnchors {
+			http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.serveInternalError(req.ctx, w, err)
+		return
+	}
+	req.reply(s, w, *reply)
+}
+
+func (s *Server) handleAPIMessage(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.authorizeAPI(w, r)
+	if !ok {
+		return
+	}
+
+	msg, ok := s.apiMessage(req, w, r)
+	if !ok {
+		return
+	}
+	req.reply(s, w, proto.GetMessageReply(*msg))
+}
+
+func (s *Server) handleAPIThread(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.authorizeAPI(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := apiLogSize(r)
+	if err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	root, ok := s.apiMessage(req, w, r)
+	if !ok {
+		return
+	}
+
+	// Fetch one extra message to find out if the thread was cut short.
+	msgs, err := req.room.Thread(req.ctx, n+1, root.ID)
+	if err != nil {
+		s.serveInternalError(req.ctx, w, err)
+		return
+	}
+	reply := proto.LogReply{Log: msgs}
+	if len(msgs) > n {
+		reply.Log = msgs[:n]
+		reply.MoreAfter = true
+	}
+	if reply.Log == nil {
+		reply.Log = []proto.Message{}
+	}
+	req.reply(s, w, reply)
+}
+
+func (s *Server) handleAPIWho(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.authorizeAPI(w, r)
+	if !ok {
+		return
+	}
+
+	listing, err := req.room.Listing(req.ctx, req.level)
+	if err != nil {
+		s.serveInternalError(req.ctx, w, err)
+		return
+	}
+	req.reply(s, w, &proto.WhoReply{Listing: listing})
+}
+
+// apiMessage looks up the message named in the request path. If false is
+// returned, an error response has already been written.
+func (s *Server) apiMessage(req *apiRequest, w http.ResponseWriter, r *http.Request) (*proto.Message, bool) {
+	var msgID snowflake.Snowflake
+	if err := msgID.FromString(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	msg, err := req.room.GetMessage(req.ctx, msgID)
+	if err != nil {
+		if err == proto.ErrMessageNotFound {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return nil, false
+		}
+		s.serveInternalError(req.ctx, w, err)
+		return nil, false
+	}
+	return msg, true
+}
+
+// apiLogSize returns the number of messages requested with the n parameter.
+func apiLogSize(r *http.Request) (int, error) {
+	value := r.FormValue("n")
+	if value == "" {
+		return DefaultAPILogSize, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > MaxAPILogSize {
+		return 0, fmt.Errorf("n must be between 1 and %d", MaxAPILogSize)
+	}
+	return n, nil
+}
@@ -9,6 +9,8 @@ import (
 	"image/png"
 	"time"
 
+	"euphoria.leet.nu/lib/scope"
+
 	"euphoria.leet.nu/heim/proto"
 	"euphoria.leet.nu/heim/proto/logging"
 	"euphoria.leet.nu/heim/proto/security"
@@ -81,17 +83,19 @@ func (s *session) joinedState(cmd *proto.Packet) *response {
 			cost:   1,
 		}
 	case *proto.LogCommand:
-		msgs, err := s.room.Latest(s.ctx, msg.N, msg.Before)
-		if err != nil {
-			return &response{err: err}
-		}
-		packet, err := proto.DecryptPayload(
-			proto.LogReply{Log: msgs, Before: msg.Before}, &s.client.Authorization, s.privilegeLevel())
-		return &response{
-			packet: packet,
-			err:    err,
-			cost:   1,
-		}
+		return s.handleLogCommand(msg)
+	case *proto.SearchCommand:
+		return s.handleSearchCommand(msg)
+	case *proto.MarkReadCommand:
+		return s.handleMarkReadCommand(msg)
+	case *proto.GetE2EKeysCommand:
+		return s.handleGetE2EKeysCommand()
+	case *proto.GetE2EPublicKeyCommand:
+		return s.handleGetE2EPublicKeyCommand(msg)
+	case *proto.ReactCommand:
+		return s.handleReactCommand(msg.ID, msg.Reaction, false)
+	case *proto.UnreactCommand:
+		return s.handleReactCommand(msg.ID, msg.Reaction, true)
 	case *proto.NickCommand:
 		nick, err := proto.NormalizeNick(msg.Name)
 		if err != nil {
@@ -138,10 +142,16 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 	// account management commands
 	case *proto.ChangeEmailCommand:
 		return s.handleChangeEmailCommand(msg)
+	case *proto.ChangeEmailPreferencesCommand:
+		return s.handleChangeEmailPreferencesCommand(msg)
 	case *proto.ChangeNameCommand:
 		return s.handleChangeNameCommand(msg)
 	case *proto.ChangePasswordCommand:
 		return s.handleChangePasswordCommand(msg)
+	case *proto.IssueBotTokenCommand:
+		return s.handleIssueBotTokenCommand(msg)
+	case *proto.ListBotTokensCommand:
+		return s.handleListBotTokensCommand()
 	case *proto.LoginCommand:
 		return s.handleLoginCommand(msg)
 	case *proto.LogoutCommand:
@@ -152,8 +162,24 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return s.handleResendVerificationEmail(msg)
 	case *proto.ResetPasswordCommand:
 		return s.handleResetPasswordCommand(msg)
+	case *proto.RevokeBotTokenCommand:
+		return s.handleRevokeBotTokenCommand(msg)
+	case *proto.SetE2EPublicKeyCommand:
+		return s.handleSetE2EPublicKeyCommand(msg)
 
 	// room manager commands
+	case *proto.AddWebhookCommand:
+		return s.handleAddWebhookCommand(msg)
+	case *proto.ListWebhooksCommand:
+		return s.handleListWebhooksCommand()
+	case *proto.RemoveWebhookCommand:
+		return s.handleRemoveWebhookCommand(msg)
+	case *proto.AddIncomingWebhookCommand:
+		return s.handleAddIncomingWebhookCommand(msg)
+	case *proto.ListIncomingWebhooksCommand:
+		return s.handleListIncomingWebhooksCommand()
+	case *proto.RemoveIncomingWebhookCommand:
+		return s.handleRemoveIncomingWebhookCommand(msg)
 	case *proto.BanCommand:
 		return s.handleBanCommand(msg)
 	case *proto.UnbanCommand:
@@ -168,10 +194,24 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return s.handleRevokeManagerCommand(msg)
 	case *proto.RevokeAccessCommand:
 		return s.handleRevokeAccessCommand(msg)
+	case *proto.RotateRoomKeyCommand:
+		return s.handleRotateRoomKeyCommand()
+	case *proto.GetAnnouncementModeCommand:
+		return s.handleGetAnnouncementModeCommand()
+	case *proto.SetAnnouncementModeCommand:
+		return s.handleSetAnnouncementModeCommand(msg)
+	case *proto.EnableE2ECommand:
+		return s.handleEnableE2ECommand()
+	case *proto.ShareE2EKeyCommand:
+		return s.handleShareE2EKeyCommand(msg)
 
 	// staff commands
+	case *proto.StaffArchiveRoomCommand:
+		return s.handleStaffArchiveRoomCommand()
 	case *proto.StaffCreateRoomCommand:
 		return s.handleStaffCreateRoomCommand(msg)
+	case *proto.StaffDeleteRoomCommand:
+		return s.handleStaffDeleteRoomCommand()
 	case *proto.StaffGrantManagerCommand:
 		return s.handleStaffGrantManagerCommand(msg)
 	case *proto.StaffRevokeManagerCommand:
@@ -180,6 +220,12 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return s.handleStaffRevokeAccessCommand(msg)
 	case *proto.StaffLockRoomCommand:
 		return s.handleStaffLockRoomCommand()
+	case *proto.StaffRenameRoomCommand:
+		return s.handleStaffRenameRoomCommand(msg)
+	case *proto.StaffAddRoomAliasCommand:
+		return s.handleStaffAddRoomAliasCommand(msg)
+	case *proto.StaffRemoveRoomAliasCommand:
+		return s.handleStaffRemoveRoomAliasCommand(msg)
 	case *proto.StaffEnrollOTPCommand:
 		return s.handleStaffEnrollOTPCommand(msg)
 	case *proto.StaffValidateOTPCommand:
@@ -192,6 +238,8 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return s.handleUnlockStaffCapabilityCommand(msg)
 
 	// other commands
+	case *proto.MentionsCommand:
+		return s.handleMentionsCommand(msg)
 	case *proto.PMInitiateCommand:
 		return s.handlePMInitiateCommand(msg)
 
@@ -206,10 +254,27 @@ func (s *session) handleSendCommand(cmd *proto.SendCommand) *response {
 		return &response{err: fmt.Errorf("you must choose a name before you may begin chatting")}
 	}
 
+	if err := s.checkMaySend(); err != nil {
+		return &response{err: err}
+	}
+
 	if len(cmd.Content) > proto.MaxMessageLength {
 		return &response{err: proto.ErrMessageTooLong}
 	}
 
+	e2e, err := s.isE2E()
+	if err != nil {
+		return &response{err: err}
+	}
+	switch {
+	case e2e && cmd.EncryptionKeyID == "":
+		return &response{err: proto.ErrE2EEncryptionRequired}
+	case !e2e && cmd.EncryptionKeyID != "":
+		return &response{err: proto.ErrNotE2E}
+	case len(cmd.EncryptionKeyID) > proto.MaxE2EKeyIDLength:
+		return &response{err: fmt.Errorf("encryption_key_id too long")}
+	}
+
 	msgID, err := snowflake.New()
 	if err != nil {
 		return &response{err: err}
@@ -234,14 +299,23 @@ func (s *session) handleSendCommand(cmd *proto.SendCommand) *response {
 		Sender:  s.View(proto.Host),
 	}
 
-	if s.keyID != "" {
+	switch {
+	case e2e:
+		// The client has already encrypted the content.
+		msg.EncryptionKeyID = proto.E2EEncryptionKeyID(cmd.EncryptionKeyID)
+	case s.keyID != "":
 		key := s.client.Authorization.MessageKeys[s.keyID]
 		if err := proto.EncryptMessage(&msg, s.keyID, key); err != nil {
 			return &response{err: err}
 		}
 	}
 
-	sent, err := s.room.Send(s.ctx, s, msg)
+	// Mentions can't be found in content the server can't read.
+	content := cmd.Content
+	if e2e {
+		content = ""
+	}
+	sent, err := sendMessage(s.ctx, s.backend, s.room, s.roomName, s, msg, content)
 	if err != nil {
 		return &response{err: err}
 	}
@@ -258,6 +332,73 @@ func (s *session) handleSendCommand(cmd *proto.SendCommand) *response {
 	}
 }
 
+// sendMessage sends a message into the room as the given sender, then alerts
+// the users it mentions and queues it for the room's webhooks. The content is
+// the message's plaintext, or empty if the server can't read it. The message
+// is returned as sent.
+func sendMessage(
+	ctx scope.Context, b proto.Backend, room proto.Room, roomName string, sender proto.Session,
+	msg proto.Message, content string) (proto.Message, error) {
+
+	sent, err := room.Send(ctx, sender, msg)
+	if err != nil {
+		return proto.Message{}, err
+	}
+
+	if content != "" {
+		if err := notifyMentions(ctx, b, room, roomName, sender.Identity().ID(), &sent, content); err != nil {
+			logging.Logger(ctx).Printf("mention notification failed: %s", err)
+		}
+	}
+
+	if managedRoom, ok := room.(proto.ManagedRoom); ok {
+		event := proto.SendEvent(sent)
+		event.Sender.ClientAddress = ""
+		dispatchWebhooks(ctx, b, managedRoom, roomName, proto.SendEventType, &event)
+	}
+	return sent, nil
+}
+
+// notifyMentions resolves the @-mentions in a message just sent, records them
+// in the mentioned accounts' mention indexes, and alerts the mentioned users.
+// The sender is never notified of their own mentions.
+func notifyMentions(
+	ctx scope.Context, b proto.Backend, room proto.Room, roomName string, senderID proto.UserID,
+	msg *proto.Message, content string) error {
+
+	notified := map[proto.UserID]bool{senderID: true}
+	for _, name := range proto.ParseMentions(content) {
+		userIDs, err := room.ResolveMention(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, userID := range userIDs {
+			if notified[userID] {
+				continue
+			}
+			notified[userID] = true
+
+			mention := proto.Mention{
+				Room:       roomName,
+				MessageID:  msg.ID,
+				SenderID:   msg.Sender.ID,
+				SenderName: msg.Sender.Name,
+				UnixTime:   msg.UnixTime,
+			}
+			if kind, _ := userID.Parse(); kind == "account" {
+				if err := b.MentionTracker().Add(ctx, userID, mention); err != nil {
+					return err
+				}
+			}
+			event := proto.MentionEvent(mention)
+			if err := b.NotifyUser(ctx, userID, proto.MentionEventType, &event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (s *session) handleGrantAccessCommand(cmd *proto.GrantAccessCommand) *response {
 	mkp := s.client.Authorization.ManagerKeyPair
 	if s.managedRoom == nil || mkp == nil {
@@ -276,8 +417,23 @@ func (s *session) handleGrantAccessCommand(cmd *proto.GrantAccessCommand) *respo
 		return &response{err: fmt.Errorf("not holding message key")}
 	}
 
+	if cmd.Seconds < 0 || cmd.MaxUses < 0 {
+		return &response{err: fmt.Errorf("seconds and max_uses must not be negative")}
+	}
+	if cmd.Seconds > proto.MaxPasscodeGrantSeconds {
+		return &response{err: fmt.Errorf("seconds must not exceed %d", proto.MaxPasscodeGrantSeconds)}
+	}
+	limits := &proto.PasscodeGrantLimits{MaxUses: cmd.MaxUses}
+	if cmd.Seconds > 0 {
+		limits.Expires = time.Now().Add(time.Duration(cmd.Seconds) * time.Second)
+	}
+
 	switch {
 	case cmd.AccountID != 0:
+		if !limits.Unlimited() {
+			return &response{err: fmt.Errorf("only passcode grants may be limited")}
+		}
+
 		account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
 		if err != nil {
 			return &response{err: err}
@@ -289,7 +445,8 @@ func (s *session) handleGrantAccessCommand(cmd *proto.GrantAccessCommand) *respo
 			return &response{err: err}
 		}
 	case cmd.Passcode != "":
-		err = rmk.GrantToPasscode(s.ctx, s.client.Account, s.client.Authorization.ClientKey, cmd.Passcode)
+		err = rmk.GrantToPasscode(
+			s.ctx, s.client.Account, s.client.Authorization.ClientKey, cmd.Passcode, limits)
 		if err != nil {
 			return &response{err: err}
 		}
@@ -327,6 +484,41 @@ func (s *session) handleRevokeAccessCommand(cmd *proto.RevokeAccessCommand) *res
 	return &response{packet: &proto.RevokeAccessReply{}}
 }
 
+func (s *session) handleRotateRoomKeyCommand() *response {
+	mkp := s.client.Authorization.ManagerKeyPair
+	if s.managedRoom == nil || s.client.Account == nil || mkp == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	rmk, err := s.managedRoom.MessageKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	if rmk == nil {
+		return &response{err: fmt.Errorf("room is public")}
+	}
+
+	currentKey, ok := s.client.Authorization.MessageKeys[rmk.KeyID()]
+	if !ok {
+		return &response{err: fmt.Errorf("not holding message key")}
+	}
+
+	// Grant the new key to every manager, so none of them are locked out.
+	// Nobody holds a grant of the new key to copy yet, so the grants are
+	// made through the KMS.
+	managers, err := s.managedRoom.Managers(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	// Every session in the room, this one included, is disconnected by the
+	// rotation and picks up the new key when it reconnects.
+	if _, err := s.managedRoom.RotateMessageKey(s.ctx, s.kms, rmk.KeyID(), currentKey, managers...); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RotateRoomKeyReply{}}
+}
+
 func (s *session) handleGrantManagerCommand(cmd *proto.GrantManagerCommand) *response {
 	mkp := s.client.Authorization.ManagerKeyPair
 	if s.managedRoom == nil || s.client.Account == nil || mkp == nil {
@@ -475,7 +667,84 @@ func (s *session) handleStaffLockRoomCommand() *response {
 	return &response{packet: &proto.StaffLockRoomReply{}}
 }
 
+// roomNames describes the current canonical name and aliases of the room.
+func (s *session) roomNames() (*proto.StaffRenameRoomReply, error) {
+	name, err := s.managedRoom.CanonicalName(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := s.managedRoom.Aliases(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.StaffRenameRoomReply{Name: name, Aliases: aliases}, nil
+}
+
+func (s *session) handleStaffRenameRoomCommand(cmd *proto.StaffRenameRoomCommand) *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.Rename(s.ctx, s, cmd.Name); err != nil {
+		return &response{err: err}
+	}
+
+	reply, err := s.roomNames()
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleStaffAddRoomAliasCommand(cmd *proto.StaffAddRoomAliasCommand) *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.AddAlias(s.ctx, cmd.Alias); err != nil {
+		return &response{err: err}
+	}
+
+	reply, err := s.roomNames()
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: (*proto.StaffAddRoomAliasReply)(reply)}
+}
+
+func (s *session) handleStaffRemoveRoomAliasCommand(cmd *proto.StaffRemoveRoomAliasCommand) *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.RemoveAlias(s.ctx, cmd.Alias); err != nil {
+		return &response{err: err}
+	}
+
+	reply, err := s.roomNames()
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: (*proto.StaffRemoveRoomAliasReply)(reply)}
+}
+
 func (s *session) handleLoginCommand(cmd *proto.LoginCommand) *response {
+	if s.client.BotToken != nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
 	account, err := s.backend.AccountManager().Resolve(s.ctx, cmd.Namespace, cmd.ID)
 	if err != nil {
 		switch err {
@@ -516,6 +785,9 @@ func (s *session) handleLoginCommand(cmd *proto.LoginCommand) *response {
 }
 
 func (s *session) handleLogoutCommand() *response {
+	if s.client.BotToken != nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
 	if err := s.backend.AgentTracker().ClearClientKey(s.ctx, s.client.Agent.IDString()); err != nil {
 		return &response{err: err}
 	}
@@ -576,6 +848,95 @@ func (s *session) handleResendVerificationEmail(msg *proto.ResendVerificationEma
 	return &response{packet: &proto.ResendVerificationEmailReply{}}
 }
 
+func (s *session) handleChangeEmailPreferencesCommand(msg *proto.ChangeEmailPreferencesCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	prefs := &proto.EmailPreferences{
+		Digest:       msg.Digest,
+		Unsubscribed: msg.Unsubscribed,
+	}
+	if err := s.backend.AccountManager().ChangeEmailPreferences(s.ctx, s.client.Account.ID(), prefs); err != nil {
+		return &response{err: err}
+	}
+	reply := &proto.ChangeEmailPreferencesReply{
+		Digest:       prefs.Digest,
+		Unsubscribed: prefs.Unsubscribed,
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleIssueBotTokenCommand(msg *proto.IssueBotTokenCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if s.client.BotToken != nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	token, secret, err := proto.IssueBotToken(
+		s.ctx, s.backend, s.client.Account, s.client.Authorization.ClientKey, msg.Name, msg.Rooms)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.IssueBotTokenReply{BotToken: *token, Secret: secret}}
+}
+
+func (s *session) handleListBotTokensCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if s.client.BotToken != nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	tokens, err := s.backend.BotTokenTracker().List(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	reply := &proto.ListBotTokensReply{Tokens: make([]proto.BotToken, len(tokens))}
+	for i, token := range tokens {
+		reply.Tokens[i] = *token
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleRevokeBotTokenCommand(msg *proto.RevokeBotTokenCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if s.client.BotToken != nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.backend.BotTokenTracker().Revoke(s.ctx, s.client.Account.ID(), msg.TokenID); err != nil {
+		return &response{err: err}
+	}
+
+	// Drop the client key held by the token's agent, so the secret is useless
+	// even if the token record were somehow restored.
+	if err := s.backend.AgentTracker().ClearClientKey(s.ctx, msg.TokenID); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.RevokeBotTokenReply{TokenID: msg.TokenID}}
+}
+
+func (s *session) handleSetE2EPublicKeyCommand(msg *proto.SetE2EPublicKeyCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if len(msg.PublicKey) != proto.E2EKeyPairType.PublicKeySize() {
+		return &response{err: security.ErrInvalidPublicKey}
+	}
+
+	if err := s.backend.AccountManager().SetE2EPublicKey(s.ctx, s.client.Account.ID(), msg.PublicKey); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.SetE2EPublicKeyReply{}}
+}
+
 func (s *session) handleChangeNameCommand(msg *proto.ChangeNameCommand) *response {
 	if s.client.Account == nil {
 		return &response{err: proto.ErrNotLoggedIn}
@@ -798,9 +1159,218 @@ func (s *session) handleStaffValidateOTPCommand(cmd *proto.StaffValidateOTPComma
 		return failure(err)
 	}
 
+	s.otpValidated = time.Now()
 	return &response{packet: &proto.StaffValidateOTPReply{}}
 }
 
+// checkArchived returns ErrRoomArchived if nothing more may be posted to the
+// room.
+func (s *session) checkArchived() error {
+	if s.managedRoom == nil {
+		return nil
+	}
+	archived, err := s.managedRoom.Archived(s.ctx)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return proto.ErrRoomArchived
+	}
+	return nil
+}
+
+// checkMaySend returns an error if the session may not send messages to the
+// room, because it's archived or in announcement mode.
+func (s *session) checkMaySend() error {
+	if err := s.checkArchived(); err != nil {
+		return err
+	}
+	if s.managedRoom == nil || s.privilegeLevel() != proto.General {
+		return nil
+	}
+	var accountID snowflake.Snowflake
+	if s.client.Account != nil {
+		accountID = s.client.Account.ID()
+	}
+	return checkAnnouncementMode(s.ctx, s.managedRoom, accountID)
+}
+
+// checkAnnouncementMode returns ErrAnnouncementOnly if the room is in
+// announcement mode and the given account isn't one of its posters. An
+// accountID of 0 means the sender isn't logged in.
+func checkAnnouncementMode(ctx scope.Context, room proto.ManagedRoom, accountID snowflake.Snowflake) error {
+	mode, err := room.AnnouncementMode(ctx)
+	if err != nil {
+		return err
+	}
+	if !mode.MaySend(accountID) {
+		return proto.ErrAnnouncementOnly
+	}
+	return nil
+}
+
+func (s *session) handleGetAnnouncementModeCommand() *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	mode, err := s.managedRoom.AnnouncementMode(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: (*proto.GetAnnouncementModeReply)(mode)}
+}
+
+func (s *session) handleSetAnnouncementModeCommand(cmd *proto.SetAnnouncementModeCommand) *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	// Drop duplicate posters.
+	mode := &proto.AnnouncementMode{Enabled: cmd.Enabled}
+	seen := map[snowflake.Snowflake]bool{}
+	for _, accountID := range cmd.Posters {
+		if !seen[accountID] {
+			seen[accountID] = true
+			mode.Posters = append(mode.Posters, accountID)
+		}
+	}
+	if len(mode.Posters) > proto.MaxAnnouncementPosters {
+		return &response{err: fmt.Errorf("at most %d accounts may be allowed to post", proto.MaxAnnouncementPosters)}
+	}
+
+	if err := s.managedRoom.SetAnnouncementMode(s.ctx, s, mode); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: (*proto.SetAnnouncementModeReply)(mode)}
+}
+
+// isE2E returns true if the session's room is end-to-end encrypted.
+func (s *session) isE2E() (bool, error) {
+	if s.managedRoom == nil {
+		return false, nil
+	}
+	return s.managedRoom.E2E(s.ctx)
+}
+
+func (s *session) handleEnableE2ECommand() *response {
+	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.EnableE2E(s.ctx); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.EnableE2EReply{}}
+}
+
+func (s *session) handleShareE2EKeyCommand(cmd *proto.ShareE2EKeyCommand) *response {
+	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	e2e, err := s.isE2E()
+	if err != nil {
+		return &response{err: err}
+	}
+	if !e2e {
+		return &response{err: proto.ErrNotE2E}
+	}
+
+	key := (*proto.E2EKey)(cmd)
+	if err := key.Validate(); err != nil {
+		return &response{err: err}
+	}
+	if _, err := s.backend.AccountManager().Get(s.ctx, key.AccountID); err != nil {
+		return &response{err: err}
+	}
+
+	if err := s.managedRoom.ShareE2EKey(s.ctx, key); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ShareE2EKeyReply{}}
+}
+
+func (s *session) handleGetE2EKeysCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	e2e, err := s.isE2E()
+	if err != nil {
+		return &response{err: err}
+	}
+	if !e2e {
+		return &response{err: proto.ErrNotE2E}
+	}
+
+	keys, err := s.managedRoom.E2EKeys(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.GetE2EKeysReply{Keys: keys}}
+}
+
+func (s *session) handleGetE2EPublicKeyCommand(cmd *proto.GetE2EPublicKeyCommand) *response {
+	// Only hosts seal room keys, so nobody else needs to look up public keys.
+	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	publicKey, err := s.backend.AccountManager().E2EPublicKey(s.ctx, cmd.AccountID)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.GetE2EPublicKeyReply{AccountID: cmd.AccountID, PublicKey: publicKey}}
+}
+
+// checkStaffOTP returns an error unless the session may issue a staff command
+// that requires a recently validated one-time password.
+func (s *session) checkStaffOTP() error {
+	if s.client.Account == nil || !s.client.Account.IsStaff() {
+		return proto.ErrAccessDenied
+	}
+	if s.staffKMS == nil {
+		return fmt.Errorf("must unlock staff capability first")
+	}
+	if time.Since(s.otpValidated) > StaffOTPValidity {
+		return fmt.Errorf("must validate otp first")
+	}
+	return nil
+}
+
+func (s *session) handleStaffArchiveRoomCommand() *response {
+	if err := s.checkStaffOTP(); err != nil {
+		return &response{err: err}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.Archive(s.ctx); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.StaffArchiveRoomReply{}}
+}
+
+func (s *session) handleStaffDeleteRoomCommand() *response {
+	if err := s.checkStaffOTP(); err != nil {
+		return &response{err: err}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.Delete(s.ctx); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.StaffDeleteRoomReply{}}
+}
+
 func (s *session) handleStaffInspectIPCommand(cmd *proto.StaffInspectIPCommand) *response {
 	if s.privilegeLevel() != proto.Staff {
 		return &response{err: proto.ErrAccessDenied}
@@ -867,7 +1437,9 @@ func (s *session) handleStaffInvadeCommand(cmd *proto.StaffInvadeCommand) *respo
 		if err := s.kms.DecryptKey(&k); err != nil {
 			return failure(fmt.Errorf("decrypt message key: %s", err))
 		}
-		s.client.Authorization.AddMessageKey(mkey.KeyID(), &k)
+		if err := s.client.Authorization.AddMessageKeyHistory(s.ctx, s.managedRoom, mkey.KeyID(), &k); err != nil {
+			return failure(fmt.Errorf("message key history: %s", err))
+		}
 		s.keyID = s.client.Authorization.CurrentMessageKeyID
 		s.state = s.joinedState
 		if err := s.join(); err != nil {
@@ -950,14 +1522,343 @@ func (s *session) handleStaffCreateRoomCommand(cmd *proto.StaffCreateRoomCommand
 }
 
 func (s *session) handleEditMessageCommand(msg *proto.EditMessageCommand) *response {
-	if s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+	if err := s.checkArchived(); err != nil {
+		return &response{err: err}
+	}
+
+	isManager := s.client.Account != nil && s.client.Authorization.ManagerKeyPair != nil
+
+	// Senders may only rewrite or re-parent their own messages.
+	if !isManager && (msg.Delete || (msg.Content == "" && msg.Parent == 0)) {
 		return &response{err: proto.ErrAccessDenied}
 	}
-	reply, err := s.room.EditMessage(s.ctx, s, *msg)
+
+	if len(msg.Content) > proto.MaxMessageLength {
+		return &response{err: proto.ErrMessageTooLong}
+	}
+
+	edit := *msg
+	if !isManager || msg.Content != "" || msg.Parent != 0 {
+		// Deleted messages can't be looked up, so only managers can get past
+		// this point with an edit to one (by undeleting it).
+		orig, err := s.room.GetMessage(s.ctx, msg.ID)
+		if err != nil {
+			return &response{err: err}
+		}
+
+		if !isManager && orig.Sender.ID != s.Identity().ID() {
+			return &response{err: proto.ErrAccessDenied}
+		}
+
+		if msg.Parent != 0 {
+			// Requiring parents to be older than their children rules out cycles.
+			if !msg.Parent.Before(orig.ID) {
+				return &response{err: proto.ErrInvalidParent}
+			}
+			var isValidParent bool
+			if s.managedRoom != nil {
+				isValidParent, err = s.managedRoom.IsValidParent(msg.Parent)
+			} else {
+				isValidParent, err = s.room.IsValidParent(msg.Parent)
+			}
+			if err != nil {
+				return &response{err: err}
+			}
+			if !isValidParent {
+				return &response{err: proto.ErrInvalidParent}
+			}
+		}
+
+		if msg.Content != "" && !proto.IsE2EEncrypted(orig.EncryptionKeyID) {
+			// New content for a client-encrypted message is stored as given,
+			// but content the server would store readably can't be added to
+			// an end-to-end encrypted room.
+			e2e, err := s.isE2E()
+			if err != nil {
+				return &response{err: err}
+			}
+			if e2e {
+				return &response{err: proto.ErrE2EEncryptionRequired}
+			}
+		}
+
+		if msg.Content != "" && orig.EncryptionKeyID != "" && !proto.IsE2EEncrypted(orig.EncryptionKeyID) {
+			nonceID, err := snowflake.New()
+			if err != nil {
+				return &response{err: err}
+			}
+			if err := proto.ReencryptMessage(orig, msg.Content, nonceID, s.client.Authorization.MessageKeys); err != nil {
+				return &response{err: err}
+			}
+			edit.Content = orig.Content
+		}
+	}
+
+	reply, err := s.room.EditMessage(s.ctx, s, edit)
 	if err != nil {
 		return &response{err: err}
 	}
-	return &response{packet: reply}
+
+	event := proto.EditMessageEvent{EditID: reply.EditID, Message: reply.Message}
+	event.Sender.ClientAddress = ""
+	s.dispatchWebhooks(s.ctx, proto.EditMessageEventType, &event)
+
+	if s.privilegeLevel() == proto.General {
+		reply.Sender.ClientAddress = ""
+	}
+
+	packet, err := proto.DecryptPayload(reply, &s.client.Authorization, s.privilegeLevel())
+	return &response{
+		packet: packet,
+		err:    err,
+		cost:   10,
+	}
+}
+
+func (s *session) handleMentionsCommand(msg *proto.MentionsCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	mentions, err := s.backend.MentionTracker().Latest(s.ctx, s.Identity().ID(), msg.N, msg.Before)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{
+		packet: &proto.MentionsReply{Mentions: mentions},
+		cost:   1,
+	}
+}
+
+func (s *session) handleMarkReadCommand(msg *proto.MarkReadCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if _, err := s.room.GetMessage(s.ctx, msg.ID); err != nil {
+		return &response{err: err}
+	}
+
+	marker, unread, err := s.room.MarkRead(s.ctx, s.client.Account.ID(), msg.ID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	event := &proto.ReadEvent{
+		Room:   s.roomName,
+		ID:     marker,
+		Unread: unread,
+	}
+	if err := s.backend.NotifyUser(s.ctx, s.Identity().ID(), proto.ReadEventType, event, s); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{
+		packet: &proto.MarkReadReply{ID: marker, Unread: unread},
+		cost:   1,
+	}
+}
+
+func (s *session) handleReactCommand(msgID snowflake.Snowflake, reaction string, remove bool) *response {
+	if s.Identity().Name() == "" {
+		return &response{err: fmt.Errorf("you must choose a name before you may begin chatting")}
+	}
+
+	if err := s.checkArchived(); err != nil {
+		return &response{err: err}
+	}
+
+	reaction, err := proto.NormalizeReaction(reaction)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	event, err := s.room.React(s.ctx, s, msgID, reaction, remove)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if s.privilegeLevel() == proto.General {
+		event.Sender.ClientAddress = ""
+	}
+
+	if remove {
+		return &response{packet: (*proto.UnreactReply)(event), cost: 1}
+	}
+	return &response{packet: (*proto.ReactReply)(event), cost: 1}
+}
+
+func (s *session) handleLogCommand(msg *proto.LogCommand) *response {
+	reply, err := roomLog(s.ctx, s.room, msg)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	packet, err := proto.DecryptPayload(*reply, &s.client.Authorization, s.privilegeLevel())
+	return &response{
+		packet: packet,
+		err:    err,
+		cost:   1,
+	}
+}
+
+var errLogAnchors = fmt.Errorf("at most one of before, after, and around may be given")
+
+// roomLog fetches the part of the room's log requested by a log command.
+// Encrypted messages are returned as they are stored.
+func roomLog(ctx scope.Context, room proto.Room, msg *proto.LogCommand) (*proto.LogReply, error) {
+	anchors := 0
+	for _, anchor := range []snowflake.Snowflake{msg.Before, msg.After, msg.Around} {
+		if !anchor.IsZero() {
+			anchors++
+		}
+	}
+	if anchors > 1 {
+		return nil, errLogAnchors
+	}
+
+	var (
+		msgs []proto.Message
+		err  error
+		// lo and hi bound the requested range of the log (inclusively), in case
+		// no messages are returned.
+		lo, hi snowflake.Snowflake
+	)
+	switch {
+	case !msg.After.IsZero():
+		msgs, err = room.Earliest(ctx, msg.N, msg.After)
+		lo, hi = msg.After+1, msg.After
+	case !msg.Around.IsZero():
+		msgs, err = room.Latest(ctx, msg.N/2, msg.Around)
+		if err == nil {
+			var newer []proto.Message
+			newer, err = room.Earliest(ctx, msg.N-len(msgs), msg.Around-1)
+			msgs = append(msgs, newer...)
+		}
+		lo, hi = msg.Around, msg.Around-1
+	default:
+		msgs, err = room.Latest(ctx, msg.N, msg.Before)
+		if !msg.Before.IsZero() {
+			lo, hi = msg.Before, msg.Before-1
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msgs == nil {
+		msgs = []proto.Message{}
+	}
+
+	reply := proto.LogReply{
+		Log:    msgs,
+		Before: msg.Before,
+		After:  msg.After,
+		Around: msg.Around,
+	}
+	if len(msgs) > 0 {
+		lo, hi = msgs[0].ID, msgs[len(msgs)-1].ID
+	}
+	if !lo.IsZero() {
+		older, err := room.Latest(ctx, 1, lo)
+		if err != nil {
+			return nil, err
+		}
+		reply.MoreBefore = len(older) > 0
+	}
+	if !hi.IsZero() {
+		newer, err := room.Earliest(ctx, 1, hi)
+		if err != nil {
+			return nil, err
+		}
+		reply.MoreAfter = len(newer) > 0
+	}
+
+	return &reply, nil
+}
+
+func (s *session) handleSearchCommand(msg *proto.SearchCommand) *response {
+	if len(proto.SearchTerms(msg.Query)) == 0 {
+		return &response{err: fmt.Errorf("search query is empty")}
+	}
+
+	var (
+		results []proto.Message
+		err     error
+	)
+	if s.managedRoom != nil {
+		rmk, err := s.managedRoom.MessageKey(s.ctx)
+		if err != nil {
+			return &response{err: err}
+		}
+		if rmk != nil {
+			if _, ok := s.client.Authorization.MessageKeys[rmk.KeyID()]; !ok {
+				return &response{err: proto.ErrAccessDenied}
+			}
+			results, err = s.searchEncrypted(msg)
+			if err != nil {
+				return &response{err: err}
+			}
+		}
+	}
+	if results == nil {
+		results, err = s.room.Search(s.ctx, msg)
+		if err != nil {
+			return &response{err: err}
+		}
+		if results == nil {
+			results = []proto.Message{}
+		}
+	}
+
+	packet, err := proto.DecryptPayload(
+		proto.SearchReply{Results: results, Before: msg.Before}, &s.client.Authorization, s.privilegeLevel())
+	return &response{
+		packet: packet,
+		err:    err,
+		cost:   5,
+	}
+}
+
+// searchEncrypted searches the log of a private room by decrypting its most
+// recent messages, as the backend can't index their content.
+func (s *session) searchEncrypted(msg *proto.SearchCommand) ([]proto.Message, error) {
+	n := msg.N
+	if n > 1000 {
+		n = 1000
+	}
+
+	matches := []proto.Message{}
+	before := msg.Before
+	for scanned := 0; scanned < MaxEncryptedSearchScan && len(matches) < n; {
+		page, err := s.room.Latest(s.ctx, 1000, before)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for i := len(page) - 1; i >= 0 && len(matches) < n; i-- {
+			// A message we can't decrypt can't match, and shouldn't stop the
+			// search of the rest.
+			dm, err := proto.DecryptMessage(page[i], s.client.Authorization.MessageKeys, proto.Staff)
+			if err != nil {
+				logging.Logger(s.ctx).Printf("search: skipping message %s: %s", page[i].ID, err)
+				continue
+			}
+			if msg.Matches(&dm) {
+				matches = append(matches, page[i])
+			}
+		}
+		scanned += len(page)
+		before = page[0].ID
+	}
+
+	// Restore chronological order.
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches, nil
 }
 
 func (s *session) handleBanCommand(msg *proto.BanCommand) *response {
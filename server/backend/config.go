@@ -28,6 +28,7 @@ import (
 	"euphoria.leet.nu/heim/proto/logging"
 	"euphoria.leet.nu/heim/proto/security"
 	"euphoria.leet.nu/heim/templates"
+	vault "euphoria.leet.nu/heim/vault/kms"
 )
 
 var (
@@ -72,12 +73,23 @@ func init() {
 		"name of the AWS region to use for crypto")
 	flag.StringVar(&Config.KMS.Amazon.KeyID, "kms-aws-key-id", env("HEIM_KMS_AWS_KEY_ID", ""),
 		"id of the AWS key to use for crypto")
+	flag.StringVar(&Config.KMS.Vault.Address, "kms-vault-addr", env("HEIM_KMS_VAULT_ADDR", ""),
+		"address of the Vault server whose transit engine to use for crypto")
+	flag.StringVar(&Config.KMS.Vault.Token, "kms-vault-token", env("HEIM_KMS_VAULT_TOKEN", ""),
+		"token to authenticate with Vault")
+	flag.StringVar(&Config.KMS.Vault.Mount, "kms-vault-mount", env("HEIM_KMS_VAULT_MOUNT", vault.DefaultMount),
+		"path where the Vault transit engine is mounted")
+	flag.StringVar(&Config.KMS.Vault.KeyName, "kms-vault-key", env("HEIM_KMS_VAULT_KEY", ""),
+		"name of the Vault transit key to use for crypto")
 	flag.StringVar(&Config.KMS.AES256.KeyFile, "kms-local-key-file", env("HEIM_KMS_LOCAL_KEY", ""),
 		"path to file containing a 256-bit key for using local key-management instead of AWS")
+	flag.StringVar(&Config.KMS.Keyring.KeyDir, "kms-keyring-dir", env("HEIM_KMS_KEYRING_DIR", ""),
+		"path to directory of versioned 256-bit keys (named <version>.key) for local key-management")
 
 	flag.BoolVar(&Config.Policy.AllowRoomCreation, "allow-room-creation", true, "allow rooms to be created")
 	flag.BoolVar(&Config.Policy.AllowAccountCreation, "allow-account-creation", true, "allow accounts to be created")
-	flag.BoolVar(&Config.Policy.AllowAPI, "allow-api", true, "enable API access")
+	flag.BoolVar(&Config.Policy.AllowAPI, "allow-api", true,
+		"enable API access (SSE commands must be routed to the process holding the stream)")
 	flag.IntVar(&Config.Policy.MaxNewRoomNameLen, "max-new-room-name-len", 0,
 		"do not create rooms whose names are longer")
 	flag.DurationVar(&Config.Policy.NewAccountMinAgentAge, "new-account-min-agent-age", 0,
@@ -318,10 +330,21 @@ type KMSConfig struct {
 		KeyFile string `yaml:"key-file"`
 	} `yaml:"aes256,omitempty"`
 
+	Keyring struct {
+		KeyDir string `yaml:"key-dir"`
+	} `yaml:"keyring,omitempty"`
+
 	Amazon struct {
 		Region string `yaml:"region"`
 		KeyID  string `yaml:"key-id"`
 	} `yaml:"amazon,omitempty"`
+
+	Vault struct {
+		Address string `yaml:"address"`
+		Token   string `yaml:"token"`
+		Mount   string `yaml:"mount,omitempty"`
+		KeyName string `yaml:"key-name"`
+	} `yaml:"vault,omitempty"`
 }
 
 func (kc *KMSConfig) Get() (security.KMS, error) {
@@ -332,12 +355,24 @@ func (kc *KMSConfig) Get() (security.KMS, error) {
 			return nil, fmt.Errorf("kms: aes256: %s", err)
 		}
 		return kms, nil
+	case kc.Keyring.KeyDir != "":
+		kms, err := kc.keyring()
+		if err != nil {
+			return nil, fmt.Errorf("kms: keyring: %s", err)
+		}
+		return kms, nil
 	case kc.Amazon.Region != "" || kc.Amazon.KeyID != "":
 		kms, err := kc.amazon()
 		if err != nil {
 			return nil, fmt.Errorf("kms: amazon: %s", err)
 		}
 		return kms, nil
+	case kc.Vault.Address != "" || kc.Vault.KeyName != "":
+		kms, err := kc.vault()
+		if err != nil {
+			return nil, fmt.Errorf("kms: vault: %s", err)
+		}
+		return kms, nil
 	default:
 		return nil, fmt.Errorf("kms: not configured")
 	}
@@ -369,6 +404,36 @@ func (kc *KMSConfig) local() (security.KMS, error) {
 	return kms, nil
 }
 
+// keyring loads every file named <version>.key in the configured directory
+// as a master key. The highest version is used to encrypt new keys.
+func (kc *KMSConfig) keyring() (security.KMS, error) {
+	names, err := filepath.Glob(filepath.Join(kc.Keyring.KeyDir, "*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	keySize := security.AES256.KeySize()
+	keys := map[uint32][]byte{}
+	for _, name := range names {
+		version, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".key"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key file must be named <version>.key", name)
+		}
+		key, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%s: key must be exactly %d bytes in size", name, keySize)
+		}
+		keys[uint32(version)] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", kc.Keyring.KeyDir)
+	}
+	return security.NewKeyring(keys)
+}
+
 func (kc *KMSConfig) amazon() (security.KMS, error) {
 	switch {
 	case kc.Amazon.Region == "":
@@ -379,6 +444,16 @@ func (kc *KMSConfig) amazon() (security.KMS, error) {
 	return kms.New(kc.Amazon.Region, kc.Amazon.KeyID)
 }
 
+func (kc *KMSConfig) vault() (security.KMS, error) {
+	switch {
+	case kc.Vault.Address == "":
+		return nil, fmt.Errorf("address must be specified")
+	case kc.Vault.KeyName == "":
+		return nil, fmt.Errorf("key-name must be specified")
+	}
+	return vault.New(kc.Vault.Address, kc.Vault.Token, kc.Vault.Mount, kc.Vault.KeyName)
+}
+
 type EmailConfig struct {
 	Server     string `yaml:"server"`
 	AuthMethod string `yaml:"auth_method"` // must be "", "CRAM-MD5", or "PLAIN"
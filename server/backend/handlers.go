@@ -4,8 +4,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -40,9 +40,17 @@ func (s *Server) route() {
 		instrumentHttpHandlerFunc("about", http.HandlerFunc(s.handleAboutStatic)))
 
 	s.r.HandleFunc("/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/ws", instrumentSocketHandlerFunc("ws", s.handleRoom))
+	s.r.Path("/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/sse").Methods("GET").Handler(
+		instrumentHttpHandlerFunc("sse", s.handleRoomEvents))
+	s.r.Path("/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/sse/{token:[A-Za-z0-9_-]+}").Methods("POST").Handler(
+		instrumentHttpHandlerFunc("sseCommand", s.handleRoomCommand))
 	s.r.Handle(
 		"/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/", instrumentHttpHandlerFunc("room_static", s.handleRoomStatic))
+	s.r.Path("/room/{room:[a-z0-9]+}/hook/{id:[a-z0-9]+}/{secret:[A-Za-z0-9_-]+}").Methods("POST").Handler(
+		instrumentHttpHandlerFunc("hook", s.handleIncomingWebhook))
 
+	s.r.Handle(
+		"/prefs/emails", instrumentHttpHandlerFunc("prefsEmails", s.handlePrefsEmails))
 	s.r.Handle(
 		"/prefs/reset-password",
 		instrumentHttpHandlerFunc("prefsResetPassword", s.handlePrefsResetPassword))
@@ -50,6 +58,8 @@ func (s *Server) route() {
 		"/prefs/verify", instrumentHttpHandlerFunc("prefsVerify", s.handlePrefsVerify))
 
 	s.r.Handle("/lib/{name}", instrumentHttpHandlerFunc("libPage", s.handleLibPage))
+
+	s.routeAPI()
 }
 
 func (s *Server) handleProbe(w http.ResponseWriter, r *http.Request) {
@@ -89,7 +99,7 @@ func (s *Server) handleRoomStatic(w http.ResponseWriter, r *http.Request) {
 	// Parameterize and serve the page.
 	prefix := mux.Vars(r)["prefix"]
 	roomName := mux.Vars(r)["room"]
-	room, err := s.resolveRoom(ctx, prefix, roomName, client)
+	room, err := s.resolveRoom(ctx, prefix, roomName, client, true)
 	if err != nil {
 		if err == proto.ErrRoomNotFound {
 			if !s.settings.ShowAllRooms && !s.policy.MayAutoCreateRoom(prefix, roomName) {
@@ -101,6 +111,22 @@ func (s *Server) handleRoomStatic(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+
+	// Send visitors who came by an alias to the room's canonical name. The
+	// redirect is temporary, since the canonical name may change again.
+	if managedRoom, ok := room.(proto.ManagedRoom); ok && prefix == "" {
+		canonical, err := managedRoom.CanonicalName(ctx)
+		if err != nil {
+			s.serveInternalError(ctx, w, err)
+			return
+		}
+		if canonical != roomName {
+			target := &url.URL{Path: "/room/" + canonical + "/", RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusFound)
+			return
+		}
+	}
+
 	params := map[string]interface{}{}
 	if room == nil {
 		params["RoomTitle"] = roomName
@@ -126,7 +152,12 @@ func (s *Server) handleRobotsTxt(w http.ResponseWriter, r *http.Request) {
 	s.serveGzippedFile(w, r, "/static/robots.txt", false)
 }
 
-func (s *Server) resolveRoom(ctx scope.Context, prefix, roomName string, client *proto.Client) (room proto.Room, err error) {
+// resolveRoom looks up the room with the given prefix and name, and checks
+// that the client may enter it. Missing rooms are created if autoCreate is set
+// and the policy allows it.
+func (s *Server) resolveRoom(
+	ctx scope.Context, prefix, roomName string, client *proto.Client, autoCreate bool) (room proto.Room, err error) {
+
 	switch prefix {
 	case "pm:":
 		var (
@@ -145,16 +176,25 @@ func (s *Server) resolveRoom(ctx scope.Context, prefix, roomName string, client
 				return nil, err
 			}
 		}
+		if client.BotToken != nil && !client.BotToken.AllowsRoom("pm:"+roomName) {
+			return nil, proto.ErrAccessDenied
+		}
 		client.Authorization.AddMessageKey("pm:"+roomName, roomKey)
 		return room, nil
 	case "":
 		room, err = s.b.GetRoom(ctx, roomName)
-		if err == proto.ErrRoomNotFound && s.policy.MayAutoCreateRoom(prefix, roomName) {
+		if err == proto.ErrRoomNotFound && autoCreate && s.policy.MayAutoCreateRoom(prefix, roomName) {
+			if client.BotToken != nil && !client.BotToken.AllowsRoom(roomName) {
+				return nil, proto.ErrAccessDenied
+			}
 			room, err = s.b.CreateRoom(ctx, s.kms, false, roomName)
 		}
 		if err != nil {
 			return nil, err
 		}
+		if err := checkBotTokenRoom(ctx, client, room); err != nil {
+			return nil, err
+		}
 		if err := client.RoomAuthorize(ctx, room); err != nil {
 			return nil, err
 		}
@@ -164,41 +204,107 @@ func (s *Server) resolveRoom(ctx scope.Context, prefix, roomName string, client
 	}
 }
 
+// checkBotTokenRoom returns ErrAccessDenied if the client authenticated with
+// a bot token that may not be used in the room. The room is named by its
+// canonical name, so that an alias can't stand in for a room the token
+// doesn't allow.
+func checkBotTokenRoom(ctx scope.Context, client *proto.Client, room proto.Room) error {
+	if client.BotToken == nil {
+		return nil
+	}
+	name := room.ID()
+	if managedRoom, ok := room.(proto.ManagedRoom); ok {
+		canonical, err := managedRoom.CanonicalName(ctx)
+		if err != nil {
+			return err
+		}
+		name = canonical
+	}
+	if !client.BotToken.AllowsRoom(name) {
+		return proto.ErrAccessDenied
+	}
+	return nil
+}
+
 func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.authorizeRoom(w, r, "room")
+	if !ok {
+		return
+	}
+
+	// Serve the room websocket.
+	s.serveRoomWebsocket(req.ctx, req.room, req.cookie, req.client, req.agentKey, w, r)
+}
+
+// A roomRequest is a request to open a session in a room, made by a client
+// that may enter the room.
+type roomRequest struct {
+	ctx      scope.Context
+	room     proto.Room
+	client   *proto.Client
+	cookie   *http.Cookie
+	agentKey *security.ManagedKey
+}
+
+// authorizeRoom authenticates the client of a request to open a session, and
+// resolves the room it names. If false is returned, an error response has
+// already been written.
+func (s *Server) authorizeRoom(w http.ResponseWriter, r *http.Request, logPrefix string) (*roomRequest, bool) {
 	if !s.policy.AllowAPI {
 		http.Error(w, "403 forbidden", http.StatusForbidden)
-		return
+		return nil, false
 	}
 
 	ctx := logging.LoggingContext(s.rootCtx.Fork(), os.Stdout,
-		fmt.Sprintf("[room %p] ", r))
+		fmt.Sprintf("[%s %p] ", logPrefix, r))
+
+	prefix := mux.Vars(r)["prefix"]
+	roomName := mux.Vars(r)["room"]
 
-	client, cookie, agentKey, err := getClient(ctx, s, r)
+	var (
+		client   *proto.Client
+		cookie   *http.Cookie
+		agentKey *security.ManagedKey
+		err      error
+	)
+	if secret, ok := bearerToken(r); ok {
+		client, agentKey, err = getBotClient(ctx, s, r, secret)
+	} else {
+		client, cookie, agentKey, err = getClient(ctx, s, r)
+	}
 	if err != nil {
+		if err == proto.ErrAccessDenied {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
 		s.serveInternalError(ctx, w, err)
-		return
+		return nil, false
 	}
 
 	// Resolve the room.
-	prefix := mux.Vars(r)["prefix"]
-	roomName := mux.Vars(r)["room"]
-	room, err := s.resolveRoom(ctx, prefix, roomName, client)
+	room, err := s.resolveRoom(ctx, prefix, roomName, client, true)
 	if err != nil {
 		switch err {
 		case proto.ErrAccessDenied:
 			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
-			return
+			return nil, false
 		case proto.ErrRoomNotFound:
 			http.Error(w, "404 page not found", http.StatusNotFound)
-			return
+			return nil, false
 		default:
 			s.serveInternalError(ctx, w, err)
-			return
+			return nil, false
 		}
 	}
 
-	// Serve the room websocket.
-	s.serveRoomWebsocket(ctx, room, cookie, client, agentKey, w, r)
+	req := &roomRequest{
+		ctx:      ctx,
+		room:     room,
+		client:   client,
+		cookie:   cookie,
+		agentKey: agentKey,
+	}
+	return req, true
 }
 
 func (s *Server) serveRoomWebsocket(
@@ -218,21 +324,21 @@ func (s *Server) serveRoomWebsocket(
 	}
 	defer conn.Close()
 
-	// Determine client address.
-	clientAddress := r.Header.Get("X-Forwarded-For")
-	if clientAddress == "" {
-		addr := conn.RemoteAddr()
-		switch a := addr.(type) {
-		case *net.TCPAddr:
-			clientAddress = a.IP.String()
-		default:
-			clientAddress = addr.String()
-		}
-	}
-
 	// Serve the session.
-	session := newSession(ctx, s, conn, clientAddress, room, client, agentKey, s.settings.Verbose)
-	if err = session.serve(); err != nil {
+	s.serveSession(ctx, &websocketTransport{conn}, clientAddress(r), room, client, agentKey, r)
+}
+
+// serveSession runs a session over the given transport until it ends.
+func (s *Server) serveSession(
+	ctx scope.Context, transport transport, clientAddress string,
+	room proto.Room, client *proto.Client, agentKey *security.ManagedKey, r *http.Request) {
+
+	session := newSession(ctx, s, transport, clientAddress, room, client, agentKey, s.settings.Verbose)
+	session.resume = s.resumePoint(r, room, client)
+	if mux.Vars(r)["prefix"] == "" {
+		session.requestedName = mux.Vars(r)["room"]
+	}
+	if err := session.serve(); err != nil {
 		// TODO: error handling
 		if err != ErrUnresponsive && err != scope.Canceled {
 			logging.Logger(ctx).Printf("session serve error: %s", err)
@@ -330,6 +436,122 @@ func (s *Server) handlePrefsVerifyPost(w http.ResponseWriter, r *http.Request) {
 	reply(nil, http.StatusOK)
 }
 
+func (s *Server) handlePrefsEmails(w http.ResponseWriter, r *http.Request) {
+	if !s.policy.AllowAPI {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage(nil, "bad request", http.StatusBadRequest, w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		token := r.Form.Get("token")
+		ctx := logging.LoggingContext(s.rootCtx.Fork(), os.Stdout,
+			fmt.Sprintf("[prefs-emails %p] ", r))
+		account, err := s.emailPreferencesAccount(ctx, token)
+		switch err {
+		case nil:
+		case proto.ErrInvalidVerificationToken, proto.ErrAccountNotFound:
+			s.serveErrorPage(ctx, "invalid email preferences link", http.StatusBadRequest, w, r)
+			return
+		default:
+			s.serveInternalError(ctx, w, err)
+			return
+		}
+
+		prefs, err := s.b.AccountManager().EmailPreferences(ctx, account.ID())
+		if err != nil {
+			s.serveInternalError(ctx, w, err)
+			return
+		}
+		email, _ := account.Email()
+		params := map[string]interface{}{
+			"token":        token,
+			"email":        email,
+			"digest":       prefs.Digest,
+			"unsubscribed": prefs.Unsubscribed,
+		}
+		s.serveJSONPage(ctx, EmailPreferencesPage, params, w, r)
+	case "POST":
+		s.handlePrefsEmailsPost(w, r)
+	default:
+		s.serveErrorPage(nil, "invalid method", http.StatusMethodNotAllowed, w, r)
+	}
+}
+
+func (s *Server) handlePrefsEmailsPost(w http.ResponseWriter, r *http.Request) {
+	reply := func(err error, status int) {
+		data := struct {
+			Error string `json:"error,omitempty"`
+		}{}
+		if err != nil {
+			data.Error = err.Error()
+		}
+		w.WriteHeader(status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+
+	var req struct {
+		Token        string `json:"token"`
+		Digest       bool   `json:"digest"`
+		Unsubscribed bool   `json:"unsubscribed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		reply(err, http.StatusBadRequest)
+		return
+	}
+
+	ctx := logging.LoggingContext(s.rootCtx.Fork(), os.Stdout,
+		fmt.Sprintf("[prefs-emails %p] ", r))
+	account, err := s.emailPreferencesAccount(ctx, req.Token)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case proto.ErrInvalidVerificationToken:
+			status = http.StatusForbidden
+		case proto.ErrAccountNotFound:
+			status = http.StatusNotFound
+		}
+		reply(err, status)
+		return
+	}
+
+	prefs := &proto.EmailPreferences{
+		Digest:       req.Digest,
+		Unsubscribed: req.Unsubscribed,
+	}
+	if err := s.b.AccountManager().ChangeEmailPreferences(ctx, account.ID(), prefs); err != nil {
+		reply(err, http.StatusInternalServerError)
+		return
+	}
+
+	reply(nil, http.StatusOK)
+}
+
+// emailPreferencesAccount returns the account an email preferences token
+// grants access to.
+func (s *Server) emailPreferencesAccount(ctx scope.Context, token string) (proto.Account, error) {
+	accountID, mac, err := proto.ParseEmailPreferencesToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := s.b.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := proto.CheckEmailPreferencesToken(s.kms, account, mac); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
 func (s *Server) handlePrefsResetPassword(w http.ResponseWriter, r *http.Request) {
 	if !s.policy.AllowAPI {
 		http.Error(w, "403 forbidden", http.StatusForbidden)
@@ -0,0 +1,306 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"github.com/gorilla/mux"
+	"github.com/juju/ratelimit"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/logging"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+var (
+	// IncomingWebhookRate is how often an incoming webhook may post a
+	// message, once its burst of IncomingWebhookBurst is used up.
+	IncomingWebhookRate  = 3 * time.Second
+	IncomingWebhookBurst = int64(10)
+)
+
+// An IncomingWebhookMessage is the body POSTed to an incoming webhook.
+type IncomingWebhookMessage struct {
+	Content string              `json:"content"`
+	Parent  snowflake.Snowflake `json:"parent"`
+}
+
+func (s *Server) handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	if !s.policy.AllowAPI {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	ctx := logging.LoggingContext(s.rootCtx.Fork(), os.Stdout,
+		fmt.Sprintf("[hook %p] ", r))
+
+	roomName := mux.Vars(r)["room"]
+	var hookID snowflake.Snowflake
+	if err := hookID.FromString(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	// Unknown rooms, unknown hooks, and wrong secrets are indistinguishable
+	// to the caller.
+	room, err := s.b.GetRoom(ctx, roomName)
+	if err != nil {
+		if err == proto.ErrRoomNotFound {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		s.serveInternalError(ctx, w, err)
+		return
+	}
+	hook, err := room.GetIncomingWebhook(ctx, hookID)
+	if err != nil {
+		if err == proto.ErrWebhookNotFound {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		s.serveInternalError(ctx, w, err)
+		return
+	}
+	if !hook.Verify(mux.Vars(r)["secret"]) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	if !s.allowIncomingWebhook(hook.ID) {
+		w.Header().Set("Retry-After", strconv.Itoa(int((IncomingWebhookRate+time.Second-1)/time.Second)))
+		http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var msg IncomingWebhookMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4*proto.MaxMessageLength)).Decode(&msg); err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sent, err := s.postIncomingWebhookMessage(ctx, room, hook, &msg)
+	if err != nil {
+		switch err {
+		case proto.ErrMessageTooLong, proto.ErrInvalidParent, errEmptyMessage:
+			http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		case proto.ErrRoomArchived, proto.ErrAnnouncementOnly:
+			http.Error(w, "403 forbidden: "+err.Error(), http.StatusForbidden)
+		default:
+			s.serveInternalError(ctx, w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sent); err != nil {
+		logging.Logger(ctx).Printf("error writing hook response: %s", err)
+	}
+}
+
+var errEmptyMessage = fmt.Errorf("message content is required")
+
+// postIncomingWebhookMessage sends a message into the room as the incoming
+// webhook, encrypting it if the room is private. Like any message, it may
+// mention users and is delivered to the room's webhooks. Hooks have no
+// account, so they can't post while the room is in announcement mode. The
+// message is returned with its content in plaintext.
+func (s *Server) postIncomingWebhookMessage(
+	ctx scope.Context, room proto.ManagedRoom, hook *proto.IncomingWebhook, cmd *IncomingWebhookMessage) (
+	proto.SendReply, error) {
+
+	if cmd.Content == "" {
+		return proto.SendReply{}, errEmptyMessage
+	}
+	if len(cmd.Content) > proto.MaxMessageLength {
+		return proto.SendReply{}, proto.ErrMessageTooLong
+	}
+
+	archived, err := room.Archived(ctx)
+	if err != nil {
+		return proto.SendReply{}, err
+	}
+	if archived {
+		return proto.SendReply{}, proto.ErrRoomArchived
+	}
+	if err := checkAnnouncementMode(ctx, room, 0); err != nil {
+		return proto.SendReply{}, err
+	}
+
+	// Webhooks can't hold the keys of an end-to-end encrypted room.
+	e2e, err := room.E2E(ctx)
+	if err != nil {
+		return proto.SendReply{}, err
+	}
+	if e2e {
+		return proto.SendReply{}, proto.ErrE2EEncryptionRequired
+	}
+
+	isValidParent, err := room.IsValidParent(cmd.Parent)
+	if err != nil {
+		return proto.SendReply{}, err
+	}
+	if !isValidParent {
+		return proto.SendReply{}, proto.ErrInvalidParent
+	}
+
+	msgID, err := snowflake.New()
+	if err != nil {
+		return proto.SendReply{}, err
+	}
+
+	session := &hookSession{hook: hook, serverID: s.ID, serverEra: s.Era}
+	msg := proto.Message{
+		ID:      msgID,
+		Content: cmd.Content,
+		Parent:  cmd.Parent,
+		Sender:  session.View(proto.Host),
+	}
+
+	keyID, isPrivate, err := room.MessageKeyID(ctx)
+	if err != nil {
+		return proto.SendReply{}, err
+	}
+	if isPrivate {
+		mkey, err := room.MessageKey(ctx)
+		if err != nil {
+			return proto.SendReply{}, err
+		}
+		key := mkey.ManagedKey()
+		if err := s.kms.DecryptKey(&key); err != nil {
+			return proto.SendReply{}, err
+		}
+		if err := proto.EncryptMessage(&msg, keyID, &key); err != nil {
+			return proto.SendReply{}, err
+		}
+	}
+
+	sent, err := sendMessage(ctx, s.b, room, room.ID(), session, msg, cmd.Content)
+	if err != nil {
+		return proto.SendReply{}, err
+	}
+
+	reply := proto.SendReply(sent)
+	reply.Sender = session.View(proto.Host)
+	reply.Content = cmd.Content
+	reply.EncryptionKeyID = ""
+	return reply, nil
+}
+
+// allowIncomingWebhook takes a token from the incoming webhook's rate
+// limiter, and returns false if none are available.
+func (s *Server) allowIncomingWebhook(hookID snowflake.Snowflake) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.hookLimiters == nil {
+		s.hookLimiters = map[snowflake.Snowflake]*ratelimit.Bucket{}
+	}
+	limiter, ok := s.hookLimiters[hookID]
+	if !ok {
+		limiter = ratelimit.NewBucket(IncomingWebhookRate, IncomingWebhookBurst)
+		s.hookLimiters[hookID] = limiter
+	}
+	return limiter.TakeAvailable(1) > 0
+}
+
+// forgetIncomingWebhook drops the rate limiter of a removed incoming webhook.
+func (s *Server) forgetIncomingWebhook(hookID snowflake.Snowflake) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.hookLimiters, hookID)
+}
+
+// hookSession stands in for a connected session when an incoming webhook
+// posts a message.
+type hookSession struct {
+	hook      *proto.IncomingWebhook
+	serverID  string
+	serverEra string
+}
+
+func (h *hookSession) ID() string               { return h.hook.UserID().String() }
+func (h *hookSession) ServerID() string         { return h.serverID }
+func (h *hookSession) AgentID() string          { return h.hook.UserID().String() }
+func (h *hookSession) Identity() proto.Identity { return (*hookIdentity)(h) }
+func (h *hookSession) SetName(name string)      {}
+func (h *hookSession) Close()                   {}
+func (h *hookSession) CheckAbandoned() error    { return nil }
+
+func (h *hookSession) Send(scope.Context, proto.PacketType, interface{}) error { return nil }
+
+func (h *hookSession) View(level proto.PrivilegeLevel) proto.SessionView {
+	return proto.SessionView{
+		IdentityView: h.Identity().View(),
+		SessionID:    h.ID(),
+		IsBot:        true,
+	}
+}
+
+type hookIdentity hookSession
+
+func (h *hookIdentity) ID() proto.UserID { return h.hook.UserID() }
+func (h *hookIdentity) Name() string     { return h.hook.Name }
+func (h *hookIdentity) ServerID() string { return h.serverID }
+
+func (h *hookIdentity) View() proto.IdentityView {
+	return proto.IdentityView{
+		ID:        h.ID(),
+		Name:      h.Name(),
+		ServerID:  h.serverID,
+		ServerEra: h.serverEra,
+	}
+}
+
+func (s *session) handleAddIncomingWebhookCommand(msg *proto.AddIncomingWebhookCommand) *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	hook, secret, err := proto.NewIncomingWebhook(msg.Name)
+	if err != nil {
+		return &response{err: err}
+	}
+	if err := s.managedRoom.AddIncomingWebhook(s.ctx, hook); err != nil {
+		return &response{err: err}
+	}
+	reply := &proto.AddIncomingWebhookReply{
+		IncomingWebhook: *hook,
+		Path:            hook.Path(s.roomName, secret),
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleListIncomingWebhooksCommand() *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	hooks, err := s.managedRoom.IncomingWebhooks(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	reply := &proto.ListIncomingWebhooksReply{IncomingWebhooks: make([]proto.IncomingWebhook, len(hooks))}
+	for i, hook := range hooks {
+		reply.IncomingWebhooks[i] = *hook
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleRemoveIncomingWebhookCommand(msg *proto.RemoveIncomingWebhookCommand) *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.RemoveIncomingWebhook(s.ctx, msg.ID); err != nil {
+		return &response{err: err}
+	}
+	s.server.forgetIncomingWebhook(msg.ID)
+	return &response{packet: &proto.RemoveIncomingWebhookReply{ID: msg.ID}}
+}
@@ -1,11 +1,16 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -152,7 +157,7 @@ func (s *serverUnderTest) openWebsocket(roomName string, cookies []*http.Cookie,
 		prefix = "pm:"
 		roomName = roomName[3:]
 	}
-	room, err := s.app.resolveRoom(newTestScope(), prefix, roomName, client)
+	room, err := s.app.resolveRoom(newTestScope(), prefix, roomName, client, true)
 	if err == proto.ErrRoomNotFound {
 		err = fmt.Errorf("roomName: %s%s", prefix, roomName)
 	}
@@ -190,6 +195,19 @@ func (s *serverUnderTest) Reconnect(tc *testConn, roomNames ...string) *testConn
 	return tc
 }
 
+func (s *serverUnderTest) Resume(tc *testConn) *testConn {
+	vs := url.Values{}
+	vs.Add("resume", tc.resumeToken)
+	vs.Add("cursor", tc.cursor)
+	room, conn, resp := s.openWebsocket(tc.roomName, tc.cookies, vs)
+	tc.room = room
+	tc.Conn = conn
+	tc.cookies = resp.Cookies()
+	tc.resumed = true
+	tc.expectHello()
+	return tc
+}
+
 func (s *serverUnderTest) Account(
 	ctx scope.Context, kms security.KMS, namespace, id, password string) (
 	proto.Account, *security.ManagedKey, error) {
@@ -273,6 +291,33 @@ func (s *serverUnderTest) Login(c *testConn, namespace, id, password string) *te
 	return c
 }
 
+func (s *serverUnderTest) dialWithBotToken(roomName, secret string) (*websocket.Conn, *http.Response, error) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+secret)
+	url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/" + roomName + "/ws"
+	return websocket.DefaultDialer.Dial(url, headers)
+}
+
+// ConnectWithBotToken connects to the room as the account tc is logged into,
+// authenticating with a bot token instead of an agent cookie.
+func (s *serverUnderTest) ConnectWithBotToken(tc *testConn, roomName, secret string) *testConn {
+	conn, _, err := s.dialWithBotToken(roomName, secret)
+	So(err, ShouldBeNil)
+	room, err := s.backend.GetRoom(newTestScope(), roomName)
+	So(err, ShouldBeNil)
+
+	bot := tc.clone()
+	bot.Conn = conn
+	bot.room = room
+	bot.roomName = roomName
+	bot.cookies = nil
+	bot.isBot = true
+	bot.resumed = false
+	bot.debug(debugSendReceive)
+	bot.expectHello()
+	return bot
+}
+
 type testConn struct {
 	*websocket.Conn
 	room                 proto.Room
@@ -288,9 +333,17 @@ type testConn struct {
 	accountHasAccess     bool
 	isStaff              bool
 	isManager            bool
+	isBot                bool
 	debugOn              bool
 	pmNick               string
 	pmUserID             string
+	resumeToken          string
+	cursor               string
+	resumed              bool
+	readMarker           string
+	unread               int
+	announcementMode     bool
+	readOnly             bool
 }
 
 func (tc *testConn) clone() *testConn {
@@ -376,6 +429,9 @@ func (tc *testConn) expect(id string, cmdType proto.PacketType, data string, arg
 	So(packet.Error, ShouldEqual, "")
 
 	So(packet.Type, ShouldEqual, cmdType)
+	if packet.Cursor != 0 {
+		tc.cursor = packet.Cursor.String()
+	}
 
 	// Inspect events and replies to track some state automatically.
 	switch packet.Type {
@@ -499,10 +555,20 @@ func (tc *testConn) expectHello() {
 		if tc.isManager {
 			sessionParts += `,"is_manager":true,"client_address":"*"`
 		}
+		if tc.isBot {
+			sessionParts += `,"is_bot":true`
+		}
 		account += "},"
 	}
 	_, ok, err := tc.room.MessageKeyID(newTestScope())
 	So(err, ShouldBeNil)
+	if managedRoom, isManaged := tc.room.(proto.ManagedRoom); isManaged {
+		e2e, err := managedRoom.E2E(newTestScope())
+		So(err, ShouldBeNil)
+		if e2e {
+			isParts += `,"room_is_e2e":true`
+		}
+	}
 	if ok {
 		isParts += `,"room_is_private":true`
 		if tc.accountHasAccess {
@@ -539,9 +605,26 @@ func (tc *testConn) expectSnapshot(version string, listingParts []string, logPar
 	if tc.pmUserID != "" {
 		optionals += fmt.Sprintf(`,"pm_with_user_id":"%s"`, tc.pmUserID)
 	}
-	tc.expect("", "snapshot-event",
-		`{"identity":"*","session_id":"*","version":"%s","listing":[%s],"log":[%s]%s}`,
+	if tc.resumed {
+		optionals += `,"resumed":true`
+	}
+	if tc.readMarker != "" {
+		optionals += fmt.Sprintf(`,"read_marker":"%s"`, tc.readMarker)
+	}
+	if tc.unread != 0 {
+		optionals += fmt.Sprintf(`,"unread":%d`, tc.unread)
+	}
+	if tc.announcementMode {
+		optionals += `,"announcement_mode":true`
+	}
+	if tc.readOnly {
+		optionals += `,"read_only":true`
+	}
+	captures := tc.expect("", "snapshot-event",
+		`{"identity":"*","session_id":"*","version":"%s","listing":[%s],"log":[%s],"resume_token":"*","cursor":"*"%s}`,
 		version, strings.Join(listingParts, ","), strings.Join(logParts, ","), optionals)
+	tc.resumeToken, _ = captures["resume_token"].(string)
+	tc.cursor, _ = captures["cursor"].(string)
 }
 
 func (tc *testConn) Close() {
@@ -627,6 +710,26 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 	runTest("Authentication", testAuthentication)
 	runTestWithFactory("Presence", testPresence)
 	runTest("Deletion", testDeletion)
+	runTest("Message editing", testMessageEditing)
+	runTest("Search", testSearch)
+	runTest("Log paging", testLogPaging)
+	runTest("Resume", testResume)
+	runTest("Reactions", testReactions)
+	runTest("Read markers", testReadMarkers)
+	runTest("Mentions", testMentions)
+	runTest("Digests", testDigests)
+	runTest("Email preferences", testEmailPreferences)
+	runTest("Bot tokens", testBotTokens)
+	runTest("Webhooks", testWebhooks)
+	runTest("Incoming webhooks", testIncomingWebhooks)
+	runTest("Read-only API", testAPI)
+	runTest("SSE transport", testSSE)
+	runTest("Room aliases", testRoomAliases)
+	runTest("Room archival and deletion", testRoomLifecycle)
+	runTest("Announcement mode", testAnnouncementMode)
+	runTest("Message key rotation", testMessageKeyRotation)
+	runTest("End-to-end encrypted rooms", testE2ERooms)
+	runTest("Passcode grant limits", testPasscodeGrantLimits)
 	runTest("Account login", testAccountLogin)
 	runTest("Account registration", testAccountRegistration)
 	runTest("Account change password", testAccountChangePassword)
@@ -789,7 +892,7 @@ func testThreading(s *serverUnderTest) {
 		room, err := s.Room(ctx, kms, true, "threading", owner)
 		So(err, ShouldBeNil)
 		rkey, err := room.MessageKey(ctx)
-		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2", nil), ShouldBeNil)
 
 		conn := s.Connect("threading")
 		defer conn.Close()
@@ -974,7 +1077,7 @@ func testAuthentication(s *serverUnderTest) {
 	s.once.Do(func() {
 		rkey, err := room.MessageKey(ctx)
 		So(err, ShouldBeNil)
-		So(rkey.GrantToPasscode(ctx, logan, loganKey, "hunter2"), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, logan, loganKey, "hunter2", nil), ShouldBeNil)
 	})
 
 	Convey("Access denied", func() {
@@ -1102,7 +1205,7 @@ func testDeletion(s *serverUnderTest) {
 		// Delete message.
 		conn.send("4", "edit-message", `{"id":"%s","delete":true,"announce":true}`, capture["id"])
 		conn.expect("4", "edit-message-reply",
-			`{"edit_id":"*","id":"*","time":"*","sender":{"session_id":"*","id":"*","client_address":"*",%s},"content":"@#$!","edited":"*","deleted":"*"}`,
+			`{"edit_id":"*","id":"*","previous_edit_id":"*","time":"*","sender":{"session_id":"*","id":"*","client_address":"*",%s},"content":"@#$!","edited":"*","deleted":"*"}`,
 			server)
 
 		conn2 := s.Connect("deletion")
@@ -1121,6 +1224,1824 @@ func testDeletion(s *serverUnderTest) {
 	})
 }
 
+func testMessageEditing(s *serverUnderTest) {
+	Convey("Sender can edit content and parent", func() {
+		author := s.Connect("editing")
+		defer author.Close()
+		author.expectPing()
+		author.expectSnapshot(s.backend.Version(), nil, nil)
+
+		observer := s.Connect("editing")
+		defer observer.Close()
+		observer.expectPing()
+		observer.expectSnapshot(s.backend.Version(), []string{
+			fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+				author.sessionID, author.id()),
+		}, nil)
+		author.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+			observer.sessionID, observer.id())
+
+		author.send("0", "nick", `{"name":"author"}`)
+		author.expect("0", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+		observer.expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+
+		author.send("1", "send", `{"content":"root"}`)
+		root := author.expect("1", "send-reply", `{"id":"*","time":"*","sender":"*","content":"root"}`)
+		observer.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"root"}`, root["id"])
+
+		author.send("2", "send", `{"content":"tpyo"}`)
+		msg := author.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"tpyo"}`)
+		observer.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"tpyo"}`, msg["id"])
+
+		// Others may not edit the message.
+		observer.send("1", "edit-message", `{"id":"%s","content":"pwned","announce":true}`, msg["id"])
+		observer.expectError("1", "edit-message-reply", "access denied")
+
+		// Senders may not delete their own messages.
+		author.send("3", "edit-message", `{"id":"%s","delete":true}`, msg["id"])
+		author.expectError("3", "edit-message-reply", "access denied")
+
+		// The parent must precede the message.
+		author.send("4", "edit-message", `{"id":"%s","parent":"%s"}`, root["id"], msg["id"])
+		author.expectError("4", "edit-message-reply", "invalid parent ID")
+
+		author.send("5", "edit-message",
+			`{"id":"%s","parent":"%s","content":"typo","announce":true}`, msg["id"], root["id"])
+		edit := author.expect("5", "edit-message-reply",
+			`{"edit_id":"*","id":"%s","parent":"%s","previous_edit_id":"*","time":"*","sender":"*","content":"typo","edited":"*"}`,
+			msg["id"], root["id"])
+		observer.expect("", "edit-message-event",
+			`{"edit_id":"%s","id":"%s","parent":"%s","previous_edit_id":"%s","time":"*","sender":"*","content":"typo","edited":"*"}`,
+			edit["edit_id"], msg["id"], root["id"], edit["edit_id"])
+
+		// A stale previous_edit_id is rejected.
+		author.send("6", "edit-message", `{"id":"%s","previous_edit_id":"%s","content":"oops"}`,
+			msg["id"], root["id"])
+		author.expectError("6", "edit-message-reply", "edit inconsistent")
+
+		observer.send("2", "get-message", `{"id":"%s"}`, msg["id"])
+		observer.expect("2", "get-message-reply",
+			`{"id":"%s","parent":"%s","previous_edit_id":"%s","time":"*","sender":"*","content":"typo","edited":"*"}`,
+			msg["id"], root["id"], edit["edit_id"])
+	})
+
+	Convey("Edits in private rooms are re-encrypted", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		owner, ownerKey, err := s.Account(ctx, kms, "email", "editing-owner", "passcode")
+		So(err, ShouldBeNil)
+		room, err := s.Room(ctx, kms, true, "privateediting", owner)
+		So(err, ShouldBeNil)
+		rkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2", nil), ShouldBeNil)
+
+		conns := make([]*testConn, 2)
+		for i := range conns {
+			conns[i] = s.Connect("privateediting")
+			defer conns[i].Close()
+			conns[i].expectPing()
+			conns[i].expect("", "bounce-event", `{"reason":"authentication required"}`)
+			conns[i].send("1", "auth", `{"type":"passcode","passcode":"hunter2"}`)
+			conns[i].expect("1", "auth-reply", `{"success":true}`)
+			conns[i].expectSnapshot(s.backend.Version(), nil, nil)
+		}
+		conns[0].expect("", "join-event", `{"session_id":"%s","id":"*","name":"","server_id":"*","server_era":"*"}`,
+			conns[1].sessionID)
+
+		conns[0].send("1", "nick", `{"name":"author"}`)
+		conns[0].expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+		conns[1].expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+
+		conns[0].send("2", "send", `{"content":"secret"}`)
+		msg := conns[0].expect("2", "send-reply",
+			`{"id":"*","time":"*","sender":"*","content":"secret","encryption_key_id":"*"}`)
+		conns[1].expect("", "send-event",
+			`{"id":"%s","time":"*","sender":"*","content":"secret","encryption_key_id":"*"}`, msg["id"])
+
+		conns[0].send("3", "edit-message", `{"id":"%s","content":"still secret","announce":true}`, msg["id"])
+		conns[0].expect("3", "edit-message-reply",
+			`{"edit_id":"*","id":"%s","previous_edit_id":"*","time":"*","sender":"*","content":"still secret","encryption_key_id":"*","edited":"*"}`,
+			msg["id"])
+		conns[1].expect("", "edit-message-event",
+			`{"edit_id":"*","id":"%s","previous_edit_id":"*","time":"*","sender":"*","content":"still secret","encryption_key_id":"*","edited":"*"}`,
+			msg["id"])
+
+		conns[1].send("2", "log", `{"n":10}`)
+		conns[1].expect("2", "log-reply",
+			`{"log":[{"id":"%s","previous_edit_id":"*","time":"*","sender":"*","content":"still secret","encryption_key_id":"*","edited":"*"}]}`,
+			msg["id"])
+	})
+}
+
+func testSearch(s *serverUnderTest) {
+	Convey("Search public room", func() {
+		conn := s.Connect("search")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("1", "nick", `{"name":"searcher"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"searcher"}`)
+
+		conn.send("2", "send", `{"content":"Hello, world!"}`)
+		first := conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"Hello, world!"}`)
+		conn.send("3", "send", `{"content":"goodbye world"}`)
+		conn.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"goodbye world"}`)
+		conn.send("4", "send", `{"content":"hello again"}`)
+		last := conn.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello again"}`)
+
+		conn.send("5", "search", `{"query":"HELLO","n":10}`)
+		conn.expect("5", "search-reply",
+			`{"results":[`+
+				`{"id":"%s","time":"*","sender":"*","content":"Hello, world!"},`+
+				`{"id":"%s","time":"*","sender":"*","content":"hello again"}]}`,
+			first["id"], last["id"])
+
+		conn.send("6", "search", `{"query":"hello","n":10,"before":"%s"}`, last["id"])
+		conn.expect("6", "search-reply",
+			`{"results":[{"id":"%s","time":"*","sender":"*","content":"Hello, world!"}],"before":"%s"}`,
+			first["id"], last["id"])
+
+		conn.send("7", "search", `{"query":"hello","n":1}`)
+		conn.expect("7", "search-reply",
+			`{"results":[{"id":"%s","time":"*","sender":"*","content":"hello again"}]}`, last["id"])
+
+		conn.send("8", "search", `{"query":"hello","sender":"bot:nobody","n":10}`)
+		conn.expect("8", "search-reply", `{"results":[]}`)
+
+		conn.send("9", "search", `{"query":"!?","n":10}`)
+		conn.expectError("9", "search-reply", "search query is empty")
+	})
+
+	Convey("Search private room", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		owner, ownerKey, err := s.Account(ctx, kms, "email", "search-owner", "passcode")
+		So(err, ShouldBeNil)
+		room, err := s.Room(ctx, kms, true, "privatesearch", owner)
+		So(err, ShouldBeNil)
+		rkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2", nil), ShouldBeNil)
+
+		conn := s.Connect("privatesearch")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		conn.send("1", "auth", `{"type":"passcode","passcode":"hunter2"}`)
+		conn.expect("1", "auth-reply", `{"success":true}`)
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("2", "nick", `{"name":"searcher"}`)
+		conn.expect("2", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"searcher"}`)
+		conn.send("3", "send", `{"content":"top secret"}`)
+		msg := conn.expect("3", "send-reply",
+			`{"id":"*","time":"*","sender":"*","content":"top secret","encryption_key_id":"*"}`)
+		conn.send("4", "send", `{"content":"nothing to see"}`)
+		conn.expect("4", "send-reply",
+			`{"id":"*","time":"*","sender":"*","content":"nothing to see","encryption_key_id":"*"}`)
+
+		conn.send("5", "search", `{"query":"secret","n":10}`)
+		conn.expect("5", "search-reply",
+			`{"results":[{"id":"%s","time":"*","sender":"*","content":"top secret","encryption_key_id":"*"}]}`,
+			msg["id"])
+	})
+}
+
+func testLogPaging(s *serverUnderTest) {
+	Convey("Log paging", func() {
+		conn := s.Connect("logpaging")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("1", "nick", `{"name":"pager"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"pager"}`)
+
+		ids := make([]string, 5)
+		for i := range ids {
+			conn.send("2", "send", `{"content":"%d"}`, i)
+			capture := conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"%d"}`, i)
+			ids[i] = capture["id"].(string)
+		}
+		entry := func(i int) string {
+			return fmt.Sprintf(`{"id":"%s","time":"*","sender":"*","content":"%d"}`, ids[i], i)
+		}
+
+		conn.send("3", "log", `{"n":2}`)
+		conn.expect("3", "log-reply", `{"log":[%s,%s],"more_before":true}`, entry(3), entry(4))
+
+		conn.send("4", "log", `{"n":2,"before":"%s"}`, ids[1])
+		conn.expect("4", "log-reply", `{"log":[%s],"before":"%s","more_after":true}`, entry(0), ids[1])
+
+		conn.send("5", "log", `{"n":2,"after":"%s"}`, ids[0])
+		conn.expect("5", "log-reply", `{"log":[%s,%s],"after":"%s","more_before":true,"more_after":true}`,
+			entry(1), entry(2), ids[0])
+
+		conn.send("6", "log", `{"n":10,"after":"%s"}`, ids[4])
+		conn.expect("6", "log-reply", `{"log":[],"after":"%s","more_before":true}`, ids[4])
+
+		conn.send("7", "log", `{"n":3,"around":"%s"}`, ids[2])
+		conn.expect("7", "log-reply", `{"log":[%s,%s,%s],"around":"%s","more_before":true,"more_after":true}`,
+			entry(1), entry(2), entry(3), ids[2])
+
+		conn.send("8", "log", `{"n":10,"around":"%s"}`, ids[2])
+		conn.expect("8", "log-reply", `{"log":[%s,%s,%s,%s,%s],"around":"%s"}`,
+			entry(0), entry(1), entry(2), entry(3), entry(4), ids[2])
+
+		conn.send("9", "log", `{"n":10,"before":"%s","after":"%s"}`, ids[4], ids[0])
+		conn.expectError("9", "log-reply", "at most one of before, after, and around may be given")
+	})
+}
+
+func testResume(s *serverUnderTest) {
+	Convey("Resuming replays missed events", func() {
+		conn := s.Connect("resume")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"resumer"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"resumer"}`)
+		conn.Close()
+
+		other := s.Connect("resume")
+		defer other.Close()
+		other.expectPing()
+		other.expectSnapshot(s.backend.Version(), nil, nil)
+		other.send("1", "nick", `{"name":"other"}`)
+		other.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"other"}`)
+		other.send("2", "send", `{"content":"missed"}`)
+		capture := other.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"missed"}`)
+		msgID := capture["id"].(string)
+
+		lastCursor := conn.cursor
+		s.Resume(conn)
+		defer conn.Close()
+		conn.expectPing()
+		listing := fmt.Sprintf(
+			`{"session_id":"%s","id":"%s","name":"other","server_id":"test1","server_era":"era1"}`,
+			other.sessionID, other.id())
+		msg := fmt.Sprintf(
+			`{"id":"%s","time":"*","sender":{"session_id":"%s","id":"%s","name":"other","server_id":"test1","server_era":"era1"},"content":"missed"}`,
+			msgID, other.sessionID, other.id())
+		conn.expectSnapshot(s.backend.Version(), []string{listing}, []string{msg})
+		So(conn.cursor, ShouldNotEqual, lastCursor)
+
+		conn.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+			other.sessionID, other.id())
+		conn.expect("", "nick-event",
+			`{"session_id":"%s","id":"%s","from":"","to":"other"}`, other.sessionID, other.id())
+		conn.expect("", "send-event",
+			`{"id":"%s","time":"*","sender":"*","content":"missed"}`, msgID)
+		So(conn.cursor, ShouldNotEqual, lastCursor)
+
+		other.expect("", "join-event",
+			`{"session_id":"%s","id":"*","name":"resumer","server_id":"test1","server_era":"era1"}`, conn.sessionID)
+	})
+
+	Convey("Invalid resume tokens are ignored", func() {
+		conn := s.Connect("resume2")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.Close()
+
+		conn.resumeToken = "bogus"
+		s.Resume(conn)
+		defer conn.Close()
+		conn.resumed = false
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+	})
+}
+
+func testReactions(s *serverUnderTest) {
+	Convey("Reactions are counted per user and broadcast", func() {
+		author := s.Connect("reactions")
+		defer author.Close()
+		author.expectPing()
+		author.expectSnapshot(s.backend.Version(), nil, nil)
+
+		reactor := s.Connect("reactions")
+		defer reactor.Close()
+		reactor.expectPing()
+		reactor.expectSnapshot(s.backend.Version(), []string{
+			fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+				author.sessionID, author.id()),
+		}, nil)
+		author.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+			reactor.sessionID, reactor.id())
+
+		author.send("1", "nick", `{"name":"author"}`)
+		author.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+		reactor.expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+
+		// Reacting requires a name, like sending.
+		reactor.send("1", "react", `{"id":"%s","reaction":"+1"}`, snowflake.Snowflake(1))
+		reactor.expectError("1", "react-reply", "you must choose a name before you may begin chatting")
+
+		reactor.send("2", "nick", `{"name":"reactor"}`)
+		reactor.expect("2", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"reactor"}`)
+		author.expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"reactor"}`)
+
+		author.send("2", "send", `{"content":"hello"}`)
+		msg := author.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello"}`)
+		reactor.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"hello"}`, msg["id"])
+
+		reactor.send("3", "react", `{"id":"%s","reaction":" +1 "}`, msg["id"])
+		reactor.expect("3", "react-reply", `{"id":"%s","reaction":"+1","sender":"*","count":1}`, msg["id"])
+		author.expect("", "reaction-event", `{"id":"%s","reaction":"+1","sender":"*","count":1}`, msg["id"])
+
+		// Repeating a reaction doesn't count twice, and isn't broadcast.
+		reactor.send("4", "react", `{"id":"%s","reaction":"+1"}`, msg["id"])
+		reactor.expect("4", "react-reply", `{"id":"%s","reaction":"+1","sender":"*","count":1}`, msg["id"])
+
+		author.send("3", "react", `{"id":"%s","reaction":"+1"}`, msg["id"])
+		author.expect("3", "react-reply", `{"id":"%s","reaction":"+1","sender":"*","count":2}`, msg["id"])
+		reactor.expect("", "reaction-event", `{"id":"%s","reaction":"+1","sender":"*","count":2}`, msg["id"])
+
+		reactor.send("5", "log", `{"n":10}`)
+		reactor.expect("5", "log-reply",
+			`{"log":[{"id":"%s","time":"*","sender":"*","content":"hello","reactions":{"+1":2}}]}`, msg["id"])
+
+		reactor.send("6", "unreact", `{"id":"%s","reaction":"+1"}`, msg["id"])
+		reactor.expect("6", "unreact-reply",
+			`{"id":"%s","reaction":"+1","sender":"*","removed":true,"count":1}`, msg["id"])
+		author.expect("", "reaction-event",
+			`{"id":"%s","reaction":"+1","sender":"*","removed":true,"count":1}`, msg["id"])
+
+		reactor.send("7", "get-message", `{"id":"%s"}`, msg["id"])
+		reactor.expect("7", "get-message-reply",
+			`{"id":"%s","time":"*","sender":"*","content":"hello","reactions":{"+1":1}}`, msg["id"])
+
+		reactor.send("8", "react", `{"id":"%s","reaction":"thumbs up"}`, msg["id"])
+		reactor.expectError("8", "react-reply", "invalid reaction")
+
+		reactor.send("9", "react", `{"id":"%s","reaction":"+1"}`, snowflake.Snowflake(1))
+		reactor.expectError("9", "react-reply", "message not found")
+	})
+}
+
+func testReadMarkers(s *serverUnderTest) {
+	Convey("Accounts can mark how far they've read", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("readmarkers-%s", time.Now())
+		_, _, err := s.Account(ctx, kms, "email", "reader"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		poster := s.Connect("readmarkers")
+		defer poster.Close()
+		poster.expectPing()
+		poster.expectSnapshot(s.backend.Version(), nil, nil)
+		poster.send("1", "nick", `{"name":"poster"}`)
+		poster.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"poster"}`)
+
+		ids := make([]string, 3)
+		log := make([]string, len(ids))
+		for i := range ids {
+			poster.send("2", "send", `{"content":"%d"}`, i)
+			capture := poster.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"%d"}`, i)
+			ids[i] = capture["id"].(string)
+			log[i] = fmt.Sprintf(`{"id":"%s","time":"*","sender":"*","content":"%d"}`, ids[i], i)
+		}
+
+		// Only accounts have read markers.
+		poster.send("3", "mark-read", `{"id":"%s"}`, ids[0])
+		poster.expectError("3", "mark-read-reply", "not logged in")
+
+		listing := []string{fmt.Sprintf(
+			`{"session_id":"%s","id":"%s","name":"poster","server_id":"test1","server_era":"era1"}`,
+			poster.sessionID, poster.id())}
+
+		reader := s.Login(nil, "email", "reader"+nonce, "hunter2")
+		reader.Close()
+		reader = s.Reconnect(reader, "readmarkers")
+		reader.expectPing()
+		reader.expectSnapshot(s.backend.Version(), listing, log)
+
+		other := reader.clone()
+		s.Reconnect(other, "readmarkers2")
+		defer other.Close()
+		other.expectPing()
+		other.expectSnapshot(s.backend.Version(), nil, nil)
+
+		reader.send("1", "mark-read", `{"id":"%s"}`, ids[1])
+		reader.expect("1", "mark-read-reply", `{"id":"%s","unread":1}`, ids[1])
+		other.expect("", "read-event", `{"room":"readmarkers","id":"%s","unread":1}`, ids[1])
+
+		// The marker doesn't move backwards.
+		reader.send("2", "mark-read", `{"id":"%s"}`, ids[0])
+		reader.expect("2", "mark-read-reply", `{"id":"%s","unread":1}`, ids[1])
+		other.expect("", "read-event", `{"room":"readmarkers","id":"%s","unread":1}`, ids[1])
+
+		reader.send("3", "mark-read", `{"id":"%s"}`, snowflake.Snowflake(1))
+		reader.expectError("3", "mark-read-reply", "message not found")
+
+		reader.Close()
+		reader = s.Reconnect(reader)
+		defer reader.Close()
+		reader.readMarker = ids[1]
+		reader.unread = 1
+		reader.expectPing()
+		reader.expectSnapshot(s.backend.Version(), listing, log)
+	})
+}
+
+func testMentions(s *serverUnderTest) {
+	Convey("Mentions are indexed and pushed to the mentioned user", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("mentions-%s", time.Now())
+		_, _, err := s.Account(ctx, kms, "email", "bird"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		// The mentioned account establishes a nick in the room, then leaves.
+		bird := s.Login(nil, "email", "bird"+nonce, "hunter2")
+		bird.Close()
+		bird = s.Reconnect(bird, "mentions")
+		bird.expectPing()
+		bird.expectSnapshot(s.backend.Version(), nil, nil)
+		bird.send("1", "nick", `{"name":"Big Bird"}`)
+		bird.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"Big Bird"}`)
+		bird.Close()
+
+		lurker := s.Connect("mentions")
+		defer lurker.Close()
+		lurker.expectPing()
+		lurker.expectSnapshot(s.backend.Version(), nil, nil)
+		lurker.send("1", "nick", `{"name":"lurker"}`)
+		lurker.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"lurker"}`)
+
+		poster := s.Connect("mentions")
+		defer poster.Close()
+		poster.expectPing()
+		poster.expectSnapshot(s.backend.Version(), []string{
+			fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"lurker","server_id":"test1","server_era":"era1"}`,
+				lurker.sessionID, lurker.id()),
+		}, nil)
+		lurker.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+			poster.sessionID, poster.id())
+		poster.send("1", "nick", `{"name":"poster"}`)
+		poster.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"poster"}`)
+		lurker.expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"poster"}`)
+
+		poster.send("2", "send", `{"content":"hey @BigBird."}`)
+		first := poster.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hey @BigBird."}`)
+		lurker.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"hey @BigBird."}`, first["id"])
+
+		// Live sessions are notified, and senders don't mention themselves.
+		poster.send("3", "send", `{"content":"@lurker @poster hi"}`)
+		second := poster.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"@lurker @poster hi"}`)
+		lurker.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"@lurker @poster hi"}`, second["id"])
+		lurker.expect("", "mention-event",
+			`{"room":"mentions","message_id":"%s","sender_id":"%s","sender_name":"poster","time":"*"}`,
+			second["id"], poster.id())
+
+		// Only accounts have a mention index.
+		poster.send("4", "mentions", `{"n":10}`)
+		poster.expectError("4", "mentions-reply", "not logged in")
+
+		bird = s.Reconnect(bird, "mentions2")
+		defer bird.Close()
+		bird.expectPing()
+		bird.expectSnapshot(s.backend.Version(), nil, nil)
+		bird.send("1", "mentions", `{"n":10}`)
+		bird.expect("1", "mentions-reply",
+			`{"mentions":[{"room":"mentions","message_id":"%s","sender_id":"%s","sender_name":"poster","time":"*"}]}`,
+			first["id"], poster.id())
+		bird.send("2", "mentions", `{"n":10,"before":"%s"}`, first["id"])
+		bird.expect("2", "mentions-reply", `{"mentions":[]}`)
+	})
+}
+
+func testDigests(s *serverUnderTest) {
+	ctx := newTestScope()
+	kms := s.app.kms
+	nonce := time.Now().Format("20060102150405")
+	bert, _, err := s.Account(ctx, kms, "email", "bert"+nonce, "bertpass")
+	So(err, ShouldBeNil)
+	ernie, _, err := s.Account(ctx, kms, "email", "ernie"+nonce, "erniepass")
+	So(err, ShouldBeNil)
+
+	Convey("Accounts opt in to digests", func() {
+		conn := s.Connect("digests")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "change-email-preferences", `{"digest":true}`)
+		conn.expectError("1", "change-email-preferences-reply", "not logged in")
+		conn.send("2", "login", `{"namespace":"email","id":"bert%s","password":"bertpass"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":true,"account_id":"%s"}`, bert.ID())
+		conn.Close()
+
+		s.Reconnect(conn)
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "change-email-preferences", `{"digest":true}`)
+		conn.expect("1", "change-email-preferences-reply", `{"digest":true,"unsubscribed":false}`)
+
+		prefs, err := s.backend.AccountManager().EmailPreferences(ctx, bert.ID())
+		So(err, ShouldBeNil)
+		So(prefs.Digest, ShouldBeTrue)
+	})
+
+	Convey("Digests cover mentions received while offline", func() {
+		am := s.backend.AccountManager()
+		dt := s.backend.DigestTracker()
+		userID := proto.UserID(fmt.Sprintf("account:%s", ernie.ID()))
+
+		seen := time.Now().Add(-time.Hour)
+		So(dt.Seen(ctx, ernie.ID(), seen), ShouldBeNil)
+
+		stale, err := snowflake.New()
+		So(err, ShouldBeNil)
+		So(s.backend.MentionTracker().Add(ctx, userID, proto.Mention{
+			Room:       "digests",
+			MessageID:  stale,
+			SenderName: "poster",
+			UnixTime:   proto.Time(seen.Add(-time.Minute)),
+		}), ShouldBeNil)
+		missed, err := snowflake.New()
+		So(err, ShouldBeNil)
+		So(s.backend.MentionTracker().Add(ctx, userID, proto.Mention{
+			Room:       "digests",
+			MessageID:  missed,
+			SenderName: "poster",
+			UnixTime:   proto.Time(time.Now()),
+		}), ShouldBeNil)
+
+		// Digests are opt-in.
+		cutoff := time.Now().Add(-30 * time.Minute)
+		claimed, err := dt.Claim(ctx, cutoff, time.Now(), 1000)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldNotContain, ernie.ID())
+
+		So(am.ChangeEmailPreferences(ctx, ernie.ID(), &proto.EmailPreferences{Digest: true}), ShouldBeNil)
+		digest, err := dt.Collect(ctx, ernie.ID())
+		So(err, ShouldBeNil)
+		So(len(digest.Mentions), ShouldEqual, 1)
+		So(digest.Mentions[0].MessageID, ShouldEqual, missed)
+		So(digest.PMs, ShouldBeEmpty)
+
+		// Claiming marks the digest sent, so only one is sent per absence.
+		claimed, err = dt.Claim(ctx, cutoff, time.Now(), 1000)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldContain, ernie.ID())
+		claimed, err = dt.Claim(ctx, cutoff, time.Now(), 1000)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldNotContain, ernie.ID())
+
+		// The next absence earns another.
+		So(dt.Seen(ctx, ernie.ID(), time.Now().Add(time.Minute)), ShouldBeNil)
+		claimed, err = dt.Claim(ctx, time.Now().Add(time.Hour), time.Now().Add(2*time.Minute), 1000)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldContain, ernie.ID())
+		claimed, err = dt.Claim(ctx, time.Now().Add(time.Hour), time.Now().Add(2*time.Minute), 1000)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldNotContain, ernie.ID())
+	})
+}
+
+func testEmailPreferences(s *serverUnderTest) {
+	ctx := newTestScope()
+	kms := s.app.kms
+	nonce := time.Now().Format("20060102150405")
+	oscar, _, err := s.Account(ctx, kms, "email", "oscar"+nonce, "oscarpass")
+	So(err, ShouldBeNil)
+
+	Convey("Emails link to preferences that allow unsubscribing", func() {
+		am := s.backend.AccountManager()
+		So(am.ChangeEmailPreferences(ctx, oscar.ID(), &proto.EmailPreferences{Digest: true}), ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox("oscar" + nonce)
+
+		params := &proto.DigestEmailParams{
+			CommonEmailParams: proto.DefaultCommonEmailParams,
+			AccountName:       "oscar",
+		}
+		ref, err := s.app.heim.SendEmail(ctx, s.backend, oscar, "", proto.DigestEmail, params)
+		So(err, ShouldBeNil)
+		So(ref, ShouldNotBeNil)
+		msg := receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.DigestEmail)
+		p, ok := msg.Data.(*proto.DigestEmailParams)
+		So(ok, ShouldBeTrue)
+		So(string(p.EmailPreferencesURL()), ShouldContainSubstring, "/prefs/emails?token=")
+
+		post := func(token string) int {
+			req := struct {
+				Token        string `json:"token"`
+				Unsubscribed bool   `json:"unsubscribed"`
+			}{
+				Token:        token,
+				Unsubscribed: true,
+			}
+			reqBytes, err := json.Marshal(req)
+			So(err, ShouldBeNil)
+			resp, err := http.Post(s.server.URL+"/prefs/emails", "application/json", bytes.NewReader(reqBytes))
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// Tokens are bound to the account.
+		So(post(fmt.Sprintf("%s-%s", oscar.ID(), strings.Repeat("00", 32))), ShouldEqual, http.StatusForbidden)
+		So(post(p.EmailPreferencesToken), ShouldEqual, http.StatusOK)
+
+		prefs, err := am.EmailPreferences(ctx, oscar.ID())
+		So(err, ShouldBeNil)
+		So(prefs.Unsubscribed, ShouldBeTrue)
+
+		// Unsubscribed accounts still receive transactional email.
+		ref, err = s.app.heim.SendEmail(ctx, s.backend, oscar, "", proto.DigestEmail, params)
+		So(err, ShouldBeNil)
+		So(ref, ShouldBeNil)
+		So(s.app.heim.OnAccountPasswordChanged(ctx, s.backend, oscar), ShouldBeNil)
+		msg = receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.PasswordChangedEmail)
+	})
+}
+
+func testBotTokens(s *serverUnderTest) {
+	Convey("Accounts can issue bot tokens", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("bottokens-%s", time.Now())
+		_, _, err := s.Account(ctx, kms, "email", "botowner"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		anon := s.Connect("bottokens")
+		anon.expectPing()
+		anon.expectSnapshot(s.backend.Version(), nil, nil)
+		anon.send("1", "issue-bot-token", `{"name":"relay"}`)
+		anon.expectError("1", "issue-bot-token-reply", "not logged in")
+		anon.Close()
+
+		owner := s.Login(nil, "email", "botowner"+nonce, "hunter2")
+		owner.Close()
+		owner = s.Reconnect(owner, "bottokens")
+		defer owner.Close()
+		owner.expectPing()
+		owner.expectSnapshot(s.backend.Version(), nil, nil)
+
+		owner.send("1", "issue-bot-token", `{"name":"relay","rooms":["bottokens"]}`)
+		capture := owner.expect("1", "issue-bot-token-reply",
+			`{"token_id":"*","name":"relay","rooms":["bottokens"],"created":"*","secret":"*"}`)
+		tokenID := capture["token_id"].(string)
+		secret := capture["secret"].(string)
+
+		owner.send("2", "list-bot-tokens", "")
+		owner.expect("2", "list-bot-tokens-reply",
+			`{"tokens":[{"token_id":"%s","name":"relay","rooms":["bottokens"],"created":"*"}]}`, tokenID)
+
+		// The token is only good in rooms on its allowlist.
+		_, resp, err := s.dialWithBotToken("bottokens2", secret)
+		So(err, ShouldNotBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		_, resp, err = s.dialWithBotToken("bottokens", tokenID+".AAAAAAAAAAAAAAAAAAAAAA==")
+		So(err, ShouldNotBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		bot := s.ConnectWithBotToken(owner, "bottokens", secret)
+		bot.expectPing()
+		listing := fmt.Sprintf(
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+			owner.sessionID, owner.id())
+		bot.expectSnapshot(s.backend.Version(), []string{listing}, nil)
+		So(bot.id(), ShouldEqual, owner.id())
+		owner.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_bot":true}`,
+			bot.sessionID, owner.id())
+
+		// Bot sessions can't manage tokens or change login state.
+		bot.send("1", "list-bot-tokens", "")
+		bot.expectError("1", "list-bot-tokens-reply", "access denied")
+		bot.send("2", "logout", "")
+		bot.expectError("2", "logout-reply", "access denied")
+		bot.Close()
+		owner.expect("", "part-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_bot":true}`,
+			bot.sessionID, owner.id())
+
+		owner.send("3", "list-bot-tokens", "")
+		owner.expect("3", "list-bot-tokens-reply",
+			`{"tokens":[{"token_id":"%s","name":"relay","rooms":["bottokens"],"created":"*","last_used":"*"}]}`,
+			tokenID)
+
+		owner.send("4", "revoke-bot-token", `{"token_id":"%s"}`, tokenID)
+		owner.expect("4", "revoke-bot-token-reply", `{"token_id":"%s"}`, tokenID)
+		owner.send("5", "revoke-bot-token", `{"token_id":"%s"}`, tokenID)
+		owner.expectError("5", "revoke-bot-token-reply", "bot token not found")
+		owner.send("6", "list-bot-tokens", "")
+		owner.expect("6", "list-bot-tokens-reply", `{"tokens":[]}`)
+
+		_, resp, err = s.dialWithBotToken("bottokens", secret)
+		So(err, ShouldNotBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Bot tokens stop working when the password changes", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("bottokenspw-%s", time.Now())
+		_, _, err := s.Account(ctx, kms, "email", "botowner"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		owner := s.Login(nil, "email", "botowner"+nonce, "hunter2")
+		owner.Close()
+		owner = s.Reconnect(owner, "bottokenspw")
+		defer owner.Close()
+		owner.expectPing()
+		owner.expectSnapshot(s.backend.Version(), nil, nil)
+
+		owner.send("1", "issue-bot-token", `{"name":"relay","rooms":["bottokenspw"]}`)
+		capture := owner.expect("1", "issue-bot-token-reply",
+			`{"token_id":"*","name":"relay","rooms":["bottokenspw"],"created":"*","secret":"*"}`)
+		secret := capture["secret"].(string)
+
+		apiLog := func() int {
+			req, err := http.NewRequest("GET", s.server.URL+"/api/room/bottokenspw/log", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", "Bearer "+secret)
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		So(apiLog(), ShouldEqual, http.StatusOK)
+
+		owner.send("2", "change-password", `{"old_password":"hunter2","new_password":"hunter3"}`)
+		owner.expect("2", "change-password-reply", `{}`)
+
+		// The bot isn't let in anonymously, either.
+		_, resp, err := s.dialWithBotToken("bottokenspw", secret)
+		So(err, ShouldNotBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		So(apiLog(), ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Bot token allowlists name rooms by their canonical name", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("bottokensalias-%s", time.Now())
+		owner, ownerKey, err := s.Account(ctx, kms, "email", "botowner"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		room, err := s.backend.CreateRoom(ctx, kms, false, "bottokensold")
+		So(err, ShouldBeNil)
+		So(room.(proto.ManagedRoom).Rename(ctx, nil, "bottokensnew"), ShouldBeNil)
+
+		apiLog := func(roomName, secret string) int {
+			req, err := http.NewRequest("GET", s.server.URL+"/api/room/"+roomName+"/log", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", "Bearer "+secret)
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		_, current, err := proto.IssueBotToken(ctx, s.backend, owner, ownerKey, "current", []string{"bottokensnew"})
+		So(err, ShouldBeNil)
+		So(apiLog("bottokensnew", current), ShouldEqual, http.StatusOK)
+		So(apiLog("bottokensold", current), ShouldEqual, http.StatusOK)
+
+		_, stale, err := proto.IssueBotToken(ctx, s.backend, owner, ownerKey, "stale", []string{"bottokensold"})
+		So(err, ShouldBeNil)
+		So(apiLog("bottokensnew", stale), ShouldEqual, http.StatusUnauthorized)
+		So(apiLog("bottokensold", stale), ShouldEqual, http.StatusUnauthorized)
+	})
+}
+
+func testWebhooks(s *serverUnderTest) {
+	Convey("Hosts can register outgoing webhooks", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("webhooks-%s", time.Now())
+		host, _, err := s.Account(ctx, kms, "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		_, err = s.backend.CreateRoom(ctx, kms, false, "webhooks", host)
+		So(err, ShouldBeNil)
+
+		type delivery struct {
+			header http.Header
+			body   []byte
+		}
+		received := make(chan delivery, 10)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- delivery{r.Header, body}
+			if r.URL.Path == "/fail" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer receiver.Close()
+
+		guest := s.Connect("webhooks")
+		guest.expectPing()
+		guest.expectSnapshot(s.backend.Version(), nil, nil)
+		guest.send("1", "add-webhook", `{"url":"%s/hook","events":["send-event"]}`, receiver.URL)
+		guest.expectError("1", "add-webhook-reply", "access denied")
+		guest.Close()
+
+		conn := s.Login(nil, "email", "host"+nonce, "hunter2")
+		conn.Close()
+		conn.isManager = true
+		s.Reconnect(conn, "webhooks")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("1", "add-webhook", `{"url":"ftp://example.com/hook","events":["send-event"]}`)
+		conn.expectError("1", "add-webhook-reply", "invalid webhook url")
+		conn.send("2", "add-webhook", `{"url":"%s/hook","events":["snapshot-event"]}`, receiver.URL)
+		conn.expectError("2", "add-webhook-reply", "invalid webhook event: snapshot-event")
+
+		conn.send("3", "add-webhook",
+			`{"url":"%s/hook","events":["send-event","edit-message-event"],"secret":"sekrit"}`, receiver.URL)
+		capture := conn.expect("3", "add-webhook-reply",
+			`{"id":"*","url":"%s/hook","events":["send-event","edit-message-event"],"created":"*","secret":"sekrit"}`,
+			receiver.URL)
+		webhookID := capture["id"].(string)
+
+		conn.send("4", "list-webhooks", "")
+		conn.expect("4", "list-webhooks-reply",
+			`{"webhooks":[{"id":"%s","url":"%s/hook","events":["send-event","edit-message-event"],"created":"*"}]}`,
+			webhookID, receiver.URL)
+
+		conn.send("5", "nick", `{"name":"host"}`)
+		conn.expect("5", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
+		conn.send("6", "send", `{"content":"hello hook"}`)
+		capture = conn.expect("6", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello hook"}`)
+		msgID := capture["id"].(string)
+
+		// Only the send is queued; the webhook doesn't subscribe to joins.
+		jq, err := s.backend.Jobs().GetQueue(ctx, jobs.WebhookQueue)
+		So(err, ShouldBeNil)
+		job, err := jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		So(job.Type, ShouldEqual, jobs.WebhookJobType)
+		payload, err := job.Payload()
+		So(err, ShouldBeNil)
+		webhookJob := payload.(*jobs.WebhookJob)
+		So(webhookJob.Room, ShouldEqual, "webhooks")
+		So(webhookJob.EventType, ShouldEqual, string(proto.SendEventType))
+
+		var body proto.WebhookDelivery
+		So(json.Unmarshal(webhookJob.Body, &body), ShouldBeNil)
+		So(body.WebhookID.String(), ShouldEqual, webhookID)
+		So(body.Room, ShouldEqual, "webhooks")
+		So(body.Type, ShouldEqual, proto.SendEventType)
+		var event proto.SendEvent
+		So(json.Unmarshal(body.Data, &event), ShouldBeNil)
+		So(event.ID.String(), ShouldEqual, msgID)
+		So(event.Content, ShouldEqual, "hello hook")
+		So(event.Sender.ClientAddress, ShouldEqual, "")
+
+		room, err := s.backend.GetRoom(ctx, "webhooks")
+		So(err, ShouldBeNil)
+		webhooks, err := room.Webhooks(ctx)
+		So(err, ShouldBeNil)
+		So(len(webhooks), ShouldEqual, 1)
+		webhook := webhooks[0]
+
+		// Deliveries are signed with the webhook's secret.
+		So(webhook.Deliver(ctx, http.DefaultClient, job.ID.String(), webhookJob), ShouldBeNil)
+		So(job.Complete(ctx), ShouldBeNil)
+		got := <-received
+		So(string(got.body), ShouldEqual, string(webhookJob.Body))
+		mac := hmac.New(sha256.New, []byte("sekrit"))
+		mac.Write(got.body)
+		So(got.header.Get(proto.WebhookSignatureHeader), ShouldEqual, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		So(got.header.Get(proto.WebhookEventHeader), ShouldEqual, "send-event")
+		So(got.header.Get(proto.WebhookDeliveryHeader), ShouldEqual, job.ID.String())
+
+		// Failed deliveries are reported so they can be retried.
+		webhook.URL = receiver.URL + "/fail"
+		So(webhook.Deliver(ctx, http.DefaultClient, job.ID.String(), webhookJob), ShouldNotBeNil)
+		<-received
+
+		conn.send("7", "remove-webhook", `{"id":"%s"}`, webhookID)
+		conn.expect("7", "remove-webhook-reply", `{"id":"%s"}`, webhookID)
+		conn.send("8", "remove-webhook", `{"id":"%s"}`, webhookID)
+		conn.expectError("8", "remove-webhook-reply", "webhook not found")
+
+		conn.send("9", "send", `{"content":"unheard"}`)
+		conn.expect("9", "send-reply", `{"id":"*","time":"*","sender":"*","content":"unheard"}`)
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+	})
+}
+
+func testIncomingWebhooks(s *serverUnderTest) {
+	Convey("Incoming webhooks post messages into the room", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("hooks-%s", time.Now())
+		host, _, err := s.Account(ctx, kms, "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		_, err = s.backend.CreateRoom(ctx, kms, false, "hooks", host)
+		So(err, ShouldBeNil)
+
+		post := func(path, body string) (int, map[string]interface{}) {
+			resp, err := http.Post(s.server.URL+path, "application/json", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			var reply map[string]interface{}
+			if resp.StatusCode == http.StatusOK {
+				So(json.NewDecoder(resp.Body).Decode(&reply), ShouldBeNil)
+			}
+			return resp.StatusCode, reply
+		}
+
+		guest := s.Connect("hooks")
+		guest.expectPing()
+		guest.expectSnapshot(s.backend.Version(), nil, nil)
+		guest.send("1", "add-incoming-webhook", `{"name":"ci"}`)
+		guest.expectError("1", "add-incoming-webhook-reply", "access denied")
+		guest.Close()
+
+		conn := s.Login(nil, "email", "host"+nonce, "hunter2")
+		conn.Close()
+		conn.isManager = true
+		s.Reconnect(conn, "hooks")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("1", "add-incoming-webhook", `{"name":"  "}`)
+		conn.expectError("1", "add-incoming-webhook-reply", "invalid nick")
+
+		conn.send("2", "add-incoming-webhook", `{"name":"ci"}`)
+		capture := conn.expect("2", "add-incoming-webhook-reply", `{"id":"*","name":"ci","created":"*","path":"*"}`)
+		hookID := capture["id"].(string)
+		path := capture["path"].(string)
+		So(path, ShouldStartWith, "/room/hooks/hook/"+hookID+"/")
+
+		conn.send("3", "list-incoming-webhooks", "")
+		conn.expect("3", "list-incoming-webhooks-reply",
+			`{"incoming_webhooks":[{"id":"%s","name":"ci","created":"*"}]}`, hookID)
+
+		// Posting sends the message to the room as the hook.
+		status, reply := post(path, `{"content":"build passed"}`)
+		So(status, ShouldEqual, http.StatusOK)
+		So(reply["content"], ShouldEqual, "build passed")
+		sender := reply["sender"].(map[string]interface{})
+		So(sender["id"], ShouldEqual, "hook:"+hookID)
+		So(sender["name"], ShouldEqual, "ci")
+		So(sender["is_bot"], ShouldEqual, true)
+
+		conn.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"build passed"}`, reply["id"])
+		var msgID snowflake.Snowflake
+		So(msgID.FromString(reply["id"].(string)), ShouldBeNil)
+		room, err := s.backend.GetRoom(ctx, "hooks")
+		So(err, ShouldBeNil)
+		msg, err := room.GetMessage(ctx, msgID)
+		So(err, ShouldBeNil)
+		So(msg.Sender.Name, ShouldEqual, "ci")
+		So(msg.Content, ShouldEqual, "build passed")
+
+		// Hook messages mention users like any other.
+		conn.send("4", "nick", `{"name":"host"}`)
+		conn.expect("4", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
+		status, reply = post(path, `{"content":"deployed @host"}`)
+		So(status, ShouldEqual, http.StatusOK)
+		conn.expect("", "send-event", `{"id":"%s","time":"*","sender":"*","content":"deployed @host"}`, reply["id"])
+		conn.expect("", "mention-event",
+			`{"room":"hooks","message_id":"%s","sender_id":"hook:%s","sender_name":"ci","time":"*"}`,
+			reply["id"], hookID)
+
+		// Hooks have no account, so they can't post announcements.
+		conn.send("5", "set-announcement-mode", `{"enabled":true}`)
+		conn.expect("5", "set-announcement-mode-reply", `{"enabled":true}`)
+		status, _ = post(path, `{"content":"nope"}`)
+		So(status, ShouldEqual, http.StatusForbidden)
+		conn.send("6", "set-announcement-mode", `{"enabled":false}`)
+		conn.expect("6", "set-announcement-mode-reply", `{"enabled":false}`)
+
+		// Bad secrets look like missing hooks.
+		status, _ = post(path[:strings.LastIndex(path, "/")]+"/wrong", `{"content":"nope"}`)
+		So(status, ShouldEqual, http.StatusNotFound)
+
+		status, _ = post(path, `{"content":""}`)
+		So(status, ShouldEqual, http.StatusBadRequest)
+		status, _ = post(path, `{"content":"reply","parent":"zzzzzzzzzzzzz"}`)
+		So(status, ShouldEqual, http.StatusBadRequest)
+
+		// Each hook is rate limited.
+		throttled := false
+		for i := int64(0); i <= IncomingWebhookBurst && !throttled; i++ {
+			status, _ = post(path, `{}`)
+			throttled = status == http.StatusTooManyRequests
+		}
+		So(throttled, ShouldBeTrue)
+
+		conn.send("7", "remove-incoming-webhook", `{"id":"%s"}`, hookID)
+		conn.expect("7", "remove-incoming-webhook-reply", `{"id":"%s"}`, hookID)
+		conn.send("8", "remove-incoming-webhook", `{"id":"%s"}`, hookID)
+		conn.expectError("8", "remove-incoming-webhook-reply", "webhook not found")
+
+		status, _ = post(path, `{"content":"revoked"}`)
+		So(status, ShouldEqual, http.StatusNotFound)
+	})
+}
+
+func testAPI(s *serverUnderTest) {
+	get := func(path, token string, reply interface{}) int {
+		req, err := http.NewRequest("GET", s.server.URL+path, nil)
+		So(err, ShouldBeNil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && reply != nil {
+			So(json.NewDecoder(resp.Body).Decode(reply), ShouldBeNil)
+		}
+		return resp.StatusCode
+	}
+
+	Convey("Public rooms can be read anonymously", func() {
+		conn := s.Connect("apipublic")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"speaker"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"speaker"}`)
+
+		conn.send("2", "send", `{"content":"root"}`)
+		capture := conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"root"}`)
+		rootID := capture["id"].(string)
+		conn.send("3", "send", `{"content":"unrelated"}`)
+		conn.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"unrelated"}`)
+		conn.send("4", "send", `{"content":"reply","parent":"%s"}`, rootID)
+		capture = conn.expect("4", "send-reply", `{"id":"*","parent":"%s","time":"*","sender":"*","content":"reply"}`, rootID)
+		replyID := capture["id"].(string)
+
+		var log proto.LogReply
+		So(get("/api/room/apipublic/log?n=2", "", &log), ShouldEqual, http.StatusOK)
+		So(len(log.Log), ShouldEqual, 2)
+		So(log.Log[0].Content, ShouldEqual, "unrelated")
+		So(log.Log[1].Content, ShouldEqual, "reply")
+		So(log.Log[1].Sender.ClientAddress, ShouldEqual, "")
+		So(log.MoreBefore, ShouldBeTrue)
+
+		var msg proto.GetMessageReply
+		So(get("/api/room/apipublic/message/"+rootID, "", &msg), ShouldEqual, http.StatusOK)
+		So(msg.Content, ShouldEqual, "root")
+		So(msg.Sender.Name, ShouldEqual, "speaker")
+
+		var thread proto.LogReply
+		So(get("/api/room/apipublic/thread/"+rootID, "", &thread), ShouldEqual, http.StatusOK)
+		So(len(thread.Log), ShouldEqual, 2)
+		So(thread.Log[0].ID.String(), ShouldEqual, rootID)
+		So(thread.Log[1].ID.String(), ShouldEqual, replyID)
+		So(thread.MoreAfter, ShouldBeFalse)
+
+		So(get("/api/room/apipublic/thread/"+rootID+"?n=1", "", &thread), ShouldEqual, http.StatusOK)
+		So(len(thread.Log), ShouldEqual, 1)
+		So(thread.MoreAfter, ShouldBeTrue)
+
+		var who proto.WhoReply
+		So(get("/api/room/apipublic/who", "", &who), ShouldEqual, http.StatusOK)
+		So(len(who.Listing), ShouldEqual, 1)
+		So(who.Listing[0].Name, ShouldEqual, "speaker")
+
+		So(get("/api/room/apipublic/message/zzzzzzzzzzzzz", "", nil), ShouldEqual, http.StatusNotFound)
+		So(get("/api/room/apipublic/log?n=0", "", nil), ShouldEqual, http.StatusBadRequest)
+		So(get("/api/room/apipublic/log?before=%21", "", nil), ShouldEqual, http.StatusBadRequest)
+		So(get("/api/room/apipublic/log?before="+rootID+"&after="+rootID, "", nil), ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Private rooms need an account with access", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("api-%s", time.Now())
+		host, hostKey, err := s.Account(ctx, kms, "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		room, err := s.backend.CreateRoom(ctx, kms, true, "apiprivate", host)
+		So(err, ShouldBeNil)
+
+		hook, _, err := proto.NewIncomingWebhook("ci")
+		So(err, ShouldBeNil)
+		sent, err := s.app.postIncomingWebhookMessage(ctx, room, hook, &IncomingWebhookMessage{Content: "classified"})
+		So(err, ShouldBeNil)
+
+		So(get("/api/room/apiprivate/log", "", nil), ShouldEqual, http.StatusUnauthorized)
+		So(get("/api/room/apiprivate/log", "not-a-token", nil), ShouldEqual, http.StatusUnauthorized)
+
+		_, secret, err := proto.IssueBotToken(ctx, s.backend, host, hostKey, "reader", []string{"apiprivate"})
+		So(err, ShouldBeNil)
+
+		var log proto.LogReply
+		So(get("/api/room/apiprivate/log", secret, &log), ShouldEqual, http.StatusOK)
+		So(len(log.Log), ShouldEqual, 1)
+		So(log.Log[0].Content, ShouldEqual, "classified")
+
+		var msg proto.GetMessageReply
+		So(get("/api/room/apiprivate/message/"+sent.ID.String(), secret, &msg), ShouldEqual, http.StatusOK)
+		So(msg.Content, ShouldEqual, "classified")
+
+		// The token's allowlist still applies.
+		So(get("/api/room/apipublic/log", secret, nil), ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Missing rooms aren't created", func() {
+		So(get("/api/room/apinowhere/log", "", nil), ShouldEqual, http.StatusNotFound)
+		_, err := s.backend.GetRoom(newTestScope(), "apinowhere")
+		So(err, ShouldEqual, proto.ErrRoomNotFound)
+	})
+
+	Convey("Banned clients are refused", func() {
+		ctx := newTestScope()
+		room, err := s.backend.CreateRoom(ctx, s.app.kms, false, "apibanned")
+		So(err, ShouldBeNil)
+		So(get("/api/room/apibanned/log", "", nil), ShouldEqual, http.StatusOK)
+
+		So(room.Ban(ctx, proto.Ban{IP: "127.0.0.1"}, time.Time{}), ShouldBeNil)
+		So(get("/api/room/apibanned/log", "", nil), ShouldEqual, http.StatusForbidden)
+		So(room.Unban(ctx, proto.Ban{IP: "127.0.0.1"}), ShouldBeNil)
+		So(get("/api/room/apibanned/log", "", nil), ShouldEqual, http.StatusOK)
+	})
+}
+
+func testSSE(s *serverUnderTest) {
+	type event struct {
+		name string
+		data string
+	}
+
+	readEvent := func(r *bufio.Reader) event {
+		var ev event
+		for {
+			line, err := r.ReadString('\n')
+			So(err, ShouldBeNil)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return ev
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	readPacket := func(r *bufio.Reader) *proto.Packet {
+		ev := readEvent(r)
+		So(ev.name, ShouldEqual, "")
+		packet, err := proto.ParseRequest([]byte(ev.data))
+		So(err, ShouldBeNil)
+		return packet
+	}
+
+	post := func(path, body string) int {
+		resp, err := http.Post(s.server.URL+path, "application/json", strings.NewReader(body))
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// openStream connects to the room over an event stream and reads up to
+	// the snapshot. It returns the stream and the path to POST commands to.
+	openStream := func(roomName string) (*http.Response, *bufio.Reader, string) {
+		resp, err := http.Get(s.server.URL + "/room/" + roomName + "/sse")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+		So(len(resp.Cookies()), ShouldEqual, 1)
+		stream := bufio.NewReader(resp.Body)
+
+		ev := readEvent(stream)
+		So(ev.name, ShouldEqual, "token")
+		var tokenEvent SSETokenEvent
+		So(json.Unmarshal([]byte(ev.data), &tokenEvent), ShouldBeNil)
+		So(tokenEvent.Token, ShouldNotEqual, "")
+
+		So(readPacket(stream).Type, ShouldEqual, proto.HelloEventType)
+		So(readPacket(stream).Type, ShouldEqual, proto.PingEventType)
+		So(readPacket(stream).Type, ShouldEqual, proto.SnapshotEventType)
+		return resp, stream, "/room/" + roomName + "/sse/" + tokenEvent.Token
+	}
+
+	Convey("Sessions can be served over an event stream", func() {
+		conn := s.Connect("ssetest")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"watcher"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"watcher"}`)
+
+		resp, stream, commandPath := openStream("ssetest")
+		defer resp.Body.Close()
+
+		So(post(commandPath, `{"id":"1","type":"nick","data":{"name":"streamer"}}`), ShouldEqual, http.StatusAccepted)
+		packet := readPacket(stream)
+		So(packet.ID, ShouldEqual, "1")
+		So(packet.Type, ShouldEqual, proto.NickReplyType)
+		So(packet.Error, ShouldEqual, "")
+		conn.expect("", "join-event", `{"session_id":"*","id":"*","name":"","server_id":"test1","server_era":"era1"}`)
+		conn.expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"streamer"}`)
+
+		So(post(commandPath, `{"id":"2","type":"send","data":{"content":"hi"}}`), ShouldEqual, http.StatusAccepted)
+		packet = readPacket(stream)
+		So(packet.ID, ShouldEqual, "2")
+		So(packet.Type, ShouldEqual, proto.SendReplyType)
+		conn.expect("", "send-event", `{"id":"*","time":"*","sender":"*","content":"hi"}`)
+
+		conn.send("2", "send", `{"content":"hello"}`)
+		conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello"}`)
+		packet = readPacket(stream)
+		So(packet.Type, ShouldEqual, proto.SendEventType)
+
+		Convey("Commands must be well-formed", func() {
+			So(post(commandPath, `{"id":`), ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Commands need the stream's token and room", func() {
+			So(post("/room/ssetest/sse/nope", `{"id":"3","type":"who"}`), ShouldEqual, http.StatusNotFound)
+			So(post("/room/ssetest2/sse/"+commandPath[len("/room/ssetest/sse/"):], `{"id":"3","type":"who"}`),
+				ShouldEqual, http.StatusNotFound)
+		})
+	})
+
+	Convey("Commands are refused once the stream is closed", func() {
+		conn := s.Connect("sseclosed")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		resp, stream, commandPath := openStream("sseclosed")
+		So(post(commandPath, `{"id":"1","type":"nick","data":{"name":"streamer"}}`), ShouldEqual, http.StatusAccepted)
+		So(readPacket(stream).Type, ShouldEqual, proto.NickReplyType)
+		conn.expect("", "join-event", `{"session_id":"*","id":"*","name":"","server_id":"test1","server_era":"era1"}`)
+		conn.expect("", "nick-event", `{"session_id":"*","id":"*","from":"","to":"streamer"}`)
+
+		resp.Body.Close()
+		conn.expect("", "part-event", `{"session_id":"*","id":"*","name":"streamer","server_id":"test1","server_era":"era1"}`)
+		So(post(commandPath, `{"id":"2","type":"who"}`), ShouldEqual, http.StatusNotFound)
+	})
+}
+
+func testRoomAliases(s *serverUnderTest) {
+	Convey("Staff can rename rooms and manage their aliases", func() {
+		b := s.backend
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		_, err := b.CreateRoom(ctx, kms, false, "aliasstaff")
+		So(err, ShouldBeNil)
+		_, err = b.CreateRoom(ctx, kms, false, "aliastaken")
+		So(err, ShouldBeNil)
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+
+		conn := s.Connect("aliasstaff")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "staff-rename-room", `{"name":"aliasrenamed"}`)
+		conn.expectError("1", "staff-rename-room-reply", "must unlock staff capability first")
+		conn.send("2", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		conn.Close()
+
+		So(b.AccountManager().GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
+		conn.isStaff = true
+		s.Reconnect(conn)
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("1", "staff-rename-room", `{"name":"aliasrenamed"}`)
+		conn.expect("1", "staff-rename-room-reply", `{"name":"aliasrenamed","aliases":["aliasstaff"]}`)
+		conn.send("2", "staff-rename-room", `{"name":"aliastaken"}`)
+		conn.expectError("2", "staff-rename-room-reply", "room name already in use")
+		conn.send("3", "staff-rename-room", `{"name":"Alias Room"}`)
+		conn.expectError("3", "staff-rename-room-reply", "invalid room name")
+
+		conn.send("4", "staff-add-room-alias", `{"alias":"aliasextra"}`)
+		conn.expect("4", "staff-add-room-alias-reply",
+			`{"name":"aliasrenamed","aliases":["aliasextra","aliasstaff"]}`)
+		conn.send("5", "staff-add-room-alias", `{"alias":"aliastaken"}`)
+		conn.expectError("5", "staff-add-room-alias-reply", "room name already in use")
+
+		conn.send("6", "staff-remove-room-alias", `{"alias":"aliasrenamed"}`)
+		conn.expectError("6", "staff-remove-room-alias-reply", "room alias not found")
+		conn.send("7", "staff-remove-room-alias", `{"alias":"aliasstaff"}`)
+		conn.expectError("7", "staff-remove-room-alias-reply", "room alias not found")
+		conn.send("8", "staff-remove-room-alias", `{"alias":"aliasextra"}`)
+		conn.expect("8", "staff-remove-room-alias-reply", `{"name":"aliasrenamed","aliases":["aliasstaff"]}`)
+
+		_, err = b.GetRoom(ctx, "aliasextra")
+		So(err, ShouldEqual, proto.ErrRoomNotFound)
+	})
+
+	Convey("Renamed rooms are still found by their old names", func() {
+		b := s.backend
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		room, err := b.CreateRoom(ctx, kms, false, "aliasold")
+		So(err, ShouldBeNil)
+		managedRoom := room.(proto.ManagedRoom)
+
+		observer := s.Connect("aliasold")
+		defer observer.Close()
+		observer.expectPing()
+		observer.expectSnapshot(s.backend.Version(), nil, nil)
+
+		So(managedRoom.Rename(ctx, nil, "aliasnew"), ShouldBeNil)
+		observer.expect("", "room-renamed-event", `{"from":"aliasold","to":"aliasnew"}`)
+
+		for _, name := range []string{"aliasold", "aliasnew"} {
+			found, err := b.GetRoom(ctx, name)
+			So(err, ShouldBeNil)
+			So(found.ID(), ShouldEqual, "aliasold")
+		}
+		_, err = b.CreateRoom(ctx, kms, false, "aliasnew")
+		So(err, ShouldEqual, proto.ErrRoomNameInUse)
+
+		// Clients that join by an old name are told the new one.
+		conn := s.Connect("aliasold")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), []string{
+			fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+				observer.sessionID, observer.id()),
+		}, nil)
+		conn.expect("", "room-renamed-event", `{"from":"aliasold","to":"aliasnew"}`)
+
+		// Room pages redirect to the new name.
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get(s.server.URL + "/room/aliasold/?h=1")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		So(resp.Header.Get("Location"), ShouldEqual, "/room/aliasnew/?h=1")
+	})
+}
+
+func testRoomLifecycle(s *serverUnderTest) {
+	// staffConn logs a new staff account in and connects it to the given
+	// room, with a validated one-time password.
+	staffConn := func(roomName string) *testConn {
+		b := s.backend
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		So(b.AccountManager().GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
+
+		conn := s.Connect(roomName + "stage")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		conn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		conn.Close()
+
+		conn.isStaff = true
+		s.Reconnect(conn, roomName)
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		conn.send("1", "staff-archive-room", `{}`)
+		conn.expectError("1", "staff-archive-room-reply", "must validate otp first")
+		conn.send("2", "staff-delete-room", `{}`)
+		conn.expectError("2", "staff-delete-room-reply", "must validate otp first")
+
+		conn.send("3", "staff-enroll-otp", ``)
+		capture := conn.expect("3", "staff-enroll-otp-reply", `{"uri":"*","qr_uri":"*"}`)
+		conn.send("4", "staff-validate-otp", `{"otp":"%s"}`, oneTimePassword(capture["uri"].(string), 0))
+		conn.expect("4", "staff-validate-otp-reply", `{}`)
+
+		conn.send("5", "nick", `{"name":"logan"}`)
+		conn.expect("5", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"logan"}`)
+		conn.send("6", "send", `{"content":"hello"}`)
+		conn.expect("6", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello"}`)
+		return conn
+	}
+
+	Convey("Staff can archive a room", func() {
+		ctx := newTestScope()
+		room, err := s.backend.CreateRoom(ctx, s.app.kms, false, "archived")
+		So(err, ShouldBeNil)
+
+		conn := s.Connect("archived")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "staff-archive-room", `{}`)
+		conn.expectError("1", "staff-archive-room-reply", "access denied")
+		conn.Close()
+
+		staff := staffConn("archived")
+		staff.send("1", "staff-archive-room", `{}`)
+		staff.expect("1", "staff-archive-room-reply", `{}`)
+		staff.expect("", "disconnect-event", `{"reason":"room archived"}`)
+		staff.Close()
+
+		archived, err := room.Archived(ctx)
+		So(err, ShouldBeNil)
+		So(archived, ShouldBeTrue)
+
+		// The history is still there, but nothing more can be posted.
+		s.Reconnect(conn)
+		defer conn.Close()
+		conn.expectPing()
+		capture := conn.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*","read_only":true}`)
+		log := capture["log"].([]interface{})
+		So(len(log), ShouldEqual, 1)
+		So(log[0].(map[string]interface{})["content"], ShouldEqual, "hello")
+
+		conn.send("1", "nick", `{"name":"visitor"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"visitor"}`)
+		conn.send("2", "send", `{"content":"anyone?"}`)
+		conn.expectError("2", "send-reply", "room is archived")
+		conn.send("3", "react", `{"id":"%s","reaction":"+1"}`, log[0].(map[string]interface{})["id"])
+		conn.expectError("3", "react-reply", "room is archived")
+	})
+
+	Convey("Staff can delete a room", func() {
+		ctx := newTestScope()
+		_, err := s.backend.CreateRoom(ctx, s.app.kms, false, "deleted")
+		So(err, ShouldBeNil)
+
+		staff := staffConn("deleted")
+		staff.send("1", "staff-delete-room", `{}`)
+		staff.expect("1", "staff-delete-room-reply", `{}`)
+		staff.expect("", "disconnect-event", `{"reason":"room deleted"}`)
+		staff.Close()
+
+		_, err = s.backend.GetRoom(ctx, "deleted")
+		So(err, ShouldEqual, proto.ErrRoomNotFound)
+	})
+}
+
+func testAnnouncementMode(s *serverUnderTest) {
+	Convey("Only hosts and allowed accounts may send in announcement mode", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		_, _, _, err := s.RoomAndManager(ctx, kms, false, "announce", "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		poster, _, err := s.Account(ctx, kms, "email", "poster"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		host := s.Login(nil, "email", "host"+nonce, "hunter2")
+		host.Close()
+		host.isManager = true
+		s.Reconnect(host, "announce")
+		host.expectPing()
+		host.expectSnapshot(s.backend.Version(), nil, nil)
+
+		host.send("1", "get-announcement-mode", `{}`)
+		host.expect("1", "get-announcement-mode-reply", `{"enabled":false}`)
+		host.send("2", "set-announcement-mode", `{"enabled":true,"posters":["%s","%s"]}`, poster.ID(), poster.ID())
+		host.expect("2", "set-announcement-mode-reply", `{"enabled":true,"posters":["%s"]}`, poster.ID())
+		host.send("3", "get-announcement-mode", `{}`)
+		host.expect("3", "get-announcement-mode-reply", `{"enabled":true,"posters":["%s"]}`, poster.ID())
+		host.Close()
+
+		// Anyone else can read, but not send.
+		visitor := s.Connect("announce")
+		visitor.announcementMode = true
+		visitor.readOnly = true
+		visitor.expectPing()
+		visitor.expectSnapshot(s.backend.Version(), nil, nil)
+		visitor.send("1", "nick", `{"name":"visitor"}`)
+		visitor.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"visitor"}`)
+		visitor.send("2", "send", `{"content":"hello?"}`)
+		visitor.expectError("2", "send-reply", "%s", proto.ErrAnnouncementOnly.Error())
+		visitor.send("3", "set-announcement-mode", `{"enabled":false}`)
+		visitor.expectError("3", "set-announcement-mode-reply", "access denied")
+		visitor.Close()
+
+		// Allowed accounts can send.
+		conn := s.Login(nil, "email", "poster"+nonce, "hunter2")
+		conn.Close()
+		conn.announcementMode = true
+		s.Reconnect(conn, "announce")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"poster"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"poster"}`)
+		conn.send("2", "send", `{"content":"news"}`)
+		conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"news"}`)
+		conn.Close()
+
+		// So can hosts, who can also turn announcement mode off.
+		s.Reconnect(host)
+		defer host.Close()
+		host.expectPing()
+		host.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*","announcement_mode":true}`)
+		host.send("1", "nick", `{"name":"host"}`)
+		host.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
+		host.send("2", "send", `{"content":"more news"}`)
+		host.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"more news"}`)
+
+		s.Reconnect(visitor)
+		defer visitor.Close()
+		visitor.expectPing()
+		visitor.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":"*","log":"*","resume_token":"*","nick":"visitor","cursor":"*","announcement_mode":true,"read_only":true}`)
+		host.expect("", "join-event", `{"session_id":"*","id":"*","name":"visitor","server_id":"*","server_era":"*","client_address":"*"}`)
+
+		// Sessions already in the room learn whether they may now send.
+		host.send("3", "set-announcement-mode", `{"enabled":false}`)
+		host.expect("3", "set-announcement-mode-reply", `{"enabled":false}`)
+		visitor.expect("", "announcement-mode-event", `{"enabled":false}`)
+		visitor.send("1", "send", `{"content":"hello!"}`)
+		visitor.expect("1", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello!"}`)
+		host.expect("", "send-event", `{"id":"*","time":"*","sender":"*","content":"hello!"}`)
+
+		host.send("4", "set-announcement-mode", `{"enabled":true,"posters":["%s"]}`, poster.ID())
+		host.expect("4", "set-announcement-mode-reply", `{"enabled":true,"posters":["%s"]}`, poster.ID())
+		visitor.expect("", "announcement-mode-event", `{"enabled":true,"read_only":true}`)
+		host.send("5", "set-announcement-mode", `{"enabled":false}`)
+		host.expect("5", "set-announcement-mode-reply", `{"enabled":false}`)
+		visitor.expect("", "announcement-mode-event", `{"enabled":false}`)
+	})
+}
+
+func testMessageKeyRotation(s *serverUnderTest) {
+	Convey("Rotating a room's message key keeps its history readable", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		room, _, _, err := s.RoomAndManager(ctx, kms, true, "keyrotation", "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		member, _, err := s.Account(ctx, kms, "email", "member"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		oldKeyID, _, err := room.MessageKeyID(ctx)
+		So(err, ShouldBeNil)
+
+		host := s.Login(nil, "email", "host"+nonce, "hunter2")
+		host.Close()
+		host.isManager = true
+		host.accountHasAccess = true
+		s.Reconnect(host, "keyrotation")
+		host.expectPing()
+		host.expectSnapshot(s.backend.Version(), nil, nil)
+		host.send("1", "nick", `{"name":"host"}`)
+		host.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
+		host.send("2", "grant-access", `{"account_id":"%s"}`, member.ID())
+		host.expect("2", "grant-access-reply", `{}`)
+		host.send("3", "grant-access", `{"passcode":"swordfish"}`)
+		host.expect("3", "grant-access-reply", `{}`)
+		host.send("4", "send", `{"content":"before"}`)
+		before := host.expect("4", "send-reply",
+			`{"id":"*","time":"*","sender":"*","content":"before","encryption_key_id":"*"}`)
+		host.send("5", "rotate-room-key", `{}`)
+		host.expect("5", "rotate-room-key-reply", `{}`)
+		host.expect("", "disconnect-event", `{"reason":"room key rotated"}`)
+		host.Close()
+
+		s.Reconnect(host)
+		host.expectPing()
+		host.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*","nick":"host"}`)
+		host.send("6", "send", `{"content":"after"}`)
+		after := host.expect("6", "send-reply",
+			`{"id":"*","time":"*","sender":"*","content":"after","encryption_key_id":"*"}`)
+		So(before["encryption_key_id"], ShouldEqual, "v1/"+oldKeyID)
+		So(after["encryption_key_id"], ShouldNotEqual, before["encryption_key_id"])
+		host.Close()
+
+		newKeyID, _, err := room.MessageKeyID(ctx)
+		So(err, ShouldBeNil)
+		So(after["encryption_key_id"], ShouldEqual, "v1/"+newKeyID)
+
+		// Grants made with the previous key no longer work.
+		conn := s.Login(nil, "email", "member"+nonce, "hunter2")
+		conn.Close()
+		s.Reconnect(conn, "keyrotation")
+		conn.expectPing()
+		conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		conn.send("1", "auth", `{"type":"passcode","passcode":"swordfish"}`)
+		conn.expect("1", "auth-reply", `{"success":false,"reason":"passcode incorrect"}`)
+		conn.Close()
+
+		// Managers are granted the new key, and through it can read the
+		// room's whole history.
+		s.Reconnect(host)
+		host.expectPing()
+		host.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*","nick":"host"}`)
+		host.send("1", "get-message", `{"id":"%s"}`, before["id"])
+		host.expect("1", "get-message-reply",
+			`{"id":"%s","time":"*","sender":"*","content":"before","encryption_key_id":"*"}`, before["id"])
+		host.send("2", "grant-access", `{"account_id":"%s"}`, member.ID())
+		host.expect("2", "grant-access-reply", `{}`)
+		host.Close()
+
+		// So can accounts granted the new key.
+		conn.accountHasAccess = true
+		s.Reconnect(conn)
+		defer conn.Close()
+		conn.expectPing()
+		conn.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*"}`)
+		conn.send("1", "get-message", `{"id":"%s"}`, before["id"])
+		conn.expect("1", "get-message-reply",
+			`{"id":"%s","time":"*","sender":"*","content":"before","encryption_key_id":"*"}`, before["id"])
+		conn.send("2", "get-message", `{"id":"%s"}`, after["id"])
+		conn.expect("2", "get-message-reply",
+			`{"id":"%s","time":"*","sender":"*","content":"after","encryption_key_id":"*"}`, after["id"])
+
+		// Only hosts holding the current key may rotate it.
+		conn.send("3", "rotate-room-key", `{}`)
+		conn.expectError("3", "rotate-room-key-reply", "access denied")
+	})
+}
+
+func testE2ERooms(s *serverUnderTest) {
+	Convey("End-to-end encrypted rooms only hold client ciphertext", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		_, _, _, err := s.RoomAndManager(ctx, kms, false, "e2e", "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		member, _, err := s.Account(ctx, kms, "email", "member"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		hostKeyPair, err := proto.E2EKeyPairType.Generate(rand.Reader)
+		So(err, ShouldBeNil)
+		memberKeyPair, err := proto.E2EKeyPairType.Generate(rand.Reader)
+		So(err, ShouldBeNil)
+		roomKey := []byte("0123456789abcdef0123456789abcdef")
+
+		// Client-encrypted messages are only accepted once the room is
+		// switched over.
+		host := s.Login(nil, "email", "host"+nonce, "hunter2")
+		host.Close()
+		host.isManager = true
+		s.Reconnect(host, "e2e")
+		host.expectPing()
+		host.expectSnapshot(s.backend.Version(), nil, nil)
+		host.send("1", "nick", `{"name":"host"}`)
+		host.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
+		host.send("2", "send", `{"content":"secret","encryption_key_id":"k1"}`)
+		host.expectError("2", "send-reply", "%s", proto.ErrNotE2E.Error())
+		host.send("3", "share-e2e-key", `{}`)
+		host.expectError("3", "share-e2e-key-reply", "%s", proto.ErrNotE2E.Error())
+		host.send("4", "send", `{"content":"before"}`)
+		before := host.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"before"}`)
+		host.send("5", "enable-e2e", `{}`)
+		host.expect("5", "enable-e2e-reply", `{}`)
+		host.expect("", "disconnect-event", `{"reason":"room is now end-to-end encrypted"}`)
+		host.Close()
+
+		// Members register the public key that room keys are sealed for. The
+		// hello-event tells them the room is end-to-end encrypted.
+		conn := s.Login(nil, "email", "member"+nonce, "hunter2")
+		conn.Close()
+		s.Reconnect(conn, "e2e")
+		conn.expectPing()
+		conn.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*"}`)
+		conn.send("1", "set-e2e-public-key", `{"public_key":"%s"}`, base64.StdEncoding.EncodeToString([]byte("short")))
+		conn.expectError("1", "set-e2e-public-key-reply", "%s", security.ErrInvalidPublicKey.Error())
+		conn.send("2", "set-e2e-public-key", `{"public_key":"%s"}`,
+			base64.StdEncoding.EncodeToString(memberKeyPair.PublicKey))
+		conn.expect("2", "set-e2e-public-key-reply", `{}`)
+		conn.send("3", "get-e2e-keys", `{}`)
+		conn.expect("3", "get-e2e-keys-reply", `{"keys":[]}`)
+		conn.send("4", "share-e2e-key", `{}`)
+		conn.expectError("4", "share-e2e-key-reply", "access denied")
+		conn.send("5", "get-e2e-public-key", `{"account_id":"%s"}`, member.ID())
+		conn.expectError("5", "get-e2e-public-key-reply", "access denied")
+		conn.Close()
+
+		// Hosts seal the room key for each member, and send ciphertext.
+		s.Reconnect(host)
+		host.expectPing()
+		host.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*","nick":"host"}`)
+		host.send("1", "get-e2e-public-key", `{"account_id":"%s"}`, member.ID())
+		capture := host.expect("1", "get-e2e-public-key-reply", `{"account_id":"%s","public_key":"*"}`, member.ID())
+		publicKey, err := base64.StdEncoding.DecodeString(capture["public_key"].(string))
+		So(err, ShouldBeNil)
+		sealed, err := proto.SealE2EKey("k1", roomKey, hostKeyPair, member.ID(), publicKey)
+		So(err, ShouldBeNil)
+		sealedJSON, err := json.Marshal(sealed)
+		So(err, ShouldBeNil)
+		host.send("2", "share-e2e-key", "%s", sealedJSON)
+		host.expect("2", "share-e2e-key-reply", `{}`)
+
+		host.send("3", "send", `{"content":"plaintext"}`)
+		host.expectError("3", "send-reply", "%s", proto.ErrE2EEncryptionRequired.Error())
+		host.send("4", "send", `{"content":"ciphertext","encryption_key_id":"k1"}`)
+		after := host.expect("4", "send-reply",
+			`{"id":"*","time":"*","sender":"*","content":"ciphertext","encryption_key_id":"e2e/k1"}`)
+		host.send("5", "edit-message", `{"id":"%s","content":"edited"}`, before["id"])
+		host.expectError("5", "edit-message-reply", "%s", proto.ErrE2EEncryptionRequired.Error())
+		host.Close()
+
+		// Members fetch and open their sealed keys; the server passes the
+		// ciphertext through untouched.
+		s.Reconnect(conn)
+		defer conn.Close()
+		conn.expectPing()
+		conn.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":[],"log":"*","resume_token":"*","cursor":"*"}`)
+		conn.send("1", "get-e2e-keys", `{}`)
+		capture = conn.expect("1", "get-e2e-keys-reply",
+			`{"keys":[{"account_id":"%s","key_id":"k1","sender_public_key":"*","nonce":"*","sealed_key":"*"}]}`,
+			member.ID())
+		ek := &proto.E2EKey{KeyID: "k1"}
+		ek.SenderPublicKey, err = base64.StdEncoding.DecodeString(capture["keys[0].sender_public_key"].(string))
+		So(err, ShouldBeNil)
+		ek.Nonce, err = base64.StdEncoding.DecodeString(capture["keys[0].nonce"].(string))
+		So(err, ShouldBeNil)
+		ek.SealedKey, err = base64.StdEncoding.DecodeString(capture["keys[0].sealed_key"].(string))
+		So(err, ShouldBeNil)
+		key, err := ek.Open(memberKeyPair)
+		So(err, ShouldBeNil)
+		So(bytes.Equal(key, roomKey), ShouldBeTrue)
+
+		conn.send("2", "get-message", `{"id":"%s"}`, after["id"])
+		conn.expect("2", "get-message-reply",
+			`{"id":"%s","time":"*","sender":"*","content":"ciphertext","encryption_key_id":"e2e/k1"}`, after["id"])
+	})
+}
+
+func testPasscodeGrantLimits(s *serverUnderTest) {
+	Convey("Passcode grants may expire or be used up", func() {
+		ctx := newTestScope()
+		kms := s.app.kms
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		room, manager, managerKey, err := s.RoomAndManager(
+			ctx, kms, true, "limitedgrants", "email", "host"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+
+		// Grants made in the past have already expired.
+		rkey, err := room.(proto.ManagedRoom).MessageKey(ctx)
+		So(err, ShouldBeNil)
+		limits := &proto.PasscodeGrantLimits{Expires: time.Now().Add(-time.Minute)}
+		So(rkey.GrantToPasscode(ctx, manager, managerKey, "expired", limits), ShouldBeNil)
+
+		host := s.Login(nil, "email", "host"+nonce, "hunter2")
+		host.Close()
+		host.isManager = true
+		host.accountHasAccess = true
+		s.Reconnect(host, "limitedgrants")
+		host.expectPing()
+		host.expectSnapshot(s.backend.Version(), nil, nil)
+		host.send("1", "grant-access", `{"account_id":"%s","max_uses":1}`, manager.ID())
+		host.expectError("1", "grant-access-reply", "only passcode grants may be limited")
+		host.send("2", "grant-access", `{"passcode":"never","seconds":-1}`)
+		host.expectError("2", "grant-access-reply", "seconds and max_uses must not be negative")
+		host.send("2", "grant-access", `{"passcode":"never","seconds":%d}`, proto.MaxPasscodeGrantSeconds+1)
+		host.expectError("2", "grant-access-reply", "seconds must not exceed %d", proto.MaxPasscodeGrantSeconds)
+		host.send("3", "grant-access", `{"passcode":"once","max_uses":1}`)
+		host.expect("3", "grant-access-reply", `{}`)
+		host.send("4", "grant-access", `{"passcode":"later","seconds":3600,"max_uses":2}`)
+		host.expect("4", "grant-access-reply", `{}`)
+		host.Close()
+
+		auth := func(passcode string, success bool) {
+			conn := s.Connect("limitedgrants")
+			defer conn.Close()
+			conn.expectPing()
+			conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+			conn.send("1", "auth", `{"type":"passcode","passcode":"%s"}`, passcode)
+			if success {
+				conn.expect("1", "auth-reply", `{"success":true}`)
+				conn.expectSnapshot(s.backend.Version(), nil, nil)
+			} else {
+				conn.expect("1", "auth-reply", `{"success":false,"reason":"passcode incorrect"}`)
+			}
+		}
+
+		auth("expired", false)
+		auth("once", true)
+		auth("once", false)
+		auth("later", true)
+		auth("later", true)
+		auth("later", false)
+	})
+}
+
 func testAccountsLowLevel(s *serverUnderTest) {
 	b := s.backend
 	kms := s.app.kms
@@ -2457,7 +4378,7 @@ func testMessageTruncation(s *serverUnderTest) {
 		room, err := s.Room(ctx, kms, true, "getmessage", owner)
 		So(err, ShouldBeNil)
 		rkey, err := room.MessageKey(ctx)
-		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2", nil), ShouldBeNil)
 
 		conn := s.Connect("getmessage")
 		defer conn.Close()
@@ -2527,12 +4448,12 @@ func testMessageTruncation(s *serverUnderTest) {
 		c1.send("2", "edit-message", `{"id":"%s","delete":true,"announce":true}`, capture["id"])
 		c1.debug(false)
 		c1.expect("2", "edit-message-reply",
-			`{"edit_id":"*","id":"*","time":"*","sender":%s,"content":"*","edited":"*","deleted":"*","truncated":true}`,
+			`{"edit_id":"*","id":"*","previous_edit_id":"*","time":"*","sender":%s,"content":"*","edited":"*","deleted":"*","truncated":true}`,
 			named("c2", true))
 
 		c2.debug(false)
 		c2.expect("", "edit-message-event",
-			`{"edit_id":"*","id":"*","time":"*","sender":%s,"content":"*","edited":"*","deleted":"*","truncated":true}`,
+			`{"edit_id":"*","id":"*","previous_edit_id":"*","time":"*","sender":%s,"content":"*","edited":"*","deleted":"*","truncated":true}`,
 			named("c2"))
 	})
 }
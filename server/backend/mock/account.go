@@ -437,6 +437,38 @@ func (m *accountManager) ChangeName(ctx scope.Context, accountID snowflake.Snowf
 	return nil
 }
 
+func (m *accountManager) EmailPreferences(ctx scope.Context, accountID snowflake.Snowflake) (
+	*proto.EmailPreferences, error) {
+
+	m.b.Lock()
+	_, ok := m.b.accounts[accountID]
+	m.b.Unlock()
+	if !ok {
+		return nil, proto.ErrAccountNotFound
+	}
+	return m.b.et.preferences(accountID), nil
+}
+
+func (m *accountManager) ChangeEmailPreferences(
+	ctx scope.Context, accountID snowflake.Snowflake, prefs *proto.EmailPreferences) error {
+
+	m.b.Lock()
+	_, ok := m.b.accounts[accountID]
+	m.b.Unlock()
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	m.b.et.m.Lock()
+	defer m.b.et.m.Unlock()
+
+	if m.b.et.prefs == nil {
+		m.b.et.prefs = map[snowflake.Snowflake]proto.EmailPreferences{}
+	}
+	m.b.et.prefs[accountID] = *prefs
+	return nil
+}
+
 func (m *accountManager) GenerateOTP(ctx scope.Context, heim *proto.Heim, kms security.KMS, account proto.Account) (proto.OTPInfo, error) {
 	m.b.Lock()
 	defer m.b.Unlock()
@@ -21,21 +21,28 @@ type TestBackend struct {
 	accountNames   map[string]bool
 	agents         map[string]*proto.Agent
 	agentBans      map[proto.UserID]time.Time
+	botTokens      botTokens
+	digests        digestStates
+	e2eKeys        map[snowflake.Snowflake][]byte
 	et             EmailTracker
 	ipBans         map[string]time.Time
 	js             JobService
 	ljs            *jobs.LocalJobQueue
+	mentions       MentionTracker
 	otps           map[snowflake.Snowflake]*proto.OTP
 	pms            PMTracker
 	resetReqs      map[snowflake.Snowflake]*proto.PasswordResetRequest
 	rooms          map[string]proto.ManagedRoom
+	roomAliases    map[string]string
 	version        string
 }
 
-func (b *TestBackend) AccountManager() proto.AccountManager { return &accountManager{b: b} }
-func (b *TestBackend) AgentTracker() proto.AgentTracker     { return &agentTracker{b} }
-func (b *TestBackend) EmailTracker() proto.EmailTracker     { return &b.et }
-func (b *TestBackend) Jobs() jobs.JobService                { return &b.js }
+func (b *TestBackend) AccountManager() proto.AccountManager   { return &accountManager{b: b} }
+func (b *TestBackend) AgentTracker() proto.AgentTracker       { return &agentTracker{b} }
+func (b *TestBackend) BotTokenTracker() proto.BotTokenTracker { return &botTokenTracker{b} }
+func (b *TestBackend) DigestTracker() proto.DigestTracker     { return &digestTracker{b} }
+func (b *TestBackend) EmailTracker() proto.EmailTracker       { return &b.et }
+func (b *TestBackend) Jobs() jobs.JobService                  { return &b.js }
 
 func (b *TestBackend) LocalJobs() jobs.LocalJobService {
 	b.Lock()
@@ -47,6 +54,8 @@ func (b *TestBackend) LocalJobs() jobs.LocalJobService {
 	return b.ljs
 }
 
+func (b *TestBackend) MentionTracker() proto.MentionTracker { return &b.mentions }
+
 func (b *TestBackend) PMTracker() proto.PMTracker {
 	b.pms.b = b
 	return &b.pms
@@ -62,7 +71,9 @@ func (b *TestBackend) GetRoom(ctx scope.Context, name string) (proto.ManagedRoom
 
 	room, ok := b.rooms[name]
 	if !ok {
-		return nil, proto.ErrRoomNotFound
+		if room, ok = b.rooms[b.roomAliases[name]]; !ok {
+			return nil, proto.ErrRoomNotFound
+		}
 	}
 	return room, nil
 }
@@ -78,10 +89,15 @@ func (b *TestBackend) CreateRoom(
 		b.rooms = map[string]proto.ManagedRoom{}
 	}
 
+	if _, ok := b.roomAliases[name]; ok {
+		return nil, proto.ErrRoomNameInUse
+	}
+
 	room, err := NewRoom(ctx, kms, private, name, b.version, managers...)
 	if err != nil {
 		return nil, err
 	}
+	room.(*memRoom).backend = b
 
 	b.rooms[name] = room
 	return room, nil
@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type botTokenEntry struct {
+	accountID snowflake.Snowflake
+	token     proto.BotToken
+	revoked   bool
+}
+
+type botTokens struct {
+	sync.Mutex
+	tokens map[string]*botTokenEntry
+}
+
+type botTokenTracker struct {
+	b *TestBackend
+}
+
+func (t *botTokenTracker) Issue(ctx scope.Context, accountID snowflake.Snowflake, token *proto.BotToken) error {
+	bt := &t.b.botTokens
+	bt.Lock()
+	defer bt.Unlock()
+
+	if bt.tokens == nil {
+		bt.tokens = map[string]*botTokenEntry{}
+	}
+	entry := &botTokenEntry{
+		accountID: accountID,
+		token:     *token,
+	}
+	entry.token.Rooms = append([]string(nil), token.Rooms...)
+	bt.tokens[token.ID] = entry
+	return nil
+}
+
+func (t *botTokenTracker) Get(ctx scope.Context, tokenID string) (*proto.BotToken, error) {
+	bt := &t.b.botTokens
+	bt.Lock()
+	defer bt.Unlock()
+
+	entry, ok := bt.tokens[tokenID]
+	if !ok || entry.revoked {
+		return nil, proto.ErrBotTokenNotFound
+	}
+	token := entry.token
+	return &token, nil
+}
+
+func (t *botTokenTracker) List(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.BotToken, error) {
+	bt := &t.b.botTokens
+	bt.Lock()
+	defer bt.Unlock()
+
+	tokens := []*proto.BotToken{}
+	for _, entry := range bt.tokens {
+		if entry.accountID == accountID && !entry.revoked {
+			token := entry.token
+			tokens = append(tokens, &token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		ti, tj := tokens[i].Created.StdTime(), tokens[j].Created.StdTime()
+		if ti.Equal(tj) {
+			return tokens[i].ID < tokens[j].ID
+		}
+		return ti.Before(tj)
+	})
+	return tokens, nil
+}
+
+func (t *botTokenTracker) Revoke(ctx scope.Context, accountID snowflake.Snowflake, tokenID string) error {
+	bt := &t.b.botTokens
+	bt.Lock()
+	defer bt.Unlock()
+
+	entry, ok := bt.tokens[tokenID]
+	if !ok || entry.revoked || entry.accountID != accountID {
+		return proto.ErrBotTokenNotFound
+	}
+	entry.revoked = true
+	return nil
+}
+
+func (t *botTokenTracker) Used(ctx scope.Context, tokenID string, at time.Time) error {
+	bt := &t.b.botTokens
+	bt.Lock()
+	defer bt.Unlock()
+
+	if entry, ok := bt.tokens[tokenID]; ok && at.After(entry.token.LastUsed.StdTime()) {
+		entry.token.LastUsed = proto.Time(at)
+	}
+	return nil
+}
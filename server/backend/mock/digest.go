@@ -0,0 +1,153 @@
+package mock
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type digestState struct {
+	seen time.Time
+	sent time.Time
+}
+
+type digestStates struct {
+	sync.Mutex
+	states map[snowflake.Snowflake]*digestState
+}
+
+// get returns the account's digest state, creating it if necessary. The
+// caller must hold the lock.
+func (ds *digestStates) get(accountID snowflake.Snowflake) *digestState {
+	if ds.states == nil {
+		ds.states = map[snowflake.Snowflake]*digestState{}
+	}
+	st, ok := ds.states[accountID]
+	if !ok {
+		st = &digestState{}
+		ds.states[accountID] = st
+	}
+	return st
+}
+
+type digestTracker struct {
+	b *TestBackend
+}
+
+func (t *digestTracker) Seen(ctx scope.Context, accountID snowflake.Snowflake, at time.Time) error {
+	t.b.digests.Lock()
+	defer t.b.digests.Unlock()
+
+	st := t.b.digests.get(accountID)
+	if at.After(st.seen) {
+		st.seen = at
+	}
+	return nil
+}
+
+func (t *digestTracker) Claim(
+	ctx scope.Context, cutoff, at time.Time, n int) ([]snowflake.Snowflake, error) {
+
+	t.b.digests.Lock()
+	defer t.b.digests.Unlock()
+
+	due, err := t.due(ctx, cutoff, n)
+	if err != nil {
+		return nil, err
+	}
+	for _, accountID := range due {
+		t.b.digests.get(accountID).sent = at
+	}
+	return due, nil
+}
+
+// due returns the accounts that are due a digest. The caller must hold the
+// lock on the digest states.
+func (t *digestTracker) due(ctx scope.Context, cutoff time.Time, n int) ([]snowflake.Snowflake, error) {
+	due := []snowflake.Snowflake{}
+	for accountID, st := range t.b.digests.states {
+		if !st.seen.Before(cutoff) || !st.sent.Before(st.seen) {
+			continue
+		}
+		prefs, err := t.b.AccountManager().EmailPreferences(ctx, accountID)
+		if err != nil {
+			if err == proto.ErrAccountNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if prefs.Allows(proto.DigestEmail) {
+			due = append(due, accountID)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].Before(due[j]) })
+	if len(due) > n {
+		due = due[:n]
+	}
+	return due, nil
+}
+
+func (t *digestTracker) Collect(ctx scope.Context, accountID snowflake.Snowflake) (*proto.Digest, error) {
+	t.b.digests.Lock()
+	since := t.b.digests.get(accountID).seen
+	t.b.digests.Unlock()
+
+	digest := &proto.Digest{
+		AccountID: accountID,
+		Since:     since,
+		Mentions:  []proto.Mention{},
+		PMs:       []proto.DigestPM{},
+	}
+
+	userID := proto.UserID(fmt.Sprintf("account:%s", accountID))
+	mentions, err := t.b.MentionTracker().Latest(ctx, userID, proto.MaxDigestMentions, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, mention := range mentions {
+		if time.Time(mention.UnixTime).After(since) {
+			digest.Mentions = append(digest.Mentions, mention)
+		}
+	}
+
+	t.b.pms.m.Lock()
+	defer t.b.pms.m.Unlock()
+
+	for pmID, pm := range t.b.pms.pms {
+		var withNick string
+		switch {
+		case pm.pm.Initiator == accountID:
+			withNick = pm.pm.ReceiverNick
+		case pm.pm.Receiver == userID:
+			withNick = pm.pm.InitiatorNick
+		default:
+			continue
+		}
+
+		latest, err := pm.log.Latest(ctx, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(latest) == 0 || !time.Time(latest[0].UnixTime).After(since) {
+			continue
+		}
+
+		pm.m.Lock()
+		marker := pm.readMarkers[accountID]
+		pm.m.Unlock()
+
+		if unread := pm.log.countAfter(marker, proto.MaxUnreadCount); unread > 0 {
+			digest.PMs = append(digest.PMs, proto.DigestPM{PMID: pmID, WithNick: withNick, Unread: unread})
+		}
+	}
+	sort.Slice(digest.PMs, func(i, j int) bool { return digest.PMs[i].PMID.Before(digest.PMs[j].PMID) })
+
+	return digest, nil
+}
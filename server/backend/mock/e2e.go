@@ -0,0 +1,86 @@
+package mock
+
+import (
+	"bytes"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+func (m *accountManager) SetE2EPublicKey(
+	ctx scope.Context, accountID snowflake.Snowflake, publicKey []byte) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.accounts[accountID]; !ok {
+		return proto.ErrAccountNotFound
+	}
+	if m.b.e2eKeys == nil {
+		m.b.e2eKeys = map[snowflake.Snowflake][]byte{}
+	}
+	m.b.e2eKeys[accountID] = bytes.Clone(publicKey)
+	return nil
+}
+
+func (m *accountManager) E2EPublicKey(ctx scope.Context, accountID snowflake.Snowflake) ([]byte, error) {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.accounts[accountID]; !ok {
+		return nil, proto.ErrAccountNotFound
+	}
+	return bytes.Clone(m.b.e2eKeys[accountID]), nil
+}
+
+func (r *memRoom) E2E(ctx scope.Context) (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.e2e, nil
+}
+
+func (r *memRoom) EnableE2E(ctx scope.Context) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.e2e {
+		return nil
+	}
+	r.e2e = true
+	return r.broadcastEvent(
+		ctx, proto.DisconnectEventType, &proto.DisconnectEvent{Reason: "room is now end-to-end encrypted"})
+}
+
+func (r *memRoom) ShareE2EKey(ctx scope.Context, key *proto.E2EKey) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.e2eKeys == nil {
+		r.e2eKeys = map[snowflake.Snowflake][]*proto.E2EKey{}
+	}
+	copied := *key
+	keys := r.e2eKeys[key.AccountID]
+	for i, ek := range keys {
+		if ek.KeyID == key.KeyID {
+			keys[i] = &copied
+			return nil
+		}
+	}
+	r.e2eKeys[key.AccountID] = append(keys, &copied)
+	return nil
+}
+
+func (r *memRoom) E2EKeys(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.E2EKey, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	keys := make([]*proto.E2EKey, len(r.e2eKeys[accountID]))
+	for i, ek := range r.e2eKeys[accountID] {
+		copied := *ek
+		keys[i] = &copied
+	}
+	return keys, nil
+}
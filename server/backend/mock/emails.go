@@ -18,6 +18,15 @@ import (
 type EmailTracker struct {
 	m               sync.Mutex
 	emailsByAccount map[snowflake.Snowflake][]*emails.EmailRef
+	prefs           map[snowflake.Snowflake]proto.EmailPreferences
+}
+
+func (et *EmailTracker) preferences(accountID snowflake.Snowflake) *proto.EmailPreferences {
+	et.m.Lock()
+	defer et.m.Unlock()
+
+	prefs := et.prefs[accountID]
+	return &prefs
 }
 
 func (et *EmailTracker) Send(
@@ -25,6 +34,10 @@ func (et *EmailTracker) Send(
 	account proto.Account, to, templateName string, data interface{}) (
 	*emails.EmailRef, error) {
 
+	if !et.preferences(account.ID()).Allows(templateName) {
+		return nil, nil
+	}
+
 	if to == "" {
 		to, _ = account.Email()
 	}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"sync"
+	"time"
 
 	"euphoria.leet.nu/lib/scope"
 
@@ -9,18 +10,37 @@ import (
 	"euphoria.leet.nu/heim/proto/security"
 )
 
+type capabilityLimits struct {
+	proto.PasscodeGrantLimits
+	uses int
+}
+
+func (l *capabilityLimits) exceeded() bool {
+	if !l.Expires.IsZero() && !time.Now().Before(l.Expires) {
+		return true
+	}
+	return l.MaxUses > 0 && l.uses >= l.MaxUses
+}
+
 type capabilities struct {
 	sync.Mutex
 	accountCapabilityIDs map[string]string
 	accounts             map[string]proto.Account
 	capabilities         map[string]security.Capability
+	limits               map[string]*capabilityLimits
 }
 
 func (cs *capabilities) Get(ctx scope.Context, cid string) (security.Capability, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
 	c, ok := cs.capabilities[cid]
 	if !ok {
 		return nil, proto.ErrCapabilityNotFound
 	}
+	if l, ok := cs.limits[cid]; ok && l.exceeded() {
+		return nil, proto.ErrCapabilityNotFound
+	}
 	return c, nil
 }
 
@@ -36,6 +56,42 @@ func (cs *capabilities) Save(ctx scope.Context, account proto.Account, c securit
 	cid := c.CapabilityID()
 	cs.capabilities[cid] = c
 	cs.accounts[cid] = account
+	delete(cs.limits, cid)
+	return nil
+}
+
+func (cs *capabilities) SaveLimited(
+	ctx scope.Context, c security.Capability, limits *proto.PasscodeGrantLimits) error {
+
+	if err := cs.Save(ctx, nil, c); err != nil {
+		return err
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.limits == nil {
+		cs.limits = map[string]*capabilityLimits{}
+	}
+	cs.limits[c.CapabilityID()] = &capabilityLimits{PasscodeGrantLimits: *limits}
+	return nil
+}
+
+func (cs *capabilities) Use(ctx scope.Context, cid string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if _, ok := cs.capabilities[cid]; !ok {
+		return proto.ErrCapabilityNotFound
+	}
+	l, ok := cs.limits[cid]
+	if !ok {
+		return nil
+	}
+	if l.exceeded() {
+		return proto.ErrCapabilityNotFound
+	}
+	l.uses++
 	return nil
 }
 
@@ -48,5 +104,6 @@ func (cs *capabilities) Remove(ctx scope.Context, cid string) error {
 	}
 	delete(cs.capabilities, cid)
 	delete(cs.accounts, cid)
+	delete(cs.limits, cid)
 	return nil
 }
@@ -12,10 +12,27 @@ import (
 
 type memLog struct {
 	sync.Mutex
-	msgs []*proto.Message
+	msgs      []*proto.Message
+	edits     []*memEdit
+	reactions map[snowflake.Snowflake]map[string]map[proto.UserID]struct{}
 }
 
-func newMemLog() *memLog { return &memLog{msgs: []*proto.Message{}} }
+// memEdit mirrors a row of the message_edit_log table.
+type memEdit struct {
+	EditID          snowflake.Snowflake
+	MessageID       snowflake.Snowflake
+	EditorID        proto.UserID
+	PreviousEditID  snowflake.Snowflake
+	PreviousContent string
+	PreviousParent  snowflake.Snowflake
+}
+
+func newMemLog() *memLog {
+	return &memLog{
+		msgs:      []*proto.Message{},
+		reactions: map[snowflake.Snowflake]map[string]map[proto.UserID]struct{}{},
+	}
+}
 
 func (log *memLog) post(msg *proto.Message) {
 	log.Lock()
@@ -30,7 +47,9 @@ func (log *memLog) GetMessage(ctx scope.Context, id snowflake.Snowflake) (*proto
 
 	for _, msg := range log.msgs {
 		if msg.ID == id && time.Time(msg.Deleted).IsZero() {
-			return msg, nil
+			m := *msg
+			m.Reactions = log.reactionCounts(id)
+			return &m, nil
 		}
 	}
 	return nil, proto.ErrMessageNotFound
@@ -53,7 +72,7 @@ func (log *memLog) Latest(ctx scope.Context, n int, before snowflake.Snowflake)
 	}
 
 	slice := make([]*proto.Message, 0, n)
-	for _, msg := range log.msgs[start:] {
+	for _, msg := range log.msgs[start:end] {
 		if time.Time(msg.Deleted).IsZero() {
 			slice = append(slice, maybeTruncate(msg))
 			if len(slice) >= n {
@@ -68,17 +87,137 @@ func (log *memLog) Latest(ctx scope.Context, n int, before snowflake.Snowflake)
 	messages := make([]proto.Message, len(slice))
 	for i, msg := range slice {
 		messages[i] = *msg
+		messages[i].Reactions = log.reactionCounts(msg.ID)
+	}
+	return messages, nil
+}
+
+func (log *memLog) Earliest(ctx scope.Context, n int, after snowflake.Snowflake) ([]proto.Message, error) {
+	log.Lock()
+	defer log.Unlock()
+
+	start := 0
+	for start < len(log.msgs) && !after.Before(log.msgs[start].ID) {
+		start++
+	}
+
+	slice := make([]*proto.Message, 0, n)
+	for _, msg := range log.msgs[start:] {
+		if len(slice) >= n {
+			break
+		}
+		if time.Time(msg.Deleted).IsZero() {
+			slice = append(slice, maybeTruncate(msg))
+		}
+	}
+
+	messages := make([]proto.Message, len(slice))
+	for i, msg := range slice {
+		messages[i] = *msg
+		messages[i].Reactions = log.reactionCounts(msg.ID)
 	}
 	return messages, nil
 }
 
-func (log *memLog) edit(e proto.EditMessageCommand) (*proto.Message, error) {
+func (log *memLog) Search(ctx scope.Context, cmd *proto.SearchCommand) ([]proto.Message, error) {
+	log.Lock()
+	defer log.Unlock()
+
+	n := cmd.N
+	if n > 1000 {
+		n = 1000
+	}
+
+	slice := []*proto.Message{}
+	for i := len(log.msgs) - 1; i >= 0 && len(slice) < n; i-- {
+		msg := log.msgs[i]
+		if !time.Time(msg.Deleted).IsZero() || msg.EncryptionKeyID != "" {
+			continue
+		}
+		if !cmd.Before.IsZero() && !msg.ID.Before(cmd.Before) {
+			continue
+		}
+		if cmd.Matches(msg) {
+			slice = append(slice, maybeTruncate(msg))
+		}
+	}
+
+	messages := make([]proto.Message, len(slice))
+	for i, msg := range slice {
+		messages[len(slice)-i-1] = *msg
+		messages[len(slice)-i-1].Reactions = log.reactionCounts(msg.ID)
+	}
+	return messages, nil
+}
+
+func (log *memLog) Thread(ctx scope.Context, n int, root snowflake.Snowflake) ([]proto.Message, error) {
+	log.Lock()
+	defer log.Unlock()
+
+	// Replies always follow their parents in the log, so one pass finds the
+	// whole thread.
+	inThread := map[snowflake.Snowflake]bool{root: true}
+	slice := make([]*proto.Message, 0, n)
+	for _, msg := range log.msgs {
+		if len(slice) >= n {
+			break
+		}
+		if msg.ID != root && !inThread[msg.Parent] {
+			continue
+		}
+		inThread[msg.ID] = true
+		if time.Time(msg.Deleted).IsZero() {
+			slice = append(slice, maybeTruncate(msg))
+		}
+	}
+
+	messages := make([]proto.Message, len(slice))
+	for i, msg := range slice {
+		messages[i] = *msg
+		messages[i].Reactions = log.reactionCounts(msg.ID)
+	}
+	return messages, nil
+}
+
+// countAfter returns the number of messages following the given one, up to
+// max.
+func (log *memLog) countAfter(id snowflake.Snowflake, max int) int {
+	log.Lock()
+	defer log.Unlock()
+
+	n := 0
+	for i := len(log.msgs) - 1; i >= 0 && n < max; i-- {
+		msg := log.msgs[i]
+		if !id.Before(msg.ID) {
+			break
+		}
+		if time.Time(msg.Deleted).IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+func (log *memLog) edit(
+	editID snowflake.Snowflake, editorID proto.UserID, e proto.EditMessageCommand) (*proto.Message, error) {
+
 	log.Lock()
 	defer log.Unlock()
 
 	now := proto.Now()
 	for _, msg := range log.msgs {
 		if msg.ID == e.ID {
+			if msg.PreviousEditID != e.PreviousEditID {
+				return nil, proto.ErrEditInconsistent
+			}
+			log.edits = append(log.edits, &memEdit{
+				EditID:          editID,
+				MessageID:       msg.ID,
+				EditorID:        editorID,
+				PreviousEditID:  msg.PreviousEditID,
+				PreviousContent: msg.Content,
+				PreviousParent:  msg.Parent,
+			})
 			if e.Parent != 0 {
 				msg.Parent = e.Parent
 			}
@@ -91,12 +230,65 @@ func (log *memLog) edit(e proto.EditMessageCommand) (*proto.Message, error) {
 				msg.Deleted = proto.Time{}
 			}
 			msg.Edited = now
+			msg.PreviousEditID = editID
 			return maybeTruncate(msg), nil
 		}
 	}
 	return nil, proto.ErrMessageNotFound
 }
 
+func (log *memLog) react(
+	msgID snowflake.Snowflake, userID proto.UserID, reaction string, remove bool) (int, bool, error) {
+
+	log.Lock()
+	defer log.Unlock()
+
+	found := false
+	for _, msg := range log.msgs {
+		if msg.ID == msgID && time.Time(msg.Deleted).IsZero() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, false, proto.ErrMessageNotFound
+	}
+
+	byReaction, ok := log.reactions[msgID]
+	if !ok {
+		byReaction = map[string]map[proto.UserID]struct{}{}
+		log.reactions[msgID] = byReaction
+	}
+	users, ok := byReaction[reaction]
+	if !ok {
+		users = map[proto.UserID]struct{}{}
+		byReaction[reaction] = users
+	}
+	_, had := users[userID]
+	if remove {
+		delete(users, userID)
+	} else {
+		users[userID] = struct{}{}
+	}
+	if len(users) == 0 {
+		delete(byReaction, reaction)
+	}
+	return len(users), had == remove, nil
+}
+
+// reactionCounts must be called with lock held.
+func (log *memLog) reactionCounts(msgID snowflake.Snowflake) map[string]int {
+	byReaction := log.reactions[msgID]
+	if len(byReaction) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(byReaction))
+	for reaction, users := range byReaction {
+		counts[reaction] = len(users)
+	}
+	return counts
+}
+
 func maybeTruncate(msg *proto.Message) *proto.Message {
 	if len(msg.Content) > proto.MaxMessageTransmissionLength {
 		truncated := *msg
@@ -58,4 +58,122 @@ func TestMemLogLatest(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(slice, ShouldResemble, msgs[1:4])
 	})
+
+	Convey("Before with short response", t, func() {
+		log := newMemLog()
+		for _, msg := range msgs {
+			posted := msg
+			log.post(&posted)
+		}
+
+		slice, err := log.Latest(ctx, 10, 15)
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[:2])
+	})
+}
+
+func TestMemLogEarliest(t *testing.T) {
+	ctx := scope.New()
+	msgs := []proto.Message{
+		{ID: 1, Content: "A"},
+		{ID: 2, Content: "B"},
+		{ID: 15, Content: "C"},
+		{ID: 19, Content: "D"},
+		{ID: 20, Content: "E"},
+	}
+
+	log := newMemLog()
+	for _, msg := range msgs {
+		posted := msg
+		log.post(&posted)
+	}
+
+	Convey("After", t, func() {
+		slice, err := log.Earliest(ctx, 2, 2)
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[2:4])
+
+		slice, err = log.Earliest(ctx, 10, 16)
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[3:])
+
+		slice, err = log.Earliest(ctx, 10, 20)
+		So(err, ShouldBeNil)
+		So(slice, ShouldNotBeNil)
+		So(len(slice), ShouldEqual, 0)
+	})
+}
+
+func TestMemLogSearch(t *testing.T) {
+	ctx := scope.New()
+	msgs := []proto.Message{
+		{ID: 1, Content: "Hello, world!"},
+		{ID: 2, Content: "goodbye world", Sender: proto.SessionView{IdentityView: proto.IdentityView{ID: "bot:x"}}},
+		{ID: 3, Content: "hello again"},
+		{ID: 4, Content: "worldly hello"},
+		{ID: 5, Content: "hello world", EncryptionKeyID: "v1/key"},
+	}
+
+	log := newMemLog()
+	for _, msg := range msgs {
+		posted := msg
+		log.post(&posted)
+	}
+
+	Convey("All terms must match whole words", t, func() {
+		slice, err := log.Search(ctx, &proto.SearchCommand{Query: "WORLD hello", N: 10})
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[:1])
+	})
+
+	Convey("Results are limited to the most recent matches", t, func() {
+		slice, err := log.Search(ctx, &proto.SearchCommand{Query: "hello", N: 2})
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[2:4])
+
+		slice, err = log.Search(ctx, &proto.SearchCommand{Query: "hello", N: 2, Before: 3})
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[:1])
+	})
+
+	Convey("Sender filter", t, func() {
+		slice, err := log.Search(ctx, &proto.SearchCommand{Query: "world", Sender: "bot:x", N: 10})
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, msgs[1:2])
+	})
+}
+
+func TestMemLogThread(t *testing.T) {
+	ctx := scope.New()
+	msgs := []proto.Message{
+		{ID: 1, Content: "root"},
+		{ID: 2, Content: "elsewhere"},
+		{ID: 3, Parent: 1, Content: "reply"},
+		{ID: 4, Parent: 2, Content: "other reply"},
+		{ID: 5, Parent: 3, Content: "nested reply"},
+	}
+
+	log := newMemLog()
+	for _, msg := range msgs {
+		posted := msg
+		log.post(&posted)
+	}
+
+	Convey("Replies at any depth are included", t, func() {
+		slice, err := log.Thread(ctx, 10, 1)
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, []proto.Message{msgs[0], msgs[2], msgs[4]})
+	})
+
+	Convey("Threads are truncated to n messages", t, func() {
+		slice, err := log.Thread(ctx, 2, 1)
+		So(err, ShouldBeNil)
+		So(slice, ShouldResemble, []proto.Message{msgs[0], msgs[2]})
+	})
+
+	Convey("Unknown roots have no thread", t, func() {
+		slice, err := log.Thread(ctx, 10, 6)
+		So(err, ShouldBeNil)
+		So(len(slice), ShouldEqual, 0)
+	})
 }
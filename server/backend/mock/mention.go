@@ -0,0 +1,56 @@
+package mock
+
+import (
+	"sync"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type MentionTracker struct {
+	m        sync.Mutex
+	mentions map[proto.UserID][]proto.Mention
+}
+
+func (t *MentionTracker) Add(ctx scope.Context, userID proto.UserID, mention proto.Mention) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.mentions == nil {
+		t.mentions = map[proto.UserID][]proto.Mention{}
+	}
+	t.mentions[userID] = append(t.mentions[userID], mention)
+	return nil
+}
+
+func (t *MentionTracker) Latest(
+	ctx scope.Context, userID proto.UserID, n int, before snowflake.Snowflake) ([]proto.Mention, error) {
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if n <= 0 {
+		return []proto.Mention{}, nil
+	}
+	if n > 1000 {
+		n = 1000
+	}
+
+	mentions := t.mentions[userID]
+	end := len(mentions)
+	if !before.IsZero() {
+		for end > 0 && !mentions[end-1].MessageID.Before(before) {
+			end--
+		}
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+
+	result := make([]proto.Mention, end-start)
+	copy(result, mentions[start:end])
+	return result, nil
+}
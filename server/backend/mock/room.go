@@ -1,6 +1,7 @@
 package mock
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"sort"
@@ -30,6 +31,15 @@ type RoomBase struct {
 	clients     map[string]*proto.Client
 	partWaiters map[string]chan struct{}
 	messageKey  *roomMessageKey
+	events      []loggedEvent
+	readMarkers map[snowflake.Snowflake]snowflake.Snowflake
+}
+
+// loggedEvent mirrors a row of the room_event_log table.
+type loggedEvent struct {
+	packet  proto.Packet
+	exclude []string
+	created time.Time
 }
 
 func (r *RoomBase) ID() string      { return r.name }
@@ -44,6 +54,18 @@ func (r *RoomBase) Latest(ctx scope.Context, n int, before snowflake.Snowflake)
 	return r.log.Latest(ctx, n, before)
 }
 
+func (r *RoomBase) Earliest(ctx scope.Context, n int, after snowflake.Snowflake) ([]proto.Message, error) {
+	return r.log.Earliest(ctx, n, after)
+}
+
+func (r *RoomBase) Search(ctx scope.Context, cmd *proto.SearchCommand) ([]proto.Message, error) {
+	return r.log.Search(ctx, cmd)
+}
+
+func (r *RoomBase) Thread(ctx scope.Context, n int, root snowflake.Snowflake) ([]proto.Message, error) {
+	return r.log.Thread(ctx, n, root)
+}
+
 func (r *RoomBase) Join(ctx scope.Context, session proto.Session) (string, error) {
 	client := &proto.Client{}
 	if !client.FromContext(ctx) {
@@ -88,6 +110,19 @@ func (r *RoomBase) Join(ctx scope.Context, session proto.Session) (string, error
 	return "virt:" + event.RealClientAddress, r.broadcast(ctx, proto.JoinType, &event, session)
 }
 
+func (r *RoomBase) IsBanned(ctx scope.Context, agentID proto.UserID, ip string) (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if banned, ok := r.agentBans[agentID]; ok && agentID != "" && banned.After(time.Now()) {
+		return true, nil
+	}
+	if banned, ok := r.ipBans[ip]; ok && ip != "" && banned.After(time.Now()) {
+		return true, nil
+	}
+	return false, nil
+}
+
 func (r *RoomBase) Part(ctx scope.Context, session proto.Session) error {
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -142,7 +177,12 @@ func (r *RoomBase) EditMessage(
 		return proto.EditMessageReply{}, err
 	}
 
-	msg, err := r.log.edit(edit)
+	var editorID proto.UserID
+	if session != nil {
+		editorID = session.Identity().ID()
+	}
+
+	msg, err := r.log.edit(editID, editorID, edit)
 	if err != nil {
 		return proto.EditMessageReply{}, err
 	}
@@ -164,9 +204,72 @@ func (r *RoomBase) EditMessage(
 	return reply, nil
 }
 
+func (r *RoomBase) React(
+	ctx scope.Context, session proto.Session, msgID snowflake.Snowflake, reaction string, remove bool) (
+	*proto.ReactionEvent, error) {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	count, changed, err := r.log.react(msgID, session.Identity().ID(), reaction, remove)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &proto.ReactionEvent{
+		ID:       msgID,
+		Reaction: reaction,
+		Sender:   session.View(proto.Host),
+		Removed:  remove,
+		Count:    count,
+	}
+	if changed {
+		if err := r.broadcastEvent(ctx, proto.ReactionEventType, event, session); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+func (r *RoomBase) ReadMarker(ctx scope.Context, accountID snowflake.Snowflake) (snowflake.Snowflake, int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	marker, ok := r.readMarkers[accountID]
+	if !ok {
+		return 0, 0, nil
+	}
+	return marker, r.log.countAfter(marker, proto.MaxUnreadCount), nil
+}
+
+func (r *RoomBase) MarkRead(ctx scope.Context, accountID, msgID snowflake.Snowflake) (
+	snowflake.Snowflake, int, error) {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.readMarkers == nil {
+		r.readMarkers = map[snowflake.Snowflake]snowflake.Snowflake{}
+	}
+	marker := r.readMarkers[accountID]
+	if marker.Before(msgID) {
+		marker = msgID
+		r.readMarkers[accountID] = marker
+	}
+	return marker, r.log.countAfter(marker, proto.MaxUnreadCount), nil
+}
+
 func (r *RoomBase) broadcast(
 	ctx scope.Context, cmdType proto.PacketType, payload interface{}, excluding ...proto.Session) error {
 
+	return r.broadcastEvent(ctx, cmdType.Event(), payload, excluding...)
+}
+
+// broadcastEvent is like broadcast, but takes the type of the event itself
+// rather than of the command it follows.
+func (r *RoomBase) broadcastEvent(
+	ctx scope.Context, eventType proto.PacketType, payload interface{}, excluding ...proto.Session) error {
+
 	excMap := make(map[string]struct{}, len(excluding))
 	for _, x := range excluding {
 		if x != nil {
@@ -174,19 +277,28 @@ func (r *RoomBase) broadcast(
 		}
 	}
 
+	sent := payload
+	if proto.IsLoggedEventType(eventType) {
+		logged, err := r.logEvent(eventType, payload, excMap)
+		if err != nil {
+			return err
+		}
+		sent = logged
+	}
+
 	for _, sessions := range r.live {
 		for _, session := range sessions {
 			if _, ok := excMap[session.ID()]; ok {
 				continue
 			}
-			if err := session.Send(ctx, cmdType.Event(), payload); err != nil {
+			if err := session.Send(ctx, eventType, sent); err != nil {
 				// TODO: accumulate errors
 				return err
 			}
 		}
 	}
 
-	if cmdType == proto.PartType {
+	if eventType == proto.PartEventType {
 		if presence, ok := payload.(*proto.PresenceEvent); ok {
 			if waiter, ok := r.partWaiters[presence.SessionID]; ok {
 				r.m.Unlock()
@@ -198,6 +310,65 @@ func (r *RoomBase) broadcast(
 	return nil
 }
 
+// logEvent must be called with lock held.
+func (r *RoomBase) logEvent(
+	eventType proto.PacketType, payload interface{}, excMap map[string]struct{}) (*proto.LoggedEvent, error) {
+
+	cursor, err := snowflake.New()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	event := loggedEvent{
+		packet:  proto.Packet{Type: eventType, Data: data, Cursor: cursor},
+		exclude: make([]string, 0, len(excMap)),
+		created: time.Now(),
+	}
+	for id := range excMap {
+		event.exclude = append(event.exclude, id)
+	}
+
+	// Expire old events.
+	threshold := time.Now().Add(-proto.EventLogTTL)
+	for len(r.events) > 0 && r.events[0].created.Before(threshold) {
+		r.events = r.events[1:]
+	}
+	r.events = append(r.events, event)
+
+	return &proto.LoggedEvent{
+		Cursor:  cursor,
+		Type:    eventType,
+		Payload: payload,
+		Exclude: event.exclude,
+	}, nil
+}
+
+func (r *RoomBase) EventsSince(ctx scope.Context, cursor snowflake.Snowflake) ([]proto.LoggedEvent, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	events := []proto.LoggedEvent{}
+	for _, event := range r.events {
+		if !cursor.Before(event.packet.Cursor) {
+			continue
+		}
+		payload, err := event.packet.Payload()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, proto.LoggedEvent{
+			Cursor:  event.packet.Cursor,
+			Type:    event.packet.Type,
+			Payload: payload,
+			Exclude: event.exclude,
+		})
+	}
+	return events, nil
+}
+
 func (r *RoomBase) Listing(ctx scope.Context, level proto.PrivilegeLevel, exclude ...proto.Session) (proto.Listing, error) {
 	listing := proto.Listing{}
 	for _, sessions := range r.live {
@@ -237,6 +408,19 @@ func (r *RoomBase) ResolveNick(ctx scope.Context, userID proto.UserID) (string,
 	return nick, ok, nil
 }
 
+func (r *RoomBase) ResolveMention(ctx scope.Context, mention string) ([]proto.UserID, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var userIDs []proto.UserID
+	for userID, nick := range r.nicks {
+		if proto.NormalizeMention(nick) == mention {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
+
 func (r *RoomBase) Snapshot(
 	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, numMessages int) (*proto.SnapshotEvent, error) {
 
@@ -323,8 +507,17 @@ func (r *RoomBase) ResolveClientAddress(ctx scope.Context, addr string) (net.IP,
 type memRoom struct {
 	RoomBase
 
-	sec        *proto.RoomSecurity
-	managerKey *roomManagerKey
+	sec           *proto.RoomSecurity
+	managerKey    *roomManagerKey
+	webhooks      []*proto.Webhook
+	hooks         []*proto.IncomingWebhook
+	backend       *TestBackend
+	canonicalName string
+	archived      bool
+	announcement  proto.AnnouncementMode
+	keyLinks      map[string]*proto.MessageKeyLink
+	e2e           bool
+	e2eKeys       map[snowflake.Snowflake][]*proto.E2EKey
 }
 
 func NewRoom(
@@ -425,6 +618,7 @@ func (r *memRoom) GenerateMessageKey(ctx scope.Context, kms security.KMS) (proto
 			KeyEncryptingKey: &r.sec.KeyEncryptingKey,
 			SubjectKeyPair:   &kp,
 			SubjectNonce:     nonce,
+			PayloadKey:       mkey,
 		},
 		timestamp: time.Now(),
 		nonce:     nonce,
@@ -434,6 +628,56 @@ func (r *memRoom) GenerateMessageKey(ctx scope.Context, kms security.KMS) (proto
 	return r.messageKey, nil
 }
 
+func (r *memRoom) RotateMessageKey(
+	ctx scope.Context, kms security.KMS, currentKeyID string, currentKey *security.ManagedKey,
+	grantees ...proto.Account) (proto.RoomMessageKey, error) {
+
+	// Hold the lock from the check through the swap, so that concurrent
+	// rotations can't both replace the same key.
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.messageKey == nil || r.messageKey.id != currentKeyID {
+		return nil, fmt.Errorf("message key %s is not current", currentKeyID)
+	}
+
+	previous := r.messageKey
+	rmk, err := r.GenerateMessageKey(ctx, kms)
+	if err != nil {
+		return nil, err
+	}
+
+	key := rmk.ManagedKey()
+	if err := kms.DecryptKey(&key); err != nil {
+		r.messageKey = previous
+		return nil, err
+	}
+	link, err := proto.NewMessageKeyLink(kms, rmk.KeyID(), &key, currentKeyID, currentKey)
+	if err != nil {
+		r.messageKey = previous
+		return nil, err
+	}
+	for _, account := range grantees {
+		if err := rmk.StaffGrantToAccount(ctx, kms, account); err != nil {
+			r.messageKey = previous
+			return nil, err
+		}
+	}
+
+	if r.keyLinks == nil {
+		r.keyLinks = map[string]*proto.MessageKeyLink{}
+	}
+	r.keyLinks[link.KeyID] = link
+	return rmk, r.broadcastEvent(ctx, proto.DisconnectEventType, &proto.DisconnectEvent{Reason: "room key rotated"})
+}
+
+func (r *memRoom) PreviousMessageKey(ctx scope.Context, keyID string) (*proto.MessageKeyLink, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.keyLinks[keyID], nil
+}
+
 func (r *memRoom) Ban(ctx scope.Context, ban proto.Ban, until time.Time) error {
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -571,6 +815,62 @@ func (r *memRoom) RemoveManager(
 
 func (r *memRoom) MinAgentAge() time.Duration { return 0 }
 
+func (r *memRoom) Archived(ctx scope.Context) (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.archived, nil
+}
+
+func (r *memRoom) Archive(ctx scope.Context) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.archived = true
+	return r.broadcastEvent(ctx, proto.DisconnectEventType, &proto.DisconnectEvent{Reason: "room archived"})
+}
+
+func (r *memRoom) AnnouncementMode(ctx scope.Context) (*proto.AnnouncementMode, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	mode := r.announcement
+	mode.Posters = append([]snowflake.Snowflake(nil), mode.Posters...)
+	return &mode, nil
+}
+
+func (r *memRoom) SetAnnouncementMode(
+	ctx scope.Context, session proto.Session, mode *proto.AnnouncementMode) error {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.announcement = *mode
+	r.announcement.Posters = append([]snowflake.Snowflake(nil), mode.Posters...)
+	event := &proto.AnnouncementModeEvent{Enabled: mode.Enabled, Posters: r.announcement.Posters}
+	return r.broadcastEvent(ctx, proto.AnnouncementModeEventType, event, session)
+}
+
+func (r *memRoom) Delete(ctx scope.Context) error {
+	if r.backend == nil {
+		return fmt.Errorf("room not registered with a backend")
+	}
+
+	r.backend.Lock()
+	delete(r.backend.rooms, r.name)
+	for alias, roomName := range r.backend.roomAliases {
+		if roomName == r.name {
+			delete(r.backend.roomAliases, alias)
+		}
+	}
+	r.backend.Unlock()
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.broadcastEvent(ctx, proto.DisconnectEventType, &proto.DisconnectEvent{Reason: "room deleted"})
+}
+
 type roomMessageKey struct {
 	*proto.GrantManager
 	id        string
@@ -0,0 +1,131 @@
+package mock
+
+import (
+	"fmt"
+	"sort"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+)
+
+func (r *memRoom) CanonicalName(ctx scope.Context) (string, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.canonicalName == "" {
+		return r.name, nil
+	}
+	return r.canonicalName, nil
+}
+
+func (r *memRoom) Aliases(ctx scope.Context) ([]string, error) {
+	if r.backend == nil {
+		return nil, fmt.Errorf("room not registered with a backend")
+	}
+
+	canonical, err := r.CanonicalName(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.backend.Lock()
+	defer r.backend.Unlock()
+
+	aliases := []string{}
+	if canonical != r.name {
+		aliases = append(aliases, r.name)
+	}
+	for alias, roomName := range r.backend.roomAliases {
+		if roomName == r.name && alias != canonical {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+// claimName registers the name as an alias of the room, unless it already
+// leads to the room. The backend must be locked.
+func (r *memRoom) claimName(name string) error {
+	if name == r.name {
+		return nil
+	}
+	if _, ok := r.backend.rooms[name]; ok {
+		return proto.ErrRoomNameInUse
+	}
+	if roomName, ok := r.backend.roomAliases[name]; ok {
+		if roomName != r.name {
+			return proto.ErrRoomNameInUse
+		}
+		return nil
+	}
+	if r.backend.roomAliases == nil {
+		r.backend.roomAliases = map[string]string{}
+	}
+	r.backend.roomAliases[name] = r.name
+	return nil
+}
+
+func (r *memRoom) AddAlias(ctx scope.Context, alias string) error {
+	if r.backend == nil {
+		return fmt.Errorf("room not registered with a backend")
+	}
+	if err := proto.ValidateRoomName(alias); err != nil {
+		return err
+	}
+
+	r.backend.Lock()
+	defer r.backend.Unlock()
+
+	return r.claimName(alias)
+}
+
+func (r *memRoom) RemoveAlias(ctx scope.Context, alias string) error {
+	if r.backend == nil {
+		return fmt.Errorf("room not registered with a backend")
+	}
+
+	canonical, err := r.CanonicalName(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.backend.Lock()
+	defer r.backend.Unlock()
+
+	if alias == r.name || alias == canonical || r.backend.roomAliases[alias] != r.name {
+		return proto.ErrRoomAliasNotFound
+	}
+	delete(r.backend.roomAliases, alias)
+	return nil
+}
+
+func (r *memRoom) Rename(ctx scope.Context, session proto.Session, name string) error {
+	if r.backend == nil {
+		return fmt.Errorf("room not registered with a backend")
+	}
+	if err := proto.ValidateRoomName(name); err != nil {
+		return err
+	}
+
+	r.backend.Lock()
+	err := r.claimName(name)
+	r.backend.Unlock()
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	from := r.canonicalName
+	if from == "" {
+		from = r.name
+	}
+	if from == name {
+		return nil
+	}
+	r.canonicalName = name
+	return r.broadcastEvent(ctx, proto.RoomRenamedEventType, &proto.RoomRenamedEvent{From: from, To: name}, session)
+}
@@ -43,6 +43,9 @@ func (s *session) View(level proto.PrivilegeLevel) proto.SessionView {
 }
 
 func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload interface{}) error {
+	if logged, ok := payload.(*proto.LoggedEvent); ok {
+		payload = logged.Payload
+	}
 	s.Lock()
 	s.history = append(s.history, message{cmdType, payload})
 	s.Unlock()
@@ -0,0 +1,95 @@
+package mock
+
+import (
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+func (r *memRoom) Webhooks(ctx scope.Context) ([]*proto.Webhook, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	webhooks := make([]*proto.Webhook, len(r.webhooks))
+	for i, webhook := range r.webhooks {
+		copied := *webhook
+		webhooks[i] = &copied
+	}
+	return webhooks, nil
+}
+
+func (r *memRoom) AddWebhook(ctx scope.Context, webhook *proto.Webhook) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.webhooks) >= proto.MaxWebhooks {
+		return proto.ErrTooManyWebhooks
+	}
+	copied := *webhook
+	r.webhooks = append(r.webhooks, &copied)
+	return nil
+}
+
+func (r *memRoom) RemoveWebhook(ctx scope.Context, webhookID snowflake.Snowflake) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for i, webhook := range r.webhooks {
+		if webhook.ID == webhookID {
+			r.webhooks = append(r.webhooks[:i], r.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return proto.ErrWebhookNotFound
+}
+
+func (r *memRoom) IncomingWebhooks(ctx scope.Context) ([]*proto.IncomingWebhook, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	hooks := make([]*proto.IncomingWebhook, len(r.hooks))
+	for i, hook := range r.hooks {
+		copied := *hook
+		hooks[i] = &copied
+	}
+	return hooks, nil
+}
+
+func (r *memRoom) GetIncomingWebhook(ctx scope.Context, hookID snowflake.Snowflake) (*proto.IncomingWebhook, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for _, hook := range r.hooks {
+		if hook.ID == hookID {
+			copied := *hook
+			return &copied, nil
+		}
+	}
+	return nil, proto.ErrWebhookNotFound
+}
+
+func (r *memRoom) AddIncomingWebhook(ctx scope.Context, hook *proto.IncomingWebhook) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.hooks) >= proto.MaxIncomingWebhooks {
+		return proto.ErrTooManyWebhooks
+	}
+	copied := *hook
+	r.hooks = append(r.hooks, &copied)
+	return nil
+}
+
+func (r *memRoom) RemoveIncomingWebhook(ctx scope.Context, hookID snowflake.Snowflake) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for i, hook := range r.hooks {
+		if hook.ID == hookID {
+			r.hooks = append(r.hooks[:i], r.hooks[i+1:]...)
+			return nil
+		}
+	}
+	return proto.ErrWebhookNotFound
+}
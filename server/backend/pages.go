@@ -14,18 +14,43 @@ import (
 )
 
 const (
-	RoomPage          = "room.html"
-	ResetPasswordPage = "reset-password.html"
-	VerifyEmailPage   = "verify-email.html"
-	LibPage           = "libpage.html"
+	RoomPage             = "room.html"
+	EmailPreferencesPage = "email-preferences.html"
+	ResetPasswordPage    = "reset-password.html"
+	VerifyEmailPage      = "verify-email.html"
+	LibPage              = "libpage.html"
+	ArchivePage          = "archive.html"
 )
 
 var PageScenarios = map[string]map[string]templates.TemplateTest{
+	ArchivePage: map[string]templates.TemplateTest{
+		"default": templates.TemplateTest{
+			Data: map[string]interface{}{
+				"Room": "test",
+				"Messages": []map[string]interface{}{
+					{"ID": "a", "Depth": 0, "Sender": "alice", "Time": "2015-01-01 00:00:00 UTC", "Content": "hi"},
+					{"ID": "b", "Depth": 1, "Sender": "bob", "Time": "2015-01-01 00:00:01 UTC", "Content": "hello"},
+				},
+			},
+		},
+	},
 	RoomPage: map[string]templates.TemplateTest{
 		"default": templates.TemplateTest{
 			Data: map[string]interface{}{"RoomName": "test"},
 		},
 	},
+	EmailPreferencesPage: map[string]templates.TemplateTest{
+		"default": templates.TemplateTest{
+			Data: map[string]interface{}{
+				"Data": map[string]interface{}{
+					"email":        "test@test.invalid",
+					"token":        "token",
+					"digest":       true,
+					"unsubscribed": false,
+				},
+			},
+		},
+	},
 	ResetPasswordPage: map[string]templates.TemplateTest{
 		"default": templates.TemplateTest{
 			Data: map[string]interface{}{
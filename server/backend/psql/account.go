@@ -18,6 +18,31 @@ import (
 
 const OTPKeyType = security.AES128
 
+type EmailPreferences struct {
+	AccountID    string `db:"account_id"`
+	Digest       bool   `db:"digest"`
+	Unsubscribed bool   `db:"unsubscribed"`
+}
+
+func (p *EmailPreferences) ToBackend() *proto.EmailPreferences {
+	return &proto.EmailPreferences{
+		Digest:       p.Digest,
+		Unsubscribed: p.Unsubscribed,
+	}
+}
+
+// emailPreferences returns the email preferences of the given account,
+// which are the defaults if none have been stored.
+func emailPreferences(db gorp.SqlExecutor, accountID snowflake.Snowflake) (*proto.EmailPreferences, error) {
+	var row EmailPreferences
+	err := db.SelectOne(&row,
+		"SELECT account_id, digest, unsubscribed FROM email_preferences WHERE account_id = $1", accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return row.ToBackend(), nil
+}
+
 type Account struct {
 	ID                  string         `db:"id"`
 	Name                string         `db:"name"`
@@ -561,6 +586,34 @@ func (b *AccountManagerBinding) get(
 func (b *AccountManagerBinding) GrantStaff(
 	ctx scope.Context, accountID snowflake.Snowflake, kmsCred security.KMSCredential) error {
 
+	dbCap, err := b.staffCapability(accountID, kmsCred)
+	if err != nil {
+		return err
+	}
+
+	// Store capability and update account table.
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := setStaffCapability(t, accountID, dbCap); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// staffCapability returns a new staff capability holding kmsCred, encrypted
+// for the given account.
+func (b *AccountManagerBinding) staffCapability(
+	accountID snowflake.Snowflake, kmsCred security.KMSCredential) (*Capability, error) {
+
 	// Look up the target account's (system) encrypted client key. This is
 	// not part of the transaction, because we want to interact with KMS
 	// before we proceed. That should be fine, since this is an infrequently
@@ -573,9 +626,9 @@ func (b *AccountManagerBinding) GrantStaff(
 		&row, "SELECT encrypted_system_key, nonce FROM account WHERE id = $1", accountID.String())
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return proto.ErrAccountNotFound
+			return nil, proto.ErrAccountNotFound
 		}
-		return err
+		return nil, err
 	}
 
 	// Use kmsCred to obtain kms and decrypt the client's key.
@@ -587,25 +640,19 @@ func (b *AccountManagerBinding) GrantStaff(
 		ContextValue: base64.URLEncoding.EncodeToString(row.Nonce.v),
 	}
 	if err := kms.DecryptKey(clientKey); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Grant staff capability. This involves marshalling kmsCred to JSON and
 	// encrypting it with the client key.
 	nonce, err := kms.GenerateNonce(clientKey.KeyType.BlockSize())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	capability, err := security.GrantSharedSecretCapability(clientKey, nonce, kmsCred.KMSType(), kmsCred)
 	if err != nil {
-		return err
-	}
-
-	// Store capability and update account table.
-	t, err := b.DbMap.Begin()
-	if err != nil {
-		return err
+		return nil, err
 	}
 
 	dbCap := &Capability{
@@ -614,32 +661,28 @@ func (b *AccountManagerBinding) GrantStaff(
 		EncryptedPrivateData: NewByteANonNull(capability.EncryptedPayload()),
 		PublicData:           NewByteANonNull(capability.PublicPayload()),
 	}
+	return dbCap, nil
+}
+
+// setStaffCapability stores the given staff capability and points the
+// account at it.
+func setStaffCapability(t *gorp.Transaction, accountID snowflake.Snowflake, dbCap *Capability) error {
 	if err := t.Insert(dbCap); err != nil {
-		rollback(ctx, t)
 		return err
 	}
 
 	result, err := t.Exec(
-		"UPDATE account SET staff_capability_id = $2 WHERE id = $1",
-		accountID.String(), capability.CapabilityID())
+		"UPDATE account SET staff_capability_id = $2 WHERE id = $1", accountID.String(), dbCap.ID)
 	if err != nil {
-		rollback(ctx, t)
 		return err
 	}
 	n, err := result.RowsAffected()
 	if err != nil {
-		rollback(ctx, t)
 		return err
 	}
 	if n != 1 {
-		rollback(ctx, t)
 		return proto.ErrAccountNotFound
 	}
-
-	if err := t.Commit(); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -820,6 +863,45 @@ func (b *AccountManagerBinding) ChangeName(ctx scope.Context, accountID snowflak
 	return nil
 }
 
+func (b *AccountManagerBinding) EmailPreferences(ctx scope.Context, accountID snowflake.Snowflake) (
+	*proto.EmailPreferences, error) {
+
+	if _, err := b.get(b.DbMap, accountID); err != nil {
+		return nil, err
+	}
+	return emailPreferences(b.DbMap, accountID)
+}
+
+func (b *AccountManagerBinding) ChangeEmailPreferences(
+	ctx scope.Context, accountID snowflake.Snowflake, prefs *proto.EmailPreferences) error {
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.get(t, accountID); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	row := &EmailPreferences{
+		AccountID:    accountID.String(),
+		Digest:       prefs.Digest,
+		Unsubscribed: prefs.Unsubscribed,
+	}
+	n, err := t.Update(row)
+	if err == nil && n < 1 {
+		err = t.Insert(row)
+	}
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	return t.Commit()
+}
+
 func (b *AccountManagerBinding) ChangeEmail(ctx scope.Context, accountID snowflake.Snowflake, email string) (bool, error) {
 	t, err := b.DbMap.Begin()
 	if err != nil {
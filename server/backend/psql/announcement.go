@@ -0,0 +1,70 @@
+package psql
+
+import (
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type RoomPoster struct {
+	Room      string `db:"room"`
+	AccountID string `db:"account_id"`
+}
+
+func (rb *ManagedRoomBinding) AnnouncementMode(ctx scope.Context) (*proto.AnnouncementMode, error) {
+	n, err := rb.DbMap.SelectInt(
+		"SELECT COUNT(*) FROM room WHERE name = $1 AND announcement", rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []RoomPoster
+	_, err = rb.DbMap.Select(&rows,
+		"SELECT room, account_id FROM room_poster WHERE room = $1 ORDER BY account_id", rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := &proto.AnnouncementMode{Enabled: n > 0}
+	for _, row := range rows {
+		var accountID snowflake.Snowflake
+		if err := accountID.FromString(row.AccountID); err != nil {
+			return nil, err
+		}
+		mode.Posters = append(mode.Posters, accountID)
+	}
+	return mode, nil
+}
+
+func (rb *ManagedRoomBinding) SetAnnouncementMode(
+	ctx scope.Context, session proto.Session, mode *proto.AnnouncementMode) error {
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Exec(
+		"UPDATE room SET announcement = $2 WHERE name = $1", rb.RoomName, mode.Enabled); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if _, err := t.Exec("DELETE FROM room_poster WHERE room = $1", rb.RoomName); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	for _, accountID := range mode.Posters {
+		if err := t.Insert(&RoomPoster{Room: rb.RoomName, AccountID: accountID.String()}); err != nil {
+			rollback(ctx, t)
+			return err
+		}
+	}
+
+	event := &proto.AnnouncementModeEvent{Enabled: mode.Enabled, Posters: mode.Posters}
+	if err := rb.broadcast(ctx, t, proto.AnnouncementModeEventType, event, session); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
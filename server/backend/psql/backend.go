@@ -40,11 +40,18 @@ var schema = []struct {
 	{"room_capability", RoomCapability{}, []string{"Room", "CapabilityID"}},
 	{"room_manager_capability", RoomManagerCapability{}, []string{"Room", "CapabilityID"}},
 	{"room", Room{}, []string{"Name"}},
+	{"webhook", Webhook{}, []string{"ID"}},
+	{"incoming_webhook", IncomingWebhook{}, []string{"ID"}},
+	{"room_alias", RoomAlias{}, []string{"Name"}},
+	{"room_poster", RoomPoster{}, []string{"Room", "AccountID"}},
+	{"message_key_link", MessageKeyLink{}, []string{"KeyID"}},
+	{"room_e2e_key", RoomE2EKey{}, []string{"Room", "AccountID", "KeyID"}},
 
 	// Presence.
 	{"presence", Presence{}, []string{"Room", "Topic", "ServerID", "ServerEra", "SessionID"}},
 	{"virtual_address", VirtualAddress{}, []string{"Room", "Virtual"}},
 	{"nick", Nick{}, []string{"UserID", "Room"}},
+	{"mention", Mention{}, []string{"UserID", "Room", "MessageID"}},
 
 	// Bans.
 	{"banned_agent", BannedAgent{}, []string{"AgentID", "Room"}},
@@ -53,13 +60,18 @@ var schema = []struct {
 	// Messages.
 	{"message", Message{}, []string{"Room", "ID"}},
 	{"message_edit_log", MessageEditLog{}, []string{"EditID"}},
+	{"message_reaction", MessageReaction{}, []string{"Room", "MessageID", "UserID", "Reaction"}},
 	{"pm", PM{}, []string{"ID"}},
+	{"read_marker", ReadMarker{}, []string{"Room", "AccountID"}},
+	{"room_event_log", RoomEvent{}, []string{"Room", "ID"}},
 
 	// Sessions.
 	{"session_log", SessionLog{}, []string{"SessionID"}},
 
 	// Emails.
 	{"email", Email{}, []string{"ID"}},
+	{"email_preferences", EmailPreferences{}, []string{"AccountID"}},
+	{"digest_state", DigestState{}, []string{"AccountID"}},
 
 	// Keys and capabilities.
 	{"master_key", MessageKey{}, []string{"ID"}},
@@ -67,10 +79,12 @@ var schema = []struct {
 
 	// Accounts.
 	{"agent", Agent{}, []string{"ID"}},
+	{"bot_token", BotToken{}, []string{"ID"}},
 	{"otp", OTP{}, []string{"AccountID"}},
 	{"password_reset_request", PasswordResetRequest{}, []string{"ID"}},
 	{"personal_identity", PersonalIdentity{}, []string{"Namespace", "ID"}},
 	{"account", Account{}, []string{"ID"}},
+	{"account_e2e_key", AccountE2EKey{}, []string{"AccountID"}},
 
 	// Jobs.
 	{"job_log", JobLog{}, []string{"JobID", "Attempt"}},
@@ -224,6 +238,9 @@ func (b *Backend) background(wg *sync.WaitGroup) {
 	keepalive := time.NewTicker(3 * cluster.TTL / 4)
 	defer keepalive.Stop()
 
+	grantCleanup := time.NewTicker(PasscodeGrantCleanupInterval)
+	defer grantCleanup.Stop()
+
 	// Signal to constructor that we're ready to handle client connections.
 	wg.Done()
 
@@ -245,6 +262,23 @@ func (b *Backend) background(wg *sync.WaitGroup) {
 			}
 			// Update metrics
 			connCount.Set(float64(b.Stats().OpenConnections))
+			// Expire events that can no longer be replayed.
+			_, err := b.DbMap.Exec(
+				"DELETE FROM room_event_log WHERE created < $1", time.Now().Add(-proto.EventLogTTL))
+			if err != nil {
+				logger.Printf("event log expiry error: %s", err)
+			}
+		case <-grantCleanup.C:
+			b.localJobs.PushNew("remove spent passcode grants", func() error {
+				n, err := b.RemoveSpentPasscodeGrants(ctx, time.Now())
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					logger.Printf("removed %d expired or used up passcode grants", n)
+				}
+				return nil
+			})
 		case event := <-peerWatcher:
 			b.Lock()
 			switch e := event.(type) {
@@ -340,7 +374,16 @@ func (b *Backend) GetRoom(ctx scope.Context, name string) (proto.ManagedRoom, er
 		return nil, err
 	}
 	if obj == nil {
-		return nil, proto.ErrRoomNotFound
+		roomName, err := resolveRoomAlias(b.DbMap, name)
+		if err != nil {
+			return nil, err
+		}
+		if obj, err = b.DbMap.Get(Room{}, roomName); err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			return nil, proto.ErrRoomNotFound
+		}
 	}
 	return obj.(*Room).Bind(b), nil
 }
@@ -349,6 +392,13 @@ func (b *Backend) CreateRoom(
 	ctx scope.Context, kms security.KMS, private bool, name string, managers ...proto.Account) (
 	proto.ManagedRoom, error) {
 
+	if _, err := resolveRoomAlias(b.DbMap, name); err != proto.ErrRoomNotFound {
+		if err == nil {
+			err = proto.ErrRoomNameInUse
+		}
+		return nil, err
+	}
+
 	sec, err := proto.NewRoomSecurity(kms, name)
 	if err != nil {
 		return nil, err
@@ -713,6 +763,9 @@ func (b *Backend) join(ctx scope.Context, rb *RoomBinding, session proto.Session
 		UserAgent: client.UserAgent,
 		Connected: client.Connected,
 	}
+	if client.BotToken != nil {
+		entry.BotTokenID = sql.NullString{String: client.BotToken.ID, Valid: true}
+	}
 	if _, err := t.Delete(entry); err != nil {
 		rollback(ctx, t)
 		return "", err
@@ -898,6 +951,178 @@ func (b *Backend) latest(ctx scope.Context, rb *RoomBinding, n int, before snowf
 		results[len(msgs)-i-1] = msg.ToTransmission()
 	}
 
+	if err := loadReactions(b.DbMap, rb.RoomName, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (b *Backend) earliest(ctx scope.Context, rb *RoomBinding, n int, after snowflake.Snowflake) (
+	[]proto.Message, error) {
+
+	if n <= 0 {
+		return nil, nil
+	}
+	// TODO: define constant
+	if n > 1000 {
+		n = 1000
+	}
+
+	args := []interface{}{rb.RoomName, n, after.String()}
+
+	// Get the time before which messages will be expired
+	nDays, err := b.DbMap.SelectInt("SELECT retention_days FROM room WHERE name = $1", rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := allColumns(b.DbMap, Message{}, "")
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(
+		"SELECT %s FROM message WHERE room = $1 AND id > $3 AND deleted IS NULL ORDER BY id ASC LIMIT $2", cols)
+	if nDays != 0 {
+		threshold := time.Now().Add(time.Duration(-nDays) * 24 * time.Hour)
+		query = fmt.Sprintf(
+			"SELECT %s FROM message WHERE room = $1 AND id > $3 AND deleted IS NULL AND posted > $4 ORDER BY id ASC LIMIT $2",
+			cols)
+		args = append(args, threshold)
+	}
+
+	msgs, err := b.DbMap.Select(Message{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]proto.Message, len(msgs))
+	for i, row := range msgs {
+		msg := row.(*Message)
+		results[i] = msg.ToTransmission()
+	}
+
+	if err := loadReactions(b.DbMap, rb.RoomName, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (b *Backend) thread(ctx scope.Context, rb *RoomBinding, n int, root snowflake.Snowflake) (
+	[]proto.Message, error) {
+
+	if n <= 0 {
+		return nil, nil
+	}
+	if n > 1000 {
+		n = 1000
+	}
+
+	args := []interface{}{rb.RoomName, n, root.String()}
+
+	// Get the time before which messages will be expired
+	nDays, err := b.DbMap.SelectInt("SELECT retention_days FROM room WHERE name = $1", rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := allColumns(b.DbMap, Message{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted messages are walked through, so that replies to them are still
+	// part of the thread.
+	query := "WITH RECURSIVE thread(id) AS (" +
+		" SELECT id FROM message WHERE room = $1 AND id = $3" +
+		" UNION SELECT m.id FROM message m, thread t WHERE m.room = $1 AND m.parent = t.id)" +
+		" SELECT %s FROM message WHERE room = $1 AND id IN (SELECT id FROM thread) AND deleted IS NULL"
+	if nDays != 0 {
+		threshold := time.Now().Add(time.Duration(-nDays) * 24 * time.Hour)
+		query += " AND posted > $4"
+		args = append(args, threshold)
+	}
+	query = fmt.Sprintf(query+" ORDER BY id ASC LIMIT $2", cols)
+
+	msgs, err := b.DbMap.Select(Message{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]proto.Message, len(msgs))
+	for i, row := range msgs {
+		msg := row.(*Message)
+		results[i] = msg.ToTransmission()
+	}
+
+	if err := loadReactions(b.DbMap, rb.RoomName, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (b *Backend) search(ctx scope.Context, rb *RoomBinding, cmd *proto.SearchCommand) (
+	[]proto.Message, error) {
+
+	n := cmd.N
+	if n <= 0 {
+		return nil, nil
+	}
+	if n > 1000 {
+		n = 1000
+	}
+
+	nDays, err := b.DbMap.SelectInt("SELECT retention_days FROM room WHERE name = $1", rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := allColumns(b.DbMap, Message{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Matches the expression indexed by message_content_search.
+	conds := []string{
+		"room = $1",
+		"deleted IS NULL",
+		"encryption_key_id IS NULL",
+		"to_tsvector('simple', content) @@ plainto_tsquery('simple', $2)",
+	}
+	args := []interface{}{rb.RoomName, cmd.Query}
+	addCond := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if cmd.Sender != "" {
+		addCond("sender_id = $%d", string(cmd.Sender))
+	}
+	if since := time.Time(cmd.Since); !since.IsZero() {
+		addCond("posted >= $%d", since)
+	}
+	if until := time.Time(cmd.Until); !until.IsZero() {
+		addCond("posted < $%d", until)
+	}
+	if !cmd.Before.IsZero() {
+		addCond("id < $%d", cmd.Before.String())
+	}
+	if nDays != 0 {
+		addCond("posted > $%d", time.Now().Add(time.Duration(-nDays)*24*time.Hour))
+	}
+	args = append(args, n)
+	query := fmt.Sprintf("SELECT %s FROM message WHERE %s ORDER BY id DESC LIMIT $%d",
+		cols, strings.Join(conds, " AND "), len(args))
+
+	msgs, err := b.DbMap.Select(Message{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]proto.Message, len(msgs))
+	for i, row := range msgs {
+		msg := row.(*Message)
+		results[len(msgs)-i-1] = msg.ToTransmission()
+	}
+
+	if err := loadReactions(b.DbMap, rb.RoomName, results); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
@@ -922,12 +1147,15 @@ func (b *Backend) invalidatePeer(ctx scope.Context, id, era string) {
 
 func (b *Backend) Peers() []cluster.PeerDesc { return b.cluster.Peers() }
 
-func (b *Backend) AccountManager() proto.AccountManager { return &AccountManagerBinding{b} }
-func (b *Backend) AgentTracker() proto.AgentTracker     { return &AgentTrackerBinding{b} }
-func (b *Backend) EmailTracker() proto.EmailTracker     { return &EmailTracker{b} }
-func (b *Backend) Jobs() jobs.JobService                { return &JobService{b} }
-func (b *Backend) LocalJobs() jobs.LocalJobService      { return b.localJobs }
-func (b *Backend) PMTracker() proto.PMTracker           { return &PMTracker{b} }
+func (b *Backend) AccountManager() proto.AccountManager   { return &AccountManagerBinding{b} }
+func (b *Backend) AgentTracker() proto.AgentTracker       { return &AgentTrackerBinding{b} }
+func (b *Backend) BotTokenTracker() proto.BotTokenTracker { return &BotTokenTracker{b} }
+func (b *Backend) DigestTracker() proto.DigestTracker     { return &DigestTracker{b} }
+func (b *Backend) EmailTracker() proto.EmailTracker       { return &EmailTracker{b} }
+func (b *Backend) Jobs() jobs.JobService                  { return &JobService{b} }
+func (b *Backend) LocalJobs() jobs.LocalJobService        { return b.localJobs }
+func (b *Backend) MentionTracker() proto.MentionTracker   { return &MentionTracker{b} }
+func (b *Backend) PMTracker() proto.PMTracker             { return &PMTracker{b} }
 
 func (b *Backend) jobQueueListener() *jobQueueListener {
 	b.Lock()
@@ -0,0 +1,106 @@
+package psql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type BotToken struct {
+	ID        string        `db:"id"`
+	AccountID string        `db:"account_id"`
+	Name      string        `db:"name"`
+	Rooms     string        `db:"rooms"`
+	Created   time.Time     `db:"created"`
+	LastUsed  gorp.NullTime `db:"last_used"`
+	Revoked   gorp.NullTime `db:"revoked"`
+}
+
+func (t *BotToken) ToBackend() *proto.BotToken {
+	token := &proto.BotToken{
+		ID:      t.ID,
+		Name:    t.Name,
+		Rooms:   strings.Fields(t.Rooms),
+		Created: proto.Time(t.Created),
+	}
+	if t.LastUsed.Valid {
+		token.LastUsed = proto.Time(t.LastUsed.Time)
+	}
+	return token
+}
+
+type BotTokenTracker struct {
+	*Backend
+}
+
+func (t *BotTokenTracker) Issue(ctx scope.Context, accountID snowflake.Snowflake, token *proto.BotToken) error {
+	row := &BotToken{
+		ID:        token.ID,
+		AccountID: accountID.String(),
+		Name:      token.Name,
+		Rooms:     strings.Join(token.Rooms, " "),
+		Created:   token.Created.StdTime(),
+	}
+	return t.DbMap.Insert(row)
+}
+
+func (t *BotTokenTracker) Get(ctx scope.Context, tokenID string) (*proto.BotToken, error) {
+	var row BotToken
+	err := t.DbMap.SelectOne(&row,
+		"SELECT id, account_id, name, rooms, created, last_used, revoked FROM bot_token"+
+			" WHERE id = $1 AND revoked IS NULL",
+		tokenID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrBotTokenNotFound
+		}
+		return nil, err
+	}
+	return row.ToBackend(), nil
+}
+
+func (t *BotTokenTracker) List(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.BotToken, error) {
+	rows, err := t.DbMap.Select(BotToken{},
+		"SELECT id, account_id, name, rooms, created, last_used, revoked FROM bot_token"+
+			" WHERE account_id = $1 AND revoked IS NULL ORDER BY created, id",
+		accountID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*proto.BotToken, len(rows))
+	for i, row := range rows {
+		tokens[i] = row.(*BotToken).ToBackend()
+	}
+	return tokens, nil
+}
+
+func (t *BotTokenTracker) Revoke(ctx scope.Context, accountID snowflake.Snowflake, tokenID string) error {
+	res, err := t.DbMap.Exec(
+		"UPDATE bot_token SET revoked = NOW() WHERE id = $1 AND account_id = $2 AND revoked IS NULL",
+		tokenID, accountID.String())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrBotTokenNotFound
+	}
+	return nil
+}
+
+func (t *BotTokenTracker) Used(ctx scope.Context, tokenID string, at time.Time) error {
+	_, err := t.DbMap.Exec(
+		"UPDATE bot_token SET last_used = $2 WHERE id = $1 AND (last_used IS NULL OR last_used < $2)",
+		tokenID, at)
+	return err
+}
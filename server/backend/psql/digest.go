@@ -0,0 +1,155 @@
+package psql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type DigestState struct {
+	AccountID string        `db:"account_id"`
+	LastSeen  time.Time     `db:"last_seen"`
+	LastSent  gorp.NullTime `db:"last_sent"`
+}
+
+// digestPM is a PM with activity since an account was last seen, along with
+// the account's read marker in it.
+type digestPM struct {
+	ID       string `db:"id"`
+	WithNick string `db:"with_nick"`
+	Marker   string `db:"marker"`
+}
+
+type DigestTracker struct {
+	*Backend
+}
+
+func (t *DigestTracker) Seen(ctx scope.Context, accountID snowflake.Snowflake, at time.Time) error {
+	res, err := t.DbMap.Exec(
+		"UPDATE digest_state SET last_seen = GREATEST(last_seen, $2) WHERE account_id = $1",
+		accountID.String(), at)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	row := &DigestState{
+		AccountID: accountID.String(),
+		LastSeen:  at,
+	}
+	if err := t.DbMap.Insert(row); err != nil {
+		if isUniqueViolation(err) {
+			// Lost a race with another session; the other one recorded a
+			// recent enough time.
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *DigestTracker) Claim(
+	ctx scope.Context, cutoff, at time.Time, n int) ([]snowflake.Snowflake, error) {
+
+	// Rows locked by a concurrent claim are skipped rather than waited on,
+	// and the update rechecks that the digest hasn't been sent since.
+	var rows []struct {
+		AccountID string `db:"account_id"`
+	}
+	_, err := t.DbMap.Select(&rows,
+		"UPDATE digest_state SET last_sent = $2 WHERE account_id IN ("+
+			"SELECT d.account_id FROM digest_state d"+
+			" JOIN email_preferences p ON p.account_id = d.account_id"+
+			" WHERE p.digest AND NOT p.unsubscribed AND d.last_seen < $1 AND (d.last_sent IS NULL OR d.last_sent < d.last_seen)"+
+			" ORDER BY d.account_id LIMIT $3 FOR UPDATE OF d SKIP LOCKED)"+
+			" AND (last_sent IS NULL OR last_sent < last_seen)"+
+			" RETURNING account_id",
+		cutoff, at, n)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := make([]snowflake.Snowflake, 0, len(rows))
+	for _, row := range rows {
+		var accountID snowflake.Snowflake
+		if err := accountID.FromString(row.AccountID); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, accountID)
+	}
+	return claimed, nil
+}
+
+func (t *DigestTracker) Collect(ctx scope.Context, accountID snowflake.Snowflake) (*proto.Digest, error) {
+	var state DigestState
+	err := t.DbMap.SelectOne(&state,
+		"SELECT account_id, last_seen, last_sent FROM digest_state WHERE account_id = $1", accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	digest := &proto.Digest{
+		AccountID: accountID,
+		Since:     state.LastSeen,
+		Mentions:  []proto.Mention{},
+		PMs:       []proto.DigestPM{},
+	}
+
+	userID := fmt.Sprintf("account:%s", accountID)
+	rows, err := t.DbMap.Select(Mention{},
+		"SELECT user_id, room, message_id, sender_id, sender_name, posted FROM mention"+
+			" WHERE user_id = $1 AND posted > $2 ORDER BY message_id DESC LIMIT $3",
+		userID, state.LastSeen, proto.MaxDigestMentions)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(rows) - 1; i >= 0; i-- {
+		digest.Mentions = append(digest.Mentions, rows[i].(*Mention).ToBackend())
+	}
+
+	rows, err = t.DbMap.Select(digestPM{},
+		"SELECT pm.id,"+
+			" CASE WHEN pm.initiator = $1 THEN pm.receiver_nick ELSE pm.initiator_nick END AS with_nick,"+
+			" COALESCE(r.message_id, '') AS marker"+
+			" FROM pm LEFT JOIN read_marker r ON r.room = 'pm:' || pm.id AND r.account_id = $1"+
+			" WHERE (pm.initiator = $1 OR pm.receiver = $2)"+
+			" AND EXISTS (SELECT 1 FROM message m WHERE m.room = 'pm:' || pm.id AND m.posted > $3 AND m.deleted IS NULL)"+
+			" ORDER BY pm.id",
+		accountID.String(), userID, state.LastSeen)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		pm := row.(*digestPM)
+		var pmID, marker snowflake.Snowflake
+		if err := pmID.FromString(pm.ID); err != nil {
+			return nil, err
+		}
+		if pm.Marker != "" {
+			if err := marker.FromString(pm.Marker); err != nil {
+				return nil, err
+			}
+		}
+		unread, err := countUnread(t.DbMap, "pm:"+pm.ID, marker)
+		if err != nil {
+			return nil, err
+		}
+		if unread > 0 {
+			digest.PMs = append(digest.PMs, proto.DigestPM{PMID: pmID, WithNick: pm.WithNick, Unread: unread})
+		}
+	}
+
+	return digest, nil
+}
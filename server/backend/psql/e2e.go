@@ -0,0 +1,138 @@
+package psql
+
+import (
+	"database/sql"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type AccountE2EKey struct {
+	AccountID string       `db:"account_id"`
+	PublicKey ByteANonNull `db:"public_key"`
+}
+
+type RoomE2EKey struct {
+	Room            string       `db:"room"`
+	AccountID       string       `db:"account_id"`
+	KeyID           string       `db:"key_id"`
+	SenderPublicKey ByteANonNull `db:"sender_public_key"`
+	Nonce           ByteANonNull `db:"nonce"`
+	SealedKey       ByteANonNull `db:"sealed_key"`
+}
+
+func (b *AccountManagerBinding) SetE2EPublicKey(
+	ctx scope.Context, accountID snowflake.Snowflake, publicKey []byte) error {
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.get(t, accountID); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	_, err = t.Exec(
+		"INSERT INTO account_e2e_key (account_id, public_key) VALUES ($1, $2)"+
+			" ON CONFLICT (account_id) DO UPDATE SET public_key = EXCLUDED.public_key",
+		accountID.String(), NewByteANonNull(publicKey))
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	return t.Commit()
+}
+
+func (b *AccountManagerBinding) E2EPublicKey(ctx scope.Context, accountID snowflake.Snowflake) ([]byte, error) {
+	if _, err := b.get(b.DbMap, accountID); err != nil {
+		return nil, err
+	}
+
+	var row AccountE2EKey
+	err := b.DbMap.SelectOne(
+		&row, "SELECT account_id, public_key FROM account_e2e_key WHERE account_id = $1", accountID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return row.PublicKey.v, nil
+}
+
+func (rb *ManagedRoomBinding) E2E(ctx scope.Context) (bool, error) {
+	n, err := rb.DbMap.SelectInt("SELECT COUNT(*) FROM room WHERE name = $1 AND e2e", rb.RoomName)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (rb *ManagedRoomBinding) EnableE2E(ctx scope.Context) error {
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := t.Exec("UPDATE room SET e2e = true WHERE name = $1 AND NOT e2e", rb.RoomName)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n < 1 {
+		rollback(ctx, t)
+		return nil
+	}
+
+	event := &proto.DisconnectEvent{Reason: "room is now end-to-end encrypted"}
+	if err := rb.broadcast(ctx, t, proto.DisconnectEventType, event); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
+
+func (rb *ManagedRoomBinding) ShareE2EKey(ctx scope.Context, key *proto.E2EKey) error {
+	_, err := rb.DbMap.Exec(
+		"INSERT INTO room_e2e_key (room, account_id, key_id, sender_public_key, nonce, sealed_key)"+
+			" VALUES ($1, $2, $3, $4, $5, $6)"+
+			" ON CONFLICT (room, account_id, key_id) DO UPDATE SET"+
+			" sender_public_key = EXCLUDED.sender_public_key, nonce = EXCLUDED.nonce, sealed_key = EXCLUDED.sealed_key",
+		rb.RoomName, key.AccountID.String(), key.KeyID,
+		NewByteANonNull(key.SenderPublicKey), NewByteANonNull(key.Nonce), NewByteANonNull(key.SealedKey))
+	return err
+}
+
+func (rb *ManagedRoomBinding) E2EKeys(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.E2EKey, error) {
+	var rows []RoomE2EKey
+	_, err := rb.DbMap.Select(
+		&rows,
+		"SELECT room, account_id, key_id, sender_public_key, nonce, sealed_key FROM room_e2e_key"+
+			" WHERE room = $1 AND account_id = $2 ORDER BY key_id",
+		rb.RoomName, accountID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*proto.E2EKey, len(rows))
+	for i, row := range rows {
+		keys[i] = &proto.E2EKey{
+			AccountID:       accountID,
+			KeyID:           row.KeyID,
+			SenderPublicKey: row.SenderPublicKey.v,
+			Nonce:           row.Nonce.v,
+			SealedKey:       row.SealedKey.v,
+		}
+	}
+	return keys, nil
+}
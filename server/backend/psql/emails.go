@@ -87,6 +87,14 @@ func (et *EmailTracker) Send(
 	account proto.Account, to, templateName string, data interface{}) (
 	*emails.EmailRef, error) {
 
+	prefs, err := emailPreferences(et.Backend.DbMap, account.ID())
+	if err != nil {
+		return nil, err
+	}
+	if !prefs.Allows(templateName) {
+		return nil, nil
+	}
+
 	if to == "" {
 		to, _ = account.Email()
 	}
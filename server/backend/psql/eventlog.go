@@ -0,0 +1,86 @@
+package psql
+
+import (
+	"encoding/json"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type RoomEvent struct {
+	Room    string    `db:"room"`
+	ID      string    `db:"id"`
+	Type    string    `db:"type"`
+	Data    string    `db:"data"`
+	Exclude string    `db:"exclude"`
+	Created time.Time `db:"created"`
+}
+
+func (e *RoomEvent) ToBackend() (proto.LoggedEvent, error) {
+	var event proto.LoggedEvent
+	if err := event.Cursor.FromString(e.ID); err != nil {
+		return event, err
+	}
+	packet := &proto.Packet{Type: proto.PacketType(e.Type), Data: json.RawMessage(e.Data)}
+	payload, err := packet.Payload()
+	if err != nil {
+		return event, err
+	}
+	event.Type = packet.Type
+	event.Payload = payload
+	if err := json.Unmarshal([]byte(e.Exclude), &event.Exclude); err != nil {
+		return event, err
+	}
+	return event, nil
+}
+
+// logEvent records a broadcast in the room's event log, assigning the packet
+// its cursor.
+func (rb *RoomBinding) logEvent(db gorp.SqlExecutor, packet *proto.Packet, exclude []string) error {
+	cursor, err := snowflake.New()
+	if err != nil {
+		return err
+	}
+	encodedExclude, err := json.Marshal(exclude)
+	if err != nil {
+		return err
+	}
+	event := &RoomEvent{
+		Room:    rb.RoomName,
+		ID:      cursor.String(),
+		Type:    string(packet.Type),
+		Data:    string(packet.Data),
+		Exclude: string(encodedExclude),
+		Created: time.Now(),
+	}
+	if err := db.Insert(event); err != nil {
+		return err
+	}
+	packet.Cursor = cursor
+	return nil
+}
+
+func (rb *RoomBinding) EventsSince(ctx scope.Context, cursor snowflake.Snowflake) ([]proto.LoggedEvent, error) {
+	rows, err := rb.DbMap.Select(
+		RoomEvent{},
+		"SELECT room, id, type, data, exclude, created FROM room_event_log"+
+			" WHERE room = $1 AND id > $2 AND created > $3 ORDER BY id",
+		rb.RoomName, cursor.String(), time.Now().Add(-proto.EventLogTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]proto.LoggedEvent, 0, len(rows))
+	for _, row := range rows {
+		event, err := row.(*RoomEvent).ToBackend()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
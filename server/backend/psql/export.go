@@ -0,0 +1,72 @@
+package psql
+
+import (
+	"fmt"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+)
+
+// ExportBatchSize is the number of messages fetched at a time by ExportRoom.
+const ExportBatchSize = 1000
+
+// ExportRoom passes every message in the room to fn, oldest first, fetching
+// them in batches so that the log never has to fit in memory. Messages posted
+// before since or at or after until are skipped, unless those times are zero.
+// Deleted messages are always skipped. Content is never truncated.
+func (b *Backend) ExportRoom(
+	ctx scope.Context, roomName string, since, until time.Time, fn func(*proto.Message) error) error {
+
+	if _, err := b.GetRoom(ctx, roomName); err != nil {
+		return err
+	}
+
+	cols, err := allColumns(b.DbMap, Message{}, "")
+	if err != nil {
+		return err
+	}
+
+	where := "room = $1 AND id > $2 AND deleted IS NULL"
+	args := []interface{}{roomName, ""}
+	if !since.IsZero() {
+		args = append(args, since)
+		where += fmt.Sprintf(" AND posted >= $%d", len(args))
+	}
+	if !until.IsZero() {
+		args = append(args, until)
+		where += fmt.Sprintf(" AND posted < $%d", len(args))
+	}
+	query := fmt.Sprintf("SELECT %s FROM message WHERE %s ORDER BY id ASC LIMIT %d", cols, where, ExportBatchSize)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rows, err := b.DbMap.Select(Message{}, query, args...)
+		if err != nil {
+			return err
+		}
+
+		msgs := make([]proto.Message, len(rows))
+		for i, row := range rows {
+			msgs[i] = row.(*Message).ToBackend()
+		}
+		if err := loadReactions(b.DbMap, roomName, msgs); err != nil {
+			return err
+		}
+
+		for i := range msgs {
+			if err := fn(&msgs[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(rows) < ExportBatchSize {
+			return nil
+		}
+		args[1] = rows[len(rows)-1].(*Message).ID
+	}
+}
@@ -0,0 +1,122 @@
+package psql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+)
+
+// ImportRoom inserts messages into the room's log without broadcasting them.
+// The next function is called for each message in turn, and returns io.EOF
+// when there are no more. Messages keep their ids, parents, senders, and
+// times.
+//
+// Everything is imported in a single transaction. If a message's id is
+// already in the room's log, nothing is imported and an error is returned.
+// Messages imported into a private room must already be encrypted. End-to-end
+// encrypted rooms and messages can't be imported, since the server can't
+// check that their content matches their room's keys.
+func (b *Backend) ImportRoom(ctx scope.Context, roomName string, next func() (*proto.Message, error)) (int, error) {
+	room, err := b.GetRoom(ctx, roomName)
+	if err != nil {
+		return 0, err
+	}
+	_, isPrivate, err := room.MessageKeyID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := t.Exec("SELECT 1 FROM room WHERE name = $1 FOR UPDATE", roomName); err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+	e2e, err := t.SelectInt("SELECT COUNT(*) FROM room WHERE name = $1 AND e2e", roomName)
+	if err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+	if e2e > 0 {
+		rollback(ctx, t)
+		return 0, fmt.Errorf("%s is end-to-end encrypted", roomName)
+	}
+
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+
+		msg, err := next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			rollback(ctx, t)
+			return 0, err
+		}
+
+		if msg.ID == 0 {
+			rollback(ctx, t)
+			return 0, fmt.Errorf("message %d has no id", count+1)
+		}
+		if proto.IsE2EEncrypted(msg.EncryptionKeyID) {
+			rollback(ctx, t)
+			return 0, fmt.Errorf("message %s is end-to-end encrypted", msg.ID)
+		}
+		if isPrivate && msg.EncryptionKeyID == "" {
+			rollback(ctx, t)
+			return 0, fmt.Errorf("message %s must be encrypted to import into private room %s", msg.ID, roomName)
+		}
+		exists, err := t.SelectInt(
+			"SELECT COUNT(*) FROM message WHERE room = $1 AND id = $2", roomName, msg.ID.String())
+		if err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+		if exists > 0 {
+			rollback(ctx, t)
+			return 0, fmt.Errorf("message %s already exists in %s", msg.ID, roomName)
+		}
+
+		stored, err := NewMessage(roomName, msg.Sender, msg.ID, msg.Parent, msg.EncryptionKeyID, msg.Content)
+		if err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+		// Message times are only transmitted to the second, so keep the more
+		// precise time from the id unless they disagree.
+		if posted := time.Time(msg.UnixTime); !posted.IsZero() && posted.Unix() != stored.Posted.Unix() {
+			stored.Posted = posted
+		}
+		if edited := time.Time(msg.Edited); !edited.IsZero() {
+			stored.Edited = gorp.NullTime{Time: edited, Valid: true}
+		}
+		if deleted := time.Time(msg.Deleted); !deleted.IsZero() {
+			stored.Deleted = gorp.NullTime{Time: deleted, Valid: true}
+		}
+		stored.PreviousEditID = sql.NullString{}
+
+		if err := t.Insert(stored); err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+		count++
+	}
+
+	if err := t.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
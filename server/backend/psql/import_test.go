@@ -0,0 +1,109 @@
+package psql
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func importMessages(msgs ...*proto.Message) func() (*proto.Message, error) {
+	return func() (*proto.Message, error) {
+		if len(msgs) == 0 {
+			return nil, io.EOF
+		}
+		msg := msgs[0]
+		msgs = msgs[1:]
+		return msg, nil
+	}
+}
+
+func testImportRoom(t *testing.T, b *Backend) {
+	ctx := scope.New()
+	kms := security.LocalKMS()
+	kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+
+	sender := proto.SessionView{
+		IdentityView: proto.IdentityView{ID: "agent:importer", Name: "importer"},
+		SessionID:    "importer",
+	}
+	posted := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	var counter uint64
+	newMessage := func(parent snowflake.Snowflake, content string) *proto.Message {
+		id := snowflake.NewFromTime(posted, &counter)
+		return &proto.Message{
+			ID:       id,
+			Parent:   parent,
+			UnixTime: proto.Time(posted),
+			Sender:   sender,
+			Content:  content,
+		}
+	}
+
+	Convey("Messages keep their ids and parents", t, func() {
+		room, err := b.CreateRoom(ctx, kms, false, "importpublic")
+		So(err, ShouldBeNil)
+
+		root := newMessage(0, "root")
+		reply := newMessage(root.ID, "reply")
+		count, err := b.ImportRoom(ctx, "importpublic", importMessages(root, reply))
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 2)
+
+		msg, err := room.GetMessage(ctx, reply.ID)
+		So(err, ShouldBeNil)
+		So(msg.ID, ShouldEqual, reply.ID)
+		So(msg.Parent, ShouldEqual, root.ID)
+		So(msg.Content, ShouldEqual, "reply")
+		So(msg.Sender.ID, ShouldEqual, sender.ID)
+		So(time.Time(msg.UnixTime).Unix(), ShouldEqual, posted.Unix())
+
+		Convey("Duplicate ids import nothing", func() {
+			again := newMessage(0, "again")
+			dup := *root
+			_, err := b.ImportRoom(ctx, "importpublic", importMessages(again, &dup))
+			So(err, ShouldNotBeNil)
+			_, err = room.GetMessage(ctx, again.ID)
+			So(err, ShouldEqual, proto.ErrMessageNotFound)
+		})
+	})
+
+	Convey("Private rooms only take encrypted messages", t, func() {
+		room, err := b.CreateRoom(ctx, kms, true, "importprivate")
+		So(err, ShouldBeNil)
+
+		plain := newMessage(0, "secret")
+		_, err = b.ImportRoom(ctx, "importprivate", importMessages(plain))
+		So(err, ShouldNotBeNil)
+		_, err = room.GetMessage(ctx, plain.ID)
+		So(err, ShouldEqual, proto.ErrMessageNotFound)
+
+		keyID, _, err := room.MessageKeyID(ctx)
+		So(err, ShouldBeNil)
+		mkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		key := mkey.ManagedKey()
+		So(kms.DecryptKey(&key), ShouldBeNil)
+
+		encrypted := newMessage(0, "secret")
+		So(proto.EncryptMessage(encrypted, keyID, &key), ShouldBeNil)
+		count, err := b.ImportRoom(ctx, "importprivate", importMessages(encrypted))
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+
+		msg, err := room.GetMessage(ctx, encrypted.ID)
+		So(err, ShouldBeNil)
+		So(msg.Content, ShouldNotEqual, "secret")
+		decrypted, err := proto.DecryptMessage(
+			*msg, map[string]*security.ManagedKey{keyID: &key}, proto.General)
+		So(err, ShouldBeNil)
+		So(decrypted.Content, ShouldEqual, "secret")
+	})
+}
@@ -95,6 +95,10 @@ func TestBackend(t *testing.T) {
 
 	// Run test suite.
 	backend.IntegrationTest(t, factory)
+
+	// Run tests of psql-only features against the same backend.
+	testImportRoom(t, b)
+	testRemoveSpentPasscodeGrants(t, b)
 }
 
 type nonClosingBackend struct {
@@ -0,0 +1,162 @@
+package psql
+
+import (
+	"encoding/base64"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+// kmsWrappedColumn describes a column holding keys encrypted by the KMS.
+// Its query selects each key's row id, the value of its encryption context,
+// and its ciphertext.
+type kmsWrappedColumn struct {
+	keyType    security.KeyType
+	contextKey string
+	query      string
+	update     string
+
+	// encodeContext is set when the context is stored as raw bytes that
+	// must be base64-encoded to recover the context value.
+	encodeContext bool
+}
+
+var kmsWrappedColumns = []kmsWrappedColumn{
+	{
+		keyType:    proto.RoomManagerKeyType,
+		contextKey: "room",
+		query:      "SELECT name AS id, name AS context, encrypted_management_key AS ciphertext FROM room",
+		update:     "UPDATE room SET encrypted_management_key = $2 WHERE name = $1",
+	},
+	{
+		keyType:    proto.RoomMessageKeyType,
+		contextKey: "room",
+		query: "SELECT mk.id, r.room AS context, mk.encrypted_key AS ciphertext" +
+			" FROM master_key mk, room_master_key r WHERE mk.id = r.key_id",
+		update: "UPDATE master_key SET encrypted_key = $2 WHERE id = $1",
+	},
+	{
+		keyType:       proto.ClientKeyType,
+		contextKey:    "nonce",
+		query:         "SELECT id, nonce AS context, encrypted_system_key AS ciphertext FROM account",
+		update:        "UPDATE account SET encrypted_system_key = $2 WHERE id = $1",
+		encodeContext: true,
+	},
+	{
+		keyType:    proto.RoomMessageKeyType,
+		contextKey: "pm",
+		query:      "SELECT id, id AS context, encrypted_system_key AS ciphertext FROM pm",
+		update:     "UPDATE pm SET encrypted_system_key = $2 WHERE id = $1",
+	},
+	{
+		keyType:    OTPKeyType,
+		contextKey: "account",
+		query:      "SELECT account_id AS id, account_id AS context, encrypted_key AS ciphertext FROM otp",
+		update:     "UPDATE otp SET encrypted_key = $2 WHERE account_id = $1",
+	},
+}
+
+// RewrapKeys passes every KMS-encrypted key stored in the database through
+// kms.RewrapKey, saving those that change. All keys are rewritten in a single
+// transaction. It returns the number of keys rewrapped.
+func (b *Backend) RewrapKeys(ctx scope.Context, kms security.KeyRewrapper) (int, error) {
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, col := range kmsWrappedColumns {
+		var rows []struct {
+			ID         string       `db:"id"`
+			Context    []byte       `db:"context"`
+			Ciphertext ByteANonNull `db:"ciphertext"`
+		}
+		if _, err := t.Select(&rows, col.query); err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+
+		for _, row := range rows {
+			ctxVal := string(row.Context)
+			if col.encodeContext {
+				ctxVal = base64.URLEncoding.EncodeToString(row.Context)
+			}
+			mkey := &security.ManagedKey{
+				KeyType:      col.keyType,
+				Ciphertext:   row.Ciphertext.v,
+				ContextKey:   col.contextKey,
+				ContextValue: ctxVal,
+			}
+			rewrapped, err := kms.RewrapKey(mkey)
+			if err != nil {
+				rollback(ctx, t)
+				return 0, err
+			}
+			if !rewrapped {
+				continue
+			}
+			if _, err := t.Exec(col.update, row.ID, mkey.Ciphertext); err != nil {
+				rollback(ctx, t)
+				return 0, err
+			}
+			count++
+		}
+	}
+
+	if err := t.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RegrantStaff replaces the staff capability of every staff account with one
+// holding kmsCred. Staff capabilities carry a copy of the KMS credential, so
+// they must be regranted when the credential changes.
+func (b *Backend) RegrantStaff(ctx scope.Context, kmsCred security.KMSCredential) (int, error) {
+	var rows []struct {
+		ID                string `db:"id"`
+		StaffCapabilityID string `db:"staff_capability_id"`
+	}
+	_, err := b.DbMap.Select(
+		&rows,
+		"SELECT a.id, a.staff_capability_id FROM account a, capability c"+
+			" WHERE c.id = a.staff_capability_id")
+	if err != nil {
+		return 0, err
+	}
+
+	// Each account's old capability is replaced in its own transaction, so a
+	// failure can't leave an account without one.
+	am := &AccountManagerBinding{b}
+	for _, row := range rows {
+		var accountID snowflake.Snowflake
+		if err := accountID.FromString(row.ID); err != nil {
+			return 0, err
+		}
+		dbCap, err := am.staffCapability(accountID, kmsCred)
+		if err != nil {
+			return 0, err
+		}
+
+		t, err := b.DbMap.Begin()
+		if err != nil {
+			return 0, err
+		}
+		if err := setStaffCapability(t, accountID, dbCap); err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+		if _, err := t.Exec("DELETE FROM capability WHERE id = $1", row.StaffCapabilityID); err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+		if err := t.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
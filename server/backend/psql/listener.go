@@ -60,6 +60,17 @@ func (lm ListenerMap) Broadcast(ctx scope.Context, event *proto.Packet, exclude
 		}
 	}
 
+	// Logged events are delivered along with their cursor.
+	sent := payload
+	if !event.Cursor.IsZero() {
+		sent = &proto.LoggedEvent{
+			Cursor:  event.Cursor,
+			Type:    event.Type,
+			Payload: payload,
+			Exclude: exclude,
+		}
+	}
+
 	for sessionID, listener := range lm {
 		if _, ok := excludeSet[sessionID]; !ok {
 			if bounceAgentID != "" {
@@ -96,7 +107,7 @@ func (lm ListenerMap) Broadcast(ctx scope.Context, event *proto.Packet, exclude
 					event.Type, listener.ID())
 				continue
 			}
-			if err := listener.Send(ctx, event.Type, payload); err != nil {
+			if err := listener.Send(ctx, event.Type, sent); err != nil {
 				// TODO: accumulate errors
 				return fmt.Errorf("send message to %s: %s", listener.ID(), err)
 			}
@@ -0,0 +1,78 @@
+package psql
+
+import (
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type Mention struct {
+	UserID     string    `db:"user_id"`
+	Room       string    `db:"room"`
+	MessageID  string    `db:"message_id"`
+	SenderID   string    `db:"sender_id"`
+	SenderName string    `db:"sender_name"`
+	Posted     time.Time `db:"posted"`
+}
+
+func (m *Mention) ToBackend() proto.Mention {
+	mention := proto.Mention{
+		Room:       m.Room,
+		SenderID:   proto.UserID(m.SenderID),
+		SenderName: m.SenderName,
+		UnixTime:   proto.Time(m.Posted),
+	}
+	// ignore id parsing errors
+	_ = mention.MessageID.FromString(m.MessageID)
+	return mention
+}
+
+type MentionTracker struct {
+	*Backend
+}
+
+func (t *MentionTracker) Add(ctx scope.Context, userID proto.UserID, mention proto.Mention) error {
+	row := &Mention{
+		UserID:     string(userID),
+		Room:       mention.Room,
+		MessageID:  mention.MessageID.String(),
+		SenderID:   string(mention.SenderID),
+		SenderName: mention.SenderName,
+		Posted:     time.Time(mention.UnixTime),
+	}
+	return t.DbMap.Insert(row)
+}
+
+func (t *MentionTracker) Latest(
+	ctx scope.Context, userID proto.UserID, n int, before snowflake.Snowflake) ([]proto.Mention, error) {
+
+	if n <= 0 {
+		return []proto.Mention{}, nil
+	}
+	if n > 1000 {
+		n = 1000
+	}
+
+	query := "SELECT user_id, room, message_id, sender_id, sender_name, posted FROM mention" +
+		" WHERE user_id = $1 ORDER BY message_id DESC LIMIT $2"
+	args := []interface{}{string(userID), n}
+	if !before.IsZero() {
+		query = "SELECT user_id, room, message_id, sender_id, sender_name, posted FROM mention" +
+			" WHERE user_id = $1 AND message_id < $3 ORDER BY message_id DESC LIMIT $2"
+		args = append(args, before.String())
+	}
+
+	rows, err := t.DbMap.Select(Mention{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	mentions := make([]proto.Mention, len(rows))
+	for i, row := range rows {
+		mentions[len(rows)-i-1] = row.(*Mention).ToBackend()
+	}
+	return mentions, nil
+}
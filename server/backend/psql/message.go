@@ -25,6 +25,7 @@ type Message struct {
 	SenderClientAddress string `db:"sender_client_address"`
 	SenderIsManager     bool   `db:"sender_is_manager"`
 	SenderIsStaff       bool   `db:"sender_is_staff"`
+	SenderIsBot         bool   `db:"sender_is_bot"`
 
 	ServerID        string         `db:"server_id"`
 	ServerEra       string         `db:"server_era"`
@@ -50,6 +51,7 @@ func NewMessage(
 		SenderClientAddress: sessionView.ClientAddress,
 		SenderIsManager:     sessionView.IsManager,
 		SenderIsStaff:       sessionView.IsStaff,
+		SenderIsBot:         sessionView.IsBot,
 	}
 	if keyID != "" {
 		msg.EncryptionKeyID = sql.NullString{
@@ -74,6 +76,7 @@ func (m *Message) ToBackend() proto.Message {
 			SessionID:     m.SessionID,
 			IsManager:     m.SenderIsManager,
 			IsStaff:       m.SenderIsStaff,
+			IsBot:         m.SenderIsBot,
 		},
 		Content: m.Content,
 	}
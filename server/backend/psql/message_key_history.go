@@ -0,0 +1,126 @@
+package psql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/security"
+)
+
+type MessageKeyLink struct {
+	KeyID         string       `db:"key_id"`
+	Room          string       `db:"room"`
+	PreviousKeyID string       `db:"previous_key_id"`
+	IV            ByteANonNull `db:"iv"`
+	Digest        ByteANonNull `db:"digest"`
+	EncryptedKey  ByteANonNull `db:"encrypted_key"`
+}
+
+func (rb *ManagedRoomBinding) RotateMessageKey(
+	ctx scope.Context, kms security.KMS, currentKeyID string, currentKey *security.ManagedKey,
+	grantees ...proto.Account) (proto.RoomMessageKey, error) {
+
+	rmkb, err := rb.Room.generateMessageKey(rb.Backend, kms)
+	if err != nil {
+		return nil, err
+	}
+
+	key := rmkb.ManagedKey()
+	if err := kms.DecryptKey(&key); err != nil {
+		return nil, err
+	}
+	link, err := proto.NewMessageKeyLink(kms, rmkb.KeyID(), &key, currentKeyID, currentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the room row so concurrent rotations can't both link to the same
+	// key.
+	if _, err := t.Exec("SELECT 1 FROM room WHERE name = $1 FOR UPDATE", rb.RoomName); err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+	activeKeyID, err := t.SelectStr(
+		"SELECT key_id FROM room_master_key WHERE room = $1 AND expired < activated"+
+			" ORDER BY activated DESC LIMIT 1",
+		rb.RoomName)
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+	if activeKeyID != currentKeyID {
+		rollback(ctx, t)
+		return nil, fmt.Errorf("message key %s is not current", currentKeyID)
+	}
+
+	if err := t.Insert(&rmkb.MessageKey, &rmkb.RoomMessageKey); err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+	row := &MessageKeyLink{
+		KeyID:         link.KeyID,
+		Room:          rb.RoomName,
+		PreviousKeyID: link.PreviousKeyID,
+		IV:            NewByteANonNull(link.IV),
+		Digest:        NewByteANonNull(link.Digest),
+		EncryptedKey:  NewByteANonNull(link.EncryptedKey),
+	}
+	if err := t.Insert(row); err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+
+	// Make the grants within the transaction.
+	grants := *rmkb.GrantManager
+	grants.Capabilities = &RoomMessageCapabilities{Room: rb.Room, Executor: t}
+	for _, account := range grantees {
+		if err := grants.StaffGrantToAccount(ctx, kms, account); err != nil {
+			rollback(ctx, t)
+			return nil, err
+		}
+	}
+
+	event := &proto.DisconnectEvent{Reason: "room key rotated"}
+	if err := rb.broadcast(ctx, t, proto.DisconnectEventType, event); err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return nil, err
+	}
+
+	return rmkb, nil
+}
+
+func (rb *ManagedRoomBinding) PreviousMessageKey(ctx scope.Context, keyID string) (*proto.MessageKeyLink, error) {
+	var row MessageKeyLink
+	err := rb.DbMap.SelectOne(
+		&row,
+		"SELECT key_id, room, previous_key_id, iv, digest, encrypted_key FROM message_key_link"+
+			" WHERE key_id = $1 AND room = $2",
+		keyID, rb.RoomName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	link := &proto.MessageKeyLink{
+		KeyID:         row.KeyID,
+		PreviousKeyID: row.PreviousKeyID,
+		IV:            row.IV.v,
+		Digest:        row.Digest.v,
+		EncryptedKey:  row.EncryptedKey.v,
+	}
+	return link, nil
+}
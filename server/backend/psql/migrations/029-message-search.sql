@@ -0,0 +1,10 @@
+-- +migrate Up
+-- Add a full-text index on the content of unencrypted messages.
+
+CREATE INDEX message_content_search ON message USING GIN (to_tsvector('simple', content))
+    WHERE encryption_key_id IS NULL;
+
+-- +migrate Down
+-- Drop the full-text index.
+
+DROP INDEX message_content_search;
@@ -0,0 +1,19 @@
+-- +migrate Up
+-- Log recent room events, for replaying to resumed sessions.
+
+CREATE TABLE room_event_log (
+    room TEXT NOT NULL,
+    id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    data TEXT NOT NULL,
+    exclude TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (room, id)
+);
+
+CREATE INDEX room_event_log_created ON room_event_log(created);
+
+-- +migrate Down
+-- Drop the event log.
+
+DROP TABLE room_event_log;
@@ -0,0 +1,16 @@
+-- +migrate Up
+-- Record reactions to messages.
+
+CREATE TABLE message_reaction (
+    room TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    reaction TEXT NOT NULL,
+    reacted TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (room, message_id, user_id, reaction)
+);
+
+-- +migrate Down
+-- Drop message reactions.
+
+DROP TABLE message_reaction;
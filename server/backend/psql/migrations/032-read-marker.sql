@@ -0,0 +1,15 @@
+-- +migrate Up
+-- Record how far each account has read in each room.
+
+CREATE TABLE read_marker (
+    room TEXT NOT NULL,
+    account_id TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (room, account_id)
+);
+
+-- +migrate Down
+-- Drop read markers.
+
+DROP TABLE read_marker;
@@ -0,0 +1,23 @@
+-- +migrate Up
+-- Index the messages that mention each user.
+
+CREATE TABLE mention (
+    user_id TEXT NOT NULL,
+    room TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    sender_id TEXT NOT NULL,
+    sender_name TEXT NOT NULL,
+    posted TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, room, message_id)
+);
+
+CREATE INDEX mention_user_id_message_id ON mention(user_id, message_id);
+
+-- Matches the expression used to resolve mentions to users by nick.
+CREATE INDEX nick_room_mention ON nick(room, lower(regexp_replace(nick, '\s', '', 'g')));
+
+-- +migrate Down
+-- Drop the mentions index.
+
+DROP INDEX nick_room_mention;
+DROP TABLE mention;
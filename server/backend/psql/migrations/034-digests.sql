@@ -0,0 +1,22 @@
+-- +migrate Up
+-- Store per-account email preferences, and track when each account was last
+-- seen for digest emails.
+
+CREATE TABLE email_preferences (
+    account_id TEXT NOT NULL PRIMARY KEY,
+    digest BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE TABLE digest_state (
+    account_id TEXT NOT NULL PRIMARY KEY,
+    last_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_sent TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX digest_state_last_seen ON digest_state(last_seen);
+
+-- +migrate Down
+-- Drop email preferences and digest state.
+
+DROP TABLE digest_state;
+DROP TABLE email_preferences;
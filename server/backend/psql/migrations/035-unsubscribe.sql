@@ -0,0 +1,9 @@
+-- +migrate Up
+-- Let accounts opt out of all non-transactional email.
+
+ALTER TABLE email_preferences ADD COLUMN unsubscribed BOOLEAN NOT NULL DEFAULT false;
+
+-- +migrate Down
+-- Drop the unsubscribe flag.
+
+ALTER TABLE email_preferences DROP COLUMN unsubscribed;
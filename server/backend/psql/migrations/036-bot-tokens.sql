@@ -0,0 +1,28 @@
+-- +migrate Up
+-- Bearer tokens that let bots connect to rooms as an account, and a record of
+-- which sessions were authenticated with them.
+
+CREATE TABLE bot_token (
+    id TEXT NOT NULL PRIMARY KEY,
+    account_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    rooms TEXT NOT NULL DEFAULT '',
+    created TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_used TIMESTAMP WITH TIME ZONE,
+    revoked TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX bot_token_account_id_created ON bot_token(account_id, created);
+
+ALTER TABLE session_log ADD bot_token_id TEXT;
+CREATE INDEX session_log_bot_token_id_connected ON session_log(bot_token_id, connected);
+
+ALTER TABLE message ADD sender_is_bot BOOL DEFAULT false;
+
+-- +migrate Down
+-- Drop bot tokens.
+
+ALTER TABLE message DROP IF EXISTS sender_is_bot;
+DROP INDEX IF EXISTS session_log_bot_token_id_connected;
+ALTER TABLE session_log DROP IF EXISTS bot_token_id;
+DROP TABLE bot_token;
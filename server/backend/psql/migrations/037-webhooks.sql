@@ -0,0 +1,18 @@
+-- +migrate Up
+-- Outgoing webhooks that deliver room events to external URLs.
+
+CREATE TABLE webhook (
+    id TEXT NOT NULL PRIMARY KEY,
+    room TEXT NOT NULL,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX webhook_room ON webhook(room);
+
+-- +migrate Down
+-- Drop webhooks.
+
+DROP TABLE webhook;
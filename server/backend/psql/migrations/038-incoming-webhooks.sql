@@ -0,0 +1,17 @@
+-- +migrate Up
+-- Incoming webhooks that let outside services post messages into rooms.
+
+CREATE TABLE incoming_webhook (
+    id TEXT NOT NULL PRIMARY KEY,
+    room TEXT NOT NULL,
+    name TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX incoming_webhook_room ON incoming_webhook(room);
+
+-- +migrate Down
+-- Drop incoming webhooks.
+
+DROP TABLE incoming_webhook;
@@ -0,0 +1,18 @@
+-- +migrate Up
+-- Alternative names that lead to a room. A room's canonical alias, if it has
+-- one, is the name it was renamed to.
+
+CREATE TABLE room_alias (
+    name TEXT NOT NULL PRIMARY KEY,
+    room TEXT NOT NULL,
+    canonical BOOLEAN NOT NULL DEFAULT false,
+    created TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX room_alias_room ON room_alias(room);
+CREATE UNIQUE INDEX room_alias_canonical ON room_alias(room) WHERE canonical;
+
+-- +migrate Down
+-- Drop room aliases.
+
+DROP TABLE room_alias;
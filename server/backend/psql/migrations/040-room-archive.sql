@@ -0,0 +1,9 @@
+-- +migrate Up
+-- Record when a room was archived. Archived rooms are read-only.
+
+ALTER TABLE room ADD archived TIMESTAMP WITH TIME ZONE;
+
+-- +migrate Down
+-- Forget which rooms were archived.
+
+ALTER TABLE room DROP IF EXISTS archived;
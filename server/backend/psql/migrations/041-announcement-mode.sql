@@ -0,0 +1,17 @@
+-- +migrate Up
+-- Announcement mode, in which only managers and an allowlist of accounts may
+-- send messages to a room.
+
+ALTER TABLE room ADD announcement BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE room_poster (
+    room TEXT NOT NULL,
+    account_id TEXT NOT NULL,
+    PRIMARY KEY (room, account_id)
+);
+
+-- +migrate Down
+-- Drop announcement mode.
+
+DROP TABLE room_poster;
+ALTER TABLE room DROP IF EXISTS announcement;
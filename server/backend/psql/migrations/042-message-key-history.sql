@@ -0,0 +1,19 @@
+-- +migrate Up
+-- Links from each rotated room message key to the key it replaced, which is
+-- stored encrypted under the newer key.
+
+CREATE TABLE message_key_link (
+    key_id TEXT NOT NULL PRIMARY KEY,
+    room TEXT NOT NULL,
+    previous_key_id TEXT NOT NULL,
+    iv BYTEA NOT NULL,
+    digest BYTEA NOT NULL,
+    encrypted_key BYTEA NOT NULL
+);
+
+CREATE INDEX message_key_link_room ON message_key_link(room);
+
+-- +migrate Down
+-- Drop message key history.
+
+DROP TABLE message_key_link;
@@ -0,0 +1,27 @@
+-- +migrate Up
+-- End-to-end encrypted rooms, whose keys are held by clients and shared with
+-- each account sealed for its public key.
+
+ALTER TABLE room ADD e2e BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE account_e2e_key (
+    account_id TEXT NOT NULL PRIMARY KEY,
+    public_key BYTEA NOT NULL
+);
+
+CREATE TABLE room_e2e_key (
+    room TEXT NOT NULL,
+    account_id TEXT NOT NULL,
+    key_id TEXT NOT NULL,
+    sender_public_key BYTEA NOT NULL,
+    nonce BYTEA NOT NULL,
+    sealed_key BYTEA NOT NULL,
+    PRIMARY KEY (room, account_id, key_id)
+);
+
+-- +migrate Down
+-- Drop end-to-end encrypted rooms.
+
+DROP TABLE room_e2e_key;
+DROP TABLE account_e2e_key;
+ALTER TABLE room DROP IF EXISTS e2e;
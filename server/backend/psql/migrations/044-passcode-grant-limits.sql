@@ -0,0 +1,17 @@
+-- +migrate Up
+-- Access grants to passcodes that expire, or may only be used a limited
+-- number of times.
+
+ALTER TABLE room_capability ADD expires TIMESTAMP WITH TIME ZONE;
+ALTER TABLE room_capability ADD max_uses INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE room_capability ADD uses INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX room_capability_expires ON room_capability(expires) WHERE expires IS NOT NULL;
+
+-- +migrate Down
+-- Drop passcode grant limits.
+
+DROP INDEX IF EXISTS room_capability_expires;
+ALTER TABLE room_capability DROP IF EXISTS uses;
+ALTER TABLE room_capability DROP IF EXISTS max_uses;
+ALTER TABLE room_capability DROP IF EXISTS expires;
@@ -0,0 +1,29 @@
+package psql
+
+import (
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+)
+
+// PasscodeGrantCleanupInterval is how often passcode grants that have
+// expired or been used up are removed.
+var PasscodeGrantCleanupInterval = 10 * time.Minute
+
+const spentPasscodeGrants = "SELECT capability_id FROM room_capability" +
+	" WHERE expires <= $1 OR (max_uses > 0 AND uses >= max_uses)"
+
+// RemoveSpentPasscodeGrants deletes the passcode grants that have expired by
+// the given time or been used up. It returns the number of grants removed.
+func (b *Backend) RemoveSpentPasscodeGrants(ctx scope.Context, now time.Time) (int, error) {
+	// Deleting the capability cascades to its room_capability row.
+	resp, err := b.DbMap.Exec("DELETE FROM capability WHERE id IN ("+spentPasscodeGrants+")", now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
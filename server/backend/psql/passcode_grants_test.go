@@ -0,0 +1,66 @@
+package psql
+
+import (
+	"testing"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/security"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testRemoveSpentPasscodeGrants(t *testing.T, b *Backend) {
+	ctx := scope.New()
+	kms := security.LocalKMS()
+	kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+
+	Convey("Spent passcode grants are counted as they're removed", t, func() {
+		agentKey := &security.ManagedKey{
+			KeyType:   proto.AgentKeyType,
+			Plaintext: make([]byte, proto.AgentKeyType.KeySize()),
+		}
+		agent, err := proto.NewAgent([]byte("spentgrants"), agentKey)
+		So(err, ShouldBeNil)
+		So(b.AgentTracker().Register(ctx, agent), ShouldBeNil)
+		manager, managerKey, err := b.AccountManager().Register(
+			ctx, kms, "email", "spentgrants@heim.invalid", "hunter2", agent.IDString(), agentKey)
+		So(err, ShouldBeNil)
+
+		room, err := b.CreateRoom(ctx, kms, true, "spentgrants", manager)
+		So(err, ShouldBeNil)
+		rkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+
+		// Clear out anything left spent by earlier tests.
+		now := time.Now()
+		_, err = b.RemoveSpentPasscodeGrants(ctx, now.Add(2*time.Hour))
+		So(err, ShouldBeNil)
+
+		expiring := &proto.PasscodeGrantLimits{Expires: now.Add(3 * time.Hour)}
+		So(rkey.GrantToPasscode(ctx, manager, managerKey, "expiring", expiring), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, manager, managerKey, "once", &proto.PasscodeGrantLimits{MaxUses: 1}), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, manager, managerKey, "forever", nil), ShouldBeNil)
+		So(rkey.UsePasscode(ctx, "once"), ShouldBeNil)
+
+		n, err := b.RemoveSpentPasscodeGrants(ctx, now)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		n, err = b.RemoveSpentPasscodeGrants(ctx, now.Add(4*time.Hour))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		n, err = b.RemoveSpentPasscodeGrants(ctx, now.Add(4*time.Hour))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+
+		// Removed grants are gone from room_capability as well.
+		remaining, err := b.DbMap.SelectInt(
+			"SELECT COUNT(*) FROM room_capability WHERE room = $1 AND expires IS NOT NULL", "spentgrants")
+		So(err, ShouldBeNil)
+		So(remaining, ShouldEqual, 0)
+	})
+}
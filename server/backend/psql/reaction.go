@@ -0,0 +1,136 @@
+package psql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type MessageReaction struct {
+	Room      string    `db:"room"`
+	MessageID string    `db:"message_id"`
+	UserID    string    `db:"user_id"`
+	Reaction  string    `db:"reaction"`
+	Reacted   time.Time `db:"reacted"`
+}
+
+func (rb *RoomBinding) React(
+	ctx scope.Context, session proto.Session, msgID snowflake.Snowflake, reaction string, remove bool) (
+	*proto.ReactionEvent, error) {
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := t.SelectInt(
+		"SELECT COUNT(*) FROM message WHERE room = $1 AND id = $2 AND deleted IS NULL",
+		rb.RoomName, msgID.String())
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+	if n == 0 {
+		rollback(ctx, t)
+		return nil, proto.ErrMessageNotFound
+	}
+
+	// Repeating a reaction, or withdrawing one that was never made, changes
+	// nothing and isn't broadcast.
+	userID := string(session.Identity().ID())
+	var result sql.Result
+	if remove {
+		result, err = t.Exec(
+			"DELETE FROM message_reaction WHERE room = $1 AND message_id = $2 AND user_id = $3 AND reaction = $4",
+			rb.RoomName, msgID.String(), userID, reaction)
+	} else {
+		result, err = t.Exec(
+			"INSERT INTO message_reaction (room, message_id, user_id, reaction, reacted)"+
+				" VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING",
+			rb.RoomName, msgID.String(), userID, reaction, time.Now())
+	}
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+
+	count, err := t.SelectInt(
+		"SELECT COUNT(*) FROM message_reaction WHERE room = $1 AND message_id = $2 AND reaction = $3",
+		rb.RoomName, msgID.String(), reaction)
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+
+	event := &proto.ReactionEvent{
+		ID:       msgID,
+		Reaction: reaction,
+		Sender:   session.View(proto.Host),
+		Removed:  remove,
+		Count:    int(count),
+	}
+	if changed > 0 {
+		if err := rb.broadcast(ctx, t, proto.ReactionEventType, event, session); err != nil {
+			rollback(ctx, t)
+			return nil, err
+		}
+	}
+
+	if err := t.Commit(); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// loadReactions fills in the reaction counts of the given messages.
+func loadReactions(db gorp.SqlExecutor, roomName string, msgs []proto.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(msgs))
+	args := make([]interface{}, 0, len(msgs)+1)
+	args = append(args, roomName)
+	index := make(map[string]int, len(msgs))
+	for i, msg := range msgs {
+		args = append(args, msg.ID.String())
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+		index[msg.ID.String()] = i
+	}
+
+	var rows []struct {
+		MessageID string `db:"message_id"`
+		Reaction  string `db:"reaction"`
+		Count     int    `db:"count"`
+	}
+	_, err := db.Select(&rows,
+		fmt.Sprintf(
+			"SELECT message_id, reaction, COUNT(*) AS count FROM message_reaction"+
+				" WHERE room = $1 AND message_id IN (%s) GROUP BY message_id, reaction",
+			strings.Join(placeholders, ", ")),
+		args...)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		msg := &msgs[index[row.MessageID]]
+		if msg.Reactions == nil {
+			msg.Reactions = map[string]int{}
+		}
+		msg.Reactions[row.Reaction] = row.Count
+	}
+	return nil
+}
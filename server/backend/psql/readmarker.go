@@ -0,0 +1,99 @@
+package psql
+
+import (
+	"database/sql"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type ReadMarker struct {
+	Room      string    `db:"room"`
+	AccountID string    `db:"account_id"`
+	MessageID string    `db:"message_id"`
+	Updated   time.Time `db:"updated"`
+}
+
+func (rb *RoomBinding) ReadMarker(ctx scope.Context, accountID snowflake.Snowflake) (
+	snowflake.Snowflake, int, error) {
+
+	var row ReadMarker
+	err := rb.DbMap.SelectOne(&row,
+		"SELECT room, account_id, message_id, updated FROM read_marker WHERE room = $1 AND account_id = $2",
+		rb.RoomName, accountID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	var marker snowflake.Snowflake
+	if err := marker.FromString(row.MessageID); err != nil {
+		return 0, 0, err
+	}
+	unread, err := countUnread(rb.DbMap, rb.RoomName, marker)
+	if err != nil {
+		return 0, 0, err
+	}
+	return marker, unread, nil
+}
+
+func (rb *RoomBinding) MarkRead(ctx scope.Context, accountID, msgID snowflake.Snowflake) (
+	snowflake.Snowflake, int, error) {
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Markers only move forward. Message ids sort in the order they were
+	// posted, so they can be compared as text.
+	_, err = t.Exec(
+		"INSERT INTO read_marker (room, account_id, message_id, updated) VALUES ($1, $2, $3, $4)"+
+			" ON CONFLICT (room, account_id) DO UPDATE SET message_id = EXCLUDED.message_id, updated = EXCLUDED.updated"+
+			" WHERE read_marker.message_id < EXCLUDED.message_id",
+		rb.RoomName, accountID.String(), msgID.String(), time.Now())
+	if err != nil {
+		rollback(ctx, t)
+		return 0, 0, err
+	}
+
+	markerID, err := t.SelectStr(
+		"SELECT message_id FROM read_marker WHERE room = $1 AND account_id = $2", rb.RoomName, accountID.String())
+	if err != nil {
+		rollback(ctx, t)
+		return 0, 0, err
+	}
+	var marker snowflake.Snowflake
+	if err := marker.FromString(markerID); err != nil {
+		rollback(ctx, t)
+		return 0, 0, err
+	}
+	unread, err := countUnread(t, rb.RoomName, marker)
+	if err != nil {
+		rollback(ctx, t)
+		return 0, 0, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return marker, unread, nil
+}
+
+// countUnread returns the number of messages posted to a room after the given
+// message, up to proto.MaxUnreadCount.
+func countUnread(db gorp.SqlExecutor, roomName string, marker snowflake.Snowflake) (int, error) {
+	n, err := db.SelectInt(
+		"SELECT COUNT(*) FROM (SELECT 1 FROM message WHERE room = $1 AND id > $2 AND deleted IS NULL LIMIT $3) AS unread",
+		roomName, marker.String(), proto.MaxUnreadCount)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
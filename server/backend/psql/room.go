@@ -20,16 +20,19 @@ var notImpl = fmt.Errorf("not implemented")
 var global *RoomBinding
 
 type Room struct {
-	Name                   string       `db:"name"`
-	FoundedBy              string       `db:"founded_by"`
-	RetentionDays          int          `db:"retention_days"`
-	Nonce                  ByteANonNull `db:"pk_nonce"`
-	MAC                    ByteANonNull `db:"pk_mac"`
-	IV                     ByteANonNull `db:"pk_iv"`
-	EncryptedManagementKey ByteANonNull `db:"encrypted_management_key"`
-	EncryptedPrivateKey    ByteANonNull `db:"encrypted_private_key"`
-	PublicKey              ByteANonNull `db:"public_key"`
-	MinAgentAge            int64        `db:"min_agent_age"`
+	Name                   string        `db:"name"`
+	FoundedBy              string        `db:"founded_by"`
+	RetentionDays          int           `db:"retention_days"`
+	Nonce                  ByteANonNull  `db:"pk_nonce"`
+	MAC                    ByteANonNull  `db:"pk_mac"`
+	IV                     ByteANonNull  `db:"pk_iv"`
+	EncryptedManagementKey ByteANonNull  `db:"encrypted_management_key"`
+	EncryptedPrivateKey    ByteANonNull  `db:"encrypted_private_key"`
+	PublicKey              ByteANonNull  `db:"public_key"`
+	MinAgentAge            int64         `db:"min_agent_age"`
+	Archived               gorp.NullTime `db:"archived"`
+	Announcement           bool          `db:"announcement"`
+	E2E                    bool          `db:"e2e"`
 }
 
 func (r *Room) Bind(b *Backend) *ManagedRoomBinding {
@@ -92,6 +95,12 @@ func (rb *RoomBinding) broadcast(
 		}
 	}
 
+	if rb != nil && proto.IsLoggedEventType(packetType) {
+		if err := rb.logEvent(db, packet, broadcastMsg.Exclude); err != nil {
+			return err
+		}
+	}
+
 	encoded, err := json.Marshal(broadcastMsg)
 	if err != nil {
 		return err
@@ -141,7 +150,11 @@ func (rb *RoomBinding) GetMessage(ctx scope.Context, id snowflake.Snowflake) (*p
 		}
 	}
 	m := msg.ToBackend()
-	return &m, nil
+	msgs := []proto.Message{m}
+	if err := loadReactions(rb.DbMap, rb.RoomName, msgs); err != nil {
+		return nil, err
+	}
+	return &msgs[0], nil
 }
 
 func (rb *RoomBinding) getParentPostTime(id snowflake.Snowflake) (time.Time, error) {
@@ -177,6 +190,20 @@ func (rb *RoomBinding) Latest(ctx scope.Context, n int, before snowflake.Snowfla
 	return rb.Backend.latest(ctx, rb, n, before)
 }
 
+func (rb *RoomBinding) Earliest(ctx scope.Context, n int, after snowflake.Snowflake) (
+	[]proto.Message, error) {
+
+	return rb.Backend.earliest(ctx, rb, n, after)
+}
+
+func (rb *RoomBinding) Search(ctx scope.Context, cmd *proto.SearchCommand) ([]proto.Message, error) {
+	return rb.Backend.search(ctx, rb, cmd)
+}
+
+func (rb *RoomBinding) Thread(ctx scope.Context, n int, root snowflake.Snowflake) ([]proto.Message, error) {
+	return rb.Backend.thread(ctx, rb, n, root)
+}
+
 func (rb *RoomBinding) Snapshot(
 	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, numMessages int) (*proto.SnapshotEvent, error) {
 
@@ -213,6 +240,28 @@ func (rb *RoomBinding) Join(ctx scope.Context, session proto.Session) (string, e
 	return rb.Backend.join(ctx, rb, session)
 }
 
+func (rb *RoomBinding) IsBanned(ctx scope.Context, agentID proto.UserID, ip string) (bool, error) {
+	if agentID != "" {
+		n, err := rb.DbMap.SelectInt(
+			"SELECT COUNT(*) FROM banned_agent WHERE agent_id = $1 AND (room IS NULL OR room = $2)"+
+				" AND (expires IS NULL OR expires > NOW())",
+			agentID.String(), rb.RoomName)
+		if err != nil || n > 0 {
+			return n > 0, err
+		}
+	}
+	if ip != "" {
+		n, err := rb.DbMap.SelectInt(
+			"SELECT COUNT(*) FROM banned_ip WHERE ip = $1 AND (room IS NULL OR room = $2)"+
+				" AND (expires IS NULL OR expires > NOW())",
+			ip, rb.RoomName)
+		if err != nil || n > 0 {
+			return n > 0, err
+		}
+	}
+	return false, nil
+}
+
 func (rb *RoomBinding) Part(ctx scope.Context, session proto.Session) error {
 	return rb.Backend.part(ctx, rb, session)
 }
@@ -251,7 +300,7 @@ func (rb *RoomBinding) EditMessage(
 		return reply, err
 	}
 
-	if msg.PreviousEditID.Valid && msg.PreviousEditID.String != edit.PreviousEditID.String() {
+	if msg.PreviousEditID.String != edit.PreviousEditID.String() {
 		rollback(ctx, t)
 		return reply, proto.ErrEditInconsistent
 	}
@@ -283,6 +332,7 @@ func (rb *RoomBinding) EditMessage(
 	sets := []string{"edited = $3", "previous_edit_id = $4"}
 	args := []interface{}{rb.RoomName, edit.ID.String(), now, editID.String()}
 	msg.Edited = gorp.NullTime{Valid: true, Time: now}
+	msg.PreviousEditID = sql.NullString{String: editID.String(), Valid: true}
 	if edit.Content != "" {
 		args = append(args, edit.Content)
 		sets = append(sets, fmt.Sprintf("content = $%d", len(args)))
@@ -830,6 +880,26 @@ func (rb *ManagedRoomBinding) IsValidParent(id snowflake.Snowflake) (bool, error
 	return true, nil
 }
 
+func (rb *RoomBinding) ResolveMention(ctx scope.Context, mention string) ([]proto.UserID, error) {
+	// Matches the expression indexed by nick_room_mention.
+	rows, err := rb.DbMap.Select(
+		Nick{},
+		"SELECT room, user_id, nick FROM nick WHERE room = $1 AND lower(regexp_replace(nick, '\\s', '', 'g')) = $2",
+		rb.RoomName, mention)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []proto.UserID
+	for _, row := range rows {
+		nick := row.(*Nick)
+		if proto.NormalizeMention(nick.Nick) == mention {
+			userIDs = append(userIDs, proto.UserID(nick.UserID))
+		}
+	}
+	return userIDs, nil
+}
+
 func (rb *RoomBinding) ResolveClientAddress(ctx scope.Context, addr string) (net.IP, error) {
 	var row VirtualAddress
 	err := rb.DbMap.SelectOne(
@@ -0,0 +1,197 @@
+package psql
+
+import (
+	"sort"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+	"gopkg.in/gorp.v1"
+
+	"euphoria.leet.nu/heim/proto"
+)
+
+type RoomAlias struct {
+	Name      string    `db:"name"`
+	Room      string    `db:"room"`
+	Canonical bool      `db:"canonical"`
+	Created   time.Time `db:"created"`
+}
+
+// resolveRoomAlias returns the name of the room the given alias leads to.
+func resolveRoomAlias(db gorp.SqlExecutor, alias string) (string, error) {
+	roomName, err := db.SelectStr("SELECT room FROM room_alias WHERE name = $1", alias)
+	if err != nil {
+		return "", err
+	}
+	if roomName == "" {
+		return "", proto.ErrRoomNotFound
+	}
+	return roomName, nil
+}
+
+// nameInUse reports whether the given name belongs to another room, either as
+// its name or as one of its aliases.
+func (rb *ManagedRoomBinding) nameInUse(db gorp.SqlExecutor, name string) (bool, error) {
+	if name == rb.RoomName {
+		return false, nil
+	}
+	n, err := db.SelectInt(
+		"SELECT (SELECT COUNT(*) FROM room WHERE name = $1)"+
+			" + (SELECT COUNT(*) FROM room_alias WHERE name = $1 AND room != $2)",
+		name, rb.RoomName)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (rb *ManagedRoomBinding) CanonicalName(ctx scope.Context) (string, error) {
+	name, err := rb.DbMap.SelectStr(
+		"SELECT name FROM room_alias WHERE room = $1 AND canonical", rb.RoomName)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return rb.RoomName, nil
+	}
+	return name, nil
+}
+
+func (rb *ManagedRoomBinding) Aliases(ctx scope.Context) ([]string, error) {
+	var rows []RoomAlias
+	_, err := rb.DbMap.Select(&rows,
+		"SELECT name, room, canonical, created FROM room_alias WHERE room = $1 ORDER BY name", rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []string{}
+	renamed := false
+	for _, row := range rows {
+		if row.Canonical {
+			renamed = true
+			continue
+		}
+		aliases = append(aliases, row.Name)
+	}
+	if renamed {
+		aliases = append(aliases, rb.RoomName)
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+func (rb *ManagedRoomBinding) AddAlias(ctx scope.Context, alias string) error {
+	if err := proto.ValidateRoomName(alias); err != nil {
+		return err
+	}
+	if alias == rb.RoomName {
+		return nil
+	}
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := rb.claimName(t, alias, false); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
+
+// claimName adds the given name as an alias of the room, if it isn't one
+// already, and marks whether it's the room's canonical name.
+func (rb *ManagedRoomBinding) claimName(t *gorp.Transaction, name string, canonical bool) error {
+	// Lock the room so concurrent renames don't race.
+	if _, err := t.Exec("SELECT 1 FROM room WHERE name = $1 FOR UPDATE", rb.RoomName); err != nil {
+		return err
+	}
+
+	inUse, err := rb.nameInUse(t, name)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return proto.ErrRoomNameInUse
+	}
+
+	if canonical {
+		if _, err := t.Exec(
+			"UPDATE room_alias SET canonical = false WHERE room = $1 AND canonical", rb.RoomName); err != nil {
+			return err
+		}
+	}
+	if name == rb.RoomName {
+		return nil
+	}
+
+	res, err := t.Exec(
+		"UPDATE room_alias SET canonical = $3 WHERE room = $1 AND name = $2", rb.RoomName, name, canonical)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	row := &RoomAlias{
+		Name:      name,
+		Room:      rb.RoomName,
+		Canonical: canonical,
+		Created:   time.Now(),
+	}
+	return t.Insert(row)
+}
+
+func (rb *ManagedRoomBinding) RemoveAlias(ctx scope.Context, alias string) error {
+	res, err := rb.DbMap.Exec(
+		"DELETE FROM room_alias WHERE room = $1 AND name = $2 AND NOT canonical", rb.RoomName, alias)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrRoomAliasNotFound
+	}
+	return nil
+}
+
+func (rb *ManagedRoomBinding) Rename(ctx scope.Context, session proto.Session, name string) error {
+	if err := proto.ValidateRoomName(name); err != nil {
+		return err
+	}
+
+	from, err := rb.CanonicalName(ctx)
+	if err != nil {
+		return err
+	}
+	if from == name {
+		return nil
+	}
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := rb.claimName(t, name, true); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	event := &proto.RoomRenamedEvent{From: from, To: name}
+	if err := rb.broadcast(ctx, t, proto.RoomRenamedEventType, event, session); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
@@ -0,0 +1,115 @@
+package psql
+
+import (
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+)
+
+// roomTables are the tables holding rows for a room that are removed along
+// with it, in the order they're deleted. Capabilities and message keys are
+// removed separately, since they're only tied to the room through the
+// room_capability, room_manager_capability, and room_master_key tables.
+var roomTables = []string{
+	"room_capability",
+	"room_manager_capability",
+	"room_master_key",
+	"message",
+	"message_edit_log",
+	"message_reaction",
+	"room_event_log",
+	"read_marker",
+	"mention",
+	"presence",
+	"virtual_address",
+	"nick",
+	"banned_agent",
+	"banned_ip",
+	"webhook",
+	"incoming_webhook",
+	"room_alias",
+	"room_poster",
+	"message_key_link",
+	"room_e2e_key",
+}
+
+func (rb *ManagedRoomBinding) Archived(ctx scope.Context) (bool, error) {
+	n, err := rb.DbMap.SelectInt(
+		"SELECT COUNT(*) FROM room WHERE name = $1 AND archived IS NOT NULL", rb.RoomName)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (rb *ManagedRoomBinding) Archive(ctx scope.Context) error {
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Exec(
+		"UPDATE room SET archived = $2 WHERE name = $1 AND archived IS NULL", rb.RoomName, time.Now()); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	event := &proto.DisconnectEvent{Reason: "room archived"}
+	if err := rb.broadcast(ctx, t, proto.DisconnectEventType, event); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
+
+func (rb *ManagedRoomBinding) Delete(ctx scope.Context) error {
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Exec("SELECT 1 FROM room WHERE name = $1 FOR UPDATE", rb.RoomName); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	// Broadcast before purging the room's tables, so the event's entry in
+	// room_event_log goes with them.
+	event := &proto.DisconnectEvent{Reason: "room deleted"}
+	if err := rb.broadcast(ctx, t, proto.DisconnectEventType, event); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	// Capabilities and keys first, while the rows that tie them to the room
+	// are still around.
+	_, err = t.Exec(
+		"DELETE FROM capability WHERE id IN ("+
+			"SELECT capability_id FROM room_capability WHERE room = $1"+
+			" UNION SELECT capability_id FROM room_manager_capability WHERE room = $1)",
+		rb.RoomName)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	_, err = t.Exec(
+		"DELETE FROM master_key WHERE id IN (SELECT key_id FROM room_master_key WHERE room = $1)", rb.RoomName)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	for _, table := range roomTables {
+		if _, err := t.Exec("DELETE FROM "+table+" WHERE room = $1", rb.RoomName); err != nil {
+			rollback(ctx, t)
+			return err
+		}
+	}
+	if _, err := t.Exec("DELETE FROM room WHERE name = $1", rb.RoomName); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
@@ -14,11 +14,14 @@ import (
 )
 
 type RoomCapability struct {
-	Room         string    `db:"room"`
-	CapabilityID string    `db:"capability_id"`
-	AccountID    string    `db:"account_id"`
-	Granted      time.Time `db:"granted"`
-	Revoked      time.Time `db:"revoked"`
+	Room         string        `db:"room"`
+	CapabilityID string        `db:"capability_id"`
+	AccountID    string        `db:"account_id"`
+	Granted      time.Time     `db:"granted"`
+	Revoked      time.Time     `db:"revoked"`
+	Expires      gorp.NullTime `db:"expires"`
+	MaxUses      int           `db:"max_uses"`
+	Uses         int           `db:"uses"`
 }
 
 type RoomCapabilityBinding struct {
@@ -29,7 +32,13 @@ type RoomCapabilityBinding struct {
 
 func (rcb *RoomCapabilityBinding) CapabilityID() string { return rcb.Capability.CapabilityID() }
 
-type RoomManagerCapability RoomCapability
+type RoomManagerCapability struct {
+	Room         string    `db:"room"`
+	CapabilityID string    `db:"capability_id"`
+	AccountID    string    `db:"account_id"`
+	Granted      time.Time `db:"granted"`
+	Revoked      time.Time `db:"revoked"`
+}
 
 type RoomManagerCapabilityBinding struct {
 	AccountID string `db:"account_id"`
@@ -116,7 +125,8 @@ func (rmc *RoomMessageCapabilities) Get(ctx scope.Context, cid string) (security
 		`SELECT r.room, r.capability_id, r.granted, r.revoked,`+
 			` c.id, c.account_id, c.nonce, c.encrypted_private_data, c.public_data`+
 			` FROM room_capability r, capability c`+
-			` WHERE r.room = $1 AND c.id = $2 AND r.capability_id = c.id AND r.revoked < r.granted`,
+			` WHERE r.room = $1 AND c.id = $2 AND r.capability_id = c.id AND r.revoked < r.granted`+
+			` AND (r.expires IS NULL OR r.expires > NOW()) AND (r.max_uses = 0 OR r.uses < r.max_uses)`,
 		rmc.Room.Name, cid)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -131,6 +141,18 @@ func (rmc *RoomMessageCapabilities) Get(ctx scope.Context, cid string) (security
 func (rmc *RoomMessageCapabilities) Save(
 	ctx scope.Context, account proto.Account, c security.Capability) error {
 
+	return rmc.save(account, c, nil)
+}
+
+func (rmc *RoomMessageCapabilities) SaveLimited(
+	ctx scope.Context, c security.Capability, limits *proto.PasscodeGrantLimits) error {
+
+	return rmc.save(nil, c, limits)
+}
+
+func (rmc *RoomMessageCapabilities) save(
+	account proto.Account, c security.Capability, limits *proto.PasscodeGrantLimits) error {
+
 	capRow := &Capability{
 		ID:                   c.CapabilityID(),
 		NonceBytes:           NewByteAOrNull(c.Nonce()),
@@ -146,9 +168,36 @@ func (rmc *RoomMessageCapabilities) Save(
 		capRow.AccountID = account.ID().String()
 		roomCapRow.AccountID = account.ID().String()
 	}
+	if limits != nil {
+		if !limits.Expires.IsZero() {
+			roomCapRow.Expires = gorp.NullTime{Time: limits.Expires, Valid: true}
+		}
+		roomCapRow.MaxUses = limits.MaxUses
+	}
 	return rmc.Executor.Insert(capRow, roomCapRow)
 }
 
+func (rmc *RoomMessageCapabilities) Use(ctx scope.Context, cid string) error {
+	// The conditions are checked in the update itself, so concurrent uses
+	// can't exceed the limit.
+	resp, err := rmc.Executor.Exec(
+		"UPDATE room_capability SET uses = uses + 1"+
+			" WHERE room = $1 AND capability_id = $2"+
+			" AND (expires IS NULL OR expires > NOW()) AND (max_uses = 0 OR uses < max_uses)",
+		rmc.Room.Name, cid)
+	if err != nil {
+		return err
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrCapabilityNotFound
+	}
+	return nil
+}
+
 func (rmc *RoomMessageCapabilities) Remove(ctx scope.Context, capabilityID string) error {
 	resp, err := rmc.Executor.Exec("DELETE FROM capability WHERE id = $1", capabilityID)
 	if err != nil {
@@ -1,11 +1,15 @@
 package psql
 
-import "time"
+import (
+	"database/sql"
+	"time"
+)
 
 type SessionLog struct {
-	SessionID string    `db:"session_id"`
-	IP        string    `db:"ip"`
-	Room      string    `db:"room"`
-	UserAgent string    `db:"user_agent"`
-	Connected time.Time `db:"connected"`
+	SessionID  string         `db:"session_id"`
+	IP         string         `db:"ip"`
+	Room       string         `db:"room"`
+	UserAgent  string         `db:"user_agent"`
+	Connected  time.Time      `db:"connected"`
+	BotTokenID sql.NullString `db:"bot_token_id"`
 }
@@ -0,0 +1,207 @@
+package psql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+type Webhook struct {
+	ID      string    `db:"id"`
+	Room    string    `db:"room"`
+	URL     string    `db:"url"`
+	Events  string    `db:"events"`
+	Secret  string    `db:"secret"`
+	Created time.Time `db:"created"`
+}
+
+func (w *Webhook) ToBackend() *proto.Webhook {
+	webhook := &proto.Webhook{
+		URL:     w.URL,
+		Secret:  w.Secret,
+		Created: proto.Time(w.Created),
+	}
+	for _, event := range strings.Fields(w.Events) {
+		webhook.Events = append(webhook.Events, proto.PacketType(event))
+	}
+	// ignore id parsing errors
+	_ = webhook.ID.FromString(w.ID)
+	return webhook
+}
+
+func (rb *ManagedRoomBinding) Webhooks(ctx scope.Context) ([]*proto.Webhook, error) {
+	rows, err := rb.DbMap.Select(Webhook{},
+		"SELECT id, room, url, events, secret, created FROM webhook WHERE room = $1 ORDER BY id",
+		rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*proto.Webhook, len(rows))
+	for i, row := range rows {
+		webhooks[i] = row.(*Webhook).ToBackend()
+	}
+	return webhooks, nil
+}
+
+func (rb *ManagedRoomBinding) AddWebhook(ctx scope.Context, webhook *proto.Webhook) error {
+	events := make([]string, len(webhook.Events))
+	for i, event := range webhook.Events {
+		events[i] = string(event)
+	}
+	row := &Webhook{
+		ID:      webhook.ID.String(),
+		Room:    rb.RoomName,
+		URL:     webhook.URL,
+		Events:  strings.Join(events, " "),
+		Secret:  webhook.Secret,
+		Created: webhook.Created.StdTime(),
+	}
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Lock the room so concurrent additions can't exceed the limit.
+	if _, err := t.Exec("SELECT 1 FROM room WHERE name = $1 FOR UPDATE", rb.RoomName); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	n, err := t.SelectInt("SELECT COUNT(*) FROM webhook WHERE room = $1", rb.RoomName)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n >= proto.MaxWebhooks {
+		rollback(ctx, t)
+		return proto.ErrTooManyWebhooks
+	}
+	if err := t.Insert(row); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
+
+func (rb *ManagedRoomBinding) RemoveWebhook(ctx scope.Context, webhookID snowflake.Snowflake) error {
+	res, err := rb.DbMap.Exec(
+		"DELETE FROM webhook WHERE room = $1 AND id = $2", rb.RoomName, webhookID.String())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrWebhookNotFound
+	}
+	return nil
+}
+
+type IncomingWebhook struct {
+	ID         string    `db:"id"`
+	Room       string    `db:"room"`
+	Name       string    `db:"name"`
+	SecretHash string    `db:"secret_hash"`
+	Created    time.Time `db:"created"`
+}
+
+func (h *IncomingWebhook) ToBackend() *proto.IncomingWebhook {
+	hook := &proto.IncomingWebhook{
+		Name:       h.Name,
+		SecretHash: h.SecretHash,
+		Created:    proto.Time(h.Created),
+	}
+	// ignore id parsing errors
+	_ = hook.ID.FromString(h.ID)
+	return hook
+}
+
+func (rb *ManagedRoomBinding) IncomingWebhooks(ctx scope.Context) ([]*proto.IncomingWebhook, error) {
+	rows, err := rb.DbMap.Select(IncomingWebhook{},
+		"SELECT id, room, name, secret_hash, created FROM incoming_webhook WHERE room = $1 ORDER BY id",
+		rb.RoomName)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]*proto.IncomingWebhook, len(rows))
+	for i, row := range rows {
+		hooks[i] = row.(*IncomingWebhook).ToBackend()
+	}
+	return hooks, nil
+}
+
+func (rb *ManagedRoomBinding) GetIncomingWebhook(
+	ctx scope.Context, hookID snowflake.Snowflake) (*proto.IncomingWebhook, error) {
+
+	var row IncomingWebhook
+	err := rb.DbMap.SelectOne(&row,
+		"SELECT id, room, name, secret_hash, created FROM incoming_webhook WHERE room = $1 AND id = $2",
+		rb.RoomName, hookID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return row.ToBackend(), nil
+}
+
+func (rb *ManagedRoomBinding) AddIncomingWebhook(ctx scope.Context, hook *proto.IncomingWebhook) error {
+	row := &IncomingWebhook{
+		ID:         hook.ID.String(),
+		Room:       rb.RoomName,
+		Name:       hook.Name,
+		SecretHash: hook.SecretHash,
+		Created:    hook.Created.StdTime(),
+	}
+
+	t, err := rb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Lock the room so concurrent additions can't exceed the limit.
+	if _, err := t.Exec("SELECT 1 FROM room WHERE name = $1 FOR UPDATE", rb.RoomName); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	n, err := t.SelectInt("SELECT COUNT(*) FROM incoming_webhook WHERE room = $1", rb.RoomName)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n >= proto.MaxIncomingWebhooks {
+		rollback(ctx, t)
+		return proto.ErrTooManyWebhooks
+	}
+	if err := t.Insert(row); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	return t.Commit()
+}
+
+func (rb *ManagedRoomBinding) RemoveIncomingWebhook(ctx scope.Context, hookID snowflake.Snowflake) error {
+	res, err := rb.DbMap.Exec(
+		"DELETE FROM incoming_webhook WHERE room = $1 AND id = $2", rb.RoomName, hookID.String())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrWebhookNotFound
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"net/http"
+	"time"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const resumeTokenName = "resume"
+
+// A resumeToken is issued to a session in its snapshot. It entitles the same
+// agent to replay the room's events following the snapshot when reconnecting.
+type resumeToken struct {
+	Room      string
+	AgentID   string
+	SessionID string
+	Cursor    snowflake.Snowflake
+}
+
+func (s *Server) issueResumeToken(
+	room string, client *proto.Client, sessionID string, cursor snowflake.Snowflake) (string, error) {
+
+	return s.sc.Encode(resumeTokenName, &resumeToken{
+		Room:      room,
+		AgentID:   client.Agent.IDString(),
+		SessionID: sessionID,
+		Cursor:    cursor,
+	})
+}
+
+// resumePoint returns the resume token presented by a reconnecting client,
+// with its cursor advanced to the last event the client reports having seen.
+// It returns nil if the request doesn't carry a valid resume token or the
+// position has already expired from the room's event log.
+func (s *Server) resumePoint(r *http.Request, room proto.Room, client *proto.Client) *resumeToken {
+	encoded := r.URL.Query().Get("resume")
+	if encoded == "" {
+		return nil
+	}
+
+	token := &resumeToken{}
+	if err := s.sc.Decode(resumeTokenName, encoded, token); err != nil {
+		return nil
+	}
+	if token.Room != room.ID() || token.AgentID != client.Agent.IDString() {
+		return nil
+	}
+
+	// Never replay events from before the token was issued.
+	var cursor snowflake.Snowflake
+	if err := cursor.FromString(r.URL.Query().Get("cursor")); err == nil && token.Cursor.Before(cursor) {
+		token.Cursor = cursor
+	}
+
+	if token.Cursor.Time().Before(time.Now().Add(-proto.EventLogTTL)) {
+		return nil
+	}
+	return token
+}
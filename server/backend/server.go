@@ -13,10 +13,12 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
+	"github.com/juju/ratelimit"
 
 	"euphoria.leet.nu/heim/proto"
 	"euphoria.leet.nu/heim/proto/logging"
 	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
 	"euphoria.leet.nu/heim/templates"
 
 	gorillactx "github.com/gorilla/context"
@@ -49,7 +51,9 @@ type Server struct {
 
 	libPages *libPageSet
 
-	m sync.Mutex
+	m             sync.Mutex
+	hookLimiters  map[snowflake.Snowflake]*ratelimit.Bucket
+	sseTransports map[string]*sseTransport
 
 	agentIDGenerator func() ([]byte, error)
 }
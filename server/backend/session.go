@@ -12,25 +12,33 @@ import (
 	"time"
 
 	"euphoria.leet.nu/lib/scope"
-	"github.com/gorilla/websocket"
 	"github.com/juju/ratelimit"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"euphoria.leet.nu/heim/proto"
 	"euphoria.leet.nu/heim/proto/logging"
 	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
 )
 
 const (
 	MaxKeepAliveMisses      = 3
 	MaxAuthFailures         = 5
 	MaxConsecutiveThrottled = 10
+
+	// MaxEncryptedSearchScan bounds the number of messages decrypted in
+	// order to search the log of a private room.
+	MaxEncryptedSearchScan = 10000
 )
 
 var (
 	KeepAlive     = 20 * time.Second
 	FastKeepAlive = 2 * time.Second
 
+	// StaffOTPValidity is how long after a successful staff-validate-otp a
+	// staff member may issue commands that require it.
+	StaffOTPValidity = 5 * time.Minute
+
 	ErrUnresponsive = fmt.Errorf("connection unresponsive")
 	ErrReplaced     = fmt.Errorf("connection replaced")
 	ErrFlooding     = fmt.Errorf("connection flooding")
@@ -92,7 +100,7 @@ type session struct {
 	id          string
 	ctx         scope.Context
 	server      *Server
-	conn        *websocket.Conn
+	transport   transport
 	clientAddr  string
 	vClientAddr string
 	identity    *memIdentity
@@ -112,12 +120,27 @@ type session struct {
 	keyID    string
 	onClose  func()
 
+	// otpValidated is when the session's staff account last validated a
+	// one-time password.
+	otpValidated time.Time
+
+	// resume identifies the previous session and the position in the room's
+	// event log from which to replay events on joining, if it is resuming.
+	resume *resumeToken
+
+	// requestedName is the name the client connected to the room by, which
+	// may be one of its aliases.
+	requestedName string
+
 	incoming     chan *proto.Packet
 	outgoing     chan *proto.Packet
 	floodLimiter *ratelimit.Bucket
 
 	authFailCount int
 
+	// lastSeen is when the session's account was last recorded as online.
+	lastSeen time.Time
+
 	m                   sync.Mutex
 	joined              bool
 	maybeAbandoned      bool
@@ -129,7 +152,7 @@ type session struct {
 }
 
 func newSession(
-	ctx scope.Context, server *Server, conn *websocket.Conn, clientAddr string,
+	ctx scope.Context, server *Server, transport transport, clientAddr string,
 	room proto.Room, client *proto.Client, agentKey *security.ManagedKey,
 	verbose bool) *session {
 
@@ -142,7 +165,7 @@ func newSession(
 		id:          sessionID,
 		ctx:         ctx,
 		server:      server,
-		conn:        conn,
+		transport:   transport,
 		clientAddr:  clientAddr,
 		vClientAddr: clientAddr,
 		identity:    newMemIdentity(client.UserID(), server.ID, server.Era),
@@ -190,6 +213,7 @@ func (s *session) View(level proto.PrivilegeLevel) proto.SessionView {
 		SessionID:    s.id,
 		IsStaff:      s.client.Account != nil && s.client.Account.IsStaff(),
 		IsManager:    s.client.Authorization.ManagerKeyPair != nil,
+		IsBot:        s.client.BotToken != nil,
 	}
 
 	switch level {
@@ -203,20 +227,17 @@ func (s *session) View(level proto.PrivilegeLevel) proto.SessionView {
 	return view
 }
 
-func (s *session) writeMessage(messageType int, data []byte) error {
-	if err := s.conn.SetWriteDeadline(time.Now().Add(MaxKeepAliveMisses * KeepAlive)); err != nil {
-		return err
-	}
-	if err := s.conn.WriteMessage(messageType, data); err != nil {
-		return err
-	}
-	if err := s.conn.SetWriteDeadline(time.Time{}); err != nil {
-		return err
-	}
-	return nil
+func (s *session) writeMessage(data []byte) error {
+	return s.transport.WritePacket(data, MaxKeepAliveMisses*KeepAlive)
 }
 
 func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload interface{}) error {
+	var cursor snowflake.Snowflake
+	if logged, ok := payload.(*proto.LoggedEvent); ok {
+		cursor = logged.Cursor
+		payload = logged.Payload
+	}
+
 	// Special case: certain events have privileged info that may need to be stripped from them
 	switch event := payload.(type) {
 	case *proto.PresenceEvent:
@@ -236,6 +257,24 @@ func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload inte
 		if s.privilegeLevel() == proto.General {
 			event.Sender.ClientAddress = ""
 		}
+	case *proto.ReactionEvent:
+		if s.privilegeLevel() == proto.General {
+			event.Sender.ClientAddress = ""
+		}
+	case *proto.AnnouncementModeEvent:
+		// Each session learns whether it may still send, but only hosts learn
+		// who else may.
+		personal := *event
+		if s.privilegeLevel() == proto.General {
+			mode := proto.AnnouncementMode{Enabled: event.Enabled, Posters: event.Posters}
+			var accountID snowflake.Snowflake
+			if s.client.Account != nil {
+				accountID = s.client.Account.ID()
+			}
+			personal.ReadOnly = !mode.MaySend(accountID)
+			personal.Posters = nil
+		}
+		payload = &personal
 	}
 
 	var err error
@@ -250,8 +289,9 @@ func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload inte
 	}
 
 	cmd := &proto.Packet{
-		Type: cmdType,
-		Data: encoded,
+		Type:   cmdType,
+		Data:   encoded,
+		Cursor: cursor,
 	}
 
 	// Add to outgoing channel. If channel is full, defer to goroutine so as not to block
@@ -294,7 +334,12 @@ func (s *session) serve() error {
 		_, accountHasAccess = s.client.Authorization.MessageKeys[keyID]
 	}
 
-	if err := s.sendHello(isPrivate, accountHasAccess); err != nil {
+	isE2E, err := s.isE2E()
+	if err != nil {
+		return err
+	}
+
+	if err := s.sendHello(isPrivate, isE2E, accountHasAccess); err != nil {
 		return err
 	}
 
@@ -370,6 +415,10 @@ func (s *session) serve() error {
 			if err := s.sendPing(); err != nil {
 				return err
 			}
+
+			if s.joined {
+				s.markSeen(s.ctx, false)
+			}
 		case cmd := <-s.incoming:
 			reply := s.state(cmd)
 
@@ -413,7 +462,7 @@ func (s *session) serve() error {
 				return err
 			}
 
-			if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+			if err := s.writeMessage(data); err != nil {
 				logger.Printf("error: write message: %s", err)
 				return err
 			}
@@ -438,7 +487,7 @@ func (s *session) serve() error {
 				return err
 			}
 
-			if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+			if err := s.writeMessage(data); err != nil {
 				logger.Printf("error: write message: %s", err)
 				return err
 			}
@@ -456,9 +505,9 @@ func (s *session) readMessages() {
 	defer s.Close()
 
 	for s.ctx.Err() == nil {
-		messageType, data, err := s.conn.ReadMessage()
+		data, err := s.transport.ReadCommand()
 		if err != nil {
-			if err == io.EOF || websocket.IsCloseError(err, 1000, 1001, 1005, 1006) {
+			if err == io.EOF {
 				if s.verbose {
 					logger.Printf("client disconnected")
 				}
@@ -468,27 +517,50 @@ func (s *session) readMessages() {
 			return
 		}
 
-		switch messageType {
-		case websocket.TextMessage:
-			cmd, err := proto.ParseRequest(data)
-			if err != nil {
-				logger.Printf("error: ParseRequest: %s", err)
-				return
-			}
-			s.incoming <- cmd
-		default:
-			logger.Printf("error: unsupported message type: %v", messageType)
+		cmd, err := proto.ParseRequest(data)
+		if err != nil {
+			logger.Printf("error: ParseRequest: %s", err)
 			return
 		}
+		s.incoming <- cmd
 	}
 }
 
-func (s *session) sendSnapshot() error {
+func (s *session) sendSnapshot(cursor snowflake.Snowflake) error {
 	snapshot, err := s.room.Snapshot(s.ctx, s, s.privilegeLevel(), 100)
 	if err != nil {
 		return err
 	}
 
+	snapshot.Cursor = cursor
+	snapshot.Resumed = s.resume != nil
+	snapshot.ResumeToken, err = s.server.issueResumeToken(s.roomName, s.client, s.id, cursor)
+	if err != nil {
+		return err
+	}
+
+	if s.client.Account != nil {
+		snapshot.ReadMarker, snapshot.Unread, err = s.room.ReadMarker(s.ctx, s.client.Account.ID())
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.managedRoom != nil {
+		mode, err := s.managedRoom.AnnouncementMode(s.ctx)
+		if err != nil {
+			return err
+		}
+		snapshot.AnnouncementMode = mode.Enabled
+	}
+	switch err := s.checkMaySend(); err {
+	case nil:
+	case proto.ErrRoomArchived, proto.ErrAnnouncementOnly:
+		snapshot.ReadOnly = true
+	default:
+		return err
+	}
+
 	s.identity.name = snapshot.Nick
 
 	for i, msg := range snapshot.Log {
@@ -534,11 +606,13 @@ func (s *session) sendDisconnect(reason string) error {
 	return nil
 }
 
-func (s *session) privilegeLevel() proto.PrivilegeLevel {
+func (s *session) privilegeLevel() proto.PrivilegeLevel { return clientPrivilegeLevel(s.client) }
+
+func clientPrivilegeLevel(client *proto.Client) proto.PrivilegeLevel {
 	switch {
-	case s.client.Account != nil && s.client.Account.IsStaff():
+	case client.Account != nil && client.Account.IsStaff():
 		return proto.Staff
-	case s.client.Authorization.ManagerKeyPair != nil:
+	case client.Authorization.ManagerKeyPair != nil:
 		return proto.Host
 	default:
 		return proto.General
@@ -554,6 +628,13 @@ func (s *session) join() error {
 		s.identity.name = nick
 	}
 
+	// Events logged from here on will be observed by the session, either
+	// live or through the snapshot.
+	cursor, err := snowflake.New()
+	if err != nil {
+		return err
+	}
+
 	addr, err := s.room.Join(s.ctx, s)
 	if err != nil {
 		logging.Logger(s.ctx).Printf("join failed: %s", err)
@@ -574,25 +655,107 @@ func (s *session) join() error {
 				logging.Logger(ctx).Printf("%s", err.Error())
 				return err
 			}
+			s.markSeen(ctx, true)
+			presence := proto.PresenceEvent(s.View(proto.General))
+			s.dispatchWebhooks(ctx, proto.PartEventType, &presence)
 			return nil
 		})
 	}
+	s.markSeen(s.ctx, true)
+	presence := proto.PresenceEvent(s.View(proto.General))
+	s.dispatchWebhooks(s.ctx, proto.JoinEventType, &presence)
 
-	if err := s.sendSnapshot(); err != nil {
+	if err := s.sendSnapshot(cursor); err != nil {
 		logging.Logger(s.ctx).Printf("snapshot failed: %s", err)
 		return err
 	}
 
+	if s.resume != nil {
+		if err := s.replayEvents(cursor); err != nil {
+			logging.Logger(s.ctx).Printf("replay failed: %s", err)
+			return err
+		}
+	}
+
+	if err := s.sendRoomRenamed(); err != nil {
+		logging.Logger(s.ctx).Printf("room-renamed failed: %s", err)
+		return err
+	}
+
 	s.joined = true
 	return nil
 }
 
-func (s *session) sendHello(roomIsPrivate, accountHasAccess bool) error {
+// sendRoomRenamed tells a client that connected to the room by something
+// other than its canonical name which name it should use instead.
+func (s *session) sendRoomRenamed() error {
+	if s.managedRoom == nil || s.requestedName == "" {
+		return nil
+	}
+	canonical, err := s.managedRoom.CanonicalName(s.ctx)
+	if err != nil {
+		return err
+	}
+	if canonical == s.requestedName {
+		return nil
+	}
+	event, err := proto.MakeEvent(&proto.RoomRenamedEvent{From: s.requestedName, To: canonical})
+	if err != nil {
+		return err
+	}
+	s.outgoing <- event
+	return nil
+}
+
+// markSeen records that the session's account, if any, is online, so that it
+// isn't sent a digest of what it missed. Unless forced, updates are throttled
+// to one per proto.DigestSeenInterval.
+func (s *session) markSeen(ctx scope.Context, force bool) {
+	if s.client.Account == nil {
+		return
+	}
+
+	now := time.Now()
+	if !force && now.Sub(s.lastSeen) < proto.DigestSeenInterval {
+		return
+	}
+	s.lastSeen = now
+
+	if err := s.backend.DigestTracker().Seen(ctx, s.client.Account.ID(), now); err != nil {
+		logging.Logger(ctx).Printf("error recording account %s as seen: %s", s.client.Account.ID(), err)
+	}
+}
+
+// replayEvents sends the events the client missed between the point it is
+// resuming from and the given cursor. Later events are delivered live.
+func (s *session) replayEvents(until snowflake.Snowflake) error {
+	events, err := s.room.EventsSince(s.ctx, s.resume.Cursor)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		if !events[i].Cursor.Before(until) {
+			break
+		}
+		// Skip events the previous session wasn't meant to see, such as the
+		// announcement of its own arrival.
+		if events[i].Excludes(s.resume.SessionID) {
+			continue
+		}
+		if err := s.Send(s.ctx, events[i].Type, &events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) sendHello(roomIsPrivate, roomIsE2E, accountHasAccess bool) error {
 	logger := logging.Logger(s.ctx)
 	event := &proto.HelloEvent{
 		SessionView:      s.View(s.privilegeLevel()),
 		AccountHasAccess: accountHasAccess,
 		RoomIsPrivate:    roomIsPrivate,
+		RoomIsE2E:        roomIsE2E,
 		Version:          s.room.Version(),
 	}
 	if s.client.Account != nil {
@@ -613,7 +776,7 @@ func (s *session) sendHello(roomIsPrivate, accountHasAccess bool) error {
 		return err
 	}
 
-	if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+	if err := s.writeMessage(data); err != nil {
 		logger.Printf("error: write hello event: %s", err)
 		return err
 	}
@@ -638,7 +801,7 @@ func (s *session) sendPing() error {
 		return err
 	}
 
-	if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+	if err := s.writeMessage(data); err != nil {
 		logger.Printf("error: write ping event: %s", err)
 		return err
 	}
@@ -0,0 +1,188 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/logging"
+)
+
+const (
+	// SSETokenSize is the number of random bytes in the token that
+	// identifies an event stream to the commands POSTed for it.
+	SSETokenSize = 18
+
+	// MaxSSECommandSize is the largest command body that may be POSTed to an
+	// event stream.
+	MaxSSECommandSize = 4 * proto.MaxMessageLength
+)
+
+// An SSETokenEvent is the first event on an event stream. It carries the
+// token that commands for the session must be POSTed to.
+type SSETokenEvent struct {
+	Token string `json:"token"`
+}
+
+// sseTransport carries packets to the client as server-sent events, and
+// takes commands from HTTP POSTs naming the stream's token.
+type sseTransport struct {
+	room     string
+	w        io.Writer
+	rc       *http.ResponseController
+	commands chan []byte
+	done     <-chan struct{}
+}
+
+func (t *sseTransport) ReadCommand() ([]byte, error) {
+	select {
+	case data := <-t.commands:
+		return data, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *sseTransport) WritePacket(data []byte, timeout time.Duration) error {
+	return t.writeEvent("", data, timeout)
+}
+
+// writeEvent writes a single event to the stream and flushes it out to the
+// client. Packets are always encoded on one line, so each fits in a single
+// data field.
+func (t *sseTransport) writeEvent(event string, data []byte, timeout time.Duration) error {
+	if err := t.rc.SetWriteDeadline(time.Now().Add(timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	buf := make([]byte, 0, len(data)+len(event)+16)
+	if event != "" {
+		buf = append(buf, "event: "...)
+		buf = append(buf, event...)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, "data: "...)
+	buf = append(buf, data...)
+	buf = append(buf, "\n\n"...)
+	if _, err := t.w.Write(buf); err != nil {
+		return err
+	}
+	if err := t.rc.Flush(); err != nil {
+		return err
+	}
+
+	if err := t.rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleRoomEvents(w http.ResponseWriter, r *http.Request) {
+	if !checkOrigin(r) {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	req, ok := s.authorizeRoom(w, r, "sse")
+	if !ok {
+		return
+	}
+
+	tokenBytes := make([]byte, SSETokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		s.serveInternalError(req.ctx, w, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	transport := &sseTransport{
+		room:     mux.Vars(r)["prefix"] + mux.Vars(r)["room"],
+		w:        w,
+		rc:       http.NewResponseController(w),
+		commands: make(chan []byte),
+		done:     r.Context().Done(),
+	}
+
+	s.m.Lock()
+	if s.sseTransports == nil {
+		s.sseTransports = map[string]*sseTransport{}
+	}
+	s.sseTransports[token] = transport
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		delete(s.sseTransports, token)
+		s.m.Unlock()
+	}()
+
+	headers := w.Header()
+	if req.cookie != nil {
+		headers.Add("Set-Cookie", req.cookie.String())
+	}
+	headers.Set("Content-Type", "text/event-stream")
+	headers.Set("Cache-Control", "no-cache")
+	headers.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	data, err := json.Marshal(&SSETokenEvent{Token: token})
+	if err != nil {
+		logging.Logger(req.ctx).Printf("error encoding sse token: %s", err)
+		return
+	}
+	if err := transport.writeEvent("token", data, MaxKeepAliveMisses*KeepAlive); err != nil {
+		logging.Logger(req.ctx).Printf("error writing sse token: %s", err)
+		return
+	}
+
+	s.serveSession(req.ctx, transport, clientAddress(r), req.room, req.client, req.agentKey, r)
+}
+
+func (s *Server) handleRoomCommand(w http.ResponseWriter, r *http.Request) {
+	if !s.policy.AllowAPI {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Tokens are only known to the process that opened the stream. Clusters
+	// must route commands back to it; see the SSE transport in doc/api.md.
+	s.m.Lock()
+	transport, ok := s.sseTransports[mux.Vars(r)["token"]]
+	s.m.Unlock()
+	if !ok || transport.room != mux.Vars(r)["prefix"]+mux.Vars(r)["room"] {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxSSECommandSize+1))
+	if err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > MaxSSECommandSize {
+		http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, err := proto.ParseRequest(data); err != nil {
+		http.Error(w, "400 bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The reply arrives on the event stream. Block until the session takes
+	// the command, so that commands POSTed in turn are handled in order.
+	select {
+	case transport.commands <- data:
+		w.WriteHeader(http.StatusAccepted)
+	case <-transport.done:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A transport carries packets between a session and its client.
+type transport interface {
+	// ReadCommand blocks until the client sends a command, and returns it
+	// undecoded. It returns io.EOF once the client has gone away.
+	ReadCommand() ([]byte, error)
+
+	// WritePacket sends an encoded packet to the client, giving up if it
+	// can't be written within the given timeout.
+	WritePacket(data []byte, timeout time.Duration) error
+}
+
+// websocketTransport carries packets as text messages over a websocket.
+type websocketTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *websocketTransport) ReadCommand() ([]byte, error) {
+	messageType, data, err := t.conn.ReadMessage()
+	if err != nil {
+		if err == io.EOF || websocket.IsCloseError(err, 1000, 1001, 1005, 1006) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if messageType != websocket.TextMessage {
+		return nil, fmt.Errorf("unsupported message type: %v", messageType)
+	}
+	return data, nil
+}
+
+func (t *websocketTransport) WritePacket(data []byte, timeout time.Duration) error {
+	if err := t.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := t.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	if err := t.conn.SetWriteDeadline(time.Time{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// clientAddress determines the address of the client making a request.
+func clientAddress(r *http.Request) string {
+	if addr := r.Header.Get("X-Forwarded-For"); addr != "" {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
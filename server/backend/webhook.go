@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/jobs"
+	"euphoria.leet.nu/heim/proto/logging"
+)
+
+// dispatchWebhooks queues delivery of a room event to each of the session's
+// room's webhooks that subscribes to it.
+func (s *session) dispatchWebhooks(ctx scope.Context, eventType proto.PacketType, payload interface{}) {
+	if s.managedRoom == nil {
+		return
+	}
+	dispatchWebhooks(ctx, s.backend, s.managedRoom, s.roomName, eventType, payload)
+}
+
+// dispatchWebhooks queues delivery of a room event to each of the room's
+// webhooks that subscribes to it. Delivery happens in the webhooks job queue,
+// so a slow or failing endpoint never holds up the room. Failures to queue
+// are logged rather than returned.
+func dispatchWebhooks(
+	ctx scope.Context, b proto.Backend, room proto.ManagedRoom, roomName string, eventType proto.PacketType,
+	payload interface{}) {
+
+	webhooks, err := room.Webhooks(ctx)
+	if err != nil {
+		logging.Logger(ctx).Printf("webhook lookup failed: %s", err)
+		return
+	}
+
+	var jq jobs.JobQueue
+	for _, webhook := range webhooks {
+		if !webhook.Accepts(eventType) {
+			continue
+		}
+		if jq == nil {
+			jq, err = b.Jobs().GetQueue(ctx, jobs.WebhookQueue)
+			if err != nil {
+				logging.Logger(ctx).Printf("webhook queue error: %s", err)
+				return
+			}
+		}
+		job, err := proto.NewWebhookJob(roomName, webhook, eventType, payload)
+		if err != nil {
+			logging.Logger(ctx).Printf("webhook %s encode failed: %s", webhook.ID, err)
+			continue
+		}
+		if _, err := jq.Add(ctx, jobs.WebhookJobType, job, jobs.WebhookJobOptions...); err != nil {
+			logging.Logger(ctx).Printf("webhook %s enqueue failed: %s", webhook.ID, err)
+		}
+	}
+}
+
+func (s *session) handleAddWebhookCommand(msg *proto.AddWebhookCommand) *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	webhook, err := proto.NewWebhook(msg.URL, msg.Events, msg.Secret)
+	if err != nil {
+		return &response{err: err}
+	}
+	if err := s.managedRoom.AddWebhook(s.ctx, webhook); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.AddWebhookReply{Webhook: *webhook, Secret: webhook.Secret}}
+}
+
+func (s *session) handleListWebhooksCommand() *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	webhooks, err := s.managedRoom.Webhooks(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	reply := &proto.ListWebhooksReply{Webhooks: make([]proto.Webhook, len(webhooks))}
+	for i, webhook := range webhooks {
+		reply.Webhooks[i] = *webhook
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleRemoveWebhookCommand(msg *proto.RemoveWebhookCommand) *response {
+	if s.managedRoom == nil || s.privilegeLevel() == proto.General {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if err := s.managedRoom.RemoveWebhook(s.ctx, msg.ID); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.RemoveWebhookReply{ID: msg.ID}}
+}
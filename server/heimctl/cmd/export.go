@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/heimctl/export"
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/logging"
+	"euphoria.leet.nu/heim/proto/security"
+)
+
+func init() {
+	register("export-room", &exportRoomCmd{})
+}
+
+type exportRoomCmd struct {
+	format string
+	since  string
+	until  string
+	key    string
+}
+
+func (exportRoomCmd) desc() string { return "write an archive of a room's messages" }
+
+func (exportRoomCmd) usage() string {
+	return "export-room [--format=json|markdown|html] [--since=TIME] [--until=TIME] [--key=HEX] <room> <file>"
+}
+
+func (exportRoomCmd) longdesc() string {
+	return `
+	Write every message in the given room to a file, as JSON lines of
+	messages (the default), as a Markdown document with one nested list
+	per thread, or as a static HTML page rendered from the archive page
+	template. Deleted messages are left out.
+
+	The --since and --until options restrict the archive to messages
+	posted in that range, given either as RFC 3339 times or as dates
+	(YYYY-MM-DD). Replies to messages outside of the range are placed at
+	the top level of Markdown and HTML archives.
+
+	Private rooms can only be exported with their message key, which
+	must be given in hex with --key. Messages encrypted with keys the
+	room has since rotated away from are decrypted through the room's
+	key history.
+
+	Messages of end-to-end encrypted rooms can't be decrypted by the
+	server. They are archived as ciphertext and keep their e2e/ key id.
+`[1:]
+}
+
+func (cmd *exportRoomCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("export-room", flag.ExitOnError)
+	flags.StringVar(&cmd.format, "format", export.JSON, "archive format (json, markdown, or html)")
+	flags.StringVar(&cmd.since, "since", "", "leave out messages posted before this time")
+	flags.StringVar(&cmd.until, "until", "", "leave out messages posted at or after this time")
+	flags.StringVar(&cmd.key, "key", "", "message key of a private room, in hex")
+	return flags
+}
+
+func (cmd *exportRoomCmd) run(ctx scope.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s", cmd.usage())
+	}
+	roomName, path := args[0], args[1]
+
+	since, err := parseExportTime(cmd.since)
+	if err != nil {
+		return fmt.Errorf("--since: %s", err)
+	}
+	until, err := parseExportTime(cmd.until)
+	if err != nil {
+		return fmt.Errorf("--until: %s", err)
+	}
+
+	heim, b, err := getHeimWithPsqlBackend(ctx)
+	if err != nil {
+		return err
+	}
+	defer heim.Backend.Close()
+
+	room, err := b.GetRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+
+	var auth proto.Authorization
+	if cmd.key != "" {
+		plaintext, err := hex.DecodeString(cmd.key)
+		if err != nil || len(plaintext) != proto.RoomMessageKeyType.KeySize() {
+			return fmt.Errorf("--key: must be %d bytes in hex", proto.RoomMessageKeyType.KeySize())
+		}
+		keyID, isPrivate, err := room.MessageKeyID(ctx)
+		if err != nil {
+			return err
+		}
+		if !isPrivate {
+			return fmt.Errorf("--key: %s is not a private room", roomName)
+		}
+		key := &security.ManagedKey{KeyType: proto.RoomMessageKeyType, Plaintext: plaintext}
+		if err := auth.AddMessageKeyHistory(ctx, room, keyID, key); err != nil {
+			return fmt.Errorf("--key: %s", err)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := export.NewWriter(cmd.format, f, roomName, heim.PageTemplater)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = b.ExportRoom(ctx, roomName, since, until, func(msg *proto.Message) error {
+		decrypted, err := proto.DecryptMessage(*msg, auth.MessageKeys, proto.General)
+		if err != nil {
+			if err == proto.ErrAccessDenied {
+				if cmd.key == "" {
+					return fmt.Errorf("message %s is encrypted; the room's key must be given with --key", msg.ID)
+				}
+				return fmt.Errorf("message %s is encrypted with a different key", msg.ID)
+			}
+			return fmt.Errorf("message %s: %s", msg.ID, err)
+		}
+		if !proto.IsE2EEncrypted(decrypted.EncryptionKeyID) {
+			decrypted.EncryptionKeyID = ""
+		}
+		count++
+		return w.Write(&decrypted)
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	logging.Logger(ctx).Printf("exported %d messages from &%s to %s", count, roomName, path)
+	return nil
+}
+
+// parseExportTime parses an RFC 3339 time or a date. An empty string gives
+// the zero time.
+func parseExportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/logging"
+	"euphoria.leet.nu/heim/proto/security"
+)
+
+// maxImportLineSize is the longest line accepted from a message dump.
+const maxImportLineSize = 1024 * 1024
+
+func init() {
+	register("import-room", &importRoomCmd{})
+}
+
+type importRoomCmd struct {
+	encrypt bool
+}
+
+func (importRoomCmd) desc() string  { return "load messages into a room from an archive" }
+func (importRoomCmd) usage() string { return "import-room [--encrypt] <room> <file>" }
+
+func (importRoomCmd) longdesc() string {
+	return `
+	Load messages into an existing room from a JSON-lines archive, as
+	written by export-room. Messages keep their ids, parents, senders,
+	and times. They are added to the room's log without being broadcast
+	to anyone in the room.
+
+	All messages are imported in a single transaction. If any of their
+	ids are already in the room's log, nothing is imported.
+
+	With --encrypt, messages are encrypted under the room's current
+	message key as they're imported, as they would be if they had been
+	sent to the room. It is required when importing into a private
+	room. Encrypted messages can't be imported, and nothing can be
+	imported into an end-to-end encrypted room.
+`[1:]
+}
+
+func (cmd *importRoomCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("import-room", flag.ExitOnError)
+	flags.BoolVar(&cmd.encrypt, "encrypt", false, "encrypt messages under the room's message key")
+	return flags
+}
+
+func (cmd *importRoomCmd) run(ctx scope.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s", cmd.usage())
+	}
+	roomName, path := args[0], args[1]
+
+	heim, b, err := getHeimWithPsqlBackend(ctx)
+	if err != nil {
+		return err
+	}
+	defer heim.Backend.Close()
+
+	room, err := b.GetRoom(ctx, roomName)
+	if err != nil {
+		return err
+	}
+
+	keyID, isPrivate, err := room.MessageKeyID(ctx)
+	if err != nil {
+		return err
+	}
+	if isPrivate != cmd.encrypt {
+		if isPrivate {
+			return fmt.Errorf("%s is a private room; messages must be imported with --encrypt", roomName)
+		}
+		return fmt.Errorf("--encrypt: %s is not a private room", roomName)
+	}
+
+	var key security.ManagedKey
+	if cmd.encrypt {
+		mkey, err := room.MessageKey(ctx)
+		if err != nil {
+			return err
+		}
+		key = mkey.ManagedKey()
+		if err := heim.KMS.DecryptKey(&key); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+	line := 0
+	next := func() (*proto.Message, error) {
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			msg := &proto.Message{}
+			if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			if msg.EncryptionKeyID != "" {
+				return nil, fmt.Errorf("%s:%d: message %s is encrypted", path, line, msg.ID)
+			}
+			if cmd.encrypt {
+				if err := proto.EncryptMessage(msg, keyID, &key); err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+				}
+			}
+			return msg, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	count, err := b.ImportRoom(ctx, roomName, next)
+	if err != nil {
+		return err
+	}
+
+	logging.Logger(ctx).Printf("imported %d messages from %s into &%s", count, path, roomName)
+	return nil
+}
@@ -16,6 +16,7 @@ func init() {
 type retentionCmd struct {
 	addr     string
 	interval time.Duration
+	purge    bool
 }
 
 func (retentionCmd) desc() string {
@@ -23,14 +24,19 @@ func (retentionCmd) desc() string {
 }
 
 func (retentionCmd) usage() string {
-	return "log-retention [--http=<interface:port>] [--interval=DURATION]"
+	return "log-retention [--http=<interface:port>] [--interval=DURATION] [--purge=false]"
 }
 
 func (retentionCmd) longdesc() string {
 	return `
 	Start the service that deletes expired messages. This is a service that 
 	polls the postgres db for messages sent longer than the per-room retention
-	duration and deletes them.
+	duration (plus a grace period of one hour) and deletes them, together with
+	their edit history, in bounded batches.
+
+	Several instances may run at once; rooms are divided between the instances
+	that are alive in the cluster. With --purge=false, expired messages are
+	only reported through metrics.
 `[1:]
 }
 
@@ -38,6 +44,7 @@ func (cmd *retentionCmd) flags() *flag.FlagSet {
 	flags := flag.NewFlagSet("log-retention", flag.ExitOnError)
 	flags.StringVar(&cmd.addr, "http", ":8080", "address to serve metrics on")
 	flags.DurationVar(&cmd.interval, "interval", 60*time.Second, "sleep interval between presence table scans")
+	flags.BoolVar(&cmd.purge, "purge", true, "delete expired messages")
 	return flags
 }
 
@@ -57,13 +64,20 @@ func (cmd *retentionCmd) run(ctx scope.Context, args []string) error {
 	ctx.WaitGroup().Add(1)
 	go retention.Serve(ctx, cmd.addr)
 
+	if !cmd.purge {
+		// only run metrics scanner
+		ctx.WaitGroup().Add(1)
+		retention.ExpiredScanLoop(ctx, heim.Cluster, b, cmd.interval)
+		return nil
+	}
+
 	// start metrics scanner
 	ctx.WaitGroup().Add(1)
 	go retention.ExpiredScanLoop(ctx, heim.Cluster, b, cmd.interval)
 
 	// start delete scanner
 	ctx.WaitGroup().Add(1)
-	retention.DeleteScanLoop(ctx, heim.Cluster, b, cmd.interval)
+	retention.DeleteScanLoop(ctx, heim.Cluster, heim.PeerDesc, b, cmd.interval)
 
 	return nil
 }
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/logging"
+	"euphoria.leet.nu/heim/proto/security"
+)
+
+func init() {
+	register("rotate-kms", &rotateKMSCmd{})
+}
+
+type rotateKMSCmd struct {
+	skipStaff bool
+}
+
+func (rotateKMSCmd) desc() string  { return "re-encrypt stored keys under the current KMS master key" }
+func (rotateKMSCmd) usage() string { return "rotate-kms [--skip-staff]" }
+
+func (rotateKMSCmd) longdesc() string {
+	return `
+	Re-encrypt every key stored by the KMS under its current master key.
+	This covers room management and message keys, account system keys,
+	PM keys, and staff OTP keys. The keys themselves are unchanged, so
+	nothing encrypted with them needs to be rewritten.
+
+	Only KMS types with versioned master keys (-kms-keyring-dir) can be
+	rotated. To rotate, add a new <version>.key file to the keyring with
+	a higher version than any already there, run rotate-kms, and then
+	remove the old key files once no server is using them.
+
+	To move from -kms-local-key-file to a keyring, copy the local key
+	file into the keyring as 1.key and run rotate-kms. Keys written by
+	the local KMS are rewrapped into the keyring format.
+
+	Staff capabilities hold a copy of the KMS credential, so they are
+	regranted with the current keyring unless --skip-staff is given.
+`[1:]
+}
+
+func (cmd *rotateKMSCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("rotate-kms", flag.ExitOnError)
+	flags.BoolVar(&cmd.skipStaff, "skip-staff", false, "do not regrant staff capabilities")
+	return flags
+}
+
+func (cmd *rotateKMSCmd) run(ctx scope.Context, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %s", cmd.usage())
+	}
+
+	heim, b, err := getHeimWithPsqlBackend(ctx)
+	if err != nil {
+		return err
+	}
+	defer heim.Backend.Close()
+
+	kms, ok := heim.KMS.(security.KeyRewrapper)
+	if !ok {
+		return fmt.Errorf("configured kms does not support key rotation")
+	}
+
+	count, err := b.RewrapKeys(ctx, kms)
+	if err != nil {
+		return err
+	}
+	logging.Logger(ctx).Printf("rewrapped %d keys", count)
+
+	if cmd.skipStaff {
+		return nil
+	}
+
+	kmsCred, ok := heim.KMS.(security.KMSCredential)
+	if !ok {
+		return fmt.Errorf("configured kms cannot be granted to staff")
+	}
+	count, err = b.RegrantStaff(ctx, kmsCred)
+	if err != nil {
+		return err
+	}
+	logging.Logger(ctx).Printf("regranted %d staff capabilities", count)
+	return nil
+}
@@ -115,6 +115,9 @@ func (cmd *testmailCmd) run(ctx scope.Context, args []string) error {
 	if err != nil {
 		return fmt.Errorf("send failed: %s", err)
 	}
+	if ref == nil {
+		return fmt.Errorf("send skipped: %s has opted out of %s emails", args[1], templateName)
+	}
 
 	fmt.Fprintln(os.Stderr, "Sent email successfully.")
 	fmt.Printf("Message ID: %s\n", ref.ID)
@@ -25,13 +25,20 @@ func (workerCmd) desc() string {
 }
 
 func (workerCmd) usage() string {
-	return "worker [--http=<interface:port>] [--worker=ID] QUEUE"
+	return "worker [--http=<interface:port>] [--worker=ID] [--digest-idle=DURATION] QUEUE"
 }
 
 func (workerCmd) longdesc() string {
 	return `
 	Run a worker for processing job items from QUEUE. The worker will idle
 	until it can claim a job.
+
+	The digests queue schedules its own jobs, emailing a summary of missed
+	mentions and unread PMs to accounts that have opted in and have been
+	offline for longer than --digest-idle.
+
+	The webhooks queue delivers room events to the outgoing webhooks
+	registered by room hosts.
 `[1:]
 }
 
@@ -39,6 +46,8 @@ func (cmd *workerCmd) flags() *flag.FlagSet {
 	flags := flag.NewFlagSet("worker", flag.ExitOnError)
 	flags.StringVar(&cmd.addr, "http", ":8080", "address to serve metrics on")
 	flags.StringVar(&cmd.worker, "worker", "worker", "prefix for handler IDs")
+	flags.DurationVar(&worker.DigestIdle, "digest-idle", worker.DigestIdle,
+		"how long an account must be offline before it is sent a digest")
 	return flags
 }
 
@@ -0,0 +1,199 @@
+// Package export writes archives of a room's messages.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"euphoria.leet.nu/heim/backend"
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+	"euphoria.leet.nu/heim/templates"
+)
+
+// The formats an archive may be written in.
+const (
+	JSON     = "json"
+	Markdown = "markdown"
+	HTML     = "html"
+)
+
+// TimeFormat is how message times are written in Markdown and HTML archives.
+const TimeFormat = "2006-01-02 15:04:05 UTC"
+
+// A Writer writes an archive of a room's messages. Messages must be given to
+// it oldest first. Nothing may be written until the Writer is closed.
+type Writer interface {
+	Write(msg *proto.Message) error
+	Close() error
+}
+
+// NewWriter returns a Writer for the given format. The templater is only
+// needed for HTML archives.
+func NewWriter(format string, w io.Writer, room string, templater templates.Templater) (Writer, error) {
+	switch format {
+	case JSON:
+		return &jsonWriter{enc: json.NewEncoder(w)}, nil
+	case Markdown:
+		return &markdownWriter{w: w, room: room}, nil
+	case HTML:
+		if templater == nil {
+			return nil, fmt.Errorf("html archives need page templates")
+		}
+		return &htmlWriter{w: w, room: room, templater: templater}, nil
+	default:
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+}
+
+// jsonWriter writes each message as a line of JSON, as it's given.
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (jw *jsonWriter) Write(msg *proto.Message) error { return jw.enc.Encode(msg) }
+func (jw *jsonWriter) Close() error                   { return nil }
+
+// A thread is a message and its replies.
+type thread struct {
+	msg     proto.Message
+	replies []*thread
+}
+
+// A tree collects messages into threads. Replies to messages that aren't in
+// the tree, because they were deleted or fell outside of the exported time
+// range, are placed at the top level.
+type tree struct {
+	roots []*thread
+	byID  map[snowflake.Snowflake]*thread
+}
+
+func (t *tree) add(msg *proto.Message) {
+	if t.byID == nil {
+		t.byID = map[snowflake.Snowflake]*thread{}
+	}
+	node := &thread{msg: *msg}
+	t.byID[msg.ID] = node
+	if parent, ok := t.byID[msg.Parent]; ok && msg.Parent != 0 {
+		parent.replies = append(parent.replies, node)
+	} else {
+		t.roots = append(t.roots, node)
+	}
+}
+
+// walk visits every message in the tree, depth first, giving its depth in
+// the thread.
+func (t *tree) walk(fn func(msg *proto.Message, depth int) error) error {
+	var visit func(threads []*thread, depth int) error
+	visit = func(threads []*thread, depth int) error {
+		for _, node := range threads {
+			if err := fn(&node.msg, depth); err != nil {
+				return err
+			}
+			if err := visit(node.replies, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(t.roots, 0)
+}
+
+func formatTime(t proto.Time) string { return time.Time(t).UTC().Format(TimeFormat) }
+
+// markdownWriter writes the room as nested lists, one per thread.
+type markdownWriter struct {
+	tree
+	w    io.Writer
+	room string
+}
+
+func (mw *markdownWriter) Write(msg *proto.Message) error {
+	mw.add(msg)
+	return nil
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`)
+
+func (mw *markdownWriter) Close() error {
+	if _, err := fmt.Fprintf(mw.w, "# &%s\n", mw.room); err != nil {
+		return err
+	}
+	return mw.walk(func(msg *proto.Message, depth int) error {
+		indent := strings.Repeat("  ", depth)
+		if depth == 0 {
+			if _, err := io.WriteString(mw.w, "\n"); err != nil {
+				return err
+			}
+		}
+		lines := strings.Split(msg.Content, "\n")
+		_, err := fmt.Fprintf(mw.w, "%s- **%s** (%s): %s\n",
+			indent, markdownEscaper.Replace(msg.Sender.Name), formatTime(msg.UnixTime), lines[0])
+		if err != nil {
+			return err
+		}
+		for _, line := range lines[1:] {
+			if _, err := fmt.Fprintf(mw.w, "%s  %s\n", indent, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// An ArchivePage is the data an HTML archive is rendered from.
+type ArchivePage struct {
+	Room     string
+	Messages []ArchiveMessage
+}
+
+// An ArchiveMessage is a message in an HTML archive, flattened out of its
+// thread. Depth gives how deeply it's nested under the top of the thread.
+type ArchiveMessage struct {
+	ID      string
+	Depth   int
+	Sender  string
+	Time    string
+	Content string
+}
+
+// htmlWriter renders the room through the archive page template.
+type htmlWriter struct {
+	tree
+	w         io.Writer
+	room      string
+	templater templates.Templater
+}
+
+func (hw *htmlWriter) Write(msg *proto.Message) error {
+	hw.add(msg)
+	return nil
+}
+
+func (hw *htmlWriter) Close() error {
+	page := &ArchivePage{Room: hw.room}
+	err := hw.walk(func(msg *proto.Message, depth int) error {
+		page.Messages = append(page.Messages, ArchiveMessage{
+			ID:      msg.ID.String(),
+			Depth:   depth,
+			Sender:  msg.Sender.Name,
+			Time:    formatTime(msg.UnixTime),
+			Content: msg.Content,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	content, err := hw.templater.Evaluate(backend.ArchivePage, page)
+	if err != nil {
+		return err
+	}
+	_, err = hw.w.Write(content)
+	return err
+}
@@ -0,0 +1,104 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/snowflake"
+	"euphoria.leet.nu/heim/templates"
+)
+
+func TestWriters(t *testing.T) {
+	posted := proto.Time(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	message := func(id, parent snowflake.Snowflake, sender, content string) *proto.Message {
+		return &proto.Message{
+			ID:       id,
+			Parent:   parent,
+			UnixTime: posted,
+			Sender:   proto.SessionView{IdentityView: proto.IdentityView{Name: sender}},
+			Content:  content,
+		}
+	}
+
+	// A reply to a message outside of the export comes last.
+	msgs := []*proto.Message{
+		message(1, 0, "alice", "root"),
+		message(2, 1, "bob", "reply"),
+		message(3, 0, "carol", "other\nthread"),
+		message(4, 2, "al*ce", "nested"),
+		message(5, 99, "bob", "orphan"),
+	}
+
+	write := func(w Writer) {
+		for _, msg := range msgs {
+			So(w.Write(msg), ShouldBeNil)
+		}
+		So(w.Close(), ShouldBeNil)
+	}
+
+	Convey("JSON archives have one message per line", t, func() {
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(JSON, buf, "test", nil)
+		So(err, ShouldBeNil)
+		write(w)
+
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		So(len(lines), ShouldEqual, len(msgs))
+		for i, line := range lines {
+			var msg proto.Message
+			So(json.Unmarshal([]byte(line), &msg), ShouldBeNil)
+			So(msg.ID, ShouldEqual, msgs[i].ID)
+			So(msg.Content, ShouldEqual, msgs[i].Content)
+		}
+	})
+
+	Convey("Markdown archives nest threads", t, func() {
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(Markdown, buf, "test", nil)
+		So(err, ShouldBeNil)
+		write(w)
+
+		So(buf.String(), ShouldEqual, `# &test
+
+- **alice** (2015-01-01 00:00:00 UTC): root
+  - **bob** (2015-01-01 00:00:00 UTC): reply
+    - **al\*ce** (2015-01-01 00:00:00 UTC): nested
+
+- **carol** (2015-01-01 00:00:00 UTC): other
+  thread
+
+- **bob** (2015-01-01 00:00:00 UTC): orphan
+`)
+	})
+
+	Convey("HTML archives are rendered through the archive template", t, func() {
+		tmpl, err := template.New("archive").Parse(
+			`{{define "archive.html"}}{{.Room}}:{{range .Messages}} {{.Depth}}/{{.Sender}}{{end}}{{end}}`)
+		So(err, ShouldBeNil)
+		templater := &templates.StandardTemplater{Templates: map[string]*template.Template{"archive": tmpl}}
+
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(HTML, buf, "test", templater)
+		So(err, ShouldBeNil)
+		write(w)
+
+		So(buf.String(), ShouldEqual, "test: 0/alice 1/bob 2/al*ce 0/carol 0/bob")
+	})
+
+	Convey("HTML archives need templates", t, func() {
+		_, err := NewWriter(HTML, &bytes.Buffer{}, "test", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Unknown formats are rejected", t, func() {
+		_, err := NewWriter("pdf", &bytes.Buffer{}, "test", nil)
+		So(err, ShouldNotBeNil)
+	})
+}
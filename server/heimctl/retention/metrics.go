@@ -20,10 +20,31 @@ var (
 		Subsystem: "retention",
 		Help:      "The last Unix time the delete message scanner loop completed.",
 	})
+
+	purgedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:      "purged_messages",
+		Subsystem: "retention",
+		Help:      "Count of expired messages deleted, labeled by room name.",
+	}, []string{"room"})
+
+	purgedEdits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:      "purged_edits",
+		Subsystem: "retention",
+		Help:      "Count of edit log entries deleted along with expired messages, labeled by room name.",
+	}, []string{"room"})
+
+	purgeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:      "purge_errors",
+		Subsystem: "retention",
+		Help:      "Count of rooms that failed to be purged.",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(roomHasExpiredMsg)
 	prometheus.MustRegister(lastExpiredScan)
 	prometheus.MustRegister(lastDeleteScan)
+	prometheus.MustRegister(purgedMessages)
+	prometheus.MustRegister(purgedEdits)
+	prometheus.MustRegister(purgeErrors)
 }
@@ -3,6 +3,8 @@ package retention
 import (
 	"database/sql"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"time"
 
 	"euphoria.leet.nu/lib/scope"
@@ -16,6 +18,8 @@ import (
 
 const (
 	maxErrors   = 3
+	batchSize   = 1000
+	purgersDir  = "retention/purgers"
 	GracePeriod = time.Hour
 )
 
@@ -86,7 +90,84 @@ func ExpiredScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, int
 	}
 }
 
-func scanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
+// purgeBatch deletes up to batchSize expired messages from a room, along with
+// their edit history, reactions, and mentions, in a single statement.
+const purgeBatch = `
+WITH expired AS (
+    SELECT id FROM message WHERE room = $1 AND posted < $2 ORDER BY posted LIMIT $3
+), edits AS (
+    DELETE FROM message_edit_log WHERE room = $1 AND message_id IN (SELECT id FROM expired)
+    RETURNING 1
+), reactions AS (
+    DELETE FROM message_reaction WHERE room = $1 AND message_id IN (SELECT id FROM expired)
+), mentions AS (
+    DELETE FROM mention WHERE room = $1 AND message_id IN (SELECT id FROM expired)
+), messages AS (
+    DELETE FROM message WHERE room = $1 AND id IN (SELECT id FROM expired)
+    RETURNING 1
+)
+SELECT (SELECT COUNT(*) FROM messages) AS messages, (SELECT COUNT(*) FROM edits) AS edits`
+
+// purgers returns the sorted IDs of the live peers taking part in purging,
+// after registering self among them. Registrations are keyed by peer ID and
+// tagged with the era, so that stale entries from previous runs are ignored.
+func purgers(c cluster.Cluster, self *cluster.PeerDesc) ([]string, error) {
+	if self == nil || self.ID == "" {
+		return nil, nil
+	}
+	if err := c.SetValue(purgersDir+"/"+self.ID, self.Era); err != nil {
+		return nil, err
+	}
+	registered, err := c.GetDir(purgersDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{self.ID}
+	for _, peer := range c.Peers() {
+		if peer.ID != self.ID && registered[peer.ID] == peer.Era {
+			ids = append(ids, peer.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// assigned reports whether the given room falls to self among the purgers.
+// Rooms are divided between peers by hashing the room name, so that each
+// room is purged by exactly one peer as long as they agree on membership.
+func assigned(room, self string, purgers []string) bool {
+	if len(purgers) < 2 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(room))
+	return purgers[int(h.Sum32()%uint32(len(purgers)))] == self
+}
+
+func purgeRoom(ctx scope.Context, pb *psql.Backend, room string, threshold time.Time) error {
+	for {
+		var result struct {
+			Messages int64
+			Edits    int64
+		}
+		if err := pb.DbMap.SelectOne(&result, purgeBatch, room, threshold, batchSize); err != nil {
+			return err
+		}
+		purgedMessages.With(prometheus.Labels{"room": room}).Add(float64(result.Messages))
+		purgedEdits.With(prometheus.Labels{"room": room}).Add(float64(result.Edits))
+		if result.Messages < batchSize {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+}
+
+func scanToDelete(ctx scope.Context, c cluster.Cluster, self *cluster.PeerDesc, pb *psql.Backend) error {
 	rows, err := pb.DbMap.Select(
 		psql.Room{},
 		"SELECT name, founded_by, retention_days FROM room WHERE retention_days > 0")
@@ -97,28 +178,42 @@ func scanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error
 	if err != nil {
 		return err
 	}
+
+	peers, err := purgers(c, self)
+	if err != nil {
+		return err
+	}
+	var selfID string
+	if self != nil {
+		selfID = self.ID
+	}
+
 	for _, row := range rows {
 		room, ok := row.(*psql.Room)
 		if !ok {
 			logging.Logger(ctx).Printf("error: expected row of type *psql.Room, got %T\n", row)
 			continue
 		}
-		// don't use grace period here- delete as soon as they expire
-		threshold := time.Now().Add(time.Duration(-room.RetentionDays) * 24 * time.Hour)
-		_, err := pb.DbMap.Exec(
-			"DELETE FROM message WHERE room = $1 AND posted < $2",
-			room.Name,
-			threshold,
-		)
-		if err != nil && err != sql.ErrNoRows {
-			logging.Logger(ctx).Printf("error deleting rows: %s\n", err)
+		if !assigned(room.Name, selfID, peers) {
+			continue
+		}
+		threshold := time.Now().Add(time.Duration(-room.RetentionDays)*24*time.Hour - GracePeriod)
+		if err := purgeRoom(ctx, pb, room.Name, threshold); err != nil {
+			if err == scope.Canceled {
+				return nil
+			}
+			purgeErrors.Inc()
+			logging.Logger(ctx).Printf("error purging messages from %s: %s\n", room.Name, err)
+			continue
 		}
-		lastDeleteScan.Set(float64(time.Now().Unix()))
 	}
+	lastDeleteScan.Set(float64(time.Now().Unix()))
 	return nil
 }
 
-func DeleteScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
+func DeleteScanLoop(
+	ctx scope.Context, c cluster.Cluster, self *cluster.PeerDesc, pb *psql.Backend, interval time.Duration) {
+
 	defer ctx.WaitGroup().Done()
 
 	errCount := 0
@@ -128,7 +223,7 @@ func DeleteScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, inte
 		case <-ctx.Done():
 			return
 		case <-t:
-			if err := scanToDelete(ctx, c, pb); err != nil {
+			if err := scanToDelete(ctx, c, self, pb); err != nil {
 				errCount++
 				logging.Logger(ctx).Printf("delete scan error [%d/%d]: %s", errCount, maxErrors, err)
 				if errCount > maxErrors {
@@ -0,0 +1,58 @@
+package retention
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"euphoria.leet.nu/heim/cluster"
+	"euphoria.leet.nu/heim/cluster/mock"
+)
+
+func TestPurgers(t *testing.T) {
+	Convey("Only live, registered peers take part in purging", t, func() {
+		g := mock.NewMockClusterGroup()
+		a := &cluster.PeerDesc{ID: "a", Era: "1"}
+		b := &cluster.PeerDesc{ID: "b", Era: "1"}
+		ca := g.NewCluster(a)
+		cb := g.NewCluster(b)
+		g.NewCluster(&cluster.PeerDesc{ID: "web", Era: "1"})
+
+		ids, err := purgers(ca, a)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"a"})
+
+		ids, err = purgers(cb, b)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"a", "b"})
+
+		ids, err = purgers(ca, a)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []string{"a", "b"})
+	})
+
+	Convey("Unidentified peers purge alone", t, func() {
+		ids, err := purgers(mock.MockCluster(nil), nil)
+		So(err, ShouldBeNil)
+		So(ids, ShouldBeNil)
+		So(assigned("room", "", ids), ShouldBeTrue)
+	})
+
+	Convey("Each room is assigned to exactly one purger", t, func() {
+		peers := []string{"a", "b", "c"}
+		counts := map[string]int{}
+		for i := 0; i < 100; i++ {
+			room := fmt.Sprintf("room%d", i)
+			n := 0
+			for _, peer := range peers {
+				if assigned(room, peer, peers) {
+					counts[peer]++
+					n++
+				}
+			}
+			So(n, ShouldEqual, 1)
+		}
+		So(len(counts), ShouldEqual, len(peers))
+	})
+}
@@ -14,9 +14,10 @@ import (
 )
 
 const (
-	PollTime      = 2 * time.Second
-	StatsInterval = 10 * time.Second
-	StealChance   = 0.25
+	PollTime         = 2 * time.Second
+	ScheduleInterval = time.Minute
+	StatsInterval    = 10 * time.Second
+	StealChance      = 0.25
 )
 
 var workers = map[string]Worker{}
@@ -44,9 +45,10 @@ func NewController(ctx scope.Context, heim *proto.Heim, workerName, queueName st
 	}
 
 	ctrl := &Controller{
-		id: fmt.Sprintf("%s-%s", workerName, sf),
-		jq: jq,
-		w:  worker,
+		id:      fmt.Sprintf("%s-%s", workerName, sf),
+		jq:      jq,
+		w:       worker,
+		stopped: make(chan struct{}),
 	}
 	return ctrl, nil
 }
@@ -55,10 +57,14 @@ type Controller struct {
 	id string
 	jq jobs.JobQueue
 	w  Worker
+
+	// stopped is closed when the background loop exits.
+	stopped chan struct{}
 }
 
 func (c *Controller) background(ctx scope.Context) {
 	defer ctx.WaitGroup().Done()
+	defer close(c.stopped)
 
 	var lastStatCheck time.Time
 	for {
@@ -85,6 +91,29 @@ func (c *Controller) background(ctx scope.Context) {
 	}
 }
 
+func (c *Controller) schedule(ctx scope.Context, s Scheduler) {
+	defer ctx.WaitGroup().Done()
+
+	ticker := time.NewTicker(ScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		logging.Logger(ctx).Printf("[%s] scheduling", c.w.QueueName())
+		if err := s.Schedule(ctx, c.jq); err != nil {
+			logging.Logger(ctx).Printf("error: %s schedule: %s", c.w.QueueName(), err)
+			errorCounter.Inc()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopped:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (c *Controller) processOne(ctx scope.Context) error {
 	job, err := c.claimOrSteal(ctx.ForkWithTimeout(StatsInterval))
 	if err != nil {
@@ -94,7 +123,7 @@ func (c *Controller) processOne(ctx scope.Context) error {
 		return err
 	}
 
-	if job.Type != jobs.EmailJobType {
+	if job.Type != c.w.JobType() {
 		return jobs.ErrInvalidJobType
 	}
 
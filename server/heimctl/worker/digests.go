@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/jobs"
+	"euphoria.leet.nu/heim/proto/logging"
+)
+
+// MaxScheduledDigests is the maximum number of digest jobs added to the queue
+// per scheduling pass.
+const MaxScheduledDigests = 100
+
+// DigestIdle is how long an account must have been offline before it is sent
+// a digest.
+var DigestIdle = 24 * time.Hour
+
+type DigestWorker struct {
+	heim *proto.Heim
+	dt   proto.DigestTracker
+}
+
+func (DigestWorker) QueueName() string     { return jobs.DigestQueue }
+func (DigestWorker) JobType() jobs.JobType { return jobs.DigestJobType }
+
+func (w *DigestWorker) Init(heim *proto.Heim) error {
+	w.heim = heim
+	w.dt = heim.Backend.DigestTracker()
+	return nil
+}
+
+func (w *DigestWorker) Schedule(ctx scope.Context, jq jobs.JobQueue) error {
+	// Every worker runs the scheduler, so accounts are claimed before their
+	// jobs are queued. A claimed account whose job fails to queue misses
+	// this digest rather than risk being sent two.
+	now := time.Now()
+	due, err := w.dt.Claim(ctx, now.Add(-DigestIdle), now, MaxScheduledDigests)
+	if err != nil {
+		return err
+	}
+
+	for _, accountID := range due {
+		if _, err := jq.Add(ctx, jobs.DigestJobType, &jobs.DigestJob{AccountID: accountID}, jobs.DigestJobOptions...); err != nil {
+			return err
+		}
+	}
+
+	if len(due) > 0 {
+		logging.Logger(ctx).Printf("[%s] scheduled %d digests", w.QueueName(), len(due))
+	}
+	return nil
+}
+
+func (w *DigestWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	digestJob := payload.(*jobs.DigestJob)
+
+	b := w.heim.Backend
+	account, err := b.AccountManager().Get(ctx, digestJob.AccountID)
+	if err != nil {
+		if err == proto.ErrAccountNotFound {
+			return nil
+		}
+		return err
+	}
+
+	// The account may have opted out since the job was scheduled.
+	prefs, err := b.AccountManager().EmailPreferences(ctx, account.ID())
+	if err != nil {
+		return err
+	}
+	if !prefs.Allows(proto.DigestEmail) {
+		return nil
+	}
+
+	// Digests are only sent to verified addresses.
+	to, verified := account.Email()
+	if !verified {
+		return nil
+	}
+
+	digest, err := w.dt.Collect(ctx, account.ID())
+	if err != nil {
+		return err
+	}
+	if digest.Empty() {
+		return nil
+	}
+
+	params := &proto.DigestEmailParams{
+		CommonEmailParams: proto.DefaultCommonEmailParams,
+		AccountName:       account.Name(),
+		Mentions:          digest.Mentions,
+		PMs:               digest.PMs,
+	}
+	_, err = w.heim.SendEmail(ctx, b, account, to, proto.DigestEmail, params)
+	return err
+}
+
+func init() {
+	register(&DigestWorker{})
+}
@@ -17,6 +17,11 @@ func Loop(ctx scope.Context, heim *proto.Heim, workerName, queueName string) err
 
 	ctx.WaitGroup().Add(1)
 	go ctrl.background(ctx)
+
+	if s, ok := ctrl.w.(Scheduler); ok {
+		ctx.WaitGroup().Add(1)
+		go ctrl.schedule(ctx, s)
+	}
 	ctx.WaitGroup().Wait()
 	return ctx.Err()
 }
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"net/http"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto"
+	"euphoria.leet.nu/heim/proto/jobs"
+	"euphoria.leet.nu/heim/proto/logging"
+)
+
+// WebhookTimeout bounds how long a webhook endpoint may take to respond
+// before the delivery attempt is considered failed.
+var WebhookTimeout = 10 * time.Second
+
+type WebhookWorker struct {
+	b      proto.Backend
+	client *http.Client
+}
+
+func (WebhookWorker) QueueName() string     { return jobs.WebhookQueue }
+func (WebhookWorker) JobType() jobs.JobType { return jobs.WebhookJobType }
+
+func (w *WebhookWorker) Init(heim *proto.Heim) error {
+	w.b = heim.Backend
+	w.client = proto.NewWebhookClient(WebhookTimeout)
+	return nil
+}
+
+func (w *WebhookWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	webhookJob := payload.(*jobs.WebhookJob)
+
+	// Look the webhook up again, in case it was removed or its room deleted
+	// since the delivery was queued.
+	room, err := w.b.GetRoom(ctx, webhookJob.Room)
+	if err != nil {
+		if err == proto.ErrRoomNotFound {
+			logging.Logger(ctx).Printf("room %s not found, dropping delivery", webhookJob.Room)
+			return nil
+		}
+		return err
+	}
+	webhooks, err := room.Webhooks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if webhook.ID == webhookJob.WebhookID {
+			return webhook.Deliver(ctx, w.client, job.ID.String(), webhookJob)
+		}
+	}
+
+	logging.Logger(ctx).Printf("webhook %s not found, dropping delivery", webhookJob.WebhookID)
+	return nil
+}
+
+func init() {
+	register(&WebhookWorker{})
+}
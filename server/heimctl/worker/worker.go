@@ -13,3 +13,8 @@ type Worker interface {
 	JobType() jobs.JobType
 	Work(ctx scope.Context, job *jobs.Job, payload interface{}) error
 }
+
+// A Scheduler is a Worker that periodically adds jobs to its own queue.
+type Scheduler interface {
+	Schedule(ctx scope.Context, jq jobs.JobQueue) error
+}
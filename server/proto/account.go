@@ -74,12 +74,26 @@ type AccountManager interface {
 	// ChangeName changes an account's name.
 	ChangeName(ctx scope.Context, accountID snowflake.Snowflake, name string) error
 
+	// EmailPreferences returns an account's email preferences.
+	EmailPreferences(ctx scope.Context, accountID snowflake.Snowflake) (*EmailPreferences, error)
+
+	// ChangeEmailPreferences replaces an account's email preferences.
+	ChangeEmailPreferences(ctx scope.Context, accountID snowflake.Snowflake, prefs *EmailPreferences) error
+
 	// GenerateOTP generates a new OTP secret for the user. If one has been generated
 	// before, then it is replaced if it was never validated, or an error is returned.
 	GenerateOTP(ctx scope.Context, heim *Heim, kms security.KMS, account Account) (OTPInfo, error)
 
 	// ValidateOTP validates a one-time passcode according to the user's enrolled OTP.
 	ValidateOTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, passcode string) error
+
+	// SetE2EPublicKey records the public key that the keys of end-to-end
+	// encrypted rooms are sealed for when shared with the account.
+	SetE2EPublicKey(ctx scope.Context, accountID snowflake.Snowflake, publicKey []byte) error
+
+	// E2EPublicKey returns the account's end-to-end public key, or nil if it
+	// hasn't set one.
+	E2EPublicKey(ctx scope.Context, accountID snowflake.Snowflake) ([]byte, error)
 }
 
 type PersonalIdentity interface {
@@ -0,0 +1,31 @@
+package proto
+
+import "euphoria.leet.nu/heim/proto/snowflake"
+
+// MaxAnnouncementPosters is the maximum number of accounts other than
+// managers that may be allowed to send to a room in announcement mode.
+const MaxAnnouncementPosters = 100
+
+// An AnnouncementMode restricts who may send messages to a room.
+type AnnouncementMode struct {
+	Enabled bool                  `json:"enabled"`           // if true, only managers and the listed accounts may send messages
+	Posters []snowflake.Snowflake `json:"posters,omitempty"` // accounts other than managers that may send messages
+}
+
+// MaySend returns true if the given account may send messages to a room in
+// this mode. Managers may always send, and should be checked for separately.
+// An accountID of 0 means the sender isn't logged in.
+func (m *AnnouncementMode) MaySend(accountID snowflake.Snowflake) bool {
+	if m == nil || !m.Enabled {
+		return true
+	}
+	if accountID == 0 {
+		return false
+	}
+	for _, poster := range m.Posters {
+		if poster == accountID {
+			return true
+		}
+	}
+	return false
+}
@@ -14,9 +14,12 @@ import (
 type Backend interface {
 	AccountManager() AccountManager
 	AgentTracker() AgentTracker
+	BotTokenTracker() BotTokenTracker
+	DigestTracker() DigestTracker
 	EmailTracker() EmailTracker
 	Jobs() jobs.JobService
 	LocalJobs() jobs.LocalJobService
+	MentionTracker() MentionTracker
 	PMTracker() PMTracker
 
 	// Ban adds an entry to the global ban list. A zero value for until
@@ -0,0 +1,144 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const (
+	// MaxBotTokens is the maximum number of unrevoked bot tokens an account
+	// may hold at once.
+	MaxBotTokens = 20
+
+	// MaxBotTokenRooms is the maximum number of rooms in a bot token's
+	// allowlist.
+	MaxBotTokenRooms = 50
+
+	botTokenSeparator = "."
+)
+
+// A BotTokenTracker keeps track of the bearer tokens issued to accounts for
+// use by bots. Each token is backed by a bot agent that holds the account's
+// client key, encrypted with the token's secret.
+type BotTokenTracker interface {
+	// Issue records a new token for the given account. The token's agent must
+	// already be registered and hold the account's client key.
+	Issue(ctx scope.Context, accountID snowflake.Snowflake, token *BotToken) error
+
+	// Get returns the token with the given ID. ErrBotTokenNotFound is
+	// returned if the token does not exist or has been revoked.
+	Get(ctx scope.Context, tokenID string) (*BotToken, error)
+
+	// List returns the account's unrevoked tokens, oldest first.
+	List(ctx scope.Context, accountID snowflake.Snowflake) ([]*BotToken, error)
+
+	// Revoke prevents the given token of the account from being used again.
+	Revoke(ctx scope.Context, accountID snowflake.Snowflake, tokenID string) error
+
+	// Used records that the token was used to connect at the given time.
+	Used(ctx scope.Context, tokenID string, at time.Time) error
+}
+
+// A BotToken lets a bot connect to rooms as an account without a password.
+type BotToken struct {
+	ID       string   `json:"token_id"`        // the id of the token
+	Name     string   `json:"name,omitempty"`  // a description of the token's purpose
+	Rooms    []string `json:"rooms,omitempty"` // if not empty, the only rooms the token may be used in
+	Created  Time     `json:"created"`         // the unix timestamp of when the token was issued
+	LastUsed Time     `json:"last_used"`       // the unix timestamp of when the token was last used to connect, or null
+}
+
+// AllowsRoom returns true if the token may be used to connect to the named
+// room.
+func (t *BotToken) AllowsRoom(room string) bool {
+	if len(t.Rooms) == 0 {
+		return true
+	}
+	for _, name := range t.Rooms {
+		if name == room {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueBotToken creates a bot agent carrying the account's client key and
+// records it as a token for the account. The returned string is the bearer
+// secret; it is not stored and cannot be recovered.
+func IssueBotToken(
+	ctx scope.Context, backend Backend, account Account, clientKey *security.ManagedKey,
+	name string, rooms []string) (*BotToken, string, error) {
+
+	if len(rooms) > MaxBotTokenRooms {
+		return nil, "", fmt.Errorf("too many rooms (max %d)", MaxBotTokenRooms)
+	}
+
+	tokens, err := backend.BotTokenTracker().List(ctx, account.ID())
+	if err != nil {
+		return nil, "", err
+	}
+	if len(tokens) >= MaxBotTokens {
+		return nil, "", ErrTooManyBotTokens
+	}
+
+	accessKey := &security.ManagedKey{
+		KeyType:   AgentKeyType,
+		Plaintext: make([]byte, AgentKeyType.KeySize()),
+	}
+	if _, err := rand.Read(accessKey.Plaintext); err != nil {
+		return nil, "", err
+	}
+
+	agent, err := NewAgent(nil, accessKey)
+	if err != nil {
+		return nil, "", err
+	}
+	agent.Bot = true
+
+	agents := backend.AgentTracker()
+	if err := agents.Register(ctx, agent); err != nil {
+		return nil, "", err
+	}
+	if err := agents.SetClientKey(ctx, agent.IDString(), accessKey, account.ID(), clientKey); err != nil {
+		return nil, "", err
+	}
+
+	token := &BotToken{
+		ID:      agent.IDString(),
+		Name:    name,
+		Rooms:   rooms,
+		Created: Now(),
+	}
+	if err := backend.BotTokenTracker().Issue(ctx, account.ID(), token); err != nil {
+		return nil, "", err
+	}
+
+	secret := token.ID + botTokenSeparator + base64.URLEncoding.EncodeToString(accessKey.Plaintext)
+	return token, secret, nil
+}
+
+// ParseBotToken splits a bearer secret into the token's ID and the access
+// key of its agent.
+func ParseBotToken(secret string) (string, *security.ManagedKey, error) {
+	parts := strings.SplitN(secret, botTokenSeparator, 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, ErrBotTokenNotFound
+	}
+	key, err := base64.URLEncoding.DecodeString(parts[1])
+	if err != nil || len(key) != AgentKeyType.KeySize() {
+		return "", nil, ErrBotTokenNotFound
+	}
+	accessKey := &security.ManagedKey{
+		KeyType:   AgentKeyType,
+		Plaintext: key,
+	}
+	return parts[0], accessKey, nil
+}
@@ -23,6 +23,7 @@ type Client struct {
 	Agent         *Agent
 	Account       Account
 	Authorization Authorization
+	BotToken      *BotToken
 }
 
 func (c *Client) FromRequest(ctx scope.Context, r *http.Request) {
@@ -83,6 +84,76 @@ func (c *Client) AuthenticateWithAgent(ctx scope.Context, backend Backend, agent
 	return nil
 }
 
+// AuthenticateWithBotToken authenticates the client as the account behind
+// the given bearer secret. ErrAccessDenied is returned if the secret is
+// invalid, has been revoked, or was issued before the account's password
+// last changed. The token's room allowlist is left to the caller to check
+// once the room is resolved.
+func (c *Client) AuthenticateWithBotToken(ctx scope.Context, backend Backend, secret string) error {
+	tokenID, accessKey, err := ParseBotToken(secret)
+	if err != nil {
+		return ErrAccessDenied
+	}
+
+	token, err := backend.BotTokenTracker().Get(ctx, tokenID)
+	if err != nil {
+		if err == ErrBotTokenNotFound {
+			return ErrAccessDenied
+		}
+		return err
+	}
+	agent, err := backend.AgentTracker().Get(ctx, tokenID)
+	if err != nil {
+		if err == ErrAgentNotFound {
+			return ErrAccessDenied
+		}
+		return err
+	}
+	if !agent.Bot || agent.AccountID == "" {
+		return ErrAccessDenied
+	}
+
+	clientKey, err := agent.Unlock(accessKey)
+	if err != nil {
+		if err == ErrAccessDenied || err == ErrClientKeyNotFound {
+			return ErrAccessDenied
+		}
+		return fmt.Errorf("agent key error: %s", err)
+	}
+
+	var accountID snowflake.Snowflake
+	if err := accountID.FromString(agent.AccountID); err != nil {
+		return err
+	}
+	account, err := backend.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		if err == ErrAccountNotFound {
+			return ErrAccessDenied
+		}
+		return err
+	}
+
+	// The token's client key stops unlocking the account once its password
+	// changes, and the token goes with it.
+	if _, err := account.Unlock(clientKey); err != nil {
+		if err == ErrAccessDenied {
+			return ErrAccessDenied
+		}
+		return fmt.Errorf("client key error: %s", err)
+	}
+
+	c.Agent = agent
+	c.Account = account
+	c.Authorization.ClientKey = clientKey
+
+	if err := backend.BotTokenTracker().Used(ctx, tokenID, c.Connected); err != nil {
+		return err
+	}
+	token.LastUsed = Time(c.Connected)
+	c.BotToken = token
+	return nil
+}
+
 func (c *Client) RoomAuthorize(ctx scope.Context, room Room) error {
 	if c.Account == nil {
 		return nil
@@ -155,7 +226,10 @@ func (c *Client) RoomAuthorize(ctx scope.Context, room Room) error {
 				if err := json.Unmarshal(roomKeyJSON, &roomKey.Plaintext); err != nil {
 					return fmt.Errorf("access capability unmarshal error: %s", err)
 				}
-				c.Authorization.AddMessageKey(messageKey.KeyID(), roomKey)
+				err = c.Authorization.AddMessageKeyHistory(ctx, managedRoom, messageKey.KeyID(), roomKey)
+				if err != nil {
+					return fmt.Errorf("message key history error: %s", err)
+				}
 				c.Authorization.CurrentMessageKeyID = messageKey.KeyID()
 			}
 		}
@@ -190,9 +264,20 @@ func (c *Client) AuthenticateWithPasscode(ctx scope.Context, room ManagedRoom, p
 	}
 
 	// TODO: convert to account grant if signed in
-	// TODO: load and return all historic keys
 
-	c.Authorization.AddMessageKey(mkey.KeyID(), roomKey)
+	// Count the use only once the passcode is known to be right. A grant
+	// that has just expired or been used up is treated like any other
+	// incorrect passcode.
+	if err := mkey.UsePasscode(ctx, passcode); err != nil {
+		if err == ErrCapabilityNotFound {
+			return "passcode incorrect", nil
+		}
+		return "", err
+	}
+
+	if err := c.Authorization.AddMessageKeyHistory(ctx, room, mkey.KeyID(), roomKey); err != nil {
+		return "", err
+	}
 	c.Authorization.CurrentMessageKeyID = mkey.KeyID()
 	return "", nil
 }
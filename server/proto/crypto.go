@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
 )
 
 func DecryptPayload(payload interface{}, auth *Authorization, level PrivilegeLevel) (interface{}, error) {
@@ -35,6 +36,19 @@ func DecryptPayload(payload interface{}, auth *Authorization, level PrivilegeLev
 			return nil, err
 		}
 		return (*SendEvent)(&dm), nil
+	case EditMessageReply:
+		dm, err := DecryptMessage(msg.Message, messageKeys, level)
+		if err != nil {
+			return nil, err
+		}
+		msg.Message = dm
+		return msg, nil
+	case *EditMessageEvent:
+		dm, err := DecryptMessage(msg.Message, messageKeys, level)
+		if err != nil {
+			return nil, err
+		}
+		return &EditMessageEvent{EditID: msg.EditID, Message: dm}, nil
 	case LogReply:
 		for i, entry := range msg.Log {
 			dm, err := DecryptPayload(entry, auth, level)
@@ -44,12 +58,61 @@ func DecryptPayload(payload interface{}, auth *Authorization, level PrivilegeLev
 			msg.Log[i] = dm.(Message)
 		}
 		return msg, nil
+	case SearchReply:
+		for i, entry := range msg.Results {
+			dm, err := DecryptPayload(entry, auth, level)
+			if err != nil {
+				return nil, err
+			}
+			msg.Results[i] = dm.(Message)
+		}
+		return msg, nil
 	default:
 		return msg, nil
 	}
 }
 
 func EncryptMessage(msg *Message, keyID string, key *security.ManagedKey) error {
+	return encryptMessage(msg, msg.ID, keyID, key)
+}
+
+// ReencryptMessage replaces the content of an encrypted message, keeping the
+// sender that is hidden in its encrypted payload. The message ID was already
+// used as the nonce when the message was first sent, so every re-encryption
+// must supply a fresh nonceID. The nonceID is recorded alongside the
+// ciphertext.
+func ReencryptMessage(
+	msg *Message, content string, nonceID snowflake.Snowflake, keys map[string]*security.ManagedKey) error {
+
+	keyVersion, keyID := splitEncryptionKeyID(msg.EncryptionKeyID)
+	if keyVersion != 1 {
+		return fmt.Errorf("message re-encrypt: unsupported key version %d", keyVersion)
+	}
+
+	key, ok := keys[keyID]
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	dm, err := DecryptMessage(*msg, keys, Staff)
+	if err != nil {
+		return err
+	}
+
+	payload := &Message{
+		ID:      msg.ID,
+		Sender:  dm.Sender,
+		Content: content,
+	}
+	if err := encryptMessage(payload, nonceID, keyID, key); err != nil {
+		return err
+	}
+
+	msg.Content = payload.Content
+	return nil
+}
+
+func encryptMessage(msg *Message, nonceID snowflake.Snowflake, keyID string, key *security.ManagedKey) error {
 	if key == nil {
 		return security.ErrInvalidKey
 	}
@@ -66,8 +129,7 @@ func EncryptMessage(msg *Message, keyID string, key *security.ManagedKey) error
 		return err
 	}
 
-	// TODO: incorporate last edit ID into nonce
-	nonce := []byte(msg.ID.String())
+	nonce := []byte(nonceID.String())
 	data := []byte(msg.Sender.ID)
 
 	digest, ciphertext, err := security.EncryptGCM(key, nonce, plaintext, data)
@@ -83,25 +145,31 @@ func EncryptMessage(msg *Message, keyID string, key *security.ManagedKey) error
 		SessionID:    msg.Sender.SessionID,
 	}
 	msg.Content = digestStr + "/" + cipherStr
+	if nonceID != msg.ID {
+		msg.Content += "/" + nonceID.String()
+	}
 	msg.EncryptionKeyID = "v1/" + keyID
 	return nil
 }
 
+func splitEncryptionKeyID(encryptionKeyID string) (int, string) {
+	if strings.HasPrefix(encryptionKeyID, "v1") {
+		return 1, encryptionKeyID[3:]
+	}
+	return 0, encryptionKeyID
+}
+
 func DecryptMessage(msg Message, auths map[string]*security.ManagedKey, level PrivilegeLevel) (Message, error) {
 	if level == General {
 		msg.Sender.ClientAddress = ""
 	}
 
-	if msg.EncryptionKeyID == "" || msg.Truncated {
+	// Messages in end-to-end encrypted rooms can only be decrypted by clients.
+	if msg.EncryptionKeyID == "" || msg.Truncated || IsE2EEncrypted(msg.EncryptionKeyID) {
 		return msg, nil
 	}
 
-	keyVersion := 0
-	keyID := msg.EncryptionKeyID
-	if strings.HasPrefix(keyID, "v1") {
-		keyVersion = 1
-		keyID = keyID[3:]
-	}
+	keyVersion, keyID := splitEncryptionKeyID(msg.EncryptionKeyID)
 
 	auth, ok := auths[keyID]
 	if !ok {
@@ -113,11 +181,17 @@ func DecryptMessage(msg Message, auths map[string]*security.ManagedKey, level Pr
 		return msg, security.ErrKeyMustBeDecrypted
 	}
 
+	// Edited messages carry the id used as their nonce in a third part.
 	parts := strings.Split(msg.Content, "/")
-	if len(parts) != 2 {
+	if len(parts) != 2 && len(parts) != 3 {
 		return msg, fmt.Errorf("message corrupted")
 	}
 
+	nonce := []byte(msg.ID.String())
+	if len(parts) == 3 {
+		nonce = []byte(parts[2])
+	}
+
 	digest, err := base64.URLEncoding.DecodeString(parts[0])
 	if err != nil {
 		return msg, err
@@ -128,8 +202,7 @@ func DecryptMessage(msg Message, auths map[string]*security.ManagedKey, level Pr
 		return msg, err
 	}
 
-	plaintext, err := security.DecryptGCM(
-		auth, []byte(msg.ID.String()), digest, ciphertext, []byte(msg.Sender.ID))
+	plaintext, err := security.DecryptGCM(auth, nonce, digest, ciphertext, []byte(msg.Sender.ID))
 	if err != nil {
 		return msg, fmt.Errorf("message decrypt: %s", err)
 	}
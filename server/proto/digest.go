@@ -0,0 +1,55 @@
+package proto
+
+import (
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const (
+	// DigestSeenInterval is how often a connected account's last-seen time
+	// is refreshed.
+	DigestSeenInterval = 10 * time.Minute
+
+	// MaxDigestMentions is the maximum number of mentions listed in a
+	// single digest.
+	MaxDigestMentions = 25
+)
+
+// A DigestPM summarizes unread activity in a private chat.
+type DigestPM struct {
+	PMID     snowflake.Snowflake
+	WithNick string
+	Unread   int
+}
+
+// A Digest summarizes what an account missed while it was offline.
+type Digest struct {
+	AccountID snowflake.Snowflake
+	Since     time.Time
+	Mentions  []Mention
+	PMs       []DigestPM
+}
+
+// Empty returns true if there is nothing to report in the digest.
+func (d *Digest) Empty() bool { return len(d.Mentions) == 0 && len(d.PMs) == 0 }
+
+// A DigestTracker tracks when accounts were last online and collects what
+// they missed in the meantime.
+type DigestTracker interface {
+	// Seen records that the account was online at the given time.
+	Seen(ctx scope.Context, accountID snowflake.Snowflake, at time.Time) error
+
+	// Claim finds up to n accounts that have opted in to digests, were last
+	// seen before cutoff, and have not been sent a digest since. It records
+	// that a digest covering activity up to the given time has been
+	// scheduled for each, and returns them. An account is only claimed once
+	// per absence, even by concurrent callers.
+	Claim(ctx scope.Context, cutoff, at time.Time, n int) ([]snowflake.Snowflake, error)
+
+	// Collect gathers the mentions and unread PMs the account received since
+	// it was last seen.
+	Collect(ctx scope.Context, accountID snowflake.Snowflake) (*Digest, error)
+}
@@ -0,0 +1,102 @@
+package proto
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const (
+	// E2EKeyPairType is the key pair type accounts use to receive the keys
+	// of end-to-end encrypted rooms.
+	E2EKeyPairType = security.Curve25519
+
+	// MaxE2EKeyIDLength bounds the length of a client-chosen room key id.
+	MaxE2EKeyIDLength = 64
+
+	// MaxE2ESealedKeySize bounds the size of a sealed room key.
+	MaxE2ESealedKeySize = 1024
+
+	// e2eKeyIDPrefix marks the encryption key id of messages encrypted by
+	// clients, which the server can't decrypt.
+	e2eKeyIDPrefix = "e2e/"
+)
+
+// An E2EKey is a key of an end-to-end encrypted room, sealed by a manager for
+// a single account. The server stores and distributes sealed keys, but can't
+// open them.
+type E2EKey struct {
+	AccountID       snowflake.Snowflake `json:"account_id"`        // the account the key is sealed for
+	KeyID           string              `json:"key_id"`            // the client-chosen id of the room key
+	SenderPublicKey []byte              `json:"sender_public_key"` // the public key of the account that sealed the key
+	Nonce           []byte              `json:"nonce"`             // the nonce the key was sealed with
+	SealedKey       []byte              `json:"sealed_key"`        // the sealed room key
+}
+
+// SealE2EKey seals a room key for the given account's public key, using the
+// sender's decrypted key pair.
+func SealE2EKey(
+	keyID string, key []byte, sender *security.ManagedKeyPair, accountID snowflake.Snowflake,
+	publicKey []byte) (*E2EKey, error) {
+
+	if sender.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	nonce := make([]byte, E2EKeyPairType.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed, err := E2EKeyPairType.Seal(key, nonce, publicKey, sender.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ek := &E2EKey{
+		AccountID:       accountID,
+		KeyID:           keyID,
+		SenderPublicKey: sender.PublicKey,
+		Nonce:           nonce,
+		SealedKey:       sealed,
+	}
+	return ek, nil
+}
+
+// Open recovers the room key with the recipient's decrypted key pair.
+func (k *E2EKey) Open(recipient *security.ManagedKeyPair) ([]byte, error) {
+	if recipient.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+	return E2EKeyPairType.Open(k.SealedKey, k.Nonce, k.SenderPublicKey, recipient.PrivateKey)
+}
+
+// Validate returns an error if the sealed key is malformed.
+func (k *E2EKey) Validate() error {
+	switch {
+	case k.AccountID == 0:
+		return fmt.Errorf("account_id required")
+	case k.KeyID == "" || len(k.KeyID) > MaxE2EKeyIDLength:
+		return fmt.Errorf("key_id must be 1 to %d characters", MaxE2EKeyIDLength)
+	case len(k.SenderPublicKey) != E2EKeyPairType.PublicKeySize():
+		return security.ErrInvalidPublicKey
+	case len(k.Nonce) != E2EKeyPairType.NonceSize():
+		return security.ErrInvalidNonce
+	case len(k.SealedKey) == 0 || len(k.SealedKey) > MaxE2ESealedKeySize:
+		return fmt.Errorf("sealed_key must be 1 to %d bytes", MaxE2ESealedKeySize)
+	}
+	return nil
+}
+
+// E2EEncryptionKeyID returns the encryption key id recorded on a message
+// that a client encrypted with the given room key.
+func E2EEncryptionKeyID(keyID string) string { return e2eKeyIDPrefix + keyID }
+
+// IsE2EEncrypted returns true if the given encryption key id belongs to a
+// message encrypted by a client of an end-to-end encrypted room.
+func IsE2EEncrypted(encryptionKeyID string) bool {
+	return strings.HasPrefix(encryptionKeyID, e2eKeyIDPrefix)
+}
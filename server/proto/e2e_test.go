@@ -0,0 +1,72 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"euphoria.leet.nu/heim/proto/security"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestE2EKey(t *testing.T) {
+	sender, err := E2EKeyPairType.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := E2EKeyPairType.Generate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomKey := []byte("0123456789abcdef0123456789abcdef")
+
+	Convey("Sealed keys open for their recipient only", t, func() {
+		ek, err := SealE2EKey("k1", roomKey, sender, 1, recipient.PublicKey)
+		So(err, ShouldBeNil)
+		So(ek.Validate(), ShouldBeNil)
+		So(bytes.Equal(ek.SealedKey, roomKey), ShouldBeFalse)
+
+		key, err := ek.Open(recipient)
+		So(err, ShouldBeNil)
+		So(bytes.Equal(key, roomKey), ShouldBeTrue)
+
+		_, err = ek.Open(sender)
+		So(err, ShouldEqual, security.ErrMessageIntegrityFailed)
+	})
+
+	Convey("Malformed keys are rejected", t, func() {
+		ek, err := SealE2EKey("k1", roomKey, sender, 1, recipient.PublicKey)
+		So(err, ShouldBeNil)
+
+		bad := *ek
+		bad.KeyID = ""
+		So(bad.Validate(), ShouldNotBeNil)
+
+		bad = *ek
+		bad.Nonce = bad.Nonce[1:]
+		So(bad.Validate(), ShouldEqual, security.ErrInvalidNonce)
+
+		bad = *ek
+		bad.SenderPublicKey = nil
+		So(bad.Validate(), ShouldEqual, security.ErrInvalidPublicKey)
+
+		_, err = SealE2EKey("k1", roomKey, sender, 1, []byte("short"))
+		So(err, ShouldEqual, security.ErrInvalidPublicKey)
+	})
+
+	Convey("Client-encrypted messages pass through decryption", t, func() {
+		msg := Message{
+			Content:         "ciphertext",
+			EncryptionKeyID: E2EEncryptionKeyID("k1"),
+			Sender:          SessionView{ClientAddress: "10.0.0.1"},
+		}
+		So(IsE2EEncrypted(msg.EncryptionKeyID), ShouldBeTrue)
+		So(IsE2EEncrypted("v1/room-key"), ShouldBeFalse)
+
+		dm, err := DecryptMessage(msg, nil, General)
+		So(err, ShouldBeNil)
+		So(dm.Content, ShouldEqual, "ciphertext")
+		So(dm.Sender.ClientAddress, ShouldEqual, "")
+	})
+}
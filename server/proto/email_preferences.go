@@ -0,0 +1,101 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"euphoria.leet.nu/heim/proto/security"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+// TransactionalEmails are sent in direct response to something the account
+// holder did, and are delivered regardless of email preferences.
+var TransactionalEmails = map[string]bool{
+	PasswordChangedEmail: true,
+	PasswordResetEmail:   true,
+	VerificationEmail:    true,
+	WelcomeEmail:         true,
+}
+
+// EmailPreferences describes which optional emails an account receives.
+type EmailPreferences struct {
+	Digest       bool `json:"digest"`       // if true, send digests of missed mentions and PMs
+	Unsubscribed bool `json:"unsubscribed"` // if true, send no email other than transactional email
+}
+
+// Allows returns true if an email rendered from the given template may be
+// sent to an account with these preferences.
+func (p *EmailPreferences) Allows(templateName string) bool {
+	switch {
+	case TransactionalEmails[templateName]:
+		return true
+	case p.Unsubscribed:
+		return false
+	case templateName == DigestEmail:
+		return p.Digest
+	default:
+		return true
+	}
+}
+
+// EmailPreferencesToken returns a token that grants access to an account's
+// email preferences without logging in. It is embedded in the links to the
+// email preferences page.
+func EmailPreferencesToken(kms security.KMS, account Account) (string, error) {
+	mac, err := emailPreferencesMAC(kms, account)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", account.ID(), hex.EncodeToString(mac)), nil
+}
+
+// ParseEmailPreferencesToken extracts the account ID and MAC from an email
+// preferences token.
+func ParseEmailPreferencesToken(token string) (snowflake.Snowflake, []byte, error) {
+	var id snowflake.Snowflake
+
+	idx := strings.IndexRune(token, '-')
+	if idx < 0 {
+		return id, nil, ErrInvalidVerificationToken
+	}
+
+	mac, err := hex.DecodeString(token[idx+1:])
+	if err != nil {
+		return id, nil, ErrInvalidVerificationToken
+	}
+
+	if err := id.FromString(token[:idx]); err != nil {
+		return id, nil, ErrInvalidVerificationToken
+	}
+
+	return id, mac, nil
+}
+
+// CheckEmailPreferencesToken verifies the MAC from an email preferences token
+// against the given account.
+func CheckEmailPreferencesToken(kms security.KMS, account Account, mac []byte) error {
+	expected, err := emailPreferencesMAC(kms, account)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(mac, expected) {
+		return ErrInvalidVerificationToken
+	}
+
+	return nil
+}
+
+func emailPreferencesMAC(kms security.KMS, account Account) ([]byte, error) {
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, systemKey.Plaintext)
+	mac.Write([]byte("email-preferences:" + account.ID().String()))
+	return mac.Sum(nil), nil
+}
@@ -15,6 +15,7 @@ import (
 )
 
 const (
+	DigestEmail                = "digest"
 	PasswordChangedEmail       = "password-changed"
 	PasswordResetEmail         = "password-reset"
 	RoomInvitationEmail        = "room-invitation"
@@ -27,6 +28,10 @@ type EmailTracker interface {
 	Get(ctx scope.Context, accountID snowflake.Snowflake, id string) (*emails.EmailRef, error)
 	List(ctx scope.Context, accountID snowflake.Snowflake, n int, before time.Time) ([]*emails.EmailRef, error)
 	MarkDelivered(ctx scope.Context, accountID snowflake.Snowflake, id string) error
+
+	// Send renders and queues an email to the given account. If the account's
+	// email preferences don't allow the template, no email is sent and Send
+	// returns a nil ref.
 	Send(
 		ctx scope.Context, js jobs.JobService, templater templates.Templater, deliverer emails.Deliverer,
 		account Account, to, templateName string, data interface{}) (*emails.EmailRef, error)
@@ -40,6 +45,10 @@ type CommonEmailParams struct {
 	SiteURL       string        `yaml:"site_url"`
 	HelpAddress   template.HTML `yaml:"help_address"`
 	SenderAddress template.HTML `yaml:"sender_address"`
+
+	// EmailPreferencesToken grants the recipient access to their email
+	// preferences. It is filled in by Heim.SendEmail.
+	EmailPreferencesToken string `yaml:"-"`
 }
 
 func (p *CommonEmailParams) SiteURLShort() template.HTML {
@@ -47,8 +56,23 @@ func (p *CommonEmailParams) SiteURLShort() template.HTML {
 }
 
 func (p *CommonEmailParams) EmailPreferencesURL() template.HTML {
-	// TODO: incorporate token
-	return template.HTML(fmt.Sprintf("%s/prefs/emails", p.SiteURL))
+	if p.EmailPreferencesToken == "" {
+		return template.HTML(fmt.Sprintf("%s/prefs/emails", p.SiteURL))
+	}
+	v := url.Values{
+		"token": []string{p.EmailPreferencesToken},
+	}
+	u := url.URL{
+		Path:     "/prefs/emails",
+		RawQuery: v.Encode(),
+	}
+	return template.HTML(p.SiteURL + u.String())
+}
+
+func (p *CommonEmailParams) setEmailPreferencesToken(token string) { p.EmailPreferencesToken = token }
+
+type emailPreferencesLinker interface {
+	setEmailPreferencesToken(string)
 }
 
 type VerificationEmailParams struct {
@@ -107,6 +131,25 @@ func (p PasswordResetEmailParams) ResetPasswordURL() template.HTML {
 	return template.HTML(p.SiteURL + u.String())
 }
 
+type DigestEmailParams struct {
+	CommonEmailParams
+	AccountName string
+	Mentions    []Mention
+	PMs         []DigestPM
+}
+
+func (p DigestEmailParams) Subject() template.HTML {
+	return template.HTML(fmt.Sprintf("What you missed on %s", p.SiteName))
+}
+
+func (p DigestEmailParams) RoomURL(roomName string) template.HTML {
+	return template.HTML(fmt.Sprintf("%s/room/%s/", p.SiteURL, roomName))
+}
+
+func (p DigestEmailParams) PMURL(pmID snowflake.Snowflake) template.HTML {
+	return template.HTML(fmt.Sprintf("%s/room/pm:%s/", p.SiteURL, pmID))
+}
+
 type RoomInvitationEmailParams struct {
 	CommonEmailParams
 	AccountName   string
@@ -179,6 +222,19 @@ var (
 			},
 		},
 
+		DigestEmail + ".html": map[string]templates.TemplateTest{
+			"default": templates.TemplateTest{
+				Data: &DigestEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					Mentions: []Mention{
+						{Room: "test", MessageID: 1, SenderName: "somebody", UnixTime: Time(time.Unix(0, 0))},
+					},
+					PMs: []DigestPM{{PMID: 1, WithNick: "somebody", Unread: 3}},
+				},
+			},
+		},
+
 		RoomInvitationEmail + ".html": map[string]templates.TemplateTest{
 			"default": templates.TemplateTest{
 				Data: &RoomInvitationEmailParams{
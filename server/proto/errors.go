@@ -9,25 +9,39 @@ var (
 	ErrAccountNotFound                 = fmt.Errorf("account not found")
 	ErrAgentAlreadyExists              = fmt.Errorf("agent already exists")
 	ErrAgentNotFound                   = fmt.Errorf("agent not found")
+	ErrAnnouncementOnly                = fmt.Errorf("only managers and allowed accounts may send messages to this room")
+	ErrBotTokenNotFound                = fmt.Errorf("bot token not found")
 	ErrCapabilityNotFound              = fmt.Errorf("capability not found")
 	ErrClientKeyNotFound               = fmt.Errorf("client key not found")
+	ErrE2EEncryptionRequired           = fmt.Errorf("messages to this room must be end-to-end encrypted")
 	ErrEditInconsistent                = fmt.Errorf("edit inconsistent")
 	ErrEmailNotFound                   = fmt.Errorf("email not found")
 	ErrEmailAlreadyDelivered           = fmt.Errorf("email already delivered")
 	ErrInvalidConfirmationCode         = fmt.Errorf("invalid confirmation code")
 	ErrInvalidNick                     = fmt.Errorf("invalid nick")
 	ErrInvalidParent                   = fmt.Errorf("invalid parent ID")
+	ErrInvalidReaction                 = fmt.Errorf("invalid reaction")
+	ErrInvalidRoomName                 = fmt.Errorf("invalid room name")
 	ErrInvalidUserID                   = fmt.Errorf("invalid user ID")
 	ErrInvalidVerificationToken        = fmt.Errorf("invalid verification token")
+	ErrInvalidWebhookURL               = fmt.Errorf("invalid webhook url")
+	ErrWebhookAddressNotAllowed        = fmt.Errorf("webhook address not allowed")
 	ErrLoggedIn                        = fmt.Errorf("logged in")
 	ErrOTPAlreadyEnrolled              = fmt.Errorf("otp already enrolled")
 	ErrOTPNotEnrolled                  = fmt.Errorf("otp not enrolled")
 	ErrManagerNotFound                 = fmt.Errorf("manager not found")
 	ErrMessageNotFound                 = fmt.Errorf("message not found")
 	ErrMessageTooLong                  = fmt.Errorf("message too long")
+	ErrNotE2E                          = fmt.Errorf("room is not end-to-end encrypted")
 	ErrNotLoggedIn                     = fmt.Errorf("not logged in")
 	ErrPMNotFound                      = fmt.Errorf("pm not found")
 	ErrPersonalIdentityAlreadyVerified = fmt.Errorf("personal identity already verified")
 	ErrPersonalIdentityInUse           = fmt.Errorf("personal identity already in use")
+	ErrRoomArchived                    = fmt.Errorf("room is archived")
+	ErrRoomAliasNotFound               = fmt.Errorf("room alias not found")
+	ErrRoomNameInUse                   = fmt.Errorf("room name already in use")
 	ErrRoomNotFound                    = fmt.Errorf("room not found")
+	ErrTooManyBotTokens                = fmt.Errorf("too many bot tokens")
+	ErrTooManyWebhooks                 = fmt.Errorf("too many webhooks")
+	ErrWebhookNotFound                 = fmt.Errorf("webhook not found")
 )
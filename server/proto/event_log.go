@@ -0,0 +1,44 @@
+package proto
+
+import (
+	"time"
+
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+// EventLogTTL is how long events are kept in a room's event log, and thus
+// how long a session can be resumed after losing its connection.
+var EventLogTTL = 10 * time.Minute
+
+// A LoggedEvent is an event that was broadcast to a room and recorded in its
+// event log, so that it can be replayed to resumed sessions.
+//
+// When passed as a payload to Session.Send, the event is delivered as the
+// wrapped payload, with its cursor attached to the packet.
+type LoggedEvent struct {
+	Cursor  snowflake.Snowflake
+	Type    PacketType
+	Payload interface{}
+	Exclude []string // the ids of the sessions the event was not broadcast to
+}
+
+// IsLoggedEventType returns true if events of the given type are recorded in
+// a room's event log.
+func IsLoggedEventType(packetType PacketType) bool {
+	switch packetType {
+	case SendEventType, EditMessageEventType, ReactionEventType, JoinEventType, PartEventType, NickEventType:
+		return true
+	default:
+		return false
+	}
+}
+
+// Excludes returns true if the event was not broadcast to the given session.
+func (e *LoggedEvent) Excludes(sessionID string) bool {
+	for _, id := range e.Exclude {
+		if id == sessionID {
+			return true
+		}
+	}
+	return false
+}
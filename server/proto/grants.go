@@ -3,6 +3,7 @@ package proto
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"euphoria.leet.nu/lib/scope"
 
@@ -15,6 +16,37 @@ type CapabilityTable interface {
 	Remove(ctx scope.Context, capabilityID string) error
 }
 
+// MaxPasscodeGrantSeconds is the longest a limited passcode grant may last.
+const MaxPasscodeGrantSeconds = 365 * 24 * 60 * 60
+
+// PasscodeGrantLimits restrict how long, or how many times, an access grant
+// made to a passcode may be used. The zero value places no limits on the
+// grant.
+type PasscodeGrantLimits struct {
+	Expires time.Time // when the grant stops working, unless zero
+	MaxUses int       // how many times the grant may be used to authenticate, unless zero
+}
+
+// Unlimited returns true if the limits don't restrict the grant.
+func (l *PasscodeGrantLimits) Unlimited() bool {
+	return l == nil || (l.Expires.IsZero() && l.MaxUses == 0)
+}
+
+// A LimitedCapabilityTable can also hold capabilities that stop working
+// after a deadline or a number of uses. Get no longer returns such a
+// capability once it has expired or been used up.
+type LimitedCapabilityTable interface {
+	CapabilityTable
+
+	// SaveLimited saves a capability held by no account, subject to the
+	// given limits.
+	SaveLimited(ctx scope.Context, c security.Capability, limits *PasscodeGrantLimits) error
+
+	// Use records a use of the capability. It returns ErrCapabilityNotFound
+	// if the capability has expired or been used up.
+	Use(ctx scope.Context, capabilityID string) error
+}
+
 type AccountGrantable interface {
 	GrantToAccount(
 		ctx scope.Context, kms security.KMS, manager Account, managerClientKey *security.ManagedKey,
@@ -29,11 +61,16 @@ type AccountGrantable interface {
 
 type PasscodeGrantable interface {
 	GrantToPasscode(
-		ctx scope.Context, manager Account, managerClientKey *security.ManagedKey, passcode string) error
+		ctx scope.Context, manager Account, managerClientKey *security.ManagedKey, passcode string,
+		limits *PasscodeGrantLimits) error
 
 	RevokeFromPasscode(ctx scope.Context, passcode string) error
 
 	PasscodeCapability(ctx scope.Context, passcode string) (*security.SharedSecretCapability, error)
+
+	// UsePasscode records a successful authentication with the passcode. It
+	// returns ErrCapabilityNotFound if the grant has expired or been used up.
+	UsePasscode(ctx scope.Context, passcode string) error
 }
 
 type GrantManager struct {
@@ -189,7 +226,8 @@ func (gs *GrantManager) AccountCapability(
 }
 
 func (gs *GrantManager) GrantToPasscode(
-	ctx scope.Context, manager Account, managerKey *security.ManagedKey, passcode string) error {
+	ctx scope.Context, manager Account, managerKey *security.ManagedKey, passcode string,
+	limits *PasscodeGrantLimits) error {
 
 	_, public, private, err := gs.Authority(ctx, manager, managerKey)
 	if err != nil {
@@ -203,7 +241,14 @@ func (gs *GrantManager) GrantToPasscode(
 		return err
 	}
 
-	return gs.Capabilities.Save(ctx, nil, c)
+	if limits.Unlimited() {
+		return gs.Capabilities.Save(ctx, nil, c)
+	}
+	table, ok := gs.Capabilities.(LimitedCapabilityTable)
+	if !ok {
+		return fmt.Errorf("passcode grant limits not supported")
+	}
+	return table.SaveLimited(ctx, c, limits)
 }
 
 func (gs *GrantManager) RevokeFromPasscode(ctx scope.Context, passcode string) error {
@@ -235,3 +280,19 @@ func (gs *GrantManager) PasscodeCapability(
 	}
 	return &security.SharedSecretCapability{Capability: c}, nil
 }
+
+func (gs *GrantManager) UsePasscode(ctx scope.Context, passcode string) error {
+	// Capabilities that can't be limited can be used any number of times.
+	table, ok := gs.Capabilities.(LimitedCapabilityTable)
+	if !ok {
+		return nil
+	}
+
+	cid, err := security.SharedSecretCapabilityID(
+		security.KeyFromPasscode([]byte(passcode), gs.SubjectNonce, security.AES128),
+		gs.SubjectNonce)
+	if err != nil {
+		return err
+	}
+	return table.Use(ctx, cid)
+}
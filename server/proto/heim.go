@@ -50,6 +50,15 @@ func (heim *Heim) SendEmail(
 			}
 		}
 	}
+
+	if linker, ok := data.(emailPreferencesLinker); ok {
+		token, err := EmailPreferencesToken(heim.KMS, account)
+		if err != nil {
+			return nil, fmt.Errorf("email preferences token: %s", err)
+		}
+		linker.setEmailPreferencesToken(token)
+	}
+
 	return b.EmailTracker().Send(ctx, b.Jobs(), heim.EmailTemplater, heim.EmailDeliverer, account, to, templateName, data)
 }
 
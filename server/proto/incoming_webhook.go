@@ -0,0 +1,79 @@
+package proto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const (
+	// MaxIncomingWebhooks is the maximum number of incoming webhooks a room
+	// may have.
+	MaxIncomingWebhooks = 10
+
+	// IncomingWebhookSecretSize is the number of random bytes in an incoming
+	// webhook's secret.
+	IncomingWebhookSecretSize = 24
+)
+
+// An IncomingWebhook lets an outside service post messages into a room
+// under a fixed bot name, by POSTing to a secret URL.
+type IncomingWebhook struct {
+	ID         snowflake.Snowflake `json:"id"`      // the id of the incoming webhook
+	Name       string              `json:"name"`    // the name messages are posted under
+	SecretHash string              `json:"-"`       // the hex SHA-256 of the secret in the webhook's URL
+	Created    Time                `json:"created"` // the unix timestamp of when the incoming webhook was added
+}
+
+// NewIncomingWebhook validates the given name and returns a new incoming
+// webhook, along with its secret. Only a hash of the secret is kept, so it
+// cannot be recovered later.
+func NewIncomingWebhook(name string) (*IncomingWebhook, string, error) {
+	name, err := NormalizeNick(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secretBytes := make([]byte, IncomingWebhookSecretSize)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	id, err := snowflake.New()
+	if err != nil {
+		return nil, "", err
+	}
+
+	hook := &IncomingWebhook{
+		ID:         id,
+		Name:       name,
+		SecretHash: hashIncomingWebhookSecret(secret),
+		Created:    Now(),
+	}
+	return hook, secret, nil
+}
+
+// Verify returns true if the given secret belongs to the incoming webhook.
+func (h *IncomingWebhook) Verify(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashIncomingWebhookSecret(secret)), []byte(h.SecretHash)) == 1
+}
+
+// Path returns the path, relative to the site root, that messages may be
+// POSTed to with the given secret.
+func (h *IncomingWebhook) Path(room, secret string) string {
+	return fmt.Sprintf("/room/%s/hook/%s/%s", room, h.ID, secret)
+}
+
+// UserID returns the id of the identity messages are posted under.
+func (h *IncomingWebhook) UserID() UserID { return UserID("hook:" + h.ID.String()) }
+
+func hashIncomingWebhookSecret(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
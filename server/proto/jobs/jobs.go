@@ -17,7 +17,9 @@ import (
 const (
 	DefaultMaxWorkDuration = time.Minute
 
-	EmailQueue = "emails"
+	DigestQueue  = "digests"
+	EmailQueue   = "emails"
+	WebhookQueue = "webhooks"
 )
 
 type JobType string
@@ -25,22 +27,47 @@ type JobType string
 var (
 	BackoffDuration = 5 * time.Second
 
+	DigestJobType    = JobType("digest")
+	DigestJobOptions = []JobOption{
+		JobOptions.MaxAttempts(3),
+		JobOptions.MaxWorkDuration(30 * time.Second),
+	}
+
 	EmailJobType    = JobType("email")
 	EmailJobOptions = []JobOption{
 		JobOptions.MaxAttempts(3),
 		JobOptions.MaxWorkDuration(30 * time.Second),
 	}
 
+	WebhookJobType    = JobType("webhook")
+	WebhookJobOptions = []JobOption{
+		JobOptions.MaxAttempts(5),
+		JobOptions.MaxWorkDuration(30 * time.Second),
+	}
+
 	jobPayloadMap = map[JobType]reflect.Type{
-		EmailJobType: reflect.TypeOf(EmailJob{}),
+		DigestJobType:  reflect.TypeOf(DigestJob{}),
+		EmailJobType:   reflect.TypeOf(EmailJob{}),
+		WebhookJobType: reflect.TypeOf(WebhookJob{}),
 	}
 )
 
+type DigestJob struct {
+	AccountID snowflake.Snowflake
+}
+
 type EmailJob struct {
 	AccountID snowflake.Snowflake
 	EmailID   string
 }
 
+type WebhookJob struct {
+	Room      string
+	WebhookID snowflake.Snowflake
+	EventType string
+	Body      []byte
+}
+
 type JobService interface {
 	GetQueue(ctx scope.Context, name string) (JobQueue, error)
 }
@@ -0,0 +1,67 @@
+package proto
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+// MaxMentions is the number of distinct names that are resolved from the
+// mentions in a single message. Any further mentions are ignored.
+const MaxMentions = 16
+
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@(\S+)`)
+
+// A MentionTracker indexes the messages that mention each user.
+type MentionTracker interface {
+	// Add records a mention of the given user.
+	Add(ctx scope.Context, userID UserID, mention Mention) error
+
+	// Latest returns up to n of the most recent mentions of the given user
+	// prior to the given message id (if not zero), oldest first.
+	Latest(ctx scope.Context, userID UserID, n int, before snowflake.Snowflake) ([]Mention, error)
+}
+
+// A Mention records that a user was @-mentioned in a message.
+type Mention struct {
+	Room       string              `json:"room"`        // the name of the room the message was posted in
+	MessageID  snowflake.Snowflake `json:"message_id"`  // the id of the message
+	SenderID   UserID              `json:"sender_id"`   // the id of the message's sender
+	SenderName string              `json:"sender_name"` // the name of the message's sender when it was posted
+	UnixTime   Time                `json:"time"`        // the unix timestamp of when the message was posted
+}
+
+// NormalizeMention returns the form in which a nick is matched against
+// mentions: lowercase, with all whitespace removed.
+func NormalizeMention(nick string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, nick)
+}
+
+// ParseMentions returns the distinct normalized names @-mentioned in the
+// given message content, up to MaxMentions. Trailing punctuation is not
+// considered part of a mention.
+func ParseMentions(content string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := NormalizeMention(strings.TrimRight(match[1], `.,:;!?)'"`))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) >= MaxMentions {
+			break
+		}
+	}
+	return names
+}
@@ -0,0 +1,35 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseMentions(t *testing.T) {
+	Convey("Mentions are normalized and deduplicated", t, func() {
+		So(ParseMentions("@Alice hi"), ShouldResemble, []string{"alice"})
+		So(ParseMentions("hi @alice, @Bob! and @alice?"), ShouldResemble, []string{"alice", "bob"})
+		So(ParseMentions("(@carol)"), ShouldBeNil)
+	})
+
+	Convey("Mentions must start a word", t, func() {
+		So(ParseMentions("mail me@example.com"), ShouldBeNil)
+		So(ParseMentions("@ alone"), ShouldBeNil)
+		So(ParseMentions("line\n@dave"), ShouldResemble, []string{"dave"})
+	})
+
+	Convey("The number of mentions is limited", t, func() {
+		mentions := make([]string, MaxMentions+1)
+		for i := range mentions {
+			mentions[i] = fmt.Sprintf("@user%d", i)
+		}
+		So(len(ParseMentions(strings.Join(mentions, " "))), ShouldEqual, MaxMentions)
+	})
+
+	Convey("Nicks are matched without case or whitespace", t, func() {
+		So(NormalizeMention("Big Bird"), ShouldEqual, "bigbird")
+	})
+}
@@ -9,6 +9,7 @@ import (
 const (
 	MaxMessageLength             = 1 << 20
 	MaxMessageTransmissionLength = 4096
+	MaxUnreadCount               = 1000
 )
 
 // A `Message` is a node in a Room's Log. It corresponds to a chat message, or
@@ -24,6 +25,7 @@ type Message struct {
 	Edited          Time                `json:"edited,omitempty"`            // the unix timestamp of when the message was last edited
 	Deleted         Time                `json:"deleted,omitempty"`           // the unix timestamp of when the message was deleted
 	Truncated       bool                `json:"truncated,omitempty"`         // if true, then the full content of this message is not included (see `get-message` to obtain the message with full content)
+	Reactions       map[string]int      `json:"reactions,omitempty"`         // the number of users reacting to the message, by reaction
 }
 
 func (msg *Message) Encode() ([]byte, error) { return json.Marshal(msg) }
@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"fmt"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/security"
+)
+
+// MaxMessageKeyHistory bounds how many earlier keys are followed back from a
+// room's message key.
+const MaxMessageKeyHistory = 1000
+
+// MessageKeyLink records a room message key that was replaced by rotation.
+// The previous key is stored encrypted under the key that replaced it, so
+// anyone holding the newer key can recover the older one.
+type MessageKeyLink struct {
+	KeyID         string
+	PreviousKeyID string
+	IV            []byte
+	Digest        []byte
+	EncryptedKey  []byte
+}
+
+// NewMessageKeyLink encrypts the previous key under the key replacing it.
+// Both keys must be decrypted.
+func NewMessageKeyLink(
+	kms security.KMS, keyID string, key *security.ManagedKey, previousKeyID string,
+	previousKey *security.ManagedKey) (*MessageKeyLink, error) {
+
+	if key.Encrypted() || previousKey.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	iv, err := kms.GenerateNonce(RoomMessageKeyType.BlockSize())
+	if err != nil {
+		return nil, err
+	}
+
+	digest, ciphertext, err := security.EncryptGCM(key, iv, previousKey.Plaintext, []byte(previousKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("message key link encrypt: %s", err)
+	}
+
+	link := &MessageKeyLink{
+		KeyID:         keyID,
+		PreviousKeyID: previousKeyID,
+		IV:            iv,
+		Digest:        digest,
+		EncryptedKey:  ciphertext,
+	}
+	return link, nil
+}
+
+// Unlock decrypts the previous key with the key that replaced it.
+func (l *MessageKeyLink) Unlock(key *security.ManagedKey) (*security.ManagedKey, error) {
+	plaintext, err := security.DecryptGCM(key, l.IV, l.Digest, l.EncryptedKey, []byte(l.PreviousKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("message key link decrypt: %s", err)
+	}
+	previousKey := &security.ManagedKey{
+		KeyType:   RoomMessageKeyType,
+		Plaintext: plaintext,
+	}
+	return previousKey, nil
+}
+
+// AddMessageKeyHistory adds the given message key to the authorization,
+// along with every earlier key of the room that it can recover through the
+// room's key history.
+func (a *Authorization) AddMessageKeyHistory(
+	ctx scope.Context, room ManagedRoom, keyID string, key *security.ManagedKey) error {
+
+	a.AddMessageKey(keyID, key)
+	for i := 0; i < MaxMessageKeyHistory; i++ {
+		link, err := room.PreviousMessageKey(ctx, keyID)
+		if err != nil {
+			return err
+		}
+		if link == nil {
+			return nil
+		}
+		if _, ok := a.MessageKeys[link.PreviousKeyID]; ok {
+			return nil
+		}
+		key, err = link.Unlock(key)
+		if err != nil {
+			return err
+		}
+		keyID = link.PreviousKeyID
+		a.AddMessageKey(keyID, key)
+	}
+	return nil
+}
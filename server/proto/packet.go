@@ -14,6 +14,12 @@ func (c PacketType) Event() PacketType { return c + "-event" }
 func (c PacketType) Reply() PacketType { return c + "-reply" }
 
 var (
+	AddIncomingWebhookType      = PacketType("add-incoming-webhook")
+	AddIncomingWebhookReplyType = AddIncomingWebhookType.Reply()
+
+	AddWebhookType      = PacketType("add-webhook")
+	AddWebhookReplyType = AddWebhookType.Reply()
+
 	AuthType      = PacketType("auth")
 	AuthReplyType = AuthType.Reply()
 
@@ -29,6 +35,9 @@ var (
 	ChangeEmailType      = PacketType("change-email")
 	ChangeEmailReplyType = ChangeEmailType.Reply()
 
+	ChangeEmailPreferencesType      = PacketType("change-email-preferences")
+	ChangeEmailPreferencesReplyType = ChangeEmailPreferencesType.Reply()
+
 	ChangeNameType      = PacketType("change-name")
 	ChangeNameReplyType = ChangeNameType.Reply()
 
@@ -39,6 +48,19 @@ var (
 	EditMessageEventType = EditMessageType.Event()
 	EditMessageReplyType = EditMessageType.Reply()
 
+	EnableE2EType      = PacketType("enable-e2e")
+	EnableE2EReplyType = EnableE2EType.Reply()
+
+	GetAnnouncementModeType      = PacketType("get-announcement-mode")
+	GetAnnouncementModeReplyType = GetAnnouncementModeType.Reply()
+	AnnouncementModeEventType    = PacketType("announcement-mode").Event()
+
+	GetE2EKeysType      = PacketType("get-e2e-keys")
+	GetE2EKeysReplyType = GetE2EKeysType.Reply()
+
+	GetE2EPublicKeyType      = PacketType("get-e2e-public-key")
+	GetE2EPublicKeyReplyType = GetE2EPublicKeyType.Reply()
+
 	GetMessageType      = PacketType("get-message")
 	GetMessageReplyType = GetMessageType.Reply()
 
@@ -48,11 +70,23 @@ var (
 	GrantManagerType      = PacketType("grant-manager")
 	GrantManagerReplyType = GrantManagerType.Reply()
 
+	IssueBotTokenType      = PacketType("issue-bot-token")
+	IssueBotTokenReplyType = IssueBotTokenType.Reply()
+
 	JoinType      = PacketType("join")
 	JoinEventType = JoinType.Event()
 	PartType      = PacketType("part")
 	PartEventType = PartType.Event()
 
+	ListBotTokensType      = PacketType("list-bot-tokens")
+	ListBotTokensReplyType = ListBotTokensType.Reply()
+
+	ListIncomingWebhooksType      = PacketType("list-incoming-webhooks")
+	ListIncomingWebhooksReplyType = ListIncomingWebhooksType.Reply()
+
+	ListWebhooksType      = PacketType("list-webhooks")
+	ListWebhooksReplyType = ListWebhooksType.Reply()
+
 	LogType      = PacketType("log")
 	LogReplyType = LogType.Reply()
 
@@ -64,6 +98,14 @@ var (
 	LogoutEventType = LogoutType.Event()
 	LogoutReplyType = LogoutType.Reply()
 
+	MarkReadType      = PacketType("mark-read")
+	MarkReadReplyType = MarkReadType.Reply()
+	ReadEventType     = PacketType("read").Event()
+
+	MentionsType      = PacketType("mentions")
+	MentionsReplyType = MentionsType.Reply()
+	MentionEventType  = PacketType("mention").Event()
+
 	NickType      = PacketType("nick")
 	NickEventType = NickType.Event()
 	NickReplyType = NickType.Reply()
@@ -76,9 +118,21 @@ var (
 	PMInitiateEventType = PMInitiateType.Event()
 	PMInitiateReplyType = PMInitiateType.Reply()
 
+	ReactType         = PacketType("react")
+	ReactReplyType    = ReactType.Reply()
+	UnreactType       = PacketType("unreact")
+	UnreactReplyType  = UnreactType.Reply()
+	ReactionEventType = PacketType("reaction").Event()
+
 	RegisterAccountType      = PacketType("register-account")
 	RegisterAccountReplyType = RegisterAccountType.Reply()
 
+	RemoveIncomingWebhookType      = PacketType("remove-incoming-webhook")
+	RemoveIncomingWebhookReplyType = RemoveIncomingWebhookType.Reply()
+
+	RemoveWebhookType      = PacketType("remove-webhook")
+	RemoveWebhookReplyType = RemoveWebhookType.Reply()
+
 	ResendVerificationEmailType      = PacketType("resend-verification-email")
 	ResendVerificationEmailReplyType = ResendVerificationEmailType.Reply()
 
@@ -88,12 +142,39 @@ var (
 	RevokeAccessType      = PacketType("revoke-access")
 	RevokeAccessReplyType = RevokeAccessType.Reply()
 
+	RevokeBotTokenType      = PacketType("revoke-bot-token")
+	RevokeBotTokenReplyType = RevokeBotTokenType.Reply()
+
 	RevokeManagerType      = PacketType("revoke-manager")
 	RevokeManagerReplyType = RevokeManagerType.Reply()
 
+	RotateRoomKeyType      = PacketType("rotate-room-key")
+	RotateRoomKeyReplyType = RotateRoomKeyType.Reply()
+
+	SearchType      = PacketType("search")
+	SearchReplyType = SearchType.Reply()
+
+	SetAnnouncementModeType      = PacketType("set-announcement-mode")
+	SetAnnouncementModeReplyType = SetAnnouncementModeType.Reply()
+
+	SetE2EPublicKeyType      = PacketType("set-e2e-public-key")
+	SetE2EPublicKeyReplyType = SetE2EPublicKeyType.Reply()
+
+	ShareE2EKeyType      = PacketType("share-e2e-key")
+	ShareE2EKeyReplyType = ShareE2EKeyType.Reply()
+
+	StaffAddRoomAliasType      = PacketType("staff-add-room-alias")
+	StaffAddRoomAliasReplyType = StaffAddRoomAliasType.Reply()
+
+	StaffArchiveRoomType      = PacketType("staff-archive-room")
+	StaffArchiveRoomReplyType = StaffArchiveRoomType.Reply()
+
 	StaffCreateRoomType      = PacketType("staff-create-room")
 	StaffCreateRoomReplyType = StaffCreateRoomType.Reply()
 
+	StaffDeleteRoomType      = PacketType("staff-delete-room")
+	StaffDeleteRoomReplyType = StaffDeleteRoomType.Reply()
+
 	StaffEnrollOTPType      = PacketType("staff-enroll-otp")
 	StaffEnrollOTPReplyType = StaffEnrollOTPType.Reply()
 
@@ -112,6 +193,12 @@ var (
 	StaffLockRoomType      = PacketType("staff-lock-room")
 	StaffLockRoomReplyType = StaffLockRoomType.Reply()
 
+	StaffRemoveRoomAliasType      = PacketType("staff-remove-room-alias")
+	StaffRemoveRoomAliasReplyType = StaffRemoveRoomAliasType.Reply()
+
+	StaffRenameRoomType      = PacketType("staff-rename-room")
+	StaffRenameRoomReplyType = StaffRenameRoomType.Reply()
+
 	StaffRevokeAccessType      = PacketType("staff-revoke-access")
 	StaffRevokeAccessReplyType = StaffRevokeAccessType.Reply()
 
@@ -124,11 +211,12 @@ var (
 	WhoType      = PacketType("who")
 	WhoReplyType = WhoType.Reply()
 
-	BounceEventType     = PacketType("bounce").Event()
-	DisconnectEventType = PacketType("disconnect").Event()
-	HelloEventType      = PacketType("hello").Event()
-	NetworkEventType    = PacketType("network").Event()
-	SnapshotEventType   = PacketType("snapshot").Event()
+	BounceEventType      = PacketType("bounce").Event()
+	DisconnectEventType  = PacketType("disconnect").Event()
+	HelloEventType       = PacketType("hello").Event()
+	NetworkEventType     = PacketType("network").Event()
+	RoomRenamedEventType = PacketType("room-renamed").Event()
+	SnapshotEventType    = PacketType("snapshot").Event()
 
 	ErrorReplyType = PacketType("error").Reply()
 
@@ -140,6 +228,9 @@ var (
 		ChangeEmailType:      reflect.TypeOf(ChangeEmailCommand{}),
 		ChangeEmailReplyType: reflect.TypeOf(ChangeEmailReply{}),
 
+		ChangeEmailPreferencesType:      reflect.TypeOf(ChangeEmailPreferencesCommand{}),
+		ChangeEmailPreferencesReplyType: reflect.TypeOf(ChangeEmailPreferencesReply{}),
+
 		ChangeNameType:      reflect.TypeOf(ChangeNameCommand{}),
 		ChangeNameReplyType: reflect.TypeOf(ChangeNameReply{}),
 
@@ -159,12 +250,60 @@ var (
 		GrantManagerType:      reflect.TypeOf(GrantManagerCommand{}),
 		GrantManagerReplyType: reflect.TypeOf(GrantManagerReply{}),
 
+		GetAnnouncementModeType:      reflect.TypeOf(GetAnnouncementModeCommand{}),
+		GetAnnouncementModeReplyType: reflect.TypeOf(GetAnnouncementModeReply{}),
+		AnnouncementModeEventType:    reflect.TypeOf(AnnouncementModeEvent{}),
+		SetAnnouncementModeType:      reflect.TypeOf(SetAnnouncementModeCommand{}),
+		SetAnnouncementModeReplyType: reflect.TypeOf(SetAnnouncementModeReply{}),
+
+		EnableE2EType:            reflect.TypeOf(EnableE2ECommand{}),
+		EnableE2EReplyType:       reflect.TypeOf(EnableE2EReply{}),
+		GetE2EKeysType:           reflect.TypeOf(GetE2EKeysCommand{}),
+		GetE2EKeysReplyType:      reflect.TypeOf(GetE2EKeysReply{}),
+		GetE2EPublicKeyType:      reflect.TypeOf(GetE2EPublicKeyCommand{}),
+		GetE2EPublicKeyReplyType: reflect.TypeOf(GetE2EPublicKeyReply{}),
+		SetE2EPublicKeyType:      reflect.TypeOf(SetE2EPublicKeyCommand{}),
+		SetE2EPublicKeyReplyType: reflect.TypeOf(SetE2EPublicKeyReply{}),
+		ShareE2EKeyType:          reflect.TypeOf(ShareE2EKeyCommand{}),
+		ShareE2EKeyReplyType:     reflect.TypeOf(ShareE2EKeyReply{}),
+
+		AddWebhookType:         reflect.TypeOf(AddWebhookCommand{}),
+		AddWebhookReplyType:    reflect.TypeOf(AddWebhookReply{}),
+		ListWebhooksType:       reflect.TypeOf(ListWebhooksCommand{}),
+		ListWebhooksReplyType:  reflect.TypeOf(ListWebhooksReply{}),
+		RemoveWebhookType:      reflect.TypeOf(RemoveWebhookCommand{}),
+		RemoveWebhookReplyType: reflect.TypeOf(RemoveWebhookReply{}),
+
+		AddIncomingWebhookType:         reflect.TypeOf(AddIncomingWebhookCommand{}),
+		AddIncomingWebhookReplyType:    reflect.TypeOf(AddIncomingWebhookReply{}),
+		ListIncomingWebhooksType:       reflect.TypeOf(ListIncomingWebhooksCommand{}),
+		ListIncomingWebhooksReplyType:  reflect.TypeOf(ListIncomingWebhooksReply{}),
+		RemoveIncomingWebhookType:      reflect.TypeOf(RemoveIncomingWebhookCommand{}),
+		RemoveIncomingWebhookReplyType: reflect.TypeOf(RemoveIncomingWebhookReply{}),
+
+		IssueBotTokenType:      reflect.TypeOf(IssueBotTokenCommand{}),
+		IssueBotTokenReplyType: reflect.TypeOf(IssueBotTokenReply{}),
+
+		ListBotTokensType:      reflect.TypeOf(ListBotTokensCommand{}),
+		ListBotTokensReplyType: reflect.TypeOf(ListBotTokensReply{}),
+
 		LogType:      reflect.TypeOf(LogCommand{}),
 		LogReplyType: reflect.TypeOf(LogReply{}),
 
+		SearchType:      reflect.TypeOf(SearchCommand{}),
+		SearchReplyType: reflect.TypeOf(SearchReply{}),
+
 		JoinEventType: reflect.TypeOf(PresenceEvent{}),
 		PartEventType: reflect.TypeOf(PresenceEvent{}),
 
+		MarkReadType:      reflect.TypeOf(MarkReadCommand{}),
+		MarkReadReplyType: reflect.TypeOf(MarkReadReply{}),
+		ReadEventType:     reflect.TypeOf(ReadEvent{}),
+
+		MentionsType:      reflect.TypeOf(MentionsCommand{}),
+		MentionsReplyType: reflect.TypeOf(MentionsReply{}),
+		MentionEventType:  reflect.TypeOf(MentionEvent{}),
+
 		NickType:      reflect.TypeOf(NickCommand{}),
 		NickReplyType: reflect.TypeOf(NickReply{}),
 		NickEventType: reflect.TypeOf(NickEvent{}),
@@ -173,9 +312,18 @@ var (
 		PingEventType: reflect.TypeOf(PingEvent{}),
 		PingReplyType: reflect.TypeOf(PingReply{}),
 
+		StaffAddRoomAliasType:      reflect.TypeOf(StaffAddRoomAliasCommand{}),
+		StaffAddRoomAliasReplyType: reflect.TypeOf(StaffAddRoomAliasReply{}),
+
+		StaffArchiveRoomType:      reflect.TypeOf(StaffArchiveRoomCommand{}),
+		StaffArchiveRoomReplyType: reflect.TypeOf(StaffArchiveRoomReply{}),
+
 		StaffCreateRoomType:      reflect.TypeOf(StaffCreateRoomCommand{}),
 		StaffCreateRoomReplyType: reflect.TypeOf(StaffCreateRoomReply{}),
 
+		StaffDeleteRoomType:      reflect.TypeOf(StaffDeleteRoomCommand{}),
+		StaffDeleteRoomReplyType: reflect.TypeOf(StaffDeleteRoomReply{}),
+
 		StaffEnrollOTPType:      reflect.TypeOf(StaffEnrollOTPCommand{}),
 		StaffEnrollOTPReplyType: reflect.TypeOf(StaffEnrollOTPReply{}),
 
@@ -194,6 +342,12 @@ var (
 		StaffLockRoomType:      reflect.TypeOf(StaffLockRoomCommand{}),
 		StaffLockRoomReplyType: reflect.TypeOf(StaffLockRoomReply{}),
 
+		StaffRemoveRoomAliasType:      reflect.TypeOf(StaffRemoveRoomAliasCommand{}),
+		StaffRemoveRoomAliasReplyType: reflect.TypeOf(StaffRemoveRoomAliasReply{}),
+
+		StaffRenameRoomType:      reflect.TypeOf(StaffRenameRoomCommand{}),
+		StaffRenameRoomReplyType: reflect.TypeOf(StaffRenameRoomReply{}),
+
 		StaffRevokeAccessType:      reflect.TypeOf(StaffRevokeAccessCommand{}),
 		StaffRevokeAccessReplyType: reflect.TypeOf(StaffRevokeAccessReply{}),
 
@@ -208,11 +362,12 @@ var (
 		UnbanType:      reflect.TypeOf(UnbanCommand{}),
 		UnbanReplyType: reflect.TypeOf(UnbanReply{}),
 
-		BounceEventType:     reflect.TypeOf(BounceEvent{}),
-		DisconnectEventType: reflect.TypeOf(DisconnectEvent{}),
-		HelloEventType:      reflect.TypeOf(HelloEvent{}),
-		NetworkEventType:    reflect.TypeOf(NetworkEvent{}),
-		SnapshotEventType:   reflect.TypeOf(SnapshotEvent{}),
+		BounceEventType:      reflect.TypeOf(BounceEvent{}),
+		DisconnectEventType:  reflect.TypeOf(DisconnectEvent{}),
+		HelloEventType:       reflect.TypeOf(HelloEvent{}),
+		NetworkEventType:     reflect.TypeOf(NetworkEvent{}),
+		RoomRenamedEventType: reflect.TypeOf(RoomRenamedEvent{}),
+		SnapshotEventType:    reflect.TypeOf(SnapshotEvent{}),
 
 		LoginType:      reflect.TypeOf(LoginCommand{}),
 		LoginEventType: reflect.TypeOf(LoginEvent{}),
@@ -226,6 +381,12 @@ var (
 		PMInitiateEventType: reflect.TypeOf(PMInitiateEvent{}),
 		PMInitiateReplyType: reflect.TypeOf(PMInitiateReply{}),
 
+		ReactType:         reflect.TypeOf(ReactCommand{}),
+		ReactReplyType:    reflect.TypeOf(ReactReply{}),
+		UnreactType:       reflect.TypeOf(UnreactCommand{}),
+		UnreactReplyType:  reflect.TypeOf(UnreactReply{}),
+		ReactionEventType: reflect.TypeOf(ReactionEvent{}),
+
 		RegisterAccountType:      reflect.TypeOf(RegisterAccountCommand{}),
 		RegisterAccountReplyType: reflect.TypeOf(RegisterAccountReply{}),
 
@@ -238,9 +399,15 @@ var (
 		RevokeManagerType:      reflect.TypeOf(RevokeManagerCommand{}),
 		RevokeManagerReplyType: reflect.TypeOf(RevokeManagerReply{}),
 
+		RevokeBotTokenType:      reflect.TypeOf(RevokeBotTokenCommand{}),
+		RevokeBotTokenReplyType: reflect.TypeOf(RevokeBotTokenReply{}),
+
 		RevokeAccessType:      reflect.TypeOf(RevokeAccessCommand{}),
 		RevokeAccessReplyType: reflect.TypeOf(RevokeAccessReply{}),
 
+		RotateRoomKeyType:      reflect.TypeOf(RotateRoomKeyCommand{}),
+		RotateRoomKeyReplyType: reflect.TypeOf(RotateRoomKeyReply{}),
+
 		UnlockStaffCapabilityType:      reflect.TypeOf(UnlockStaffCapabilityCommand{}),
 		UnlockStaffCapabilityReplyType: reflect.TypeOf(UnlockStaffCapabilityReply{}),
 
@@ -268,11 +435,17 @@ type ErrorReply struct {
 // If the room is private, then the message content will be encrypted
 // before it is stored and broadcast to the rest of the room.
 //
+// In an end-to-end encrypted room the server can't encrypt messages, so the
+// client must encrypt the content itself with a room key shared through
+// `share-e2e-key`, and give that key's id in `encryption_key_id`. The
+// content is stored and broadcast as given.
+//
 // The caller of this command will not receive the corresponding
 // `send-event`, but will receive the same information in the `send-reply`.
 type SendCommand struct {
-	Content string              `json:"content"`          // the content of the message (client-defined)
-	Parent  snowflake.Snowflake `json:"parent,omitempty"` // the id of the parent message, if any
+	Content         string              `json:"content"`                     // the content of the message (client-defined)
+	Parent          snowflake.Snowflake `json:"parent,omitempty"`            // the id of the parent message, if any
+	EncryptionKeyID string              `json:"encryption_key_id,omitempty"` // the id of the room key the content is encrypted with, in an end-to-end encrypted room
 }
 
 // A `send-event` indicates a message received by the room from another session.
@@ -282,8 +455,12 @@ type SendEvent Message
 // which was populated by the server.
 type SendReply SendEvent
 
-// The `edit-message` command can be used by active room managers to modify the
-// content or display of a message.
+// The `edit-message` command can be used to modify the content or display of
+// a message. The sender of a message may change its content or parent. Active
+// room managers may edit any message, and may also delete or undelete it.
+//
+// If the room is private, then the new content will be encrypted before it is
+// stored and broadcast to the rest of the room.
 //
 // A message deleted by this command is still stored in the database. Deleted
 // messages may be undeleted by this command. (Messages that have expired from
@@ -292,9 +469,9 @@ type SendReply SendEvent
 type EditMessageCommand struct {
 	ID             snowflake.Snowflake `json:"id"`                // the id of the message to edit
 	PreviousEditID snowflake.Snowflake `json:"previous_edit_id"`  // the `previous_edit_id` of the message; if this does not match, the edit will fail (basic conflict resolution)
-	Parent         snowflake.Snowflake `json:"parent,omitempty"`  // the new parent of the message (*not yet implemented*)
-	Content        string              `json:"content,omitempty"` // the new content of the message (*not yet implemented*)
-	Delete         bool                `json:"delete"`            // the new deletion status of the message
+	Parent         snowflake.Snowflake `json:"parent,omitempty"`  // the new parent of the message (must be older than the message itself)
+	Content        string              `json:"content,omitempty"` // the new content of the message
+	Delete         bool                `json:"delete"`            // the new deletion status of the message (managers only)
 	Announce       bool                `json:"announce"`          // if true, broadcast an `edit-message-event` to the room
 }
 
@@ -314,6 +491,20 @@ type ChangeEmailReply struct {
 	VerificationNeeded bool   `json:"verification_needed"` // if true, a verification email will be sent out, and the user must verify the address before it becomes their primary address
 }
 
+// The `change-email-preferences` command changes which optional emails are
+// sent to the signed in account.
+type ChangeEmailPreferencesCommand struct {
+	Digest       bool `json:"digest"`       // if true, email digests of missed mentions and unread PMs while the account is offline
+	Unsubscribed bool `json:"unsubscribed"` // if true, send no email other than what's needed to manage the account
+}
+
+// The `change-email-preferences-reply` packet returns the account's email
+// preferences after the change.
+type ChangeEmailPreferencesReply struct {
+	Digest       bool `json:"digest"`       // if true, digests of missed mentions and unread PMs will be emailed
+	Unsubscribed bool `json:"unsubscribed"` // if true, no email will be sent other than what's needed to manage the account
+}
+
 // The `change-name` command changes the name associated with the signed in account.
 type ChangeNameCommand struct {
 	Name string `json:"name"` // the name to associate with the account
@@ -350,15 +541,107 @@ type EditMessageEvent struct {
 	Message
 }
 
+// The `add-webhook` command may be used by a host to register an outgoing
+// webhook for the room. Each of the given events that occurs in the room is
+// POSTed to the URL as a JSON object with `webhook_id`, `room`, `type`,
+// `data`, and `time` fields. The body is signed with HMAC-SHA256, keyed by
+// the webhook's secret, in the `X-Heim-Signature` header.
+//
+// Deliveries are queued, and retried if the URL does not respond with a 2xx
+// status. Redirects are not followed, and URLs that resolve to loopback,
+// link-local, or private addresses are never delivered to.
+type AddWebhookCommand struct {
+	URL    string       `json:"url"`              // the http or https URL to deliver events to
+	Events []PacketType `json:"events"`           // the events to deliver: any of `send-event`, `edit-message-event`, `join-event`, and `part-event`
+	Secret string       `json:"secret,omitempty"` // the key to sign deliveries with; if not given, one is generated
+}
+
+// The `add-webhook-reply` packet returns the new webhook along with its
+// secret.
+type AddWebhookReply struct {
+	Webhook
+	Secret string `json:"secret"` // the key deliveries are signed with
+}
+
+// The `list-webhooks` command lists the room's outgoing webhooks. It may only
+// be used by hosts.
+type ListWebhooksCommand struct{}
+
+// The `list-webhooks-reply` packet returns the room's webhooks, oldest first.
+// Secrets are not included.
+type ListWebhooksReply struct {
+	Webhooks []Webhook `json:"webhooks"` // the room's webhooks
+}
+
+// The `remove-webhook` command may be used by a host to unregister one of the
+// room's webhooks. Deliveries already queued for the webhook are dropped.
+type RemoveWebhookCommand struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the webhook to remove
+}
+
+// `remove-webhook-reply` confirms that the webhook was removed.
+type RemoveWebhookReply struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the removed webhook
+}
+
+// The `add-incoming-webhook` command may be used by a host to create an
+// incoming webhook, which lets an outside service post messages into the
+// room without opening a websocket. Messages are sent by POSTing a JSON
+// object with a `content` field, and optionally a `parent` field, to the
+// returned path. They appear in the room under the given name.
+//
+// The path contains the webhook's secret, and is only returned once.
+type AddIncomingWebhookCommand struct {
+	Name string `json:"name"` // the name to post messages under
+}
+
+// The `add-incoming-webhook-reply` packet returns the new incoming webhook
+// along with the path to POST messages to.
+type AddIncomingWebhookReply struct {
+	IncomingWebhook
+	Path string `json:"path"` // the secret path, relative to the site root, to POST messages to
+}
+
+// The `list-incoming-webhooks` command lists the room's incoming webhooks.
+// It may only be used by hosts.
+type ListIncomingWebhooksCommand struct{}
+
+// The `list-incoming-webhooks-reply` packet returns the room's incoming
+// webhooks, oldest first. Their paths are not included.
+type ListIncomingWebhooksReply struct {
+	IncomingWebhooks []IncomingWebhook `json:"incoming_webhooks"` // the room's incoming webhooks
+}
+
+// The `remove-incoming-webhook` command may be used by a host to revoke one
+// of the room's incoming webhooks. Its path stops accepting messages
+// immediately.
+type RemoveIncomingWebhookCommand struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the incoming webhook to remove
+}
+
+// `remove-incoming-webhook-reply` confirms that the incoming webhook was
+// removed.
+type RemoveIncomingWebhookReply struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the removed incoming webhook
+}
+
 // The `grant-access` command may be used by an active manager in a private room
 // to create a new capability for access. Access may be granted to either a
 // passcode or an account.
 //
+// A passcode grant may be limited to a number of seconds (up to a year),
+// after which it expires, or to a number of successful `auth` commands, after
+// which it is used up. Every successful `auth` with the passcode counts as a use,
+// including those made when reconnecting. Expired and used-up grants are
+// removed automatically.
+//
 // If the room is not private, or if the requested access grant already exists,
 // an error will be returned.
 type GrantAccessCommand struct {
 	AccountID snowflake.Snowflake `json:"account_id,omitempty"` // the id of an account to grant access to
 	Passcode  string              `json:"passcode,omitempty"`   // a passcode to grant access to; anyone presenting the same passcode can access the room
+	Seconds   int                 `json:"seconds,omitempty"`    // for a passcode grant, how long the grant lasts; if not given, it doesn't expire
+	MaxUses   int                 `json:"max_uses,omitempty"`   // for a passcode grant, how many times it may be used to authenticate; if not given, there is no limit
 }
 
 // `grant-access-reply` confirms that access was granted.
@@ -375,6 +658,43 @@ type GrantManagerCommand struct {
 // `grant-manager-reply` confirms that manager status was granted.
 type GrantManagerReply struct{}
 
+// The `issue-bot-token` command issues a token that lets a bot connect to
+// rooms as the signed in account, without a password. See
+// [Bot Tokens](#bot-tokens) for how the token is presented.
+type IssueBotTokenCommand struct {
+	Name  string   `json:"name,omitempty"`  // a description of the token's purpose
+	Rooms []string `json:"rooms,omitempty"` // if given, the only rooms the token may be used in, by their current names
+}
+
+// The `issue-bot-token-reply` packet returns the new token along with its
+// bearer secret. The secret is not stored by the server and is never
+// returned again.
+type IssueBotTokenReply struct {
+	BotToken
+	Secret string `json:"secret"` // the bearer secret to present when connecting
+}
+
+// The `list-bot-tokens` command lists the unrevoked bot tokens of the signed
+// in account.
+type ListBotTokensCommand struct{}
+
+// The `list-bot-tokens-reply` packet returns the account's bot tokens, oldest
+// first. Secrets are not included.
+type ListBotTokensReply struct {
+	Tokens []BotToken `json:"tokens"` // the account's bot tokens
+}
+
+// The `revoke-bot-token` command revokes one of the signed in account's bot
+// tokens. The token can no longer be used to connect.
+type RevokeBotTokenCommand struct {
+	TokenID string `json:"token_id"` // the id of the token to revoke
+}
+
+// `revoke-bot-token-reply` confirms that the token was revoked.
+type RevokeBotTokenReply struct {
+	TokenID string `json:"token_id"` // the id of the revoked token
+}
+
 // The `staff-grant-manager` command is a version of the [grant-manager](#grant-manager)
 // command that is available to staff. The staff account does not need to be a manager
 // of the room to use this command.
@@ -412,15 +732,47 @@ type PresenceEvent SessionView
 // The `log` command requests messages from the room's message log. This can be used
 // to supplement the log provided by `snapshot-event` (for example, when scrolling
 // back further in history).
+//
+// By default, the most recent messages are returned. At most one of `before`,
+// `after`, and `around` may be given to anchor the request elsewhere in the log.
 type LogCommand struct {
 	N      int                 `json:"n"`                // maximum number of messages to return (up to 1000)
 	Before snowflake.Snowflake `json:"before,omitempty"` // return messages prior to this snowflake
+	After  snowflake.Snowflake `json:"after,omitempty"`  // return messages following this snowflake
+	Around snowflake.Snowflake `json:"around,omitempty"` // return messages centered on (and including) this snowflake
 }
 
 // The `log-reply` packet returns a list of messages from the room's message log.
 type LogReply struct {
-	Log    []Message           `json:"log"`              // list of messages returned
-	Before snowflake.Snowflake `json:"before,omitempty"` // messages prior to this snowflake were returned
+	Log        []Message           `json:"log"`                   // list of messages returned
+	Before     snowflake.Snowflake `json:"before,omitempty"`      // messages prior to this snowflake were returned
+	After      snowflake.Snowflake `json:"after,omitempty"`       // messages following this snowflake were returned
+	Around     snowflake.Snowflake `json:"around,omitempty"`      // messages centered on this snowflake were returned
+	MoreBefore bool                `json:"more_before,omitempty"` // if true, older messages are available
+	MoreAfter  bool                `json:"more_after,omitempty"`  // if true, newer messages are available
+}
+
+// The `search` command looks for messages in the room's log that contain all
+// of the words in the given query. Results can be narrowed down by sender and
+// by the time they were posted, and are paged backwards like the results of
+// `log`.
+//
+// In private rooms, the log can only be searched by sessions holding the
+// room's message key, and only the most recent messages are searched.
+type SearchCommand struct {
+	Query  string              `json:"query"`            // the words to search for
+	Sender UserID              `json:"sender,omitempty"` // only return messages sent by this user
+	Since  Time                `json:"since,omitempty"`  // only return messages posted at or after this time
+	Until  Time                `json:"until,omitempty"`  // only return messages posted before this time
+	N      int                 `json:"n"`                // maximum number of messages to return (up to 1000)
+	Before snowflake.Snowflake `json:"before,omitempty"` // return messages prior to this snowflake
+}
+
+// The `search-reply` packet returns the most recent messages matching a `search`
+// command, in the same order as `log-reply`.
+type SearchReply struct {
+	Results []Message           `json:"results"`          // list of matching messages
+	Before  snowflake.Snowflake `json:"before,omitempty"` // messages prior to this snowflake were searched
 }
 
 // The `nick` command sets the name you present to the room. This name applies
@@ -537,11 +889,21 @@ type HelloEvent struct {
 	AccountHasAccess     bool                 `json:"account_has_access,omitempty"`     // if true, then the account has an explicit access grant to the current room
 	AccountEmailVerified bool                 `json:"account_email_verified,omitempty"` // whether the account's email address has been verified
 	RoomIsPrivate        bool                 `json:"room_is_private"`                  // if true, the session is connected to a private room
+	RoomIsE2E            bool                 `json:"room_is_e2e,omitempty"`            // if true, messages in the room are end-to-end encrypted and can't be read by the server or staff
 	Version              string               `json:"version"`                          // the version of the code being run and served by the server
 }
 
 // A `snapshot-event` indicates that a session has successfully joined a room.
 // It also offers a snapshot of the room's state and recent history.
+//
+// The snapshot includes a resume token. If the connection is lost, the client
+// may reconnect with the query parameters `resume`, set to the token, and
+// `cursor`, set to the `cursor` of the last event it received (or of the
+// snapshot). The send, edit-message, reaction, join, part, and nick events that
+// occurred in the meantime are then replayed after the new snapshot, as long as the
+// connection was lost only recently. Replayed events may overlap with the
+// snapshot and with live events, so clients should skip events whose cursor
+// they have already seen.
 type SnapshotEvent struct {
 	Identity  UserID    `json:"identity"`       // the id of the agent or account logged into this session
 	SessionID string    `json:"session_id"`     // the globally unique id of this session
@@ -552,6 +914,16 @@ type SnapshotEvent struct {
 
 	PMWithNick   string `json:"pm_with_nick,omitempty"`    // if given, this room is for private chat with the given nick
 	PMWithUserID UserID `json:"pm_with_user_id,omitempty"` // if given, this room is for private chat with the given user
+
+	ResumeToken string              `json:"resume_token,omitempty"` // a token that can be presented when reconnecting to replay missed events
+	Cursor      snowflake.Snowflake `json:"cursor,omitempty"`       // the position in the room's event log as of this snapshot
+	Resumed     bool                `json:"resumed,omitempty"`      // if true, the events missed since the cursor presented on reconnecting follow this snapshot
+
+	ReadMarker snowflake.Snowflake `json:"read_marker,omitempty"` // the id of the last message the signed in account has marked as read (see `mark-read`)
+	Unread     int                 `json:"unread,omitempty"`      // the number of messages posted after the read marker (up to 1000)
+
+	AnnouncementMode bool `json:"announcement_mode,omitempty"` // if true, only hosts and the accounts they allow may send messages to the room
+	ReadOnly         bool `json:"read_only,omitempty"`         // if true, this session may not send messages to the room
 }
 
 // A `network-event` indicates some server-side event that impacts the presence
@@ -566,6 +938,15 @@ type NetworkEvent struct {
 	ServerEra string `json:"server_era"` // the era of the affected server
 }
 
+// A `room-renamed-event` indicates that the room now goes by a different
+// name. It's also sent just after the snapshot to sessions that joined the
+// room through one of its aliases. Clients should update any URLs that lead to
+// the room, but the session needn't reconnect.
+type RoomRenamedEvent struct {
+	From string `json:"from"` // the name the room went by, or the alias the session joined through
+	To   string `json:"to"`   // the canonical name of the room
+}
+
 // The `login` command attempts to log an anonymous session into an account.
 // It will return an error if the session is already logged in.
 //
@@ -633,6 +1014,83 @@ type PMInitiateEvent struct {
 	PMID     snowflake.Snowflake `json:"pm_id"`     // the private chat can be accessed at /room/pm:*PMID*
 }
 
+// The `mark-read` command records that the signed in account has read the
+// room up to and including the given message. The read marker only moves
+// forward, so marking an earlier message has no effect.
+//
+// The account's other sessions are sent a `read-event`.
+type MarkReadCommand struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the last message read
+}
+
+// `mark-read-reply` returns the account's read marker for the room.
+type MarkReadReply struct {
+	ID     snowflake.Snowflake `json:"id"`     // the id of the last message read
+	Unread int                 `json:"unread"` // the number of messages posted after the last message read (up to 1000)
+}
+
+// A `read-event` indicates that another session of the same account has
+// moved its read marker in a room.
+type ReadEvent struct {
+	Room   string              `json:"room"`   // the name of the room
+	ID     snowflake.Snowflake `json:"id"`     // the id of the last message read
+	Unread int                 `json:"unread"` // the number of messages posted after the last message read (up to 1000)
+}
+
+// The `mentions` command requests the most recent messages, across all rooms,
+// that @-mentioned the signed in account by its nick in the room at the time.
+type MentionsCommand struct {
+	N      int                 `json:"n"`                // maximum number of mentions to return (up to 1000)
+	Before snowflake.Snowflake `json:"before,omitempty"` // return mentions in messages prior to this snowflake
+}
+
+// The `mentions-reply` packet returns a list of mentions, oldest first. The
+// mentioning messages can be retrieved with `get-message` in their rooms.
+type MentionsReply struct {
+	Mentions []Mention `json:"mentions"` // list of mentions returned
+}
+
+// A `mention-event` indicates that a message in some room has just
+// @-mentioned the user of this session.
+type MentionEvent Mention
+
+// The `react` command adds the session's reaction to a message, such as an
+// emoji. Each user counts only once towards each distinct reaction to a
+// message, so repeating a reaction has no further effect.
+//
+// A `reaction-event` is broadcast to the rest of the room, unless the
+// reaction was already there.
+type ReactCommand struct {
+	ID       snowflake.Snowflake `json:"id"`       // the id of the message to react to
+	Reaction string              `json:"reaction"` // the reaction, usually an emoji (client-defined, up to 32 bytes)
+}
+
+// `react-reply` confirms the reaction and gives the updated count.
+type ReactReply ReactionEvent
+
+// The `unreact` command withdraws the session's reaction to a message.
+//
+// A `reaction-event` is broadcast to the rest of the room, unless there was
+// no reaction to withdraw.
+type UnreactCommand struct {
+	ID       snowflake.Snowflake `json:"id"`       // the id of the message to withdraw the reaction from
+	Reaction string              `json:"reaction"` // the reaction to withdraw
+}
+
+// `unreact-reply` confirms the withdrawal and gives the updated count.
+type UnreactReply ReactionEvent
+
+// A `reaction-event` indicates that a reaction to a message was added or
+// withdrawn. If the client offers a user interface and the indicated message
+// is currently displayed, it should update the message's reaction counts.
+type ReactionEvent struct {
+	ID       snowflake.Snowflake `json:"id"`                // the id of the message reacted to
+	Reaction string              `json:"reaction"`          // the reaction
+	Sender   SessionView         `json:"sender"`            // the session that reacted
+	Removed  bool                `json:"removed,omitempty"` // if true, the reaction was withdrawn
+	Count    int                 `json:"count"`             // the number of users now reacting to the message this way
+}
+
 // The `register-account` command creates a new account and logs into it.
 // It will return an error if the session is already logged in.
 //
@@ -692,6 +1150,106 @@ type RevokeManagerCommand struct {
 // `revoke-manager-reply` confirms that the manager grant was revoked.
 type RevokeManagerReply struct{}
 
+// The `rotate-room-key` command replaces the message key of a private room
+// with a new one. The previous key is kept, encrypted under the new key, so
+// anyone granted the new key can still read the room's history.
+//
+// Existing access grants are made with the previous key and stop working,
+// except that the room's managers are granted the new key. Other accounts
+// and passcodes must be granted access again with `grant-access`.
+//
+// Every session in the room, including the host's, is sent a
+// `disconnect-event` so that it reconnects with the new key.
+type RotateRoomKeyCommand struct{}
+
+// `rotate-room-key-reply` confirms that the room's message key was replaced.
+type RotateRoomKeyReply struct{}
+
+// The `get-announcement-mode` command returns who may send messages to the
+// room. It may only be used by hosts.
+type GetAnnouncementModeCommand struct{}
+
+// `get-announcement-mode-reply` returns the room's announcement mode.
+type GetAnnouncementModeReply AnnouncementMode
+
+// The `set-announcement-mode` command may be used by a host to restrict who
+// may send messages to the room. In announcement mode, only hosts and the
+// listed accounts may send; everyone else can only read. Sessions that join
+// the room afterward learn of the mode through their `snapshot-event`.
+//
+// An `announcement-mode-event` is broadcast to the rest of the room.
+type SetAnnouncementModeCommand AnnouncementMode
+
+// `set-announcement-mode-reply` returns the room's new announcement mode.
+type SetAnnouncementModeReply AnnouncementMode
+
+// An `announcement-mode-event` indicates that a host changed who may send
+// messages to the room. Clients should stop or resume offering to send
+// messages according to `read_only`, which replaces the one given in the
+// `snapshot-event`.
+type AnnouncementModeEvent struct {
+	Enabled  bool                  `json:"enabled"`             // if true, the room is now in announcement mode
+	Posters  []snowflake.Snowflake `json:"posters,omitempty"`   // the accounts allowed to send messages (only sent to hosts)
+	ReadOnly bool                  `json:"read_only,omitempty"` // if true, this session may no longer send messages to the room
+}
+
+// The `enable-e2e` command may be used by a host to make the room end-to-end
+// encrypted. Afterward, clients encrypt messages themselves with room keys
+// that the server never sees, so neither the server nor staff can read them.
+// This can't be undone.
+//
+// Everyone in the room is disconnected, and the `hello-event` sent when they
+// reconnect has `room_is_e2e` set. Messages sent earlier remain readable as
+// before.
+type EnableE2ECommand struct{}
+
+// `enable-e2e-reply` confirms that the room is now end-to-end encrypted.
+type EnableE2EReply struct{}
+
+// The `get-e2e-keys` command returns the keys of an end-to-end encrypted room
+// that have been shared with the session's account. Each key is sealed for
+// the account's public key, and can only be opened with the matching private
+// key, which the client keeps.
+type GetE2EKeysCommand struct{}
+
+// `get-e2e-keys-reply` returns the room keys shared with the account.
+type GetE2EKeysReply struct {
+	Keys []*E2EKey `json:"keys"` // the room keys shared with the account
+}
+
+// The `get-e2e-public-key` command returns the public key that an account
+// has registered with `set-e2e-public-key`. Hosts use it to seal room keys
+// for the account. Only hosts may use it.
+type GetE2EPublicKeyCommand struct {
+	AccountID snowflake.Snowflake `json:"account_id"` // the id of the account
+}
+
+// `get-e2e-public-key-reply` returns the account's public key.
+type GetE2EPublicKeyReply struct {
+	AccountID snowflake.Snowflake `json:"account_id"`           // the id of the account
+	PublicKey []byte              `json:"public_key,omitempty"` // the account's Curve25519 public key, if it has one
+}
+
+// The `set-e2e-public-key` command registers the Curve25519 public key that
+// keys of end-to-end encrypted rooms are sealed for when shared with the
+// account. The private key never leaves the client.
+type SetE2EPublicKeyCommand struct {
+	PublicKey []byte `json:"public_key"` // the account's Curve25519 public key
+}
+
+// `set-e2e-public-key-reply` confirms that the public key was registered.
+type SetE2EPublicKeyReply struct{}
+
+// The `share-e2e-key` command may be used by a host of an end-to-end
+// encrypted room to share a room key with an account. The host seals the key
+// with `crypto_box` for the account's public key, so the server only stores
+// and distributes the sealed key. Sharing a key again replaces the account's
+// earlier copy.
+type ShareE2EKeyCommand E2EKey
+
+// `share-e2e-key-reply` confirms that the key was shared.
+type ShareE2EKeyReply struct{}
+
 // The `staff-create-room` command creates a new room.
 type StaffCreateRoomCommand struct {
 	Name     string                `json:"name"`              // the name of the new rom
@@ -705,6 +1263,28 @@ type StaffCreateRoomReply struct {
 	FailureReason string `json:"failure_reason,omitempty"` // if `success` was false, the reason why
 }
 
+// The `staff-archive-room` command makes the room read-only. Its history is
+// kept, and anyone who may enter the room can still read it, but nothing more
+// can be posted to it. Everyone in the room is disconnected.
+//
+// The staff member must have issued a successful `staff-validate-otp` command
+// within the last five minutes.
+type StaffArchiveRoomCommand struct{}
+
+// `staff-archive-room-reply` confirms that the room has been archived.
+type StaffArchiveRoomReply struct{}
+
+// The `staff-delete-room` command permanently deletes the room, along with its
+// messages, keys, access grants, presence, and nicks. Everyone in the room is
+// disconnected.
+//
+// The staff member must have issued a successful `staff-validate-otp` command
+// within the last five minutes.
+type StaffDeleteRoomCommand struct{}
+
+// `staff-delete-room-reply` confirms that the room has been deleted.
+type StaffDeleteRoomReply struct{}
+
 // The `staff-enroll-otp` command generates a new OTP key for a staff user. The
 // user must then validate the key by issuing a successful `staff-validate-otp`
 // command. An error will be returned if the user already has a validated OTP key.
@@ -750,6 +1330,40 @@ type StaffLockRoomCommand struct{}
 // `staff-lock-room-reply` confirms that the room has been made newly private.
 type StaffLockRoomReply struct{}
 
+// The `staff-rename-room` command gives the room a new canonical name. The
+// room's previous names become aliases, which keep leading to the room.
+//
+// A `room-renamed-event` is sent to everyone else in the room.
+type StaffRenameRoomCommand struct {
+	Name string `json:"name"` // the new name of the room
+}
+
+// `staff-rename-room-reply` returns the room's names after the rename.
+type StaffRenameRoomReply struct {
+	Name    string   `json:"name"`    // the canonical name of the room
+	Aliases []string `json:"aliases"` // the other names that lead to the room
+}
+
+// The `staff-add-room-alias` command makes another name lead to the room.
+type StaffAddRoomAliasCommand struct {
+	Alias string `json:"alias"` // the name to add
+}
+
+// `staff-add-room-alias-reply` returns the room's names after the alias was
+// added.
+type StaffAddRoomAliasReply StaffRenameRoomReply
+
+// The `staff-remove-room-alias` command stops a name from leading to the
+// room. Neither the room's canonical name nor the name it was created with
+// may be removed.
+type StaffRemoveRoomAliasCommand struct {
+	Alias string `json:"alias"` // the name to remove
+}
+
+// `staff-remove-room-alias-reply` returns the room's names after the alias
+// was removed.
+type StaffRemoveRoomAliasReply StaffRenameRoomReply
+
 // The `unlock-staff-capability` command may be called by a staff account to gain access to
 // staff commands.
 //
@@ -781,6 +1395,8 @@ type Packet struct {
 
 	Throttled       bool   `json:"throttled,omitempty"`        // this field appears in replies to warn the client that it may be flooding; the client should slow down its command rate
 	ThrottledReason string `json:"throttled_reason,omitempty"` // if throttled is true, this field describes why
+
+	Cursor snowflake.Snowflake `json:"cursor,omitempty"` // this field appears in events that can be replayed to resumed sessions; it gives the position of the event in the room's event log
 }
 
 func (cmd *Packet) Payload() (interface{}, error) {
@@ -843,6 +1459,8 @@ func MakeEvent(payload interface{}) (*Packet, error) {
 		packet.Type = PingEventType
 	case *NetworkEvent:
 		packet.Type = NetworkEventType
+	case *RoomRenamedEvent:
+		packet.Type = RoomRenamedEventType
 	case *SnapshotEvent:
 		packet.Type = SnapshotEventType
 	case *HelloEvent:
@@ -0,0 +1,30 @@
+package proto
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const MaxReactionLength = 32
+
+// NormalizeReaction validates and normalizes a proposed reaction to a
+// message. If the proposed reaction is not valid, returns an error.
+// Otherwise, returns the normalized form of the reaction, with leading and
+// trailing whitespace removed and emoji shortcodes replaced with the
+// corresponding Unicode code points. Reactions may not contain internal
+// whitespace or control characters.
+func NormalizeReaction(reaction string) (string, error) {
+	reaction = strings.TrimSpace(reaction)
+	if reaction == "" || !utf8.ValidString(reaction) {
+		return "", ErrInvalidReaction
+	}
+	if strings.IndexFunc(reaction, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return "", ErrInvalidReaction
+	}
+	reaction = normalizeEmoji(reaction)
+	if len(reaction) > MaxReactionLength {
+		return "", ErrInvalidReaction
+	}
+	return reaction, nil
+}
@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNormalizeReaction(t *testing.T) {
+	pass := func(reaction string) string {
+		reaction, err := NormalizeReaction(reaction)
+		So(err, ShouldBeNil)
+		return reaction
+	}
+
+	reject := func(reaction string) {
+		reaction, err := NormalizeReaction(reaction)
+		So(err, ShouldEqual, ErrInvalidReaction)
+		So(reaction, ShouldEqual, "")
+	}
+
+	Convey("Surrounding spaces are stripped", t, func() {
+		So(pass(" +1 "), ShouldEqual, "+1")
+		So(pass("❤"), ShouldEqual, "❤")
+	})
+
+	Convey("Empty reactions and internal spaces are rejected", t, func() {
+		reject("")
+		reject(" \t ")
+		reject("+ 1")
+		reject("a\x00b")
+	})
+
+	Convey("Length is limited", t, func() {
+		So(pass(strings.Repeat("x", MaxReactionLength)), ShouldEqual, strings.Repeat("x", MaxReactionLength))
+		reject(strings.Repeat("x", MaxReactionLength+1))
+	})
+
+	Convey("Emoji shortcodes are normalized", t, func() {
+		saved := validEmoji
+		defer func() { validEmoji = saved }()
+		validEmoji = map[string]string{"apple": "1f34e"}
+		So(pass(":apple:"), ShouldEqual, "\U0001f34e")
+	})
+}
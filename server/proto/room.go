@@ -51,6 +51,18 @@ type Room interface {
 	Title() string
 	GetMessage(scope.Context, snowflake.Snowflake) (*Message, error)
 	Latest(scope.Context, int, snowflake.Snowflake) ([]Message, error)
+
+	// Earliest returns up to n messages following the given snowflake, in
+	// the same order as Latest.
+	Earliest(scope.Context, int, snowflake.Snowflake) ([]Message, error)
+
+	// Search returns the most recent unencrypted messages matching the given
+	// search, in the same order as Latest.
+	Search(scope.Context, *SearchCommand) ([]Message, error)
+
+	// Thread returns up to n messages of the thread rooted at the given
+	// message: the root followed by its replies at any depth, oldest first.
+	Thread(ctx scope.Context, n int, root snowflake.Snowflake) ([]Message, error)
 	Snapshot(ctx scope.Context, session Session, level PrivilegeLevel, numMessages int) (*SnapshotEvent, error)
 
 	// Join inserts a Session into the Room's global presence.
@@ -59,6 +71,11 @@ type Room interface {
 	// Part removes a Session from the Room's global presence.
 	Part(scope.Context, Session) error
 
+	// IsBanned returns true if the given agent or client address is banned
+	// from the Room, as checked by Join. An empty agentID or ip is not
+	// checked.
+	IsBanned(ctx scope.Context, agentID UserID, ip string) (bool, error)
+
 	// IsValidParent checks whether the message with the given ID is able to be replied to.
 	IsValidParent(id snowflake.Snowflake) (bool, error)
 
@@ -68,6 +85,24 @@ type Room interface {
 	// Edit modifies or deletes a message.
 	EditMessage(scope.Context, Session, EditMessageCommand) (EditMessageReply, error)
 
+	// React adds or, if remove is true, withdraws a Session's reaction to a
+	// message, and broadcasts the change to the Room.
+	React(ctx scope.Context, session Session, msgID snowflake.Snowflake, reaction string, remove bool) (
+		*ReactionEvent, error)
+
+	// ReadMarker returns the id of the last message the account has marked as
+	// read in the Room, or zero if it never has, along with the number of
+	// messages posted since (up to MaxUnreadCount).
+	ReadMarker(ctx scope.Context, accountID snowflake.Snowflake) (snowflake.Snowflake, int, error)
+
+	// MarkRead moves the account's read marker forward to the given message,
+	// and returns the resulting read marker and unread count.
+	MarkRead(ctx scope.Context, accountID, msgID snowflake.Snowflake) (snowflake.Snowflake, int, error)
+
+	// EventsSince returns the events recorded in the Room's event log after
+	// the given cursor, oldest first.
+	EventsSince(ctx scope.Context, cursor snowflake.Snowflake) ([]LoggedEvent, error)
+
 	// Listing returns the current global list of connected sessions to this
 	// Room.
 	Listing(ctx scope.Context, level PrivilegeLevel, exclude ...Session) (Listing, error)
@@ -85,6 +120,10 @@ type Room interface {
 	ResolveClientAddress(ctx scope.Context, addr string) (net.IP, error)
 
 	ResolveNick(ctx scope.Context, userID UserID) (string, bool, error)
+
+	// ResolveMention returns the ids of the users whose current nick in the
+	// Room matches the given normalized mention (see NormalizeMention).
+	ResolveMention(ctx scope.Context, mention string) ([]UserID, error)
 }
 
 type ManagedRoom interface {
@@ -106,6 +145,21 @@ type ManagedRoom interface {
 	// unencrypted.
 	MessageKey(ctx scope.Context) (RoomMessageKey, error)
 
+	// RotateMessageKey generates and stores a new message key, as
+	// GenerateMessageKey does, and links the current key to it so holders of
+	// the new key can still read messages encrypted with older keys. The
+	// current key must be given decrypted. The new key is granted to each of
+	// the given accounts along with the rotation, so that if any grant fails
+	// the current key stays in place. Sessions in the room are disconnected,
+	// so that they reconnect with the new key.
+	RotateMessageKey(
+		ctx scope.Context, kms security.KMS, currentKeyID string, currentKey *security.ManagedKey,
+		grantees ...Account) (RoomMessageKey, error)
+
+	// PreviousMessageKey returns the link to the key replaced by the given
+	// message key, or nil if the key did not replace another.
+	PreviousMessageKey(ctx scope.Context, keyID string) (*MessageKeyLink, error)
+
 	// ManagerKey returns a handle to the room's manager key.
 	ManagerKey(ctx scope.Context) (RoomManagerKey, error)
 
@@ -129,6 +183,87 @@ type ManagedRoom interface {
 	ManagerCapability(ctx scope.Context, manager Account) (security.Capability, error)
 
 	MinAgentAge() time.Duration
+
+	// Webhooks returns the room's outgoing webhooks, oldest first.
+	Webhooks(ctx scope.Context) ([]*Webhook, error)
+
+	// AddWebhook registers an outgoing webhook for the room. Returns
+	// ErrTooManyWebhooks if the room already has MaxWebhooks.
+	AddWebhook(ctx scope.Context, webhook *Webhook) error
+
+	// RemoveWebhook unregisters one of the room's outgoing webhooks. Returns
+	// ErrWebhookNotFound if there is no such webhook.
+	RemoveWebhook(ctx scope.Context, webhookID snowflake.Snowflake) error
+
+	// IncomingWebhooks returns the room's incoming webhooks, oldest first.
+	IncomingWebhooks(ctx scope.Context) ([]*IncomingWebhook, error)
+
+	// GetIncomingWebhook returns one of the room's incoming webhooks. Returns
+	// ErrWebhookNotFound if there is no such webhook.
+	GetIncomingWebhook(ctx scope.Context, hookID snowflake.Snowflake) (*IncomingWebhook, error)
+
+	// AddIncomingWebhook registers an incoming webhook for the room. Returns
+	// ErrTooManyWebhooks if the room already has MaxIncomingWebhooks.
+	AddIncomingWebhook(ctx scope.Context, hook *IncomingWebhook) error
+
+	// RemoveIncomingWebhook unregisters one of the room's incoming webhooks.
+	// Returns ErrWebhookNotFound if there is no such webhook.
+	RemoveIncomingWebhook(ctx scope.Context, hookID snowflake.Snowflake) error
+
+	// CanonicalName returns the name the room goes by. This is the room's ID
+	// unless the room has been renamed.
+	CanonicalName(ctx scope.Context) (string, error)
+
+	// Aliases returns the names other than its canonical name that lead to
+	// the room, in alphabetical order.
+	Aliases(ctx scope.Context) ([]string, error)
+
+	// AddAlias makes another name lead to the room. Returns ErrRoomNameInUse
+	// if the name belongs to another room.
+	AddAlias(ctx scope.Context, alias string) error
+
+	// RemoveAlias stops a name from leading to the room. Returns
+	// ErrRoomAliasNotFound if the name isn't one of the room's aliases. The
+	// room's ID and canonical name can't be removed.
+	RemoveAlias(ctx scope.Context, alias string) error
+
+	// Rename gives the room a new canonical name, keeping its previous name
+	// as an alias, and broadcasts a room-renamed-event to the room, excluding
+	// the given session. Returns ErrRoomNameInUse if the name belongs to
+	// another room.
+	Rename(ctx scope.Context, session Session, name string) error
+
+	// Archived returns true if the room has been archived.
+	Archived(ctx scope.Context) (bool, error)
+
+	// Archive makes the room read-only and disconnects everyone in it.
+	Archive(ctx scope.Context) error
+
+	// Delete permanently removes the room and everything stored about it,
+	// and disconnects everyone in it.
+	Delete(ctx scope.Context) error
+
+	// AnnouncementMode returns who may send messages to the room.
+	AnnouncementMode(ctx scope.Context) (*AnnouncementMode, error)
+
+	// SetAnnouncementMode changes who may send messages to the room, and
+	// broadcasts the change to everyone else in it.
+	SetAnnouncementMode(ctx scope.Context, session Session, mode *AnnouncementMode) error
+
+	// E2E returns true if messages in the room are encrypted by clients,
+	// so that neither the server nor staff can read them.
+	E2E(ctx scope.Context) (bool, error)
+
+	// EnableE2E permanently switches the room to end-to-end encryption and
+	// disconnects everyone in it, so that they reconnect aware of the change.
+	EnableE2E(ctx scope.Context) error
+
+	// ShareE2EKey stores a room key sealed for an account, replacing any
+	// earlier copy of the same key sealed for that account.
+	ShareE2EKey(ctx scope.Context, key *E2EKey) error
+
+	// E2EKeys returns the room keys sealed for the given account.
+	E2EKeys(ctx scope.Context, accountID snowflake.Snowflake) ([]*E2EKey, error)
 }
 
 type RoomMessageKey interface {
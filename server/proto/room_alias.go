@@ -0,0 +1,14 @@
+package proto
+
+import "regexp"
+
+var roomNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// ValidateRoomName returns ErrInvalidRoomName if the given name can't be used
+// in a room's URL.
+func ValidateRoomName(name string) error {
+	if !roomNameRegexp.MatchString(name) {
+		return ErrInvalidRoomName
+	}
+	return nil
+}
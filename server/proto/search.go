@@ -0,0 +1,40 @@
+package proto
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchTerms splits a search query into the lowercased words it contains.
+func SearchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Matches returns true if the given (decrypted) message satisfies all the
+// criteria of the search, apart from paging.
+func (cmd *SearchCommand) Matches(msg *Message) bool {
+	if cmd.Sender != "" && msg.Sender.ID != cmd.Sender {
+		return false
+	}
+	posted := time.Time(msg.UnixTime)
+	if !time.Time(cmd.Since).IsZero() && posted.Before(time.Time(cmd.Since)) {
+		return false
+	}
+	if !time.Time(cmd.Until).IsZero() && !posted.Before(time.Time(cmd.Until)) {
+		return false
+	}
+
+	words := map[string]struct{}{}
+	for _, word := range SearchTerms(msg.Content) {
+		words[word] = struct{}{}
+	}
+	for _, term := range SearchTerms(cmd.Query) {
+		if _, ok := words[term]; !ok {
+			return false
+		}
+	}
+	return true
+}
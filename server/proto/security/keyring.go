@@ -0,0 +1,250 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const KeyringKMSType = KMSType("keyring")
+
+const (
+	keyringFormatGCM  = 1
+	keyringNonceSize  = 12
+	keyringHeaderSize = 5 + keyringNonceSize
+	keyringTagSize    = 16
+)
+
+// LegacyKeyVersion is the version of the master key that decrypts keys
+// written by the local KMS (-kms-local-key-file), whose ciphertexts carry no
+// version. To move from the local KMS to a keyring, install the old key file
+// as 1.key; its keys are rewrapped by the next rotation.
+const LegacyKeyVersion uint32 = 1
+
+var ErrUnknownKeyVersion = errors.New("unknown master key version")
+
+// KeyRewrapper is implemented by KMS types with more than one master key.
+// RewrapKey re-encrypts a managed key under the current master key, leaving
+// its plaintext unchanged. It reports whether the key needed rewrapping.
+type KeyRewrapper interface {
+	KMS
+	RewrapKey(*ManagedKey) (bool, error)
+}
+
+// Keyring is a local KMS with versioned master keys. New keys are always
+// encrypted under the highest version, which is recorded at the front of the
+// ciphertext so that keys encrypted under older versions remain decryptable
+// for as long as their master key is kept in the keyring.
+//
+// Keys are sealed with AES-GCM under a random nonce, with the key's context
+// as additional data. The ciphertext is laid out as:
+//
+//	format (1 byte) | version (4 bytes) | nonce | sealed key | tag
+type Keyring struct {
+	random  io.Reader
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyring returns a keyring holding the given master keys, indexed by
+// version. Versions must be positive.
+func NewKeyring(keys map[uint32][]byte) (*Keyring, error) {
+	kr := &Keyring{random: rand.Reader}
+	if err := kr.setKeys(keys); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) setKeys(keys map[uint32][]byte) error {
+	if len(keys) == 0 {
+		return ErrNoMasterKey
+	}
+	kr.keys = make(map[uint32][]byte, len(keys))
+	kr.current = 0
+	for version, key := range keys {
+		if version == 0 {
+			return fmt.Errorf("master key version must be positive")
+		}
+		if len(key) != mockCipher.KeySize() {
+			return fmt.Errorf("master key %d must be exactly %d bytes in size", version, mockCipher.KeySize())
+		}
+		kr.keys[version] = key
+		if version > kr.current {
+			kr.current = version
+		}
+	}
+	return nil
+}
+
+// CurrentVersion returns the version of the master key used to encrypt new
+// keys.
+func (kr *Keyring) CurrentVersion() uint32 { return kr.current }
+
+// Versions returns the versions of all master keys in the keyring, in
+// ascending order.
+func (kr *Keyring) Versions() []uint32 {
+	versions := make([]uint32, 0, len(kr.keys))
+	for version := range kr.keys {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// KeyVersion returns the version of the master key the given key is
+// encrypted under.
+func (kr *Keyring) KeyVersion(mkey *ManagedKey) (uint32, error) {
+	if !mkey.Encrypted() {
+		return 0, ErrKeyMustBeEncrypted
+	}
+	if isLegacyKey(mkey) {
+		return LegacyKeyVersion, nil
+	}
+	if len(mkey.Ciphertext) != keyringHeaderSize+mkey.KeySize()+keyringTagSize ||
+		mkey.Ciphertext[0] != keyringFormatGCM {
+		return 0, ErrInvalidKey
+	}
+	return binary.BigEndian.Uint32(mkey.Ciphertext[1:]), nil
+}
+
+func (kr *Keyring) KMSType() KMSType             { return KeyringKMSType }
+func (kr *Keyring) KMS() KMS                     { return kr }
+func (kr *Keyring) KMSCredential() KMSCredential { return kr }
+
+func (kr *Keyring) GenerateNonce(bytes int) ([]byte, error) {
+	nonce := make([]byte, bytes)
+	_, err := io.ReadFull(kr.random, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func (kr *Keyring) GenerateEncryptedKey(keyType KeyType, ctxKey, ctxVal string) (*ManagedKey, error) {
+	key, err := kr.GenerateNonce(keyType.KeySize())
+	if err != nil {
+		return nil, err
+	}
+
+	mkey := &ManagedKey{
+		KeyType:      keyType,
+		Plaintext:    key,
+		ContextKey:   ctxKey,
+		ContextValue: ctxVal,
+	}
+	if err := kr.encrypt(mkey); err != nil {
+		return nil, err
+	}
+
+	return mkey, nil
+}
+
+func (kr *Keyring) DecryptKey(mkey *ManagedKey) error {
+	version, err := kr.KeyVersion(mkey)
+	if err != nil {
+		return err
+	}
+	masterKey, ok := kr.keys[version]
+	if !ok {
+		return ErrUnknownKeyVersion
+	}
+
+	if isLegacyKey(mkey) {
+		inner := &localKMS{masterKey: masterKey}
+		return inner.xorKey(mkey)
+	}
+
+	nonce := mkey.Ciphertext[5:keyringHeaderSize]
+	sealed := mkey.Ciphertext[keyringHeaderSize:]
+	split := len(sealed) - keyringTagSize
+	plaintext, err := DecryptGCM(
+		&ManagedKey{KeyType: mockCipher, Plaintext: masterKey}, nonce, sealed[split:], sealed[:split],
+		keyringContext(mkey))
+	if err != nil {
+		return ErrInvalidKey
+	}
+	mkey.Ciphertext = nil
+	mkey.Plaintext = plaintext
+	return nil
+}
+
+func (kr *Keyring) RewrapKey(mkey *ManagedKey) (bool, error) {
+	version, err := kr.KeyVersion(mkey)
+	if err != nil {
+		return false, err
+	}
+	if version == kr.current && !isLegacyKey(mkey) {
+		return false, nil
+	}
+
+	key := mkey.Clone()
+	if err := kr.DecryptKey(&key); err != nil {
+		return false, err
+	}
+	if err := kr.encrypt(&key); err != nil {
+		return false, err
+	}
+	mkey.Ciphertext = key.Ciphertext
+	return true, nil
+}
+
+func (kr *Keyring) encrypt(mkey *ManagedKey) error {
+	masterKey, ok := kr.keys[kr.current]
+	if !ok {
+		return ErrNoMasterKey
+	}
+
+	header := make([]byte, keyringHeaderSize, keyringHeaderSize+len(mkey.Plaintext)+keyringTagSize)
+	header[0] = keyringFormatGCM
+	binary.BigEndian.PutUint32(header[1:], kr.current)
+	if _, err := io.ReadFull(kr.random, header[5:]); err != nil {
+		return err
+	}
+
+	digest, ciphertext, err := EncryptGCM(
+		&ManagedKey{KeyType: mockCipher, Plaintext: masterKey}, header[5:], mkey.Plaintext,
+		keyringContext(mkey))
+	if err != nil {
+		return err
+	}
+	mkey.Plaintext = nil
+	mkey.Ciphertext = append(append(header, ciphertext...), digest...)
+	return nil
+}
+
+// isLegacyKey returns true if the given encrypted key was written by the
+// local KMS. Its ciphertext is an HMAC followed by the key, which is always
+// shorter than the keyring format.
+func isLegacyKey(mkey *ManagedKey) bool {
+	return len(mkey.Ciphertext) == sha256.Size+mkey.KeySize()
+}
+
+// keyringContext returns the additional data that binds a sealed key to its
+// context.
+func keyringContext(mkey *ManagedKey) []byte {
+	data := make([]byte, 0, 4+len(mkey.ContextKey)+len(mkey.ContextValue))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(mkey.ContextKey)))
+	data = append(data, mkey.ContextKey...)
+	return append(data, mkey.ContextValue...)
+}
+
+func (kr *Keyring) MarshalJSON() ([]byte, error) { return json.Marshal(kr.keys) }
+
+func (kr *Keyring) UnmarshalJSON(data []byte) error {
+	var keys map[uint32][]byte
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	kr.random = rand.Reader
+	return kr.setKeys(keys)
+}
+
+func init() {
+	RegisterKMSType(KeyringKMSType, &Keyring{})
+}
@@ -0,0 +1,177 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testMasterKey() []byte {
+	key := make([]byte, mockCipher.KeySize())
+	rand.Read(key)
+	return key
+}
+
+func TestKeyring(t *testing.T) {
+	Convey("Keys are validated", t, func() {
+		_, err := NewKeyring(nil)
+		So(err, ShouldEqual, ErrNoMasterKey)
+
+		_, err = NewKeyring(map[uint32][]byte{0: testMasterKey()})
+		So(err, ShouldNotBeNil)
+
+		_, err = NewKeyring(map[uint32][]byte{1: []byte("short")})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Keys are encrypted under the highest version", t, func() {
+		kr, err := NewKeyring(map[uint32][]byte{1: testMasterKey(), 3: testMasterKey(), 2: testMasterKey()})
+		So(err, ShouldBeNil)
+		So(kr.CurrentVersion(), ShouldEqual, 3)
+		So(kr.Versions(), ShouldResemble, []uint32{1, 2, 3})
+
+		mkey, err := kr.GenerateEncryptedKey(AES128, "room", "test")
+		So(err, ShouldBeNil)
+		So(mkey.Encrypted(), ShouldBeTrue)
+		version, err := kr.KeyVersion(mkey)
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, 3)
+
+		So(kr.DecryptKey(mkey), ShouldBeNil)
+		So(mkey.Encrypted(), ShouldBeFalse)
+		So(len(mkey.Plaintext), ShouldEqual, AES128.KeySize())
+	})
+
+	Convey("Keys survive rotation", t, func() {
+		v1 := testMasterKey()
+		old, err := NewKeyring(map[uint32][]byte{1: v1})
+		So(err, ShouldBeNil)
+		mkey, err := old.GenerateEncryptedKey(AES256, "room", "test")
+		So(err, ShouldBeNil)
+		plain := mkey.Clone()
+		So(old.DecryptKey(&plain), ShouldBeNil)
+
+		kr, err := NewKeyring(map[uint32][]byte{1: v1, 2: testMasterKey()})
+		So(err, ShouldBeNil)
+
+		Convey("Old versions remain decryptable", func() {
+			key := mkey.Clone()
+			So(kr.DecryptKey(&key), ShouldBeNil)
+			So(bytes.Equal(key.Plaintext, plain.Plaintext), ShouldBeTrue)
+		})
+
+		Convey("Rewrapping moves a key to the current version", func() {
+			rewrapped, err := kr.RewrapKey(mkey)
+			So(err, ShouldBeNil)
+			So(rewrapped, ShouldBeTrue)
+			version, err := kr.KeyVersion(mkey)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 2)
+
+			rewrapped, err = kr.RewrapKey(mkey)
+			So(err, ShouldBeNil)
+			So(rewrapped, ShouldBeFalse)
+
+			key := mkey.Clone()
+			So(kr.DecryptKey(&key), ShouldBeNil)
+			So(bytes.Equal(key.Plaintext, plain.Plaintext), ShouldBeTrue)
+
+			// The old version can be dropped once everything is rewrapped.
+			pruned, err := NewKeyring(map[uint32][]byte{2: kr.keys[2]})
+			So(err, ShouldBeNil)
+			key = mkey.Clone()
+			So(pruned.DecryptKey(&key), ShouldBeNil)
+			So(bytes.Equal(key.Plaintext, plain.Plaintext), ShouldBeTrue)
+
+			key = mkey.Clone()
+			So(old.DecryptKey(&key), ShouldEqual, ErrUnknownKeyVersion)
+		})
+
+		Convey("Context is still checked", func() {
+			_, err := kr.RewrapKey(mkey)
+			So(err, ShouldBeNil)
+			key := mkey.Clone()
+			key.ContextValue = "test2"
+			So(kr.DecryptKey(&key), ShouldEqual, ErrInvalidKey)
+		})
+	})
+
+	Convey("Keys written by the local KMS are decryptable", t, func() {
+		masterKey := testMasterKey()
+		local := LocalKMS()
+		local.SetMasterKey(masterKey)
+		mkey, err := local.GenerateEncryptedKey(AES256, "room", "test")
+		So(err, ShouldBeNil)
+		plain := mkey.Clone()
+		So(local.DecryptKey(&plain), ShouldBeNil)
+
+		kr, err := NewKeyring(map[uint32][]byte{LegacyKeyVersion: masterKey})
+		So(err, ShouldBeNil)
+		version, err := kr.KeyVersion(mkey)
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, LegacyKeyVersion)
+
+		key := mkey.Clone()
+		So(kr.DecryptKey(&key), ShouldBeNil)
+		So(bytes.Equal(key.Plaintext, plain.Plaintext), ShouldBeTrue)
+
+		key = mkey.Clone()
+		key.ContextValue = "test2"
+		So(kr.DecryptKey(&key), ShouldEqual, ErrInvalidKey)
+
+		Convey("And are rewrapped even under the same version", func() {
+			rewrapped, err := kr.RewrapKey(mkey)
+			So(err, ShouldBeNil)
+			So(rewrapped, ShouldBeTrue)
+			So(isLegacyKey(mkey), ShouldBeFalse)
+
+			rewrapped, err = kr.RewrapKey(mkey)
+			So(err, ShouldBeNil)
+			So(rewrapped, ShouldBeFalse)
+
+			key := mkey.Clone()
+			So(kr.DecryptKey(&key), ShouldBeNil)
+			So(bytes.Equal(key.Plaintext, plain.Plaintext), ShouldBeTrue)
+		})
+	})
+
+	Convey("Keys sharing a context don't share a keystream", t, func() {
+		kr, err := NewKeyring(map[uint32][]byte{1: testMasterKey()})
+		So(err, ShouldBeNil)
+		mkey1 := &ManagedKey{KeyType: AES128, Plaintext: make([]byte, AES128.KeySize()), ContextKey: "room", ContextValue: "test"}
+		mkey2 := mkey1.Clone()
+		So(kr.encrypt(mkey1), ShouldBeNil)
+		So(kr.encrypt(&mkey2), ShouldBeNil)
+		So(bytes.Equal(mkey1.Ciphertext, mkey2.Ciphertext), ShouldBeFalse)
+
+		Convey("Tampered ciphertexts are rejected", func() {
+			mkey1.Ciphertext[len(mkey1.Ciphertext)-1] ^= 1
+			So(kr.DecryptKey(mkey1), ShouldEqual, ErrInvalidKey)
+		})
+	})
+
+	Convey("Invalid ciphertexts are rejected", t, func() {
+		kr, err := NewKeyring(map[uint32][]byte{1: testMasterKey()})
+		So(err, ShouldBeNil)
+		So(kr.DecryptKey(&ManagedKey{KeyType: AES128, Ciphertext: []byte{0, 0}}), ShouldEqual, ErrInvalidKey)
+		So(kr.DecryptKey(&ManagedKey{KeyType: AES128, Plaintext: []byte{0}}), ShouldEqual, ErrKeyMustBeEncrypted)
+	})
+
+	Convey("Keyring round-trips as a KMS credential", t, func() {
+		kr, err := NewKeyring(map[uint32][]byte{1: testMasterKey(), 2: testMasterKey()})
+		So(err, ShouldBeNil)
+		mkey, err := kr.GenerateEncryptedKey(AES128, "room", "test")
+		So(err, ShouldBeNil)
+
+		data, err := json.Marshal(kr)
+		So(err, ShouldBeNil)
+		cred, err := KeyringKMSType.KMSCredential()
+		So(err, ShouldBeNil)
+		So(json.Unmarshal(data, cred), ShouldBeNil)
+		So(cred.KMSType(), ShouldEqual, KeyringKMSType)
+		So(cred.KMS().DecryptKey(mkey), ShouldBeNil)
+	})
+}
@@ -38,6 +38,7 @@ type SessionView struct {
 	SessionID         string `json:"session_id"`                    // id of the session, unique across all sessions globally
 	IsStaff           bool   `json:"is_staff,omitempty"`            // if true, this session belongs to a member of staff
 	IsManager         bool   `json:"is_manager,omitempty"`          // if true, this session belongs to a manager of the room
+	IsBot             bool   `json:"is_bot,omitempty"`              // if true, this session was authenticated with a bot token
 	ClientAddress     string `json:"client_address,omitempty"`      // for hosts and staff, the virtual address of the client
 	RealClientAddress string `json:"real_client_address,omitempty"` // for staff, the real address of the client
 }
@@ -0,0 +1,221 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/jobs"
+	"euphoria.leet.nu/heim/proto/logging"
+	"euphoria.leet.nu/heim/proto/snowflake"
+)
+
+const (
+	// MaxWebhooks is the maximum number of webhooks a room may have.
+	MaxWebhooks = 10
+
+	// WebhookSecretSize is the number of random bytes in a generated secret.
+	WebhookSecretSize = 32
+
+	// WebhookSignatureHeader carries the HMAC-SHA256 of the request body,
+	// keyed by the webhook's secret, as "sha256=<hex>".
+	WebhookSignatureHeader = "X-Heim-Signature"
+
+	// WebhookEventHeader carries the type of the delivered event.
+	WebhookEventHeader = "X-Heim-Event"
+
+	// WebhookDeliveryHeader carries a unique id for the delivery, which
+	// stays the same across retries.
+	WebhookDeliveryHeader = "X-Heim-Delivery"
+)
+
+// WebhookEvents are the room events a webhook may subscribe to.
+var WebhookEvents = map[PacketType]bool{
+	SendEventType:        true,
+	EditMessageEventType: true,
+	JoinEventType:        true,
+	PartEventType:        true,
+}
+
+// A Webhook delivers a room's events to a URL outside of heim.
+type Webhook struct {
+	ID      snowflake.Snowflake `json:"id"`      // the id of the webhook
+	URL     string              `json:"url"`     // the URL events are POSTed to
+	Events  []PacketType        `json:"events"`  // the types of events delivered
+	Secret  string              `json:"-"`       // the key used to sign deliveries
+	Created Time                `json:"created"` // the unix timestamp of when the webhook was added
+}
+
+// NewWebhook validates the given settings and returns a new webhook. If
+// secret is empty, a random one is generated.
+func NewWebhook(rawURL string, events []PacketType, secret string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no webhook events given")
+	}
+	seen := map[PacketType]bool{}
+	filter := make([]PacketType, 0, len(events))
+	for _, event := range events {
+		if !WebhookEvents[event] {
+			return nil, fmt.Errorf("invalid webhook event: %s", event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			filter = append(filter, event)
+		}
+	}
+
+	if secret == "" {
+		secretBytes := make([]byte, WebhookSecretSize)
+		if _, err := rand.Read(secretBytes); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(secretBytes)
+	}
+
+	id, err := snowflake.New()
+	if err != nil {
+		return nil, err
+	}
+
+	webhook := &Webhook{
+		ID:      id,
+		URL:     u.String(),
+		Events:  filter,
+		Secret:  secret,
+		Created: Now(),
+	}
+	return webhook, nil
+}
+
+// Accepts returns true if the webhook subscribes to the given event type.
+func (w *Webhook) Accepts(eventType PacketType) bool {
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the value of the signature header for the given body.
+func (w *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookClient returns an HTTP client for delivering to webhooks. It
+// refuses to connect to loopback, link-local, private, and unspecified
+// addresses, and doesn't follow redirects, so that webhooks can't be used to
+// reach services inside the network heim runs in. Addresses are checked after
+// DNS resolution, which also defeats DNS rebinding.
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	return newWebhookClient(timeout, publicAddress)
+}
+
+func newWebhookClient(timeout time.Duration, allow func(net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allow(ip) {
+				return ErrWebhookAddressNotAllowed
+			}
+			return nil
+		},
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client
+}
+
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified())
+}
+
+// Deliver POSTs a queued delivery to the webhook's URL, with a client made by
+// NewWebhookClient. Any response other than 2xx (including redirects) is
+// returned as an error, so that the delivery can be retried.
+func (w *Webhook) Deliver(ctx scope.Context, client *http.Client, deliveryID string, job *jobs.WebhookJob) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(job.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, w.Sign(job.Body))
+	req.Header.Set(WebhookEventHeader, job.EventType)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	logging.Logger(ctx).Printf("webhook %s in %s: %s %s -> %s", w.ID, job.Room, job.EventType, w.URL, resp.Status)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// A WebhookDelivery is the body POSTed to a webhook's URL.
+type WebhookDelivery struct {
+	WebhookID snowflake.Snowflake `json:"webhook_id"` // the id of the webhook
+	Room      string              `json:"room"`       // the name of the room the event occurred in
+	Type      PacketType          `json:"type"`       // the type of the event
+	Data      json.RawMessage     `json:"data"`       // the event's payload, as it would be sent to a session
+	UnixTime  Time                `json:"time"`       // the unix timestamp of when the event occurred
+}
+
+// NewWebhookJob encodes a room event for delivery to the given webhook.
+func NewWebhookJob(room string, webhook *Webhook, eventType PacketType, payload interface{}) (*jobs.WebhookJob, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(&WebhookDelivery{
+		WebhookID: webhook.ID,
+		Room:      room,
+		Type:      eventType,
+		Data:      data,
+		UnixTime:  Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	job := &jobs.WebhookJob{
+		Room:      room,
+		WebhookID: webhook.ID,
+		EventType: string(eventType),
+		Body:      body,
+	}
+	return job, nil
+}
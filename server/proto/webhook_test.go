@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.leet.nu/lib/scope"
+
+	"euphoria.leet.nu/heim/proto/jobs"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhookClient(t *testing.T) {
+	ctx := scope.New()
+	job := &jobs.WebhookJob{Room: "test", EventType: string(SendEventType), Body: []byte("{}")}
+
+	Convey("Private addresses are refused", t, func() {
+		for _, addr := range []string{"127.0.0.1", "::1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "fe80::1", "0.0.0.0"} {
+			So(publicAddress(net.ParseIP(addr)), ShouldBeFalse)
+		}
+		So(publicAddress(net.ParseIP("93.184.216.34")), ShouldBeTrue)
+
+		received := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = true
+		}))
+		defer server.Close()
+
+		webhook, err := NewWebhook(server.URL, []PacketType{SendEventType}, "")
+		So(err, ShouldBeNil)
+		err = webhook.Deliver(ctx, NewWebhookClient(time.Second), "1", job)
+		So(err, ShouldNotBeNil)
+		So(strings.Contains(err.Error(), ErrWebhookAddressNotAllowed.Error()), ShouldBeTrue)
+		So(received, ShouldBeFalse)
+	})
+
+	Convey("Redirects aren't followed", t, func() {
+		followed := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/elsewhere" {
+				followed = true
+				return
+			}
+			http.Redirect(w, r, "/elsewhere", http.StatusTemporaryRedirect)
+		}))
+		defer server.Close()
+
+		webhook, err := NewWebhook(server.URL, []PacketType{SendEventType}, "")
+		So(err, ShouldBeNil)
+		client := newWebhookClient(time.Second, func(net.IP) bool { return true })
+		So(webhook.Deliver(ctx, client, "1", job), ShouldNotBeNil)
+		So(followed, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,224 @@
+package kms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"euphoria.leet.nu/heim/proto/security"
+)
+
+const (
+	VaultKMSType = security.KMSType("vault")
+
+	DefaultMount = "transit"
+)
+
+func init() {
+	security.RegisterKMSType(VaultKMSType, &KMSCredential{})
+}
+
+// New returns a KMS backed by the transit secrets engine of the Vault server
+// at the given address. Data keys are generated and decrypted under the named
+// transit key, which should be created with derived=true so that each key is
+// bound to its context.
+func New(addr, token, mount, keyName string) (*KMS, error) {
+	if mount == "" {
+		mount = DefaultMount
+	}
+	base, err := url.Parse(strings.TrimRight(addr, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("vault kms: invalid address: %s", err)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("vault kms: invalid address: %s", addr)
+	}
+	kms := &KMS{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		base:    base,
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		keyName: keyName,
+	}
+	return kms, nil
+}
+
+type KMS struct {
+	client  *http.Client
+	base    *url.URL
+	token   string
+	mount   string
+	keyName string
+}
+
+func (k *KMS) GenerateNonce(bytes int) ([]byte, error) {
+	var resp struct {
+		RandomBytes string `json:"random_bytes"`
+	}
+	req := map[string]string{"format": "base64"}
+	if err := k.call(fmt.Sprintf("random/%d", bytes), req, &resp); err != nil {
+		return nil, fmt.Errorf("vault kms: error generating nonce of %d bytes: %s", bytes, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(resp.RandomBytes)
+	if err != nil {
+		return nil, fmt.Errorf("vault kms: error generating nonce of %d bytes: %s", bytes, err)
+	}
+	if len(nonce) != bytes {
+		return nil, fmt.Errorf(
+			"vault kms: error generating nonce of %d bytes: received %d bytes", bytes, len(nonce))
+	}
+	return nonce, nil
+}
+
+func (k *KMS) GenerateEncryptedKey(keyType security.KeyType, ctxKey, ctxVal string) (
+	*security.ManagedKey, error) {
+
+	var bits int
+	switch keyType {
+	case security.AES128:
+		bits = 128
+	case security.AES256:
+		bits = 256
+	default:
+		return nil, fmt.Errorf("vault kms: key type %s not supported", keyType)
+	}
+
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]interface{}{
+		"bits":    bits,
+		"context": encodeContext(ctxKey, ctxVal),
+	}
+	if err := k.call("datakey/wrapped/"+url.PathEscape(k.keyName), req, &resp); err != nil {
+		return nil, fmt.Errorf("vault kms: error generating data key of type %s: %s", keyType, err)
+	}
+	if resp.Ciphertext == "" {
+		return nil, fmt.Errorf("vault kms: error generating data key of type %s: empty ciphertext", keyType)
+	}
+
+	mkey := &security.ManagedKey{
+		KeyType:      keyType,
+		Ciphertext:   []byte(resp.Ciphertext),
+		ContextKey:   ctxKey,
+		ContextValue: ctxVal,
+	}
+	return mkey, nil
+}
+
+func (k *KMS) DecryptKey(key *security.ManagedKey) error {
+	if !key.Encrypted() {
+		return fmt.Errorf("vault kms: key is already decrypted")
+	}
+
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	req := map[string]string{
+		"ciphertext": string(key.Ciphertext),
+		"context":    encodeContext(key.ContextKey, key.ContextValue),
+	}
+	if err := k.call("decrypt/"+url.PathEscape(k.keyName), req, &resp); err != nil {
+		return fmt.Errorf("vault kms: error decrypting data key: %s", err)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return fmt.Errorf("vault kms: error decrypting data key: %s", err)
+	}
+	key.Plaintext = plaintext
+	key.Ciphertext = nil
+	return nil
+}
+
+// call POSTs a JSON request to the given path under the transit mount and
+// decodes the data field of the response into result.
+func (k *KMS) call(path string, req, result interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	u := *k.base
+	u.Path = fmt.Sprintf("%s/v1/%s/%s", u.Path, k.mount, path)
+	httpReq, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Vault-Token", k.token)
+
+	httpResp, err := k.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s: %s", httpResp.Status, err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		if len(envelope.Errors) > 0 {
+			return fmt.Errorf("%s", strings.Join(envelope.Errors, "; "))
+		}
+		return fmt.Errorf("%s", httpResp.Status)
+	}
+	if len(envelope.Data) == 0 {
+		return fmt.Errorf("response contained no data")
+	}
+	return json.Unmarshal(envelope.Data, result)
+}
+
+// encodeContext renders an encryption context as the base64 key derivation
+// context expected by the transit engine.
+func encodeContext(ctxKey, ctxVal string) string {
+	return base64.StdEncoding.EncodeToString([]byte(ctxKey + "=" + ctxVal))
+}
+
+type kmsCredential struct {
+	Address string `json:"address"`
+	Token   string `json:"token"`
+	Mount   string `json:"mount"`
+	KeyName string `json:"key_name"`
+}
+
+type KMSCredential struct {
+	kmsCredential
+}
+
+func (c *KMSCredential) KMS() security.KMS {
+	kms, err := New(c.Address, c.Token, c.Mount, c.KeyName)
+	if err != nil {
+		return &errKMS{err}
+	}
+	return kms
+}
+
+func (c *KMSCredential) KMSType() security.KMSType    { return VaultKMSType }
+func (c *KMSCredential) MarshalJSON() ([]byte, error) { return json.Marshal(c.kmsCredential) }
+
+func (c *KMSCredential) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &c.kmsCredential)
+}
+
+// errKMS fails every operation with the error encountered while constructing
+// a KMS from a stored credential.
+type errKMS struct {
+	err error
+}
+
+func (k *errKMS) GenerateNonce(int) ([]byte, error) { return nil, k.err }
+
+func (k *errKMS) GenerateEncryptedKey(security.KeyType, string, string) (*security.ManagedKey, error) {
+	return nil, k.err
+}
+
+func (k *errKMS) DecryptKey(*security.ManagedKey) error { return k.err }
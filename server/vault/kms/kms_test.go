@@ -0,0 +1,224 @@
+package kms
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"euphoria.leet.nu/heim/proto/security"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testToken = "s.testtoken"
+
+type wrappedKey struct {
+	plaintext []byte
+	context   string
+}
+
+// transitServer is a minimal stand-in for the subset of Vault's transit
+// engine API used by KMS.
+type transitServer struct {
+	sync.Mutex
+	mount   string
+	keyName string
+	keys    map[string]wrappedKey
+}
+
+func newTransitServer(mount, keyName string) *httptest.Server {
+	ts := &transitServer{
+		mount:   mount,
+		keyName: keyName,
+		keys:    map[string]wrappedKey{},
+	}
+	return httptest.NewServer(ts)
+}
+
+func (ts *transitServer) fail(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+func (ts *transitServer) reply(w http.ResponseWriter, data interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (ts *transitServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		ts.fail(w, http.StatusMethodNotAllowed, "unsupported operation")
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != testToken {
+		ts.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	var req struct {
+		Bits       int    `json:"bits"`
+		Context    string `json:"context"`
+		Ciphertext string `json:"ciphertext"`
+		Format     string `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ts.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	prefix := "/v1/" + ts.mount + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		ts.fail(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+
+	ts.Lock()
+	defer ts.Unlock()
+
+	switch {
+	case strings.HasPrefix(path, "random/"):
+		n, err := strconv.Atoi(strings.TrimPrefix(path, "random/"))
+		if err != nil || req.Format != "base64" {
+			ts.fail(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		buf := make([]byte, n)
+		rand.Read(buf)
+		ts.reply(w, map[string]string{"random_bytes": base64.StdEncoding.EncodeToString(buf)})
+	case path == "datakey/wrapped/"+ts.keyName:
+		if req.Bits != 128 && req.Bits != 256 {
+			ts.fail(w, http.StatusBadRequest, "invalid bit length")
+			return
+		}
+		key := make([]byte, req.Bits/8)
+		rand.Read(key)
+		id := make([]byte, 16)
+		rand.Read(id)
+		ciphertext := "vault:v1:" + base64.StdEncoding.EncodeToString(id)
+		ts.keys[ciphertext] = wrappedKey{plaintext: key, context: req.Context}
+		ts.reply(w, map[string]string{"ciphertext": ciphertext})
+	case path == "decrypt/"+ts.keyName:
+		key, ok := ts.keys[req.Ciphertext]
+		if !ok || key.context != req.Context {
+			ts.fail(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		ts.reply(w, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key.plaintext)})
+	default:
+		ts.fail(w, http.StatusBadRequest, "encryption key not found")
+	}
+}
+
+func TestKMS(t *testing.T) {
+	server := newTransitServer("transit", "heim")
+	defer server.Close()
+
+	kms, err := New(server.URL, testToken, "", "heim")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("GenerateNonce", t, func() {
+		nonce, err := kms.GenerateNonce(20)
+		So(err, ShouldBeNil)
+		So(len(nonce), ShouldEqual, 20)
+	})
+
+	Convey("GenerateEncryptedKey and Decrypt", t, func() {
+		Convey("AES-256", func() {
+			key, err := kms.GenerateEncryptedKey(security.AES256, "room", "test")
+			So(err, ShouldBeNil)
+			So(key.Encrypted(), ShouldBeTrue)
+
+			So(kms.DecryptKey(key), ShouldBeNil)
+			So(key.Encrypted(), ShouldBeFalse)
+			So(len(key.Plaintext), ShouldEqual, security.AES256.KeySize())
+			So(key.ContextKey, ShouldEqual, "room")
+			So(key.ContextValue, ShouldEqual, "test")
+		})
+
+		Convey("AES-128", func() {
+			key, err := kms.GenerateEncryptedKey(security.AES128, "room", "test")
+			So(err, ShouldBeNil)
+			So(key.Encrypted(), ShouldBeTrue)
+
+			So(kms.DecryptKey(key), ShouldBeNil)
+			So(key.Encrypted(), ShouldBeFalse)
+			So(len(key.Plaintext), ShouldEqual, security.AES128.KeySize())
+		})
+
+		Convey("Invalid key type", func() {
+			key, err := kms.GenerateEncryptedKey(security.KeyType(255), "room", "test")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "vault kms: key type 255 not supported")
+			So(key, ShouldBeNil)
+		})
+
+		Convey("Key already decrypted", func() {
+			err := kms.DecryptKey(&security.ManagedKey{Plaintext: []byte{0}})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "vault kms: key is already decrypted")
+		})
+
+		Convey("Invalid context", func() {
+			key, err := kms.GenerateEncryptedKey(security.AES128, "room", "test")
+			So(err, ShouldBeNil)
+			So(key.Encrypted(), ShouldBeTrue)
+
+			key.ContextValue = "test2"
+			err = kms.DecryptKey(key)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual,
+				"vault kms: error decrypting data key: cipher: message authentication failed")
+		})
+	})
+
+	Convey("Vault errors are reported", t, func() {
+		Convey("Bad token", func() {
+			kms, err := New(server.URL, "s.wrong", "", "heim")
+			So(err, ShouldBeNil)
+			_, err = kms.GenerateNonce(20)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "vault kms: error generating nonce of 20 bytes: permission denied")
+		})
+
+		Convey("Unknown key", func() {
+			kms, err := New(server.URL, testToken, "", "other")
+			So(err, ShouldBeNil)
+			_, err = kms.GenerateEncryptedKey(security.AES256, "room", "test")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual,
+				"vault kms: error generating data key of type aes-256: encryption key not found")
+		})
+
+		Convey("Invalid address", func() {
+			_, err := New("vault:8200", testToken, "", "heim")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("KMSCredential round-trips through JSON", t, func() {
+		cred, err := VaultKMSType.KMSCredential()
+		So(err, ShouldBeNil)
+		data := fmt.Sprintf(
+			`{"address":%q,"token":%q,"mount":"transit","key_name":"heim"}`, server.URL, testToken)
+		So(json.Unmarshal([]byte(data), cred), ShouldBeNil)
+		So(cred.KMSType(), ShouldEqual, VaultKMSType)
+
+		encoded, err := json.Marshal(cred)
+		So(err, ShouldBeNil)
+		So(string(encoded), ShouldEqual, data)
+
+		key, err := cred.KMS().GenerateEncryptedKey(security.AES256, "room", "test")
+		So(err, ShouldBeNil)
+		So(kms.DecryptKey(key), ShouldBeNil)
+		So(len(key.Plaintext), ShouldEqual, security.AES256.KeySize())
+	})
+}